@@ -23,8 +23,10 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 
 	"github.com/google/uuid"
+	"github.com/spf13/viper"
 	"openacta.dev/haystack"
 )
 
@@ -34,6 +36,40 @@ func main() {
 	fmt.Fprintln(os.Stderr, "Licenced under the Affero General Public Licence (AGPL) v3(+)")
 	fmt.Fprintln(os.Stderr)
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "-dumpsection":
+			if len(os.Args) < 4 {
+				fmt.Fprintf(os.Stderr, "Missing option for -dumpsection (requires a filename and section number)\n")
+				os.Exit(1)
+			}
+			if err := dumpSection(os.Args[2], os.Args[3]); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				os.Exit(1)
+			}
+			return
+
+		case "-layout":
+			if len(os.Args) < 3 {
+				fmt.Fprintf(os.Stderr, "Missing option for -layout (requires a filename)\n")
+				os.Exit(1)
+			}
+			if err := sectionLayout(os.Args[2]); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				os.Exit(1)
+			}
+			return
+
+		default:
+			fmt.Fprintf(os.Stderr, "Usage: %s                  Generate a new AES key (and its uuid)\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "       %s -dumpsection <file> <n>\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "                      Decrypt and decompress section <n> of Haystack <file> to stdout\n")
+			fmt.Fprintf(os.Stderr, "       %s -layout <file>\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "                      List the sections of Haystack <file>, with their CRC checked\n")
+			os.Exit(1)
+		}
+	}
+
 	uuid := uuid.New()
 	fmt.Printf("UUID: %s\n", uuid.String())
 
@@ -48,4 +84,74 @@ func main() {
 	fmt.Printf("Key:  %s\n", key_str)
 }
 
+// The configuration, for the AES keystore
+func configure() error {
+	viper.SetConfigFile("./testdata/haystack.conf")
+	viper.SetConfigType("ini")
+	if err := viper.ReadInConfig(); err != nil {
+		return fmt.Errorf("reading configuration: %v", err)
+	}
+	if errors := haystack.ConfigureVariables(); errors > 0 {
+		return fmt.Errorf("%d errors reading Haystack configuration", errors)
+	}
+	if errors := haystack.ConfigureAESKeyStore(); errors > 0 {
+		return fmt.Errorf("%d errors initialising Haystack subsystem", errors)
+	}
+
+	return nil
+}
+
+// Map of a Haystack file to stdout, a section per line.
+// What we got through before an error is listed too.
+func sectionLayout(fname string) error {
+	if err := configure(); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return fmt.Errorf("reading Haystack file %s: %v", fname, err)
+	}
+
+	layout, err := haystack.SectionLayout(data, true)
+	for _, sm := range layout {
+		fmt.Printf("%v\n", sm)
+	}
+	if err != nil {
+		return fmt.Errorf("Haystack file %s: %v", fname, err)
+	}
+
+	return nil
+}
+
+// Section n of a Haystack file to stdout, what it is to stderr.
+// Needs the configuration for the AES keystore.
+func dumpSection(fname string, n_str string) error {
+	n, err := strconv.Atoi(n_str)
+	if err != nil {
+		return fmt.Errorf("section number '%s': %v", n_str, err)
+	}
+
+	if err := configure(); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return fmt.Errorf("reading Haystack file %s: %v", fname, err)
+	}
+
+	content, meta, err := haystack.DumpSection(data, n)
+	if err != nil {
+		return fmt.Errorf("section %d of Haystack file %s: %v", n, fname, err)
+	}
+	fmt.Fprintf(os.Stderr, "%v\n", meta)
+	if !meta.CRCOk {
+		fmt.Fprintf(os.Stderr, "Warning: section %d CRC mismatch, content may be damaged\n", n)
+	}
+
+	_, err = os.Stdout.Write(content)
+	return err
+}
+
 // EOF
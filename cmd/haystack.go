@@ -19,8 +19,15 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/spf13/viper"
@@ -29,6 +36,21 @@ import (
 
 var hs haystack.Haystack // New Haystack
 
+const default_config_fname = "./testdata/haystack.conf"
+
+// Viper config type by file extension: .conf (like ours) is ini,
+// anything viper knows (yaml, json, toml, ...) is what it says
+func configType(fname string) string {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(fname), "."))
+	for _, t := range viper.SupportedExts {
+		if ext == t {
+			return ext
+		}
+	}
+
+	return "ini"
+}
+
 func main() {
 	fmt.Fprintln(os.Stderr, "Haystack - Haystack log management system test & benchmark tool")
 	fmt.Fprintln(os.Stderr, "Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved")
@@ -39,11 +61,25 @@ func main() {
 
 	var action bool
 	var curarg int
+	var cpuprofile, memprofile string
+	output_format := "ndjson" // -o, for -kv and -q
+
+	// -c <configfile> goes first, before any actions
+	config_fname := default_config_fname
+	firstarg := 1
+	if len(os.Args) > 1 && os.Args[1] == "-c" {
+		if len(os.Args) < 3 {
+			fmt.Fprintf(os.Stderr, "Missing option for -c (requires a filename)\n")
+			os.Exit(1)
+		}
+		config_fname = os.Args[2]
+		firstarg = 3
+	}
 
-	viper.SetConfigFile("./testdata/haystack.conf")
-	viper.SetConfigType("ini")
+	viper.SetConfigFile(config_fname)
+	viper.SetConfigType(configType(config_fname))
 	if err := viper.ReadInConfig(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading configuration")
+		fmt.Fprintf(os.Stderr, "Error reading configuration %s: %v\n", config_fname, err)
 		os.Exit(1)
 	}
 
@@ -65,7 +101,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	for curarg = 1; curarg < len(os.Args); curarg++ {
+	for curarg = firstarg; curarg < len(os.Args); curarg++ {
 		switch os.Args[curarg] {
 		// ----------------------- ingest json file to mem
 		case "-i":
@@ -82,8 +118,9 @@ func main() {
 				}
 				defer file.Close()
 
-				// Create a new scanner to read the file line by line
-				scanner := bufio.NewScanner(file)
+				// Create a new scanner to read the file line by line,
+				// lines up to max_line_size (bufio's default stops at 64K)
+				scanner := haystack.NewLineScanner(file)
 
 				// Start the clock
 				start := time.Now()
@@ -105,10 +142,16 @@ func main() {
 						cur_hb = new_hb
 						cur_hb.HaystackPtr = &hs
 					}
-					flat, res := haystack.JSONToKVmap([]byte(line))
-					_ = res
+					flats, err := haystack.JSONToKVmaps([]byte(line))
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Skipping line %d: %v\n", i, err)
+					}
 
-					cur_hb.InsertBunch(&hs.Dict, flat)
+					for _, flat := range flats {
+						if err := cur_hb.InsertBunch(&hs.Dict, flat); err != nil {
+							fmt.Fprintf(os.Stderr, "Line %d: %v\n", i, err)
+						}
+					}
 					if (i % 1000) == 0 {
 						fmt.Fprintf(os.Stderr, "%d000 lines\r", i/1000)
 					}
@@ -119,7 +162,7 @@ func main() {
 
 				// Check for any errors that may have occurred during scanning
 				if err := scanner.Err(); err != nil {
-					fmt.Println("Error scanning file:", err)
+					fmt.Fprintf(os.Stderr, "Error scanning file '%s': %v\n", fname, haystack.LineScanError(err, i))
 					return
 				}
 
@@ -149,12 +192,96 @@ func main() {
 				break
 			}
 
-			/*
-				for k, v := range kv_array {
-					hs.SearchKeyVal(k, v)
+			var res []map[string]string
+			_, err := hs.SearchKeyValArrayBunches(kv_array, func(b *haystack.Bunch) error {
+				if output_format != "count" { // no need to copy them just to count
+					res = append(res, b.Map())
+				} else {
+					res = append(res, nil)
+				}
+				return nil
+			})
+			if err == nil {
+				err = writeResults(output_format, res)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Search %v: %v\n", kv_array, err)
+			}
+
+			action = true
+			curarg = len(os.Args) // Hack so we're always the last param(s)
+
+		case "-q":
+			if curarg+1 < len(os.Args) {
+				curarg++
+				hs.SortAllBales()
+
+				q, err := haystack.ParseQuery(os.Args[curarg])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%v\n", err)
+					break
+				}
+
+				start := time.Now()
+				res, err := hs.SearchQuery(q)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Query %s: %v\n", q, err)
+					break
+				}
+				if err := writeResults(output_format, res); err != nil {
+					fmt.Fprintf(os.Stderr, "Query %s: %v\n", q, err)
+					break
+				}
+				fmt.Fprintf(os.Stderr, "Query %s: %d matches, duration: %v\n", q, len(res), time.Since(start))
+
+				action = true
+			} else {
+				fmt.Fprintf(os.Stderr, "Missing option for -q (requires a query)\n")
+			}
+
+		case "-o":
+			if curarg+1 < len(os.Args) && haystack.ValidExportFormat(os.Args[curarg+1]) {
+				curarg++
+				output_format = os.Args[curarg]
+			} else {
+				fmt.Fprintf(os.Stderr, "-o requires a format: %s\n", strings.Join(haystack.ExportFormats, "/"))
+				os.Exit(1)
+			}
+
+		case "-cpuprofile", "-memprofile":
+			if curarg+1 < len(os.Args) {
+				curarg++
+				if os.Args[curarg-1] == "-cpuprofile" {
+					cpuprofile = os.Args[curarg]
+				} else {
+					memprofile = os.Args[curarg]
 				}
-			*/
-			hs.SearchKeyValArray(kv_array)
+			} else {
+				fmt.Fprintf(os.Stderr, "Missing option for %s (requires a filename)\n", os.Args[curarg])
+			}
+
+		case "-bench":
+			hs.SortAllBales()
+
+			if curarg+3 >= len(os.Args) {
+				fmt.Fprintf(os.Stderr, "Missing options for -bench (requires # of iterations, a key and a value)\n")
+				break
+			}
+
+			curarg++
+			iterations, err := strconv.Atoi(os.Args[curarg])
+			if err != nil || iterations < 1 {
+				fmt.Fprintf(os.Stderr, "Invalid # of iterations for -bench: %s\n", os.Args[curarg])
+				break
+			}
+
+			kv_array := make(map[string]string)
+			for curarg+2 < len(os.Args) {
+				kv_array[os.Args[curarg+1]] = os.Args[curarg+2]
+				curarg += 2
+			}
+
+			runBench(iterations, kv_array, cpuprofile, memprofile)
 
 			action = true
 			curarg = len(os.Args) // Hack so we're always the last param(s)
@@ -170,9 +297,12 @@ func main() {
 				data, sha512block, _ := hs.Mem2Disk() // also returns error
 				duration := time.Since(start)
 				fmt.Fprintf(os.Stderr, "Mem2Disk() duration: %v\n", duration)
-				os.WriteFile(fname, data, haystack.NewFilePermissions)
-				sha512hs_fname := fname + ".sha512hs"
-				os.WriteFile(sha512hs_fname, sha512block, haystack.NewFilePermissions)
+				if err := os.WriteFile(fname, data, haystack.FilePermissions()); err != nil {
+					fmt.Fprintf(os.Stderr, "Writing Haystack file %s: %v\n", fname, err)
+				} else if cname, err := haystack.WriteCatalogue(&hs, sha512block); err != nil {
+					// Catalogue goes to catalogue_dir, like the datastore's
+					fmt.Fprintf(os.Stderr, "Writing catalogue %s: %v\n", cname, err)
+				}
 
 				action = true
 			} else {
@@ -181,6 +311,22 @@ func main() {
 
 			action = true
 
+		case "-s":
+			if curarg+2 < len(os.Args) {
+				in_fname := os.Args[curarg+1]
+				out_fname := os.Args[curarg+2]
+				curarg += 2
+				fmt.Fprintf(os.Stderr, "Streaming JSON file '%s' to Haystack file '%s'\n", in_fname, out_fname)
+
+				if err := streamFile(in_fname, out_fname); err != nil {
+					fmt.Fprintf(os.Stderr, "Streaming to Haystack file %s: %v\n", out_fname, err)
+				}
+
+				action = true
+			} else {
+				fmt.Fprintf(os.Stderr, "Missing options for -s (requires JSON and Haystack filenames)\n")
+			}
+
 		case "-r":
 			if curarg+1 < len(os.Args) {
 				curarg++
@@ -192,9 +338,19 @@ func main() {
 				} else {
 					// Start the clock
 					start := time.Now()
-					if err := hs.Disk2Mem(data); err != nil {
+					last_pct := -1
+					progress := func(bytesRead, total int) {
+						if pct := bytesRead * 100 / total; pct != last_pct {
+							fmt.Fprintf(os.Stderr, "\rLoading... %3d%%", pct)
+							last_pct = pct
+						}
+					}
+					err := hs.Disk2MemProgress(data, progress)
+					fmt.Fprintf(os.Stderr, "\n")
+					if err != nil {
 						fmt.Fprintf(os.Stderr, "Reading Haystack file %s: %v\n", fname, err)
 					}
+					fmt.Fprintf(os.Stderr, "%v\n", hs.Info())
 					duration := time.Since(start)
 					fmt.Fprintf(os.Stderr, "Disk2Mem() duration: %v\n", duration)
 				}
@@ -202,16 +358,149 @@ func main() {
 			} else {
 				fmt.Fprintf(os.Stderr, "Missing option for -r (requires a filename)\n")
 			}
+
+		case "-l":
+			if curarg+1 < len(os.Args) {
+				curarg++
+				fname := os.Args[curarg]
+
+				if data, err := os.ReadFile(fname); err != nil {
+					fmt.Fprintf(os.Stderr, "Error reading Haystack file %s: %v\n", fname, err)
+				} else {
+					list, err := haystack.ListSections(data)
+					for _, si := range list {
+						fmt.Println(si)
+					}
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Listing Haystack file %s: %v\n", fname, err)
+					}
+				}
+				action = true
+			} else {
+				fmt.Fprintf(os.Stderr, "Missing option for -l (requires a filename)\n")
+			}
 		}
 	}
 
 	if !action {
-		fmt.Fprintf(os.Stderr, "Usage: %s ...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [-c <configfile>] ...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, " -c <configfile>      Read configuration from <configfile> (default %s), must be first\n", default_config_fname)
 		fmt.Fprintf(os.Stderr, " -i <file>            Ingest JSON from <file> to mem\n")
-		fmt.Fprintf(os.Stderr, " -w <file>            Write mem to Haystack <file>\n")
+		fmt.Fprintf(os.Stderr, " -w <file>            Write mem to Haystack <file>, its catalogue to catalogue_dir\n")
 		fmt.Fprintf(os.Stderr, " -r <file>            Read Haystack <file> into mem\n")
-		fmt.Fprintf(os.Stderr, " -p                   Print mem to stdout\n")
+		fmt.Fprintf(os.Stderr, " -l <file>            List sections of Haystack <file> (compression, encryption)\n")
+		fmt.Fprintf(os.Stderr, " -s <json> <file>     Ingest JSON from <json> straight to Haystack <file> (low memory)\n")
+		fmt.Fprintf(os.Stderr, " -p                   Print mem to stdout (sorts it first, like -kv)\n")
 		fmt.Fprintf(os.Stderr, " -kv <key> <val> ...  Search for <key> <value> pair(s) in mem\n")
+		fmt.Fprintf(os.Stderr, " -q <query>           Search mem, e.g. 'event_type=alert AND dest_port>=443'\n")
+		fmt.Fprintf(os.Stderr, " -o <format>          Output of -kv and -q: %s (default ndjson), put it before them\n", strings.Join(haystack.ExportFormats, "/"))
+		fmt.Fprintf(os.Stderr, " -bench <n> <key> <val> ...\n")
+		fmt.Fprintf(os.Stderr, "                      Run <n> searches for <key> <value> pair(s), report latencies\n")
+		fmt.Fprintf(os.Stderr, " -cpuprofile <file>   Write CPU profile of -bench to <file>\n")
+		fmt.Fprintf(os.Stderr, " -memprofile <file>   Write heap profile after -bench to <file>\n")
+	}
+}
+
+// Convert a JSON file to a Haystack file, without keeping it all in mem
+func streamFile(in_fname string, out_fname string) error {
+	in, err := os.Open(in_fname)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(out_fname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, haystack.FilePermissions())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var catalogue bytes.Buffer
+	var shs haystack.Haystack // separate from hs, it doesn't stay in mem anyway
+
+	// Start the clock
+	start := time.Now()
+	if err := shs.IngestAndStreamCatalogue(bufio.NewReader(in), out, &catalogue); err != nil {
+		return err
+	}
+	duration := time.Since(start)
+	fmt.Fprintf(os.Stderr, "IngestAndStream() duration: %v\n", duration)
+
+	// Catalogue goes to catalogue_dir, like the datastore's
+	_, err = haystack.WriteCatalogue(&shs, catalogue.Bytes())
+	return err
+}
+
+// Search results to stdout, buffered: there can be a lot of them
+func writeResults(format string, res []map[string]string) error {
+	w := bufio.NewWriter(os.Stdout)
+	if err := haystack.ExportResults(w, format, res); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// Run the same search a number of times, and report latency percentiles and throughput.
+// Matches are only counted, not printed, so we measure the search itself.
+func runBench(iterations int, kv_array map[string]string, cpuprofile string, memprofile string) {
+	if cpuprofile != "" {
+		f, err := os.Create(cpuprofile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating CPU profile %s: %v\n", cpuprofile, err)
+			return
+		}
+		defer f.Close()
+
+		if err := pprof.StartCPUProfile(f); err != nil {
+			fmt.Fprintf(os.Stderr, "Error starting CPU profile: %v\n", err)
+			return
+		}
+		defer pprof.StopCPUProfile()
+	}
+
+	fmt.Fprintf(os.Stderr, "Benchmarking %d searches for %v\n", iterations, kv_array)
+
+	latencies := make([]time.Duration, iterations)
+	var matches uint
+
+	// Start the clock
+	start := time.Now()
+	for i := 0; i < iterations; i++ {
+		t := time.Now()
+		matches = hs.CountKeyValArray(kv_array)
+		latencies[i] = time.Since(t)
+	}
+	duration := time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	// Nearest-rank percentile
+	percentile := func(pct int) time.Duration {
+		rank := (pct*len(latencies) + 99) / 100
+		if rank < 1 {
+			rank = 1
+		}
+		return latencies[rank-1]
+	}
+
+	fmt.Fprintf(os.Stderr, "%d matches per search, total duration: %v\n", matches, duration)
+	fmt.Fprintf(os.Stderr, "Latency min %v, p50 %v, p95 %v, p99 %v, max %v\n",
+		latencies[0], percentile(50), percentile(95), percentile(99), latencies[len(latencies)-1])
+	fmt.Fprintf(os.Stderr, "Throughput: %.1f searches/sec\n", float64(iterations)/duration.Seconds())
+
+	if memprofile != "" {
+		f, err := os.Create(memprofile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating memory profile %s: %v\n", memprofile, err)
+			return
+		}
+		defer f.Close()
+
+		runtime.GC() // get up-to-date statistics
+		if err := pprof.WriteHeapProfile(f); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing memory profile: %v\n", err)
+		}
 	}
 }
 
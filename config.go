@@ -20,6 +20,7 @@ package haystack
 import (
 	"encoding/base64"
 	"encoding/csv"
+	"fmt"
 	"log"
 	"os"
 	"os/user"
@@ -27,6 +28,7 @@ import (
 	"strings"
 	"syscall"
 
+	"github.com/google/uuid"
 	"github.com/spf13/viper"
 )
 
@@ -44,10 +46,81 @@ type Haystack_Config struct {
 	haybale_wait_minsize      uint32
 	haybale_wait_maxtime      uint32
 	compression_level         uint32
+	compression_dict_size     uint32   // shared compression dictionary of up to this many bytes, 0 = none
+	compact_bunches           bool     // write Haybales in the compact (schema) layout, see disk_compact_bunches.go
+	mapped_cache_bales        uint32   // max decoded Haybales kept per MappedHaystack
+	encryption_disabled       bool     // write sections unencrypted (config: encryption_enabled)
+	permissions_lax           bool     // too open permissions are a warning (config: strict_permissions)
+	case_sensitive_keys       bool     // Dictionary keys Host and host are different keys
+	hex_numbers               bool     // "0x12" is int 18, on insert and in searches
+	dict_table_bits           uint32   // Dictionary hash table has 2^dict_table_bits slots
+	dict_fill_warn            uint32   // percent of those in use, log a warning (once per Dictionary)
+	dict_fill_max             uint32   // percent, no new keys after that (ErrDictNearFull)
+	diskwriter_queue_len      uint32   // max Haystacks waiting for the disk writer
+	diskwriter_queue_policy   string   // block, drop or error when the queue is full
+	disk_full_policy          string   // retry or drop, when the disk writer runs out of space
+	json_array_objects        string   // flatten or records, see JSONToKVmaps()
+	max_flatten_depth         uint32   // JSON records nested deeper than this are skipped
+	max_fields_per_record     uint32   // JSON records with more (flattened) fields are skipped
+	max_line_size             uint32   // longest NDJSON line we read, see NewLineScanner()
+	store_raw                 bool     // keep the original JSON line in each record
+	raw_key                   string   // under this key, see rawKey()
+	index_keys                []string // keys with a min/max index per Haybale
+	max_ingest_rate           uint32   // records/sec from ServeIngest(), 0 = no limit
+	ingest_rate_policy        string   // block or shed when over max_ingest_rate
+	bad_timestamp_policy      string   // now or skip, for a _timestamp we can't parse
+	duplicate_key_policy      string   // keep_all, last_wins or suffix, see bunchKeys()
+	file_rollover             string   // none, hourly or daily: disk writer file per hour/day
+	search_cache_files        uint32   // max Haystacks kept loaded for SearchTimeRange()
+	search_cache_maxsize      uint32   // max Memsize of those
+	search_source_fields      bool     // add _source_file and _haybale_index to SearchTimeRange() results
+	log_level                 string   // info or debug, see debugf()
+	max_section_size          uint32   // max uncompressed length of a section we read, see maxSectionSize()
+	auto_merge                bool     // merge small datastore files in the background, see StartAutoMerge()
+	auto_merge_target_size    uint32   // merged files up to this size
+	auto_merge_min_files      uint32   // merge at least this many files at once
+	auto_merge_interval       uint32   // secs between looks at the datastore
+	recent_max_size           uint32   // keep written Haystacks in RAM up to this, 0 = don't, see RecentSnapshots()
+	recent_max_age            uint32   // secs, 0 = no age limit
+	file_mode                 uint32   // permissions for new files, see FilePermissions()
+	dir_mode                  uint32   // permissions for new directories
 }
 
 var config Haystack_Config
 
+// Where the settings come from: viper for ConfigureVariables(), a map for
+// SetConfig(). Keys are as viper has them, "haystack.<name>".
+type configSource interface {
+	IsSet(key string) bool
+	GetString(key string) string
+}
+
+var config_source configSource = viperSource{}
+
+type viperSource struct{}
+
+func (viperSource) IsSet(key string) bool       { return viper.IsSet(key) }
+func (viperSource) GetString(key string) string { return viper.GetString(key) }
+
+// Settings by name, and which ones we looked at
+type mapSource struct {
+	settings map[string]string
+	used     map[string]bool
+}
+
+func (m *mapSource) IsSet(key string) bool {
+	key = strings.TrimPrefix(key, "haystack.")
+	m.used[key] = true
+	_, ok := m.settings[key]
+	return ok
+}
+
+func (m *mapSource) GetString(key string) string {
+	key = strings.TrimPrefix(key, "haystack.")
+	m.used[key] = true
+	return m.settings[key]
+}
+
 /*
 func init() {
 	//config_set_defaults()
@@ -69,11 +142,54 @@ func config_set_defaults() {
 }
 */
 
+// Configuration from viper, the [haystack] section of the config file
 func ConfigureVariables() int {
+	return configureFrom(viperSource{})
+}
+
+// Configuration without viper, for programs that have their own: settings
+// by name, as in haystack.conf (e.g. "dict_table_bits": "16"). Same checks
+// as ConfigureVariables(), and a name we don't know is an error too.
+// Returns the number of errors, like ConfigureVariables().
+func SetConfig(settings map[string]string) int {
+	var errors int
+
+	src := &mapSource{settings: make(map[string]string), used: make(map[string]bool)}
+	for k, v := range settings {
+		name := strings.ToLower(strings.TrimPrefix(k, "haystack.")) // case-insensitive, like viper
+		if _, dup := src.settings[name]; dup {
+			log.Printf("Configuration entry '%s' given more than once", name)
+			errors++
+		}
+		src.settings[name] = v
+	}
+
+	errors += configureFrom(src)
+
+	for k := range src.settings {
+		if !src.used[k] {
+			log.Printf("Unknown configuration entry '%s'", k)
+			errors++
+		}
+	}
+
+	return errors
+}
+
+func configureFrom(src configSource) int {
 	var errors int
 
+	config_source = src
+	defer func() { config_source = viperSource{} }()
+
 	errors += config_parse_string(&config.user, "haystack.user")
 	errors += config_parse_string(&config.group, "haystack.group")
+	errors += config_parse_mode(&config.file_mode, "haystack.file_mode", NewFilePermissions, 0600)
+	errors += config_parse_mode(&config.dir_mode, "haystack.dir_mode", NewDirPermissions, 0700)
+
+	var strict_permissions bool
+	errors += config_parse_bool(&strict_permissions, "haystack.strict_permissions", true)
+	config.permissions_lax = !strict_permissions
 
 	errors += config_parse_dirname(&config.datastore_dir, "haystack.datastore_dir")
 	errors += config_parse_dirname(&config.catalogue_dir, "haystack.catalogue_dir")
@@ -84,6 +200,221 @@ func ConfigureVariables() int {
 	errors += config_parse_int(&config.haybale_wait_maxtime, "haystack.haybale_wait_maxtime", haybale_wait_maxtime_lower, haybale_wait_maxtime_upper)
 
 	errors += config_parse_int(&config.compression_level, "haystack.compression_level", compression_level_lower, compression_level_upper)
+	config.compression_dict_size = 0
+	if config_source.IsSet("haystack.compression_dict_size") { // optional, default 0 (none)
+		errors += config_parse_int(&config.compression_dict_size, "haystack.compression_dict_size", 0, compression_dict_size_upper)
+		if config.compression_dict_size != 0 && config.compression_dict_size < compression_dict_size_lower {
+			log.Printf("Variable haystack.compression_dict_size (%d) must be 0, or between %d and %d",
+				config.compression_dict_size, compression_dict_size_lower, compression_dict_size_upper)
+			errors++
+		}
+	}
+
+	errors += config_parse_bool(&config.compact_bunches, "haystack.compact_bunches", false)
+
+	config.mapped_cache_bales = mapped_cache_bales_default
+	if config_source.IsSet("haystack.mapped_cache_bales") { // optional, default 4
+		errors += config_parse_int(&config.mapped_cache_bales, "haystack.mapped_cache_bales", mapped_cache_bales_lower, mapped_cache_bales_upper)
+	}
+
+	var encryption_enabled bool
+	errors += config_parse_bool(&encryption_enabled, "haystack.encryption_enabled", true)
+	config.encryption_disabled = !encryption_enabled
+
+	errors += config_parse_bool(&config.case_sensitive_keys, "haystack.case_sensitive_keys", false)
+	errors += config_parse_bool(&config.hex_numbers, "haystack.hex_numbers", false)
+	config.dict_table_bits = hashtable_bits_max
+	if config_source.IsSet("haystack.dict_table_bits") { // optional, default 24
+		errors += config_parse_int(&config.dict_table_bits, "haystack.dict_table_bits", dict_table_bits_lower, dict_table_bits_upper)
+	}
+	config.dict_fill_warn = dict_fill_warn_default
+	if config_source.IsSet("haystack.dict_fill_warn") { // optional, default 75
+		errors += config_parse_int(&config.dict_fill_warn, "haystack.dict_fill_warn", dict_fill_lower, dict_fill_upper)
+	}
+	config.dict_fill_max = dict_fill_max_default
+	if config_source.IsSet("haystack.dict_fill_max") { // optional, default 100
+		errors += config_parse_int(&config.dict_fill_max, "haystack.dict_fill_max", dict_fill_lower, dict_fill_upper)
+	}
+
+	config.diskwriter_queue_len = diskwriter_queue_len_default
+	if config_source.IsSet("haystack.diskwriter_queue_len") { // optional, default 2
+		errors += config_parse_int(&config.diskwriter_queue_len, "haystack.diskwriter_queue_len", diskwriter_queue_len_lower, diskwriter_queue_len_upper)
+	}
+	config.diskwriter_queue_policy = diskwriter_policy_block
+	if config_source.IsSet("haystack.diskwriter_queue_policy") { // optional, default block
+		errors += config_parse_string(&config.diskwriter_queue_policy, "haystack.diskwriter_queue_policy")
+	}
+	switch config.diskwriter_queue_policy {
+	case diskwriter_policy_block, diskwriter_policy_drop, diskwriter_policy_error:
+	default:
+		log.Printf("Variable haystack.diskwriter_queue_policy '%s' invalid, must be block, drop or error",
+			config.diskwriter_queue_policy)
+		errors++
+	}
+
+	config.disk_full_policy = disk_full_policy_retry
+	if config_source.IsSet("haystack.disk_full_policy") { // optional, default retry
+		errors += config_parse_string(&config.disk_full_policy, "haystack.disk_full_policy")
+	}
+	switch config.disk_full_policy {
+	case disk_full_policy_retry, disk_full_policy_drop:
+	default:
+		log.Printf("Variable haystack.disk_full_policy '%s' invalid, must be retry or drop",
+			config.disk_full_policy)
+		errors++
+	}
+
+	config.json_array_objects = json_array_objects_flatten
+	if config_source.IsSet("haystack.json_array_objects") { // optional, default flatten
+		errors += config_parse_string(&config.json_array_objects, "haystack.json_array_objects")
+	}
+	switch config.json_array_objects {
+	case json_array_objects_flatten, json_array_objects_records:
+	default:
+		log.Printf("Variable haystack.json_array_objects '%s' invalid, must be flatten or records",
+			config.json_array_objects)
+		errors++
+	}
+
+	config.max_flatten_depth = max_flatten_depth_default
+	if config_source.IsSet("haystack.max_flatten_depth") { // optional, default 1000
+		errors += config_parse_int(&config.max_flatten_depth, "haystack.max_flatten_depth", max_flatten_depth_lower, max_flatten_depth_upper)
+	}
+	config.max_fields_per_record = max_fields_per_record_default
+	if config_source.IsSet("haystack.max_fields_per_record") { // optional, default 100000
+		errors += config_parse_int(&config.max_fields_per_record, "haystack.max_fields_per_record", max_fields_per_record_lower, max_fields_per_record_upper)
+	}
+	config.max_line_size = max_line_size_default
+	if config_source.IsSet("haystack.max_line_size") { // optional, default 16M
+		errors += config_parse_size(&config.max_line_size, "haystack.max_line_size", max_line_size_lower, max_line_size_upper)
+	}
+
+	errors += config_parse_bool(&config.store_raw, "haystack.store_raw", false)
+	if config_source.IsSet("haystack.raw_key") { // optional, see rawKey()
+		errors += config_parse_string(&config.raw_key, "haystack.raw_key")
+	}
+	if len(config.raw_key) > max_keylen || new(Dictionary).isTimestampKey(config.raw_key) {
+		log.Printf("Variable haystack.raw_key '%.32s' invalid, must be max %d chars, and not %s",
+			config.raw_key, max_keylen, Timestamp_key)
+		errors++
+	}
+
+	config.index_keys = nil
+	if config_source.IsSet("haystack.index_keys") { // optional, comma separated
+		for _, k := range strings.Split(config_source.GetString("haystack.index_keys"), ",") {
+			k = strings.TrimSpace(k)
+			if k == "" {
+				continue
+			}
+			if len(k) > max_keylen {
+				log.Printf("Variable haystack.index_keys key '%.32s' invalid, must be max %d chars", k, max_keylen)
+				errors++
+				continue
+			}
+			config.index_keys = append(config.index_keys, k)
+		}
+	}
+
+	config.max_ingest_rate = 0
+	if config_source.IsSet("haystack.max_ingest_rate") { // optional, default 0 (no limit)
+		errors += config_parse_int(&config.max_ingest_rate, "haystack.max_ingest_rate", max_ingest_rate_lower, max_ingest_rate_upper)
+	}
+	config.ingest_rate_policy = ingest_rate_policy_block
+	if config_source.IsSet("haystack.ingest_rate_policy") { // optional, default block
+		errors += config_parse_string(&config.ingest_rate_policy, "haystack.ingest_rate_policy")
+	}
+	switch config.ingest_rate_policy {
+	case ingest_rate_policy_block, ingest_rate_policy_shed:
+	default:
+		log.Printf("Variable haystack.ingest_rate_policy '%s' invalid, must be block or shed",
+			config.ingest_rate_policy)
+		errors++
+	}
+
+	config.bad_timestamp_policy = bad_timestamp_policy_now
+	if config_source.IsSet("haystack.bad_timestamp_policy") { // optional, default now
+		errors += config_parse_string(&config.bad_timestamp_policy, "haystack.bad_timestamp_policy")
+	}
+	switch config.bad_timestamp_policy {
+	case bad_timestamp_policy_now, bad_timestamp_policy_skip:
+	default:
+		log.Printf("Variable haystack.bad_timestamp_policy '%s' invalid, must be now or skip",
+			config.bad_timestamp_policy)
+		errors++
+	}
+
+	config.duplicate_key_policy = duplicate_key_policy_keep_all
+	if config_source.IsSet("haystack.duplicate_key_policy") { // optional, default keep_all
+		errors += config_parse_string(&config.duplicate_key_policy, "haystack.duplicate_key_policy")
+	}
+	switch config.duplicate_key_policy {
+	case duplicate_key_policy_keep_all, duplicate_key_policy_last_wins, duplicate_key_policy_suffix:
+	default:
+		log.Printf("Variable haystack.duplicate_key_policy '%s' invalid, must be keep_all, last_wins or suffix",
+			config.duplicate_key_policy)
+		errors++
+	}
+
+	config.file_rollover = file_rollover_none
+	if config_source.IsSet("haystack.file_rollover") { // optional, default none
+		errors += config_parse_string(&config.file_rollover, "haystack.file_rollover")
+	}
+	switch config.file_rollover {
+	case file_rollover_none, file_rollover_hourly, file_rollover_daily:
+	default:
+		log.Printf("Variable haystack.file_rollover '%s' invalid, must be none, hourly or daily",
+			config.file_rollover)
+		errors++
+	}
+
+	config.search_cache_files = search_cache_files_default
+	if config_source.IsSet("haystack.search_cache_files") { // optional, default 8
+		errors += config_parse_int(&config.search_cache_files, "haystack.search_cache_files", search_cache_files_lower, search_cache_files_upper)
+	}
+	config.search_cache_maxsize = search_cache_maxsize_default
+	if config_source.IsSet("haystack.search_cache_maxsize") { // optional, default 1G
+		errors += config_parse_size(&config.search_cache_maxsize, "haystack.search_cache_maxsize", search_cache_maxsize_lower, search_cache_maxsize_upper)
+	}
+	errors += config_parse_bool(&config.search_source_fields, "haystack.search_source_fields", false)
+
+	config.log_level = log_level_info
+	if config_source.IsSet("haystack.log_level") { // optional, default info
+		errors += config_parse_string(&config.log_level, "haystack.log_level")
+	}
+	switch config.log_level {
+	case log_level_info, log_level_debug:
+	default:
+		log.Printf("Variable haystack.log_level '%s' invalid, must be info or debug", config.log_level)
+		errors++
+	}
+
+	config.max_section_size = max_section_size_default
+	if config_source.IsSet("haystack.max_section_size") { // optional, default 512M
+		errors += config_parse_size(&config.max_section_size, "haystack.max_section_size", max_section_size_lower, max_section_size_upper)
+	}
+
+	errors += config_parse_bool(&config.auto_merge, "haystack.auto_merge", false)
+	config.auto_merge_target_size = auto_merge_target_size_default
+	if config_source.IsSet("haystack.auto_merge_target_size") { // optional, default 256M
+		errors += config_parse_size(&config.auto_merge_target_size, "haystack.auto_merge_target_size", auto_merge_target_size_lower, auto_merge_target_size_upper)
+	}
+	config.auto_merge_min_files = auto_merge_min_files_default
+	if config_source.IsSet("haystack.auto_merge_min_files") { // optional, default 4
+		errors += config_parse_int(&config.auto_merge_min_files, "haystack.auto_merge_min_files", auto_merge_min_files_lower, auto_merge_min_files_upper)
+	}
+	config.auto_merge_interval = auto_merge_interval_default
+	if config_source.IsSet("haystack.auto_merge_interval") { // optional, default 600
+		errors += config_parse_int(&config.auto_merge_interval, "haystack.auto_merge_interval", auto_merge_interval_lower, auto_merge_interval_upper)
+	}
+
+	config.recent_max_size = 0
+	if config_source.IsSet("haystack.recent_max_size") { // optional, default 0 (off)
+		errors += config_parse_size(&config.recent_max_size, "haystack.recent_max_size", recent_max_size_lower, recent_max_size_upper)
+	}
+	config.recent_max_age = 0
+	if config_source.IsSet("haystack.recent_max_age") { // optional, default 0 (no age limit)
+		errors += config_parse_int(&config.recent_max_age, "haystack.recent_max_age", recent_max_age_lower, recent_max_age_upper)
+	}
 
 	return errors
 }
@@ -102,6 +433,22 @@ func ValidateConfiguration() int {
 	return errors
 }
 
+// Permissions for new files, config file_mode (default NewFilePermissions)
+func FilePermissions() os.FileMode {
+	if config.file_mode == 0 {
+		return NewFilePermissions
+	}
+	return os.FileMode(config.file_mode)
+}
+
+// Permissions for new directories, config dir_mode (default NewDirPermissions)
+func DirPermissions() os.FileMode {
+	if config.dir_mode == 0 {
+		return NewDirPermissions
+	}
+	return os.FileMode(config.dir_mode)
+}
+
 func checkSystemUserGroup() int {
 	var errors int
 
@@ -166,7 +513,11 @@ func checkSystemUserGroup() int {
 func checkFileUserGroupAttributes(path string) int {
 	var errors int
 
-	st, _ := os.Stat(path)
+	st, err := os.Stat(path)
+	if err != nil {
+		log.Printf("Can't check '%s': %v", path, err)
+		return 1
+	}
 
 	if config.uid != st.Sys().(*syscall.Stat_t).Uid {
 		log.Printf("'%s' is not owned by current user (%s)", path, config.user)
@@ -181,22 +532,26 @@ func checkFileUserGroupAttributes(path string) int {
 	var perm_allowed uint32
 
 	if st.IsDir() {
-		perm_allowed = 0770
+		perm_allowed = uint32(DirPermissions())
 	} else {
-		perm_allowed = 0660
+		perm_allowed = uint32(FilePermissions())
 	}
 
 	file_perm := uint32(st.Mode().Perm())
-	if (file_perm & 0007) != 0 { // If any "others" are allowed, we object.
-		log.Printf("Permissions for '%s' are %04o (allowed: %04o)", path, file_perm, perm_allowed)
-		errors++
+	if (file_perm &^ perm_allowed) != 0 { // Anything beyond what we'd create, we object.
+		if config.permissions_lax { // unless told not to, e.g. a container's umask
+			log.Printf("Warning: permissions for '%s' are %04o (allowed: %04o), strict_permissions is off", path, file_perm, perm_allowed)
+		} else {
+			log.Printf("Permissions for '%s' are %04o (allowed: %04o)", path, file_perm, perm_allowed)
+			errors++
+		}
 	}
 
 	return errors
 }
 
 func config_parse_string(s *string, key string) int {
-	if str := viper.GetString(key); str != "" {
+	if str := config_source.GetString(key); str != "" {
 		*s = str
 	} else {
 		log.Printf("Configuration entry for '%s' missing or empty", key)
@@ -207,7 +562,7 @@ func config_parse_string(s *string, key string) int {
 }
 
 func config_parse_dirname(v *string, key string) int {
-	if dirpath := viper.GetString(key); dirpath != "" {
+	if dirpath := config_source.GetString(key); dirpath != "" {
 		if *v != "" {
 			log.Printf("Cannot change path for '%s' from '%s' to '%s' while running", key, *v, dirpath)
 			return 1
@@ -232,7 +587,7 @@ func config_parse_dirname(v *string, key string) int {
 }
 
 func config_parse_filename(v *string, key string) int {
-	if fname := viper.GetString(key); fname != "" {
+	if fname := config_source.GetString(key); fname != "" {
 		*v = fname
 	} else {
 		log.Printf("Configuration entry for '%s' missing or empty", key)
@@ -252,7 +607,9 @@ func config_parse_filename(v *string, key string) int {
 }
 
 func config_parse_int(i *uint32, key string, lower uint32, upper uint32) int {
-	*i = viper.GetUint32(key)
+	// Not a number is 0: out of bounds, or off where 0 is allowed
+	v, _ := strconv.ParseUint(strings.TrimSpace(config_source.GetString(key)), 10, 32)
+	*i = uint32(v)
 
 	if *i < lower || *i > upper {
 		log.Printf("Variable %s out of bounds (%d), must be between %d and %d",
@@ -263,8 +620,49 @@ func config_parse_int(i *uint32, key string, lower uint32, upper uint32) int {
 	return 0 // 0 = success
 }
 
+// Booleans are optional, we use def(ault) if not set
+func config_parse_bool(b *bool, key string, def bool) int {
+	if !config_source.IsSet(key) {
+		*b = def
+		return 0
+	}
+
+	s := config_source.GetString(key)
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		log.Printf("Cannot parse variable %s: '%s' (must be true or false)", key, s)
+		return 1
+	}
+	*b = v
+
+	return 0 // 0 = success
+}
+
+// Permissions in octal, like 0640, def(ault) if not set. Must at least have
+// the bits in need (we have to be able to use what we create).
+func config_parse_mode(m *uint32, key string, def uint32, need uint32) int {
+	if !config_source.IsSet(key) {
+		*m = def
+		return 0
+	}
+
+	s := config_source.GetString(key)
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || v > 0777 {
+		log.Printf("Cannot parse variable %s: '%s' (must be octal, like %04o)", key, s, def)
+		return 1
+	}
+	if uint32(v)&need != need {
+		log.Printf("Variable %s %04o doesn't allow the owner access (need at least %04o)", key, v, need)
+		return 1
+	}
+	*m = uint32(v)
+
+	return 0 // 0 = success
+}
+
 func config_parse_size(i *uint32, key string, lower uint32, upper uint32) int {
-	s := viper.GetString(key)
+	s := config_source.GetString(key)
 	if s == "" {
 		log.Printf("Configuration entry for '%s' missing or empty", key)
 		return 1
@@ -297,10 +695,21 @@ func config_parse_size(i *uint32, key string, lower uint32, upper uint32) int {
 }
 
 func ConfigureAESKeyStore() int {
+	if err := LoadAESKeyStore(); err != nil {
+		log.Printf("%v", err)
+		return 1
+	}
+
+	return 0 // 0 = success
+}
+
+// Load the keystore (config aes_keystore_list), the last key in it becomes
+// the active one. Keys that can't be right are ErrWrongKey.
+// If loading fails, the keystore we had stays in place.
+func LoadAESKeyStore() error {
 	file, err := os.Open(config.aes_keystore_list)
 	if err != nil {
-		log.Printf("Error opening AES keystore file: %s", err)
-		return 1
+		return fmt.Errorf("error opening AES keystore file: %w", err)
 	}
 	defer file.Close()
 
@@ -311,29 +720,65 @@ func ConfigureAESKeyStore() int {
 
 	records, err := reader.ReadAll()
 	if err != nil {
-		log.Printf("Error reading AES keystore file: %s", err)
-		return 1
+		return fmt.Errorf("error reading AES keystore file: %w", err)
+	}
+
+	// Without any key we can't encrypt or decrypt anything
+	if len(records) == 0 {
+		return fmt.Errorf("AES keystore file '%s' contains no keys", config.aes_keystore_list)
 	}
 
 	new_array := make(map[string][]byte)
+	var new_uuid string
 	for _, fields := range records {
 		// Convert printable base64 AES key string back to binary sequence we can use
 		key, err := base64.StdEncoding.DecodeString(fields[1])
 		if err != nil {
-			log.Printf("Error decoding base64 AES key (uuid %s): %s", fields[0], err)
-			return 1
+			return fmt.Errorf("%w: error decoding base64 AES key (uuid %s): %s", ErrWrongKey, fields[0], err)
+		}
+
+		if len(key) != AES_key_byte_len {
+			return fmt.Errorf("%w: AES key (uuid %s) is %d bytes, must be %d", ErrWrongKey, fields[0], len(key), AES_key_byte_len)
 		}
 
 		// uuid is key, AES key (decoded from base64) is value
 		new_array[fields[0]] = key
 
 		// most recent one is active key
-		config.aes_keystore_current_uuid = fields[0]
+		new_uuid = fields[0]
 	}
-	// We do it this way because another Go routine may be accessing
+	// We do it this way because another Go routine may be accessing,
+	// and so a keystore that fails to load leaves the active one in place.
 	config.aes_keystore_array = new_array
+	config.aes_keystore_current_uuid = new_uuid
 
-	return 0 // 0 = success
+	return nil
+}
+
+// Add an AES key to the keystore and make it the active one, without a
+// keystore file. Keys already there stay, so files written with them can
+// still be read. Same uuid again replaces that key.
+// A key that can't be right is ErrWrongKey, and changes nothing.
+func SetActiveKey(key_uuid string, key []byte) error {
+	u, err := uuid.Parse(key_uuid)
+	if err != nil || u == uuid.Nil { // the nil uuid means not encrypted
+		return fmt.Errorf("%w: invalid AES key uuid '%s'", ErrWrongKey, key_uuid)
+	}
+	if len(key) != AES_key_byte_len {
+		return fmt.Errorf("%w: AES key (uuid %s) is %d bytes, must be %d", ErrWrongKey, key_uuid, len(key), AES_key_byte_len)
+	}
+
+	// A new map, same as LoadAESKeyStore(), for whoever is using the old one
+	new_array := make(map[string][]byte, len(config.aes_keystore_array)+1)
+	for k, v := range config.aes_keystore_array {
+		new_array[k] = v
+	}
+	new_array[u.String()] = append([]byte(nil), key...) // caller may reuse theirs
+
+	config.aes_keystore_array = new_array
+	config.aes_keystore_current_uuid = u.String()
+
+	return nil
 }
 
 // EOF
@@ -0,0 +1,380 @@
+// OpenActa/Haystack Configuration - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// Write a keystore file with the given content, and point our config at it
+func writeTestKeyStore(t *testing.T, content string) {
+	fname := filepath.Join(t.TempDir(), "keystore.list")
+	if err := os.WriteFile(fname, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := config
+	t.Cleanup(func() { config = saved })
+
+	config.aes_keystore_list = fname
+	config.aes_keystore_array = nil
+	config.aes_keystore_current_uuid = ""
+}
+
+func TestConfigureAESKeyStore(t *testing.T) {
+	var tests = []struct {
+		name    string
+		content string
+		errors  int
+	}{
+		{"valid", `"f9800d09-2a20-4ffe-8916-748783c1ea0a","5/QerSN8LrWRPkLoge4IfYT/Iv8X4GjQC3njnW6MlzU=","Test key"` + "\n", 0},
+		{"empty file", "", 1},
+		{"only comments", "# no keys in here\n", 1},
+		{"bad base64", `"f9800d09-2a20-4ffe-8916-748783c1ea0a","not*base64!","Bad key"` + "\n", 1},
+		{"wrong key length", `"f9800d09-2a20-4ffe-8916-748783c1ea0a","5/QerSN8LrWRPkLoge4IfYT/Iv8X","Short key"` + "\n", 1},
+	}
+
+	for _, tt := range tests {
+		writeTestKeyStore(t, tt.content)
+
+		if errors := ConfigureAESKeyStore(); errors != tt.errors {
+			t.Errorf("%s: ConfigureAESKeyStore() = %d, wanted %d", tt.name, errors, tt.errors)
+		}
+
+		if tt.errors == 0 && config.aes_keystore_current_uuid == "" {
+			t.Errorf("%s: no current AES key uuid set", tt.name)
+		}
+	}
+}
+
+// A 16 byte (AES-128) key is a valid AES key, but not for us: reject at load time
+func TestConfigureAESKeyStoreShortKey(t *testing.T) {
+	writeTestKeyStore(t, `"f9800d09-2a20-4ffe-8916-748783c1ea0a","5/QerSN8LrWRPkLoge4IfYT/Iv8X4GjQC3njnW6MlzU=","Good key"`+"\n"+
+		`"0b4f1d2c-55a1-4c8e-9d3a-2e6f7a8b9c0d","AAECAwQFBgcICQoLDA0ODw==","AES-128 key"`+"\n")
+
+	if errors := ConfigureAESKeyStore(); errors != 1 {
+		t.Errorf("ConfigureAESKeyStore() with 16 byte key = %d errors, wanted 1", errors)
+	}
+
+	if config.aes_keystore_current_uuid != "" || config.aes_keystore_array != nil {
+		t.Errorf("keystore with 16 byte key was (partially) activated: uuid '%s'", config.aes_keystore_current_uuid)
+	}
+
+	if err := LoadAESKeyStore(); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("LoadAESKeyStore() with 16 byte key: %v", err)
+	}
+}
+
+func TestSetActiveKey(t *testing.T) {
+	setTestConfig(t)
+
+	const other_uuid = "0b4f1d2c-55a1-4c8e-9d3a-2e6f7a8b9c0d"
+	key := make([]byte, AES_key_byte_len)
+	key[0] = 42
+
+	// The old one stays, for reading
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+	old, _, err := hs.Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetActiveKey(other_uuid, key); err != nil {
+		t.Fatal(err)
+	}
+	key[0] = 0 // ours now, not the caller's
+	if config.aes_keystore_current_uuid != other_uuid || config.aes_keystore_array[other_uuid][0] != 42 {
+		t.Errorf("active key %s, %v", config.aes_keystore_current_uuid, config.aes_keystore_array[other_uuid])
+	}
+
+	data, _, err := hs.Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range [][]byte{old, data} {
+		if err := new(Haystack).Disk2Mem(d); err != nil {
+			t.Error(err)
+		}
+	}
+	if hs.aes_key_uuid != other_uuid {
+		t.Errorf("written with key %s", hs.aes_key_uuid)
+	}
+
+	for _, tt := range []struct {
+		name string
+		uuid string
+		len  int
+	}{
+		{"short key", other_uuid, 16},
+		{"long key", other_uuid, 64},
+		{"not a uuid", "not-a-uuid", AES_key_byte_len},
+		{"nil uuid", "00000000-0000-0000-0000-000000000000", AES_key_byte_len},
+	} {
+		if err := SetActiveKey(tt.uuid, make([]byte, tt.len)); !errors.Is(err, ErrWrongKey) {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+	if config.aes_keystore_current_uuid != other_uuid || len(config.aes_keystore_array) != 2 {
+		t.Errorf("bad keys changed the keystore: %s %d", config.aes_keystore_current_uuid, len(config.aes_keystore_array))
+	}
+}
+
+func TestConfigParseMode(t *testing.T) {
+	saved := config
+	t.Cleanup(func() {
+		config = saved
+		viper.Reset()
+	})
+
+	var m uint32
+	if errors := config_parse_mode(&m, "haystack.file_mode", NewFilePermissions, 0600); errors != 0 || m != NewFilePermissions {
+		t.Errorf("not set: %d errors, mode %04o", errors, m)
+	}
+
+	for _, tt := range []struct {
+		s      string
+		errors int
+		mode   uint32
+	}{
+		{"0640", 0, 0640},
+		{"600", 0, 0600},
+		{"0666", 0, 0666},
+		{"0440", 1, 0}, // owner can't write
+		{"0680", 1, 0}, // not octal
+		{"01660", 1, 0},
+		{"rw-r-----", 1, 0},
+	} {
+		viper.Set("haystack.file_mode", tt.s)
+		m = 0
+		if errors := config_parse_mode(&m, "haystack.file_mode", NewFilePermissions, 0600); errors != tt.errors || m != tt.mode {
+			t.Errorf("%s: %d errors, mode %04o", tt.s, errors, m)
+		}
+	}
+
+	// What we create is what we accept
+	config.file_mode = 0640
+	dir := t.TempDir()
+	config.uid, config.gid = uint32(os.Getuid()), uint32(os.Getgid())
+	for _, tt := range []struct {
+		perm   os.FileMode
+		errors int
+	}{
+		{0640, 0},
+		{0600, 0},
+		{0660, 1},
+		{0644, 1},
+	} {
+		fname := filepath.Join(dir, "f")
+		if err := os.WriteFile(fname, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(fname, tt.perm); err != nil {
+			t.Fatal(err)
+		}
+		if errors := checkFileUserGroupAttributes(fname); errors != tt.errors {
+			t.Errorf("%04o with file_mode 0640: %d errors", tt.perm, errors)
+		}
+
+		// Not strict: a warning, no error
+		config.permissions_lax = true
+		if errors := checkFileUserGroupAttributes(fname); errors != 0 {
+			t.Errorf("%04o with file_mode 0640, not strict: %d errors", tt.perm, errors)
+		}
+		config.permissions_lax = false
+	}
+
+	// Not there: an error, not a panic
+	if errors := checkFileUserGroupAttributes(filepath.Join(dir, "missing")); errors != 1 {
+		t.Errorf("missing file: %d errors", errors)
+	}
+}
+
+// What's in haystack.conf, with datastore and catalogue dirs of our own
+func testConfigSettings(t *testing.T) map[string]string {
+	viper.SetConfigFile("testdata/haystack.conf")
+	viper.SetConfigType("ini")
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	settings := viper.GetStringMapString("haystack")
+	settings["datastore_dir"] = t.TempDir()
+	settings["catalogue_dir"] = t.TempDir()
+
+	return settings
+}
+
+// SetConfig() with what's in haystack.conf gets what ConfigureVariables() does
+func TestSetConfig(t *testing.T) {
+	saved := config
+	t.Cleanup(func() {
+		config = saved
+		viper.Reset()
+	})
+
+	settings := testConfigSettings(t)
+	for k, v := range settings {
+		viper.Set("haystack."+k, v)
+	}
+
+	config = Haystack_Config{}
+	if errors := ConfigureVariables(); errors != 0 {
+		t.Fatalf("ConfigureVariables(): %d errors", errors)
+	}
+	from_viper := config
+
+	viper.Reset() // not used
+	config = Haystack_Config{}
+	if errors := SetConfig(settings); errors != 0 {
+		t.Fatalf("SetConfig(): %d errors", errors)
+	}
+	if !reflect.DeepEqual(config, from_viper) {
+		t.Errorf("SetConfig():\n%+v\nConfigureVariables():\n%+v", config, from_viper)
+	}
+
+	// Optional ones get their default, names are case-insensitive
+	delete(settings, "max_section_size")
+	settings["Dict_Table_Bits"] = settings["dict_table_bits"]
+	delete(settings, "dict_table_bits")
+	config = Haystack_Config{}
+	if errors := SetConfig(settings); errors != 0 || config.max_section_size != max_section_size_default {
+		t.Errorf("defaults: %d errors, max_section_size %d", errors, config.max_section_size)
+	}
+	settings["dict_table_bits"] = settings["Dict_Table_Bits"]
+	config = Haystack_Config{}
+	if errors := SetConfig(settings); errors != 1 {
+		t.Errorf("dict_table_bits twice: %d errors", errors)
+	}
+	delete(settings, "Dict_Table_Bits")
+
+	for _, tt := range []struct {
+		key, val string
+	}{
+		{"dict_table_bits", "99"},
+		{"dict_table_bits", "sixteen"},
+		{"max_section_size", "1K"},
+		{"case_sensitive_keys", "maybe"},
+		{"encryption_enabled", "maybe"},
+		{"duplicate_key_policy", "first_wins"},
+		{"no_such_setting", "1"},
+	} {
+		bad := make(map[string]string)
+		for k, v := range settings {
+			bad[k] = v
+		}
+		bad[tt.key] = tt.val
+		config = Haystack_Config{}
+		if errors := SetConfig(bad); errors != 1 {
+			t.Errorf("%s = %s: %d errors", tt.key, tt.val, errors)
+		}
+	}
+}
+
+// Optional settings that aren't there get their default
+func TestConfigDefaults(t *testing.T) {
+	saved := config
+	t.Cleanup(func() {
+		config = saved
+		viper.Reset()
+	})
+
+	settings := testConfigSettings(t)
+
+	for _, tt := range []struct {
+		key  string
+		got  func() uint64
+		want uint64
+	}{
+		{"dict_table_bits", func() uint64 { return uint64(config.dict_table_bits) }, hashtable_bits_max},
+		{"mapped_cache_bales", func() uint64 { return uint64(config.mapped_cache_bales) }, mapped_cache_bales_default},
+		{"diskwriter_queue_len", func() uint64 { return uint64(config.diskwriter_queue_len) }, diskwriter_queue_len_default},
+		{"max_flatten_depth", func() uint64 { return uint64(config.max_flatten_depth) }, max_flatten_depth_default},
+		{"max_fields_per_record", func() uint64 { return uint64(config.max_fields_per_record) }, max_fields_per_record_default},
+		{"search_cache_files", func() uint64 { return uint64(config.search_cache_files) }, search_cache_files_default},
+		{"search_cache_maxsize", func() uint64 { return uint64(config.search_cache_maxsize) }, search_cache_maxsize_default},
+	} {
+		without := make(map[string]string)
+		for k, v := range settings {
+			if k != tt.key {
+				without[k] = v
+			}
+		}
+		config = Haystack_Config{}
+		if errors := SetConfig(without); errors != 0 || tt.got() != tt.want {
+			t.Errorf("%s not set: %d errors, %d instead of %d", tt.key, errors, tt.got(), tt.want)
+		}
+	}
+
+	// Encryption is on unless it's turned off
+	for val, disabled := range map[string]bool{"": false, "true": false, "false": true} {
+		with := make(map[string]string)
+		for k, v := range settings {
+			if k != "encryption_enabled" {
+				with[k] = v
+			}
+		}
+		if val != "" {
+			with["encryption_enabled"] = val
+		}
+		config = Haystack_Config{}
+		if errors := SetConfig(with); errors != 0 || config.encryption_disabled != disabled {
+			t.Errorf("encryption_enabled '%s': %d errors, disabled %v", val, errors, config.encryption_disabled)
+		}
+	}
+
+	// A config from before any of the optional settings
+	older := make(map[string]string)
+	for k, v := range settings {
+		older[k] = v
+	}
+	for _, k := range []string{"auto_merge", "auto_merge_interval", "auto_merge_min_files", "auto_merge_target_size",
+		"bad_timestamp_policy", "case_sensitive_keys", "compact_bunches", "compression_dict_size",
+		"dict_fill_max", "dict_fill_warn", "dict_table_bits", "dir_mode", "disk_full_policy",
+		"diskwriter_queue_len", "diskwriter_queue_policy", "duplicate_key_policy", "encryption_enabled",
+		"file_mode", "file_rollover", "hex_numbers", "index_keys", "ingest_rate_policy", "json_array_objects",
+		"log_level", "mapped_cache_bales", "max_fields_per_record", "max_flatten_depth", "max_ingest_rate",
+		"max_line_size", "max_section_size", "raw_key", "search_cache_files", "search_cache_maxsize",
+		"search_source_fields", "store_raw", "strict_permissions"} {
+		delete(older, k)
+	}
+	config = Haystack_Config{}
+	if errors := SetConfig(older); errors != 0 {
+		t.Errorf("without the optional settings: %d errors", errors)
+	}
+	if config.diskwriter_queue_policy != diskwriter_policy_block || config.json_array_objects != json_array_objects_flatten ||
+		config.ingest_rate_policy != ingest_rate_policy_block || config.bad_timestamp_policy != bad_timestamp_policy_now ||
+		config.file_rollover != file_rollover_none || config.max_ingest_rate != 0 {
+		t.Errorf("without the optional settings: policies %s %s %s %s %s, max_ingest_rate %d",
+			config.diskwriter_queue_policy, config.json_array_objects, config.ingest_rate_policy,
+			config.bad_timestamp_policy, config.file_rollover, config.max_ingest_rate)
+	}
+
+	// Small enough for a test setup
+	settings["search_cache_maxsize"] = "1M"
+	config = Haystack_Config{}
+	if errors := SetConfig(settings); errors != 0 || config.search_cache_maxsize != 1024*1024 {
+		t.Errorf("search_cache_maxsize 1M: %d errors, %d", errors, config.search_cache_maxsize)
+	}
+}
+
+// EOF
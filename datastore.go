@@ -0,0 +1,266 @@
+// OpenActa/Haystack - datastore (directory of Haystack files) management
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	Haystack_file_ext  = ".hs"  // Filename extension of Haystack files in the datastore
+	Catalogue_file_ext = ".hsc" // Filename extension of catalogue (SHA512) files
+
+	legacy_catalogue_ext = ".sha512hs" // <Haystack file>.sha512hs, from before catalogue_dir
+)
+
+type HaystackFileInfo struct {
+	Path       string // Full path of the Haystack file
+	Size       int64  // File size in bytes
+	TimeFirst  int64  // _timestamp of first entry (Unix nanosecs), from the trailer
+	TimeLast   int64  // _timestamp of last entry (Unix nanosecs), from the trailer
+	AESKeyUUID string // uuid of the AES key the file was encrypted with
+	FileUUID   string // unique id of the file ("" for files from before format 1.1)
+}
+
+// Name of the catalogue file that belongs with the Haystack file we last
+// wrote or read: <time_first>-<time_last>-<file uuid>.hsc
+// The file uuid makes it unambiguous, even for files with identical timestamps.
+// Files from before format 1.1 don't have one, for those it's the start of
+// the SHA-512 of the Haystack file instead.
+func (p *Haystack) CatalogueName() string {
+	p.RLock()
+	defer p.RUnlock()
+
+	return catalogueName(p.time_first, p.time_last, p.file_uuid, p.file_sha512)
+}
+
+// file_sha512 (of the Haystack file) is only used without a file_uuid
+func catalogueName(time_first int64, time_last int64, file_uuid string, file_sha512 []byte) string {
+	id := file_uuid
+	if id == "" && len(file_sha512) >= 16 {
+		id = hex.EncodeToString(file_sha512[:16])
+	}
+
+	return fmt.Sprintf("%d-%d-%s%s", time_first, time_last, id, Catalogue_file_ext)
+}
+
+// Where the catalogue of a Haystack file in the datastore is.
+// Without a file uuid, that means reading all of it for its SHA-512.
+func cataloguePath(info *HaystackFileInfo) (string, error) {
+	var file_sha512 []byte
+	if info.FileUUID == "" {
+		data, err := fsys.ReadFile(info.Path)
+		if err != nil {
+			return "", err
+		}
+		sum := sha512.Sum512(data)
+		file_sha512 = sum[:]
+	}
+
+	return filepath.Join(config.catalogue_dir, catalogueName(info.TimeFirst, info.TimeLast, info.FileUUID, file_sha512)), nil
+}
+
+// Write the catalogue of a Haystack file we wrote ourselves (see Mem2Disk()),
+// into catalogue_dir like the disk writer does. Returns its path.
+func WriteCatalogue(hs *Haystack, sha512block []byte) (string, error) {
+	cpath := filepath.Join(config.catalogue_dir, hs.CatalogueName())
+
+	return cpath, writeFileAtomic(cpath, sha512block)
+}
+
+// List all Haystack files in the datastore, sorted by time (oldest first).
+// We use the trailer of each file for this, not its filename.
+func ListDatastore() ([]HaystackFileInfo, error) {
+	entries, err := fsys.ReadDir(config.datastore_dir)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]HaystackFileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), Haystack_file_ext) {
+			continue
+		}
+
+		path := filepath.Join(config.datastore_dir, entry.Name())
+
+		info, err := getHaystackFileInfo(path)
+		if err != nil {
+			// One bad file shouldn't stop us from listing the rest
+			log.Printf("Skipping Haystack file '%s': %s", path, err)
+			continue
+		}
+
+		list = append(list, *info)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].TimeFirst != list[j].TimeFirst {
+			return list[i].TimeFirst < list[j].TimeFirst
+		}
+		return list[i].Path < list[j].Path
+	})
+
+	return list, nil
+}
+
+// Remove a Haystack file and its catalogue, for retention. The catalogue is
+// in catalogue_dir, or next to the file if an older haystack command wrote it.
+// The Haystack file is renamed out of the way first, so ListDatastore() never
+// sees it without its catalogue. If the catalogue can't be removed, it's put back.
+// A missing catalogue is logged, but not an error. Neither is a Haystack file
+// we can't read (so we can't find its catalogue), it goes all the same.
+func DeleteHaystackFile(hsPath string) error {
+	st, err := fsys.Stat(hsPath)
+	if err != nil {
+		return err
+	}
+	if st.IsDir() {
+		return fmt.Errorf("'%s' is a directory, not a Haystack file", hsPath)
+	}
+
+	var cpath string
+	if info, err := getHaystackFileInfo(hsPath); err != nil {
+		log.Printf("Can't read Haystack file '%s', so can't find its catalogue: %s", hsPath, err)
+	} else if cpath, err = cataloguePath(info); err != nil {
+		log.Printf("Can't read Haystack file '%s', so can't find its catalogue: %s", hsPath, err)
+	}
+
+	del := hsPath + ".del"
+	if err := fsys.Rename(hsPath, del); err != nil {
+		return err
+	}
+
+	reclaimed := st.Size()
+	if cpath != "" {
+		cst, err := fsys.Stat(cpath)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Older versions of the haystack command (-w, -s) put it next to the file
+			for _, alt := range []string{filepath.Join(filepath.Dir(hsPath), filepath.Base(cpath)), hsPath + legacy_catalogue_ext} {
+				if alt_st, alt_err := fsys.Stat(alt); alt_err == nil {
+					cpath, cst, err = alt, alt_st, nil
+					break
+				}
+			}
+		}
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			log.Printf("Haystack file '%s' has no catalogue '%s'", hsPath, cpath)
+		case err == nil:
+			if err := fsys.Remove(cpath); err != nil {
+				fsys.Rename(del, hsPath)
+				return err
+			}
+			reclaimed += cst.Size()
+		default:
+			fsys.Rename(del, hsPath)
+			return err
+		}
+	}
+
+	if err := fsys.Remove(del); err != nil {
+		return err
+	}
+	searchCacheDrop(hsPath)
+
+	log.Printf("Deleted Haystack file '%s', %d bytes reclaimed", hsPath, reclaimed)
+	return nil
+}
+
+// Read header and trailer of a Haystack file, from its start and end
+// (see ReadTrailer()), or reading through it if the trailer isn't at the end.
+func getHaystackFileInfo(path string) (*HaystackFileInfo, error) {
+	info, _, err := readHeaderTrailer(path)
+	if errors.Is(err, errTrailerNotAtEnd) {
+		info, _, err = scanHeaderTrailer(path)
+	}
+
+	return info, err
+}
+
+// Read header and trailer of a Haystack file, going through all of it.
+// Only those two sections are decoded, the rest is skipped.
+func scanHeaderTrailer(path string) (*HaystackFileInfo, Trailer, error) {
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		return nil, Trailer{}, err
+	}
+
+	if len(data) < min_filesize {
+		return nil, Trailer{}, fmt.Errorf("dataset too short, not a Haystack?")
+	}
+
+	info := HaystackFileInfo{Path: path, Size: int64(len(data))}
+
+	var ofs int
+	var file_version_minor uint8
+	var last *diskSection // the section before, for errors
+	for {
+		s, err := getDisk2MemNextSection(data, ofs, file_version_minor)
+		if err != nil {
+			return nil, Trailer{}, signatureAfter(err, last)
+		}
+		last = s
+
+		if ofs == 0 && s.id != section_header {
+			return nil, Trailer{}, fmt.Errorf("%w: first section not header, not a Haystack?", ErrCorrupt)
+		}
+		ofs = s.next()
+
+		switch s.id {
+		case section_header:
+			content, err := getDisk2MemSectionContent(s, "")
+			if err != nil {
+				return nil, Trailer{}, err
+			}
+			h, err := getDisk2MemHeaderContent(content)
+			if err != nil {
+				return nil, Trailer{}, err
+			}
+			file_version_minor = h.version_minor
+			info.AESKeyUUID = h.aes_key_uuid
+			info.FileUUID = h.file_uuid
+
+		case section_trailer:
+			content, err := getDisk2MemSectionContent(s, info.AESKeyUUID)
+			if err != nil {
+				return nil, Trailer{}, err
+			}
+
+			trailer, err := getTrailerContent(content)
+			if err != nil {
+				return nil, Trailer{}, err
+			}
+			info.TimeFirst = trailer.TimeFirst
+			info.TimeLast = trailer.TimeLast
+
+			return &info, trailer, nil
+		}
+		// Other sections are skipped without decoding
+	}
+}
+
+// EOF
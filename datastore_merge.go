@@ -0,0 +1,323 @@
+// OpenActa/Haystack - merging small datastore files
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	A quiet ingest (or a short haybale_wait_maxtime) leaves lots of small
+	files in the datastore. Each costs a catalogue, a trailer, a Dictionary,
+	and a load per search. MergeFiles() puts the Haybales of a few files
+	into one new file, like the disk writer does with file_rollover, and
+	then deletes the originals. The Haybales themselves stay as they are.
+
+	With config auto_merge, StartAutoMerge() does that every
+	auto_merge_interval seconds: runs of files next to each other in time
+	(ListDatastore() order), each smaller than auto_merge_target_size, at
+	least auto_merge_min_files of them, and together no bigger than the
+	target. A file in the middle that's big enough breaks the run.
+
+	The disk writer only ever appends to its working file (.tmp), which
+	ListDatastore() doesn't see, so finished files are ours to merge.
+	The merged file is written as .tmp too and renamed when done. Putting it
+	in place and deleting the originals happens under datastore_swap, which
+	SearchTimeRange() holds (read) while it lists and loads files, so a
+	search sees either the originals or the merged file, never both or
+	neither. DeleteHaystackFile() drops the originals from the search cache.
+	Readers that have a file open or mapped keep their copy.
+	Note that with file_rollover, merged files no longer line up with hours
+	or days.
+*/
+
+package haystack
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	auto_merge_target_size_lower   = 1024 * 1024 // 1M
+	auto_merge_target_size_upper   = max_filesize / 2
+	auto_merge_target_size_default = 256 * 1024 * 1024 // 256M
+	auto_merge_min_files_lower     = 2
+	auto_merge_min_files_upper     = 1000
+	auto_merge_min_files_default   = 4
+	auto_merge_interval_lower      = 10 // secs
+	auto_merge_interval_upper      = 24 * 3600
+	auto_merge_interval_default    = 600 // 10 minutes
+)
+
+// Swapping files in the datastore (write), listing and loading them (read)
+var datastore_swap sync.RWMutex
+
+type AutoMergeStats struct {
+	Running     bool   // StartAutoMerge() and not stopped
+	Runs        uint64 // looks at the datastore
+	Merges      uint64 // merged files written
+	FilesMerged uint64 // files that went into those
+	BytesIn     uint64 // their total size
+	BytesOut    uint64 // size of the merged files
+	Errors      uint64 // failed merges (the originals stay)
+}
+
+var automerge struct {
+	mutex   sync.Mutex // protects the below, not the counters
+	running bool
+	stop    chan struct{}
+	done    sync.WaitGroup
+
+	merging sync.Mutex // one merge at a time, ours or MergeFiles()
+
+	runs         atomic.Uint64
+	merges       atomic.Uint64
+	files_merged atomic.Uint64
+	bytes_in     atomic.Uint64
+	bytes_out    atomic.Uint64
+	errors       atomic.Uint64
+}
+
+// Merge the Haystack files at paths (in the datastore, oldest first) into
+// one new file, with its catalogue, and delete them. Returns the path of
+// the new file. On error nothing changes, except if deleting an original
+// fails: then the merged file is in place, and that original with it.
+func MergeFiles(paths []string) (string, error) {
+	if len(paths) < 2 {
+		return "", fmt.Errorf("need at least 2 files to merge, got %d", len(paths))
+	}
+
+	automerge.merging.Lock()
+	defer automerge.merging.Unlock()
+
+	r, err := openWorkingFile("")
+	if err != nil {
+		return "", err
+	}
+
+	var bytes_in uint64
+	for _, path := range paths {
+		data, err := fsys.ReadFile(path)
+		if err != nil {
+			r.abandon()
+			return "", err
+		}
+		bytes_in += uint64(len(data))
+
+		src := new(Haystack)
+		if err := src.Disk2Mem(data); err != nil {
+			r.abandon()
+			return "", fmt.Errorf("loading %s: %w", path, err)
+		}
+
+		for _, hb := range src.Haybale {
+			if err := r.add(hb, &src.Dict); err != nil {
+				r.abandon()
+				return "", fmt.Errorf("merging %s: %w", path, err)
+			}
+		}
+	}
+
+	// Swap them, searches wait for this
+	datastore_swap.Lock()
+	defer datastore_swap.Unlock()
+
+	if err := r.finish(); err != nil {
+		// The originals stay, so the merged one goes, whichever name it has by now
+		if r.renamed {
+			fsys.Remove(r.fname)
+		} else {
+			r.abandon()
+		}
+		return "", err
+	}
+
+	for _, path := range paths {
+		if err := DeleteHaystackFile(path); err != nil {
+			return r.fname, fmt.Errorf("merged into %s, but: %w", r.fname, err)
+		}
+	}
+
+	bytes_out := uint64(r.sw.ofs)
+	automerge.merges.Add(1)
+	automerge.files_merged.Add(uint64(len(paths)))
+	automerge.bytes_in.Add(bytes_in)
+	automerge.bytes_out.Add(bytes_out)
+
+	log.Printf("Merged %d Haystack files (%d bytes) into '%s' (%d bytes)",
+		len(paths), bytes_in, r.fname, bytes_out)
+	return r.fname, nil
+}
+
+// Runs of files to merge, see the top of this file
+func autoMergeCandidates(files []HaystackFileInfo, target int64, min_files int) [][]string {
+	var groups [][]string
+	var run []string
+	var run_size int64
+
+	done := func() {
+		if len(run) >= min_files {
+			groups = append(groups, run)
+		}
+		run, run_size = nil, 0
+	}
+
+	for _, info := range files {
+		if info.Size >= target {
+			done()
+			continue
+		}
+		if run_size+info.Size > target {
+			done()
+		}
+		run = append(run, info.Path)
+		run_size += info.Size
+	}
+	done()
+
+	return groups
+}
+
+// config auto_merge_target_size, auto_merge_min_files and auto_merge_interval, 0 = default
+func autoMergeSettings() (int64, int, time.Duration) {
+	target := int64(config.auto_merge_target_size)
+	if target == 0 {
+		target = auto_merge_target_size_default
+	}
+	min_files := int(config.auto_merge_min_files)
+	if min_files == 0 {
+		min_files = auto_merge_min_files_default
+	}
+	interval := config.auto_merge_interval
+	if interval == 0 {
+		interval = auto_merge_interval_default
+	}
+
+	return target, min_files, time.Duration(interval) * time.Second
+}
+
+// One look at the datastore, merging what we can. Stops early on stop.
+func autoMergeRun(stop chan struct{}) {
+	automerge.runs.Add(1)
+
+	files, err := ListDatastore()
+	if err != nil {
+		automerge.errors.Add(1)
+		log.Printf("Auto merge: %v", err)
+		return
+	}
+
+	// The disk writer puts a file in place before its catalogue, leave
+	// those for next time (too big to merge breaks the run)
+	for i := range files {
+		cpath, err := cataloguePath(&files[i])
+		if err == nil {
+			_, err = fsys.Stat(cpath)
+		}
+		if err != nil {
+			files[i].Size = math.MaxInt64
+		}
+	}
+
+	target, min_files, _ := autoMergeSettings()
+	for _, group := range autoMergeCandidates(files, target, min_files) {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if _, err := MergeFiles(group); err != nil {
+			automerge.errors.Add(1)
+			log.Printf("Auto merge: %v", err)
+		}
+	}
+}
+
+// Start merging small files in the background, if config auto_merge is on
+func StartAutoMerge() error {
+	if !config.auto_merge {
+		return nil
+	}
+
+	automerge.mutex.Lock()
+	defer automerge.mutex.Unlock()
+
+	if automerge.running {
+		return fmt.Errorf("auto merge already running")
+	}
+
+	_, _, interval := autoMergeSettings()
+	automerge.stop = make(chan struct{})
+	automerge.running = true
+
+	automerge.done.Add(1)
+	go autoMerge(automerge.stop, interval)
+
+	return nil
+}
+
+// Stop merging. A merge in progress finishes first, the rest is left for
+// next time. Fine to call if it's not running.
+func StopAutoMerge() {
+	automerge.mutex.Lock()
+	if !automerge.running {
+		automerge.mutex.Unlock()
+		return
+	}
+	automerge.running = false
+	close(automerge.stop)
+	automerge.mutex.Unlock()
+
+	automerge.done.Wait()
+}
+
+// Merge counters
+func GetAutoMergeStats() AutoMergeStats {
+	automerge.mutex.Lock()
+	running := automerge.running
+	automerge.mutex.Unlock()
+
+	return AutoMergeStats{
+		Running:     running,
+		Runs:        automerge.runs.Load(),
+		Merges:      automerge.merges.Load(),
+		FilesMerged: automerge.files_merged.Load(),
+		BytesIn:     automerge.bytes_in.Load(),
+		BytesOut:    automerge.bytes_out.Load(),
+		Errors:      automerge.errors.Load(),
+	}
+}
+
+// The go routine
+func autoMerge(stop chan struct{}, interval time.Duration) {
+	defer automerge.done.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			autoMergeRun(stop)
+		}
+	}
+}
+
+// EOF
@@ -0,0 +1,239 @@
+// OpenActa/Haystack - merging small datastore files - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// head5, and a file for each of the given days, in the datastore
+func writeTestDatastore(t *testing.T, days ...string) {
+	hss := []*Haystack{newTestHaystack(t, "testdata/head5.json", 2)}
+	for _, day := range days {
+		hs := new(Haystack)
+		hb := &Haybale{HaystackPtr: hs}
+		hb.InsertBunch(&hs.Dict, map[string]interface{}{Timestamp_key: day, "dest_port": "443"})
+		hs.Haybale = append(hs.Haybale, hb)
+		hss = append(hss, hs)
+	}
+	for _, hs := range hss {
+		if err := writeHaystackFiles(hs); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMergeFiles(t *testing.T) {
+	setTestConfig(t)
+	config.datastore_dir = t.TempDir()
+	config.catalogue_dir = t.TempDir()
+
+	writeTestDatastore(t, "2023-06-05T12:00:00Z", "2023-06-06T12:00:00Z")
+	files, err := ListDatastore()
+	if err != nil || len(files) != 3 {
+		t.Fatalf("%v %v", files, err)
+	}
+
+	// Loads them all into the search cache
+	kv := map[string]string{"dest_port": "443"}
+	before, err := SearchTimeRange(0, math.MaxInt64, kv)
+	if err != nil || len(before) != 6 {
+		t.Fatalf("%d results, %v", len(before), err)
+	}
+
+	if _, err := MergeFiles([]string{files[0].Path}); err == nil {
+		t.Errorf("merging 1 file: no error")
+	}
+
+	stats := GetAutoMergeStats()
+	paths := []string{files[0].Path, files[1].Path, files[2].Path}
+	merged, err := MergeFiles(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := ListDatastore()
+	if err != nil || len(after) != 1 || after[0].Path != merged {
+		t.Fatalf("datastore after merge: %+v %v", after, err)
+	}
+	if after[0].TimeFirst != files[0].TimeFirst || after[0].TimeLast != files[2].TimeLast {
+		t.Errorf("merged time range %d-%d, want %d-%d",
+			after[0].TimeFirst, after[0].TimeLast, files[0].TimeFirst, files[2].TimeLast)
+	}
+
+	// Only the merged file's catalogue is left
+	catalogues, err := os.ReadDir(config.catalogue_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cname := catalogueName(after[0].TimeFirst, after[0].TimeLast, after[0].FileUUID, nil)
+	if len(catalogues) != 1 || catalogues[0].Name() != cname {
+		t.Errorf("catalogues %v, want %s", catalogues, cname)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(config.datastore_dir, "*.tmp")); len(tmp) > 0 {
+		t.Errorf("left behind: %v", tmp)
+	}
+
+	// The originals are out of the search cache, same results from the merged file
+	searchcache.mutex.Lock()
+	for _, path := range paths {
+		if _, ok := searchcache.files[path]; ok {
+			t.Errorf("%s still in the search cache", path)
+		}
+	}
+	searchcache.mutex.Unlock()
+
+	res, err := SearchTimeRange(0, math.MaxInt64, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, before) {
+		t.Errorf("after merge:\n%v\nbefore:\n%v", res, before)
+	}
+
+	got := GetAutoMergeStats()
+	if got.Merges-stats.Merges != 1 || got.FilesMerged-stats.FilesMerged != 3 ||
+		got.BytesIn-stats.BytesIn != uint64(files[0].Size+files[1].Size+files[2].Size) ||
+		got.BytesOut-stats.BytesOut != uint64(after[0].Size) {
+		t.Errorf("stats %+v, before %+v", got, stats)
+	}
+}
+
+// A file that's not there: nothing changes
+func TestMergeFilesError(t *testing.T) {
+	setTestConfig(t)
+	config.datastore_dir = t.TempDir()
+	config.catalogue_dir = t.TempDir()
+
+	writeTestDatastore(t, "2023-06-05T12:00:00Z")
+	files, err := ListDatastore()
+	if err != nil || len(files) != 2 {
+		t.Fatalf("%v %v", files, err)
+	}
+
+	missing := filepath.Join(config.datastore_dir, "missing"+Haystack_file_ext)
+	if _, err := MergeFiles([]string{files[0].Path, missing, files[1].Path}); err == nil {
+		t.Fatal("merging a missing file: no error")
+	}
+
+	after, err := ListDatastore()
+	if err != nil || !reflect.DeepEqual(after, files) {
+		t.Errorf("datastore after failed merge: %+v %v", after, err)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(config.datastore_dir, "*.tmp")); len(tmp) > 0 {
+		t.Errorf("left behind: %v", tmp)
+	}
+}
+
+func TestAutoMergeCandidates(t *testing.T) {
+	files := func(sizes ...int64) []HaystackFileInfo {
+		list := make([]HaystackFileInfo, len(sizes))
+		for i, size := range sizes {
+			list[i] = HaystackFileInfo{Path: string(rune('a' + i)), Size: size}
+		}
+		return list
+	}
+
+	tests := []struct {
+		sizes []int64
+		want  [][]string
+	}{
+		{nil, nil},
+		{[]int64{10, 10}, nil}, // not enough
+		{[]int64{10, 10, 10}, [][]string{{"a", "b", "c"}}},
+		{[]int64{10, 10, 100, 10, 10, 10}, [][]string{{"d", "e", "f"}}},     // big one in the middle
+		{[]int64{40, 40, 40, 10, 10, 10}, [][]string{{"c", "d", "e", "f"}}}, // up to the target
+		{[]int64{30, 30, 30, 30, 30, 30}, [][]string{{"a", "b", "c"}, {"d", "e", "f"}}},
+	}
+
+	for _, test := range tests {
+		got := autoMergeCandidates(files(test.sizes...), 100, 3)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: %v, want %v", test.sizes, got, test.want)
+		}
+	}
+}
+
+func TestAutoMerge(t *testing.T) {
+	setTestConfig(t)
+	config.datastore_dir = t.TempDir()
+	config.catalogue_dir = t.TempDir()
+	config.auto_merge_min_files = 3
+
+	// Off: nothing happens
+	if err := StartAutoMerge(); err != nil || GetAutoMergeStats().Running {
+		t.Fatalf("started with auto_merge off: %v", err)
+	}
+	StopAutoMerge()
+
+	config.auto_merge = true
+	if err := StartAutoMerge(); err != nil || !GetAutoMergeStats().Running {
+		t.Fatalf("not started: %v", err)
+	}
+	if err := StartAutoMerge(); err == nil {
+		t.Errorf("started twice")
+	}
+	StopAutoMerge()
+	if GetAutoMergeStats().Running {
+		t.Errorf("still running")
+	}
+
+	// A file without its catalogue (yet) is left alone
+	writeTestDatastore(t, "2023-06-05T12:00:00Z", "2023-06-06T12:00:00Z", "2023-06-07T12:00:00Z")
+	files, err := ListDatastore()
+	if err != nil || len(files) != 4 {
+		t.Fatalf("%v %v", files, err)
+	}
+	cpath := filepath.Join(config.catalogue_dir, catalogueName(files[1].TimeFirst, files[1].TimeLast, files[1].FileUUID, nil))
+	if err := os.Rename(cpath, cpath+".x"); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := GetAutoMergeStats()
+	autoMergeRun(make(chan struct{}))
+	if got := GetAutoMergeStats(); got.Runs-stats.Runs != 1 || got.Merges != stats.Merges {
+		t.Errorf("merged around a file without catalogue: %+v", got)
+	}
+
+	if err := os.Rename(cpath+".x", cpath); err != nil {
+		t.Fatal(err)
+	}
+	autoMergeRun(make(chan struct{}))
+	if got := GetAutoMergeStats(); got.Merges-stats.Merges != 1 || got.Errors != stats.Errors {
+		t.Errorf("stats %+v, before %+v", got, stats)
+	}
+	if after, err := ListDatastore(); err != nil || len(after) != 1 {
+		t.Errorf("datastore after auto merge: %+v %v", after, err)
+	}
+
+	// Stopped: no more merging
+	writeTestDatastore(t, "2023-06-08T12:00:00Z", "2023-06-09T12:00:00Z")
+	stop := make(chan struct{})
+	close(stop)
+	stats = GetAutoMergeStats()
+	autoMergeRun(stop)
+	if got := GetAutoMergeStats(); got.Merges != stats.Merges {
+		t.Errorf("merged after stop")
+	}
+}
+
+// EOF
@@ -0,0 +1,322 @@
+// OpenActa/Haystack - search across datastore files
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	SearchTimeRange() searches all Haystack files in the datastore that
+	overlap the time range. Loading each file every time is slow, loading
+	them all could eat all our memory. So loaded Haystacks are kept in an
+	LRU cache, bounded by config search_cache_files (count) and
+	search_cache_maxsize (Memsize). Repeated searches over recent files
+	then don't hit the disk, older files drop out.
+	The file we just loaded always stays, even if it's bigger than the max.
+
+	Searches run at the same time share the cache. Each one holds a handle
+	(getCachedHaystack(), then release()) while it's in a Haystack: one in
+	use isn't evicted, so it's counted for as long as it's in RAM. Go wouldn't
+	free it under the search anyway, but the cache would lose track of it,
+	and load the file again next to it. The limits are checked again as
+	handles are released. A file that's deleted or replaced while in use
+	is gone from the cache straight away, its Memsize goes on release.
+
+	With config search_source_fields, each bunch found also gets where it
+	came from: _source_file (path of the Haystack file) and _haybale_index
+	(0-based, the n-th Haybale with data in that file; empty ones aren't
+	loaded so they don't count). These replace any such keys in the bunch.
+*/
+
+package haystack
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	search_cache_files_default   = 8
+	search_cache_maxsize_default = 1024 * 1024 * 1024 // 1G
+)
+
+const ( // with config search_source_fields
+	Source_file_key    = "_source_file"
+	Source_haybale_key = "_haybale_index"
+)
+
+type SearchCacheStats struct {
+	Files     int    // Haystacks in the cache
+	InUse     int    // being searched, including ones no longer in the cache
+	Memsize   uint64 // approx bytes in RAM, of those
+	Hits      uint64
+	Misses    uint64 // had to load the file
+	Evictions uint64
+}
+
+var searchcache struct {
+	mutex   sync.Mutex               // protects the below, not the counters
+	lru     *list.List               // of *cachedHaystack, most recent at front
+	files   map[string]*list.Element // path -> element in lru
+	memsize uint64
+	in_use  int // cachedHaystacks with refs > 0
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+type cachedHaystack struct {
+	path string
+	size int64  // file size, and
+	uuid string // file uuid, so we notice a file that was replaced
+	hs   *Haystack
+	refs int  // handles out, see release()
+	gone bool // removed from the cache while in use
+}
+
+// Bunches (as key/value maps) from all datastore files, with a _timestamp
+// in from..to (Unix nanosecs, inclusive) and matching all of kv_array.
+// An empty kv_array matches everything in the time range.
+// Files are searched oldest first.
+func SearchTimeRange(from int64, to int64, kv_array map[string]string) ([]map[string]string, error) {
+	res := make([]map[string]string, 0)
+
+	// No merge swapping files while we list and load them
+	datastore_swap.RLock()
+	defer datastore_swap.RUnlock()
+
+	files, err := ListDatastore()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, info := range files {
+		if info.TimeLast < from || info.TimeFirst > to {
+			continue
+		}
+
+		c, err := getCachedHaystack(info)
+		if err != nil {
+			return nil, err
+		}
+
+		source := ""
+		if config.search_source_fields {
+			source = info.Path
+		}
+		res = append(res, c.hs.searchTimeRange(from, to, kv_array, source)...)
+		c.release()
+	}
+
+	return res, nil
+}
+
+// source is the file p came from, for the _source_file field ("" for none)
+func (p *Haystack) searchTimeRange(from int64, to int64, kv_array map[string]string, source string) []map[string]string {
+	res := make([]map[string]string, 0)
+
+	p.RLock()
+	defer p.RUnlock()
+
+	var hv []Haystalk
+	if len(kv_array) > 0 {
+		var found bool
+		if hv, found = p.Dict.searchConditions(kv_array); !found {
+			return res
+		}
+	}
+
+	for i, hb := range p.Haybale {
+		if hb.num_haystalks == 0 || hb.time_last < from || hb.time_first > to {
+			continue
+		}
+
+		check := func(first uint32) {
+			// The first stalk of a bunch is its _timestamp
+			ts := hb.haystalk[first].val
+			if ts.valtype == valtype_time && (ts.intval < from || ts.intval > to) {
+				return
+			}
+			m := hb.bunchMap(&p.Dict, first)
+			if source != "" {
+				m[Source_file_key] = source
+				m[Source_haybale_key] = strconv.Itoa(i)
+			}
+			res = append(res, m)
+		}
+
+		if hv != nil {
+			hb.searchBale(hv, check)
+		} else {
+			hb.forEachBunch(check)
+		}
+	}
+
+	return res
+}
+
+// Search cache counters
+func GetSearchCacheStats() SearchCacheStats {
+	searchcache.mutex.Lock()
+	defer searchcache.mutex.Unlock()
+
+	stats := SearchCacheStats{
+		InUse:     searchcache.in_use,
+		Memsize:   searchcache.memsize,
+		Hits:      searchcache.hits.Load(),
+		Misses:    searchcache.misses.Load(),
+		Evictions: searchcache.evictions.Load(),
+	}
+	if searchcache.lru != nil {
+		stats.Files = searchcache.lru.Len()
+	}
+
+	return stats
+}
+
+// Get the Haystack for a datastore file, from the cache or loaded.
+// It stays in the cache until the caller calls release(), once.
+func getCachedHaystack(info HaystackFileInfo) (*cachedHaystack, error) {
+	searchcache.mutex.Lock()
+	if searchcache.lru == nil {
+		searchcache.lru = list.New()
+		searchcache.files = make(map[string]*list.Element)
+	}
+
+	if e, ok := searchcache.files[info.Path]; ok {
+		c := e.Value.(*cachedHaystack)
+		if c.size == info.Size && c.uuid == info.FileUUID {
+			searchcache.lru.MoveToFront(e)
+			c.acquire()
+			searchcache.mutex.Unlock()
+			searchcache.hits.Add(1)
+			return c, nil
+		}
+		searchCacheRemove(e) // file changed under us
+	}
+	searchcache.mutex.Unlock()
+
+	// Load without holding the lock, other searches can carry on.
+	// If two load the same file at once, the last one stays in the cache.
+	searchcache.misses.Add(1)
+
+	data, err := fsys.ReadFile(info.Path)
+	if err != nil {
+		return nil, err
+	}
+	hs := new(Haystack)
+	if err := hs.Disk2Mem(data); err != nil {
+		return nil, err
+	}
+
+	searchcache.mutex.Lock()
+	defer searchcache.mutex.Unlock()
+
+	if e, ok := searchcache.files[info.Path]; ok {
+		searchCacheRemove(e)
+	}
+	c := &cachedHaystack{path: info.Path, size: info.Size, uuid: info.FileUUID, hs: hs}
+	c.acquire()
+	searchcache.files[info.Path] = searchcache.lru.PushFront(c)
+	searchcache.memsize += uint64(hs.memsize)
+
+	searchCacheEvict() // not the one we just loaded, it's in use
+
+	return c, nil
+}
+
+// Caller holds searchcache.mutex
+func (c *cachedHaystack) acquire() {
+	if c.refs == 0 {
+		searchcache.in_use++
+	}
+	c.refs++
+}
+
+// Done with it, for now. Then it can be evicted.
+func (c *cachedHaystack) release() {
+	searchcache.mutex.Lock()
+	defer searchcache.mutex.Unlock()
+
+	c.refs--
+	if c.refs > 0 {
+		return
+	}
+	searchcache.in_use--
+
+	if c.gone {
+		searchcache.memsize -= uint64(c.hs.memsize)
+		return
+	}
+
+	searchCacheEvict() // we may have kept it over the limits
+}
+
+// Evict least recently used file(s) until we're within the limits,
+// skipping those in use, and never the last one.
+// Caller holds searchcache.mutex
+func searchCacheEvict() {
+	max_files, max_size := searchCacheLimits()
+
+	for e := searchcache.lru.Back(); e != nil && searchcache.lru.Len() > 1 &&
+		(searchcache.lru.Len() > max_files || searchcache.memsize > max_size); {
+		prev := e.Prev()
+		if e.Value.(*cachedHaystack).refs == 0 {
+			searchCacheRemove(e)
+			searchcache.evictions.Add(1)
+		}
+		e = prev
+	}
+}
+
+// Forget a file, e.g. when it's deleted
+func searchCacheDrop(path string) {
+	searchcache.mutex.Lock()
+	defer searchcache.mutex.Unlock()
+
+	if e, ok := searchcache.files[path]; ok {
+		searchCacheRemove(e)
+	}
+}
+
+// Caller holds searchcache.mutex
+func searchCacheRemove(e *list.Element) {
+	c := e.Value.(*cachedHaystack)
+	if c.refs > 0 {
+		c.gone = true // still in RAM, release() takes it off memsize
+	} else {
+		searchcache.memsize -= uint64(c.hs.memsize)
+	}
+	delete(searchcache.files, c.path)
+	searchcache.lru.Remove(e)
+}
+
+// config search_cache_files and search_cache_maxsize, 0 = default
+func searchCacheLimits() (int, uint64) {
+	max_files := int(config.search_cache_files)
+	if max_files == 0 {
+		max_files = search_cache_files_default
+	}
+
+	max_size := uint64(config.search_cache_maxsize)
+	if max_size == 0 {
+		max_size = search_cache_maxsize_default
+	}
+
+	return max_files, max_size
+}
+
+// EOF
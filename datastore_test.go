@@ -0,0 +1,415 @@
+// OpenActa/Haystack - datastore - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Oldest first, by the trailers; anything that isn't a Haystack file is skipped
+func TestListDatastore(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	config.datastore_dir = t.TempDir()
+	config.catalogue_dir = t.TempDir()
+
+	// Written newest first, so neither write order nor uuid order is time order
+	days := []string{"2023-06-06T12:00:00Z", "2023-06-04T12:00:00Z", "2023-06-05T12:00:00Z"}
+	hss := make([]*Haystack, len(days))
+	for i, day := range days {
+		hs := new(Haystack)
+		hb := &Haybale{HaystackPtr: hs}
+		if err := hb.InsertBunch(&hs.Dict, map[string]interface{}{Timestamp_key: day, "dest_port": "443"}); err != nil {
+			t.Fatal(err)
+		}
+		hs.Haybale = append(hs.Haybale, hb)
+		if err := writeHaystackFiles(hs); err != nil {
+			t.Fatal(err)
+		}
+		hss[i] = hs
+	}
+
+	// Not ours, or not readable
+	for name, data := range map[string][]byte{
+		"notes.txt":                  []byte("not a Haystack"),
+		"broken" + Haystack_file_ext: []byte("not a Haystack either"),
+	} {
+		if err := os.WriteFile(filepath.Join(config.datastore_dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(config.datastore_dir, "subdir"+Haystack_file_ext), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := ListDatastore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != len(days) {
+		t.Fatalf("%d files listed: %+v", len(list), list)
+	}
+	for i, want := range []*Haystack{hss[1], hss[2], hss[0]} {
+		info := list[i]
+		st, err := os.Stat(info.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Path != filepath.Join(config.datastore_dir, want.file_uuid+Haystack_file_ext) ||
+			info.FileUUID != want.file_uuid || info.AESKeyUUID != test_aes_uuid || info.Size != st.Size() ||
+			info.TimeFirst != want.time_first || info.TimeLast != want.time_last {
+			t.Errorf("#%d: %+v, want %s (%d-%d)", i, info, want.file_uuid, want.time_first, want.time_last)
+		}
+	}
+
+	config.datastore_dir = filepath.Join(config.datastore_dir, "missing")
+	if _, err := ListDatastore(); err == nil {
+		t.Errorf("datastore_dir not there: no error")
+	}
+}
+
+func TestDeleteHaystackFile(t *testing.T) {
+	setTestConfig(t)
+	config.datastore_dir = t.TempDir()
+	config.catalogue_dir = t.TempDir()
+
+	// Haystack file and catalogue, like the disk writer does it
+	write := func() (string, string) {
+		hs := newTestHaystack(t, "testdata/head5.json", 2)
+		if err := writeHaystackFiles(hs); err != nil {
+			t.Fatal(err)
+		}
+		return filepath.Join(config.datastore_dir, hs.file_uuid+Haystack_file_ext),
+			filepath.Join(config.catalogue_dir, hs.CatalogueName())
+	}
+
+	hpath, cpath := write()
+	keep, keep_c := write()
+
+	if err := DeleteHaystackFile(hpath); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{hpath, cpath, hpath + ".del"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s still there: %v", path, err)
+		}
+	}
+
+	// Leaves the others alone
+	list, err := ListDatastore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Path != keep {
+		t.Errorf("datastore after delete: %+v", list)
+	}
+
+	// Catalogue already gone is fine
+	if err := os.Remove(keep_c); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteHaystackFile(keep); err != nil {
+		t.Errorf("without catalogue: %v", err)
+	}
+	if _, err := os.Stat(keep); !os.IsNotExist(err) {
+		t.Errorf("%s still there: %v", keep, err)
+	}
+
+	if err := DeleteHaystackFile(keep); err == nil {
+		t.Errorf("deleting a file that's not there: no error")
+	}
+
+	// Catalogue next to the file, as older haystack -w and -s did it
+	for _, name := range []func(hpath, cpath string) string{
+		func(hpath, cpath string) string { return filepath.Join(config.datastore_dir, filepath.Base(cpath)) },
+		func(hpath, cpath string) string { return hpath + legacy_catalogue_ext },
+	} {
+		hpath, cpath := write()
+		beside := name(hpath, cpath)
+		if err := os.Rename(cpath, beside); err != nil {
+			t.Fatal(err)
+		}
+		if err := DeleteHaystackFile(hpath); err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range []string{hpath, beside} {
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("%s still there: %v", path, err)
+			}
+		}
+	}
+}
+
+// Catalogues go to catalogue_dir, named by the file uuid, or for files from
+// before format 1.1 (no uuid) the start of the file's SHA-512
+func TestWriteCatalogue(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	config.catalogue_dir = t.TempDir()
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+	data, sha512block, err := hs.Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cpath, err := WriteCatalogue(hs, sha512block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(cpath) != config.catalogue_dir || filepath.Base(cpath) != hs.CatalogueName() ||
+		!strings.Contains(cpath, "-"+hs.file_uuid+Catalogue_file_ext) {
+		t.Errorf("catalogue at %s", cpath)
+	}
+	if got, err := os.ReadFile(cpath); err != nil || !bytes.Equal(got, sha512block) {
+		t.Errorf("catalogue content: %v", err)
+	}
+
+	hs2 := new(Haystack)
+	if err := hs2.Disk2Mem(data); err != nil || hs2.CatalogueName() != hs.CatalogueName() || hs2.file_sha512 != nil {
+		t.Errorf("read back: %s %v", hs2.CatalogueName(), err)
+	}
+
+	// No uuid
+	path := filepath.Join(t.TempDir(), "old.hs")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha512.Sum512(data)
+	want := fmt.Sprintf("%d-%d-%s%s", hs.time_first, hs.time_last, hex.EncodeToString(sum[:16]), Catalogue_file_ext)
+
+	old := &Haystack{time_first: hs.time_first, time_last: hs.time_last, file_sha512: sum[:]}
+	if name := old.CatalogueName(); name != want {
+		t.Errorf("no uuid: %s, want %s", name, want)
+	}
+	info := &HaystackFileInfo{Path: path, TimeFirst: hs.time_first, TimeLast: hs.time_last}
+	if cpath, err := cataloguePath(info); err != nil || cpath != filepath.Join(config.catalogue_dir, want) {
+		t.Errorf("no uuid, in the datastore: %s %v", cpath, err)
+	}
+}
+
+func TestSearchTimeRange(t *testing.T) {
+	setTestConfig(t)
+	config.datastore_dir = t.TempDir()
+	config.catalogue_dir = t.TempDir()
+	config.search_cache_files = 2
+
+	searchcache.mutex.Lock()
+	searchcache.lru, searchcache.files, searchcache.memsize, searchcache.in_use = nil, nil, 0, 0
+	searchcache.mutex.Unlock()
+
+	ts := func(s string) int64 {
+		v, ok := parseTimestamp(s)
+		if !ok {
+			t.Fatalf("can't parse %s", s)
+		}
+		return v
+	}
+
+	// head5 (2023-06-04 00:00:59 - 00:01:03), and a file for each of the next 2 days
+	hss := []*Haystack{newTestHaystack(t, "testdata/head5.json", 2)}
+	for _, day := range []string{"2023-06-05T12:00:00Z", "2023-06-06T12:00:00Z"} {
+		hs := new(Haystack)
+		hb := &Haybale{HaystackPtr: hs}
+		hb.InsertBunch(&hs.Dict, map[string]interface{}{Timestamp_key: day, "dest_port": "443"})
+		hs.Haybale = append(hs.Haybale, hb)
+		hss = append(hss, hs)
+	}
+	for _, hs := range hss {
+		if err := writeHaystackFiles(hs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before := GetSearchCacheStats()
+	check := func(what string, from int64, to int64, kv map[string]string, want int, hits uint64, misses uint64, evictions uint64) {
+		t.Helper()
+
+		res, err := SearchTimeRange(from, to, kv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != want {
+			t.Errorf("%s: %d bunches, want %d", what, len(res), want)
+		}
+
+		stats := GetSearchCacheStats()
+		if stats.Hits-before.Hits != hits || stats.Misses-before.Misses != misses || stats.Evictions-before.Evictions != evictions {
+			t.Errorf("%s: cache %+v, want %d hits, %d misses, %d evictions since start", what, stats, hits, misses, evictions)
+		}
+		if stats.Files > 2 {
+			t.Errorf("%s: %d files in cache, max 2", what, stats.Files)
+		}
+	}
+
+	all_from, all_to := ts("2023-06-01T00:00:00Z"), ts("2023-06-30T00:00:00Z")
+	check("all days", all_from, all_to, map[string]string{"dest_port": "443"}, 6, 0, 3, 1)
+	check("last two days", ts("2023-06-05T00:00:00Z"), all_to, nil, 2, 2, 3, 1)
+
+	// head5 got evicted, and within the file only part of the range
+	narrow_from, narrow_to := ts("2023-06-04T00:01:00Z"), ts("2023-06-04T00:01:02Z")
+	check("narrow", narrow_from, narrow_to, nil, 3, 2, 4, 2)
+	check("narrow again", narrow_from, narrow_to, nil, 3, 3, 4, 2)
+
+	check("nothing there", ts("2023-07-01T00:00:00Z"), ts("2023-07-02T00:00:00Z"), nil, 0, 3, 4, 2)
+}
+
+// Where did that come from
+func TestSearchTimeRangeSourceFields(t *testing.T) {
+	setTestConfig(t)
+	config.datastore_dir = t.TempDir()
+	config.catalogue_dir = t.TempDir()
+
+	if err := writeHaystackFiles(newTestHaystack(t, "testdata/head5.json", 2)); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ListDatastore()
+	if err != nil || len(files) != 1 {
+		t.Fatalf("%v %v", files, err)
+	}
+
+	// Off by default
+	res, err := SearchTimeRange(0, math.MaxInt64, map[string]string{"dest_port": "443"})
+	if err != nil || len(res) != 4 {
+		t.Fatalf("%d results, %v", len(res), err)
+	}
+	if _, ok := res[0][Source_file_key]; ok {
+		t.Errorf("%s without search_source_fields", Source_file_key)
+	}
+
+	config.search_source_fields = true
+	res, err = SearchTimeRange(0, math.MaxInt64, map[string]string{"src_ip": "80.229.245.222"})
+	if err != nil || len(res) != 2 {
+		t.Fatalf("%d results, %v", len(res), err)
+	}
+	// Records 1 and 3, with 2 per Haybale
+	for i, want := range []string{"0", "1"} {
+		if res[i][Source_file_key] != files[0].Path || res[i][Source_haybale_key] != want {
+			t.Errorf("result %d: %s=%s %s=%s", i, Source_file_key, res[i][Source_file_key],
+				Source_haybale_key, res[i][Source_haybale_key])
+		}
+	}
+}
+
+// Memsize is what the cache holds, plus what's in use but dropped
+func checkSearchCache(t *testing.T, what string, dropped uint64) {
+	t.Helper()
+
+	searchcache.mutex.Lock()
+	defer searchcache.mutex.Unlock()
+
+	var memsize uint64
+	for e := searchcache.lru.Front(); e != nil; e = e.Next() {
+		memsize += uint64(e.Value.(*cachedHaystack).hs.memsize)
+	}
+	if memsize+dropped != searchcache.memsize || len(searchcache.files) != searchcache.lru.Len() {
+		t.Errorf("%s: memsize %d, cached %d + dropped %d; %d files, %d in lru", what, searchcache.memsize, memsize, dropped,
+			len(searchcache.files), searchcache.lru.Len())
+	}
+}
+
+// A Haystack in use stays in the cache, and counted, until released.
+// Searches and evictions at the same time (run with -race).
+func TestSearchCacheInUse(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10 // files record it, loaded ones are small too
+	config.datastore_dir = t.TempDir()
+	config.catalogue_dir = t.TempDir()
+	config.search_cache_files = 1
+
+	searchcache.mutex.Lock()
+	searchcache.lru, searchcache.files, searchcache.memsize, searchcache.in_use = nil, nil, 0, 0
+	searchcache.mutex.Unlock()
+
+	for _, day := range []string{"2023-06-05T12:00:00Z", "2023-06-06T12:00:00Z", "2023-06-07T12:00:00Z", "2023-06-08T12:00:00Z"} {
+		hs := new(Haystack)
+		hb := &Haybale{HaystackPtr: hs}
+		hb.InsertBunch(&hs.Dict, map[string]interface{}{Timestamp_key: day, "dest_port": "443"})
+		hs.Haybale = append(hs.Haybale, hb)
+		if err := writeHaystackFiles(hs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := ListDatastore()
+	if err != nil || len(files) != 4 {
+		t.Fatalf("%d files: %v", len(files), err)
+	}
+
+	c0, err := getCachedHaystack(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, err := getCachedHaystack(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := GetSearchCacheStats(); stats.Files != 2 || stats.InUse != 2 {
+		t.Errorf("two in use, max 1 file: %+v", stats)
+	}
+	c0.release()
+	if stats := GetSearchCacheStats(); stats.Files != 1 || stats.InUse != 1 || c1.gone {
+		t.Errorf("released the older one: %+v", stats)
+	}
+	checkSearchCache(t, "released", 0)
+
+	// Deleted while in use: out of the cache, not out of memsize (yet)
+	searchCacheDrop(files[1].Path)
+	if stats := GetSearchCacheStats(); stats.Files != 0 || stats.Memsize != uint64(c1.hs.memsize) || !c1.gone {
+		t.Errorf("dropped in use: %+v", stats)
+	}
+	c1.release()
+	if stats := GetSearchCacheStats(); stats.Files != 0 || stats.InUse != 0 || stats.Memsize != 0 {
+		t.Errorf("dropped, released: %+v", stats)
+	}
+
+	// Lots at once, with files dropped in between
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				res, err := SearchTimeRange(0, math.MaxInt64, map[string]string{"dest_port": "443"})
+				if err != nil || len(res) != 4 {
+					t.Errorf("search %d/%d: %d results, %v", g, i, len(res), err)
+					return
+				}
+				if g == 0 {
+					searchCacheDrop(files[i%len(files)].Path)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if stats := GetSearchCacheStats(); stats.InUse != 0 || stats.Files > 1 {
+		t.Errorf("after: %+v", stats)
+	}
+	checkSearchCache(t, "after", 0)
+}
+
+// EOF
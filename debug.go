@@ -18,14 +18,31 @@
 package haystack
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"os"
 )
 
-// Print Haybale (TEST/DEBUG purposes)
+// Print Haybale to stdout (TEST/DEBUG purposes).
+// Note: this sorts the Haybale first, which makes it immutable, no more
+// inserts. To just have a look, use PrintBaleReadOnly().
 func (p *Haybale) PrintBale(d *Dictionary) {
 	p.SortBale()
 
+	if err := p.PrintBaleReadOnly(d, os.Stdout); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// Print a sorted Haybale to w, a bunch at a time, without changing it.
+// A Haybale that's not sorted yet is an error, we don't sort it for you.
+func (p *Haybale) PrintBaleReadOnly(d *Dictionary, w io.Writer) error {
+	if !p.is_sorted_immutable {
+		return fmt.Errorf("Haybale is not sorted, can't print read-only")
+	}
+
 	for n := uint32(0); n < p.num_haystalks; n++ {
 		if p.haystalk[n].first_ofs != n {
 			continue
@@ -36,24 +53,31 @@ func (p *Haybale) PrintBale(d *Dictionary) {
 				log.Printf("Assert: nil ptr from dkey %v\n", (*p.haystalk[r]).dkey)
 				continue
 			}
-			fmt.Printf("%v=", *d.dkey[(*p.haystalk[r]).dkey])
-
-			switch (*p.haystalk[r]).val.valtype {
-			case valtype_int:
-				fmt.Printf("%v", p.haystalk[r].val.GetInt())
-			case valtype_float:
-				fmt.Printf("%v", p.haystalk[r].val.GetFloat())
-			case valtype_string:
-				fmt.Printf("%v", *p.haystalk[r].val.GetString())
+			if _, err := fmt.Fprintf(w, "%v=%s\n", *d.dkey[(*p.haystalk[r]).dkey], p.haystalk[r].val.String()); err != nil {
+				return err
 			}
+		}
 
-			fmt.Printf("\n")
+		if _, err := fmt.Fprintf(w, "\n"); err != nil {
+			return err
 		}
+	}
+
+	_, err := fmt.Fprintf(w, "\n")
+	return err
+}
 
-		fmt.Printf("\n")
+// Write the stalks of a Haybale as JSON, one per line, in their current
+// order (see Haystalk.MarshalJSON())
+func (p *Haybale) DumpStalks(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for n := uint32(0); n < p.num_haystalks; n++ {
+		if err := enc.Encode(p.haystalk[n]); err != nil {
+			return fmt.Errorf("stalk %d: %w", n, err)
+		}
 	}
 
-	fmt.Printf("\n")
+	return nil
 }
 
 // EOF
@@ -0,0 +1,71 @@
+// OpenActa/Haystack - test/debug functions - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Printing doesn't sort, or change anything else
+func TestPrintBaleReadOnly(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	var hs Haystack
+	hb := &Haybale{HaystackPtr: &hs}
+	hs.Haybale = append(hs.Haybale, hb)
+	for _, rec := range []map[string]interface{}{
+		{Timestamp_key: "2023-06-04T00:00:02Z", "host": "b", "port": "22"},
+		{Timestamp_key: "2023-06-04T00:00:01Z", "host": "a", "port": "443"},
+	} {
+		if err := hb.InsertBunch(&hs.Dict, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := hb.PrintBaleReadOnly(&hs.Dict, &buf); err == nil || buf.Len() != 0 {
+		t.Errorf("mutable Haybale: printed %d bytes, %v", buf.Len(), err)
+	}
+	if hb.is_sorted_immutable {
+		t.Fatalf("PrintBaleReadOnly() sorted the Haybale")
+	}
+
+	hb.SortBale()
+	before := hb.haystalk[0].val.String()
+	if err := hb.PrintBaleReadOnly(&hs.Dict, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if hb.haystalk[0].val.String() != before {
+		t.Errorf("stalks changed")
+	}
+
+	bunches := strings.Split(strings.TrimSuffix(buf.String(), "\n\n\n"), "\n\n")
+	if len(bunches) != 2 {
+		t.Fatalf("%d bunches:\n%s", len(bunches), buf.String())
+	}
+	for _, want := range []string{"host=a", "port=443", "host=b", "port=22"} {
+		if !strings.Contains(buf.String(), want+"\n") {
+			t.Errorf("no %s in:\n%s", want, buf.String())
+		}
+	}
+}
+
+// EOF
@@ -27,69 +27,252 @@
 package haystack
 
 import (
+	"fmt"
 	"hash/fnv"
+	"log"
+	"sort"
 	"strings"
 )
 
 const (
-	hash_skip       = 101        // May be a prime with reasonable dispersal properties?
-	hashkey_mask    = 0x00ffffff // 24-bit
+	hash_skip       = 101 // May be a prime with reasonable dispersal properties? (odd, so we visit every slot)
 	hashkey_invalid = 0xffffffff
 )
 
+// Allocate the hash table with 2^bits slots. bits 0 means use config dict_table_bits,
+// or the max (24) if that's not set. Files we read tell us their size.
+// Once there are keys in the table, its size can't change any more.
+// A new table compares keys per config case_sensitive_keys, files we read
+// tell us how theirs were compared, see getDisk2MemDictionary().
+func (p *Dictionary) initTable(bits uint8) error {
+	if bits == 0 {
+		bits = uint8(config.dict_table_bits)
+	}
+	if bits == 0 {
+		bits = hashtable_bits_max
+	}
+
+	if bits < dict_table_bits_lower || bits > dict_table_bits_upper {
+		return fmt.Errorf("dictionary table bits %d out of range (%d-%d)", bits, dict_table_bits_lower, dict_table_bits_upper)
+	}
+
+	if p.dkey != nil {
+		if p.bits == bits { // Nothing to do
+			return nil
+		}
+		if p.num_dkeys > 0 {
+			return fmt.Errorf("dictionary has %d keys in a %d-bit table, can't change to %d bits", p.num_dkeys, p.bits, bits)
+		}
+	}
+
+	p.bits = bits
+	p.case_sensitive = config.case_sensitive_keys
+	p.dkey = make([]*string, 1<<bits)
+	p.dirty = make([]bool, 1<<bits)
+	p.used = nil
+
+	return nil
+}
+
+// Make p a copy of d's keys, for Haystack.Snapshot().
+// The key strings are shared, they never change.
+func (p *Dictionary) copyFrom(d *Dictionary) {
+	p.num_dkeys = d.num_dkeys
+	p.bits = d.bits
+	p.case_sensitive = d.case_sensitive
+	if d.dkey != nil {
+		p.dkey = append([]*string(nil), d.dkey...)
+		p.dirty = make([]bool, len(d.dkey)) // nothing to write from a copy
+		p.used = append([]uint32(nil), d.used...)
+	}
+}
+
+// Hash values are bound to the table size
+func (p *Dictionary) hashkeyMask() uint32 {
+	return (1 << p.bits) - 1
+}
+
 // This function will check whether a key exists in our hash table:
 // returns #,true if found, or insertslot,false if not found.
-// panic or -1,false if we skip all around and find no spot
-// We store dictionary keys as they were, but compare case-insensitive
+// hashkey_invalid,false if we skip all around and find no spot (table full)
+// We store dictionary keys as they were, but compare case-insensitive,
+// unless the Dictionary is case-sensitive, see keyFold().
+// Note that case-insensitive means Host and host are one and the same key
+// (whichever came first is stored), so their values end up in the same field.
 func (p *Dictionary) KeyExists(s string) (uint32, bool) {
-	s = strings.ToLower(s)
+	s = p.keyFold(s)
 
 	h := p.findKeyhash(s)
 
+	if p.dkey == nil { // No table yet, so no keys either
+		return h, false
+	}
+
 	// Now try to find our match
 	if p.dkey[h] == nil { // Empty slot
 		return h, false
-	} else if strings.ToLower(*p.dkey[h]) == s { // Match
+	} else if p.keyFold(*p.dkey[h]) == s { // Match
 		return h, true // Yay, found the key straight off
 	}
 
 	// No immediate hit, so we have to skip around
-	for i := 0; i < hashtable_size; i++ {
-		h = (h + hash_skip) & hashkey_mask
+	p.collisions.Add(1)
+	for i := 0; i < len(p.dkey); i++ {
+		p.probes.Add(1)
+		h = (h + hash_skip) & p.hashkeyMask()
 		if p.dkey[h] == nil { // Empty slot
 			return h, false
-		} else if strings.ToLower(*p.dkey[h]) == s { // Found our key now
+		} else if p.keyFold(*p.dkey[h]) == s { // Found our key now
 			return h, true
 		}
 	}
 
-	// Just in case our skipping doesn't get results
-	// We may still have to adjust the algorithm to get a nicer distribution?
-	// Just walking the table is too slow, so we panic.
-	// TODO - handle this without havoc, we already have hashkey_invalid
-	panic("dictionary.go: Dictionary key hash fail!?")
+	// We've been all around, so the table is full.
+	// A bigger dict_table_bits will help for next time.
+	return hashkey_invalid, false
+}
+
+type DictionaryStats struct {
+	NumKeys    uint32 // keys in the Dictionary
+	Collisions uint64 // look-ups (incl. inserts) that had to skip around
+	Probes     uint64 // total slots skipped over
+}
+
+// Hash table statistics, since the Dictionary was created.
+// Lots of collisions (or probes per collision) indicate the hash doesn't
+// distribute well for our keys, and the table may need enlarging or a rehash.
+func (p *Dictionary) Stats() DictionaryStats {
+	return DictionaryStats{
+		NumKeys:    p.num_dkeys,
+		Collisions: p.collisions.Load(),
+		Probes:     p.probes.Load(),
+	}
+}
+
+// Fingerprint of the Dictionary: a hash over the table size and all
+// (dkey, name) pairs, in dkey order. Dictionaries with the same fingerprint
+// use the same dkeys for the same keys, so their Haybales can be combined
+// without remapping dkeys. Also see DictionaryFingerprint() for files.
+func (p *Dictionary) Fingerprint() uint64 {
+	fnvh := fnv.New64a()
+	fnvh.Write([]byte{p.bits})
+	if p.caseSensitive() { // Same keys, but they don't compare the same
+		fnvh.Write([]byte{section_flag_case_sensitive})
+	}
+
+	for i, k := range p.dkey {
+		if k == nil {
+			continue
+		}
+		// dkey (3 bytes, like on disk) and key length, so pairs can't run into each other
+		fnvh.Write([]byte{byte(i), byte(i >> 8), byte(i >> 16), byte(len(*k))})
+		fnvh.Write([]byte(*k))
+	}
 
-	// return hashkey_invalid, false
+	return fnvh.Sum64()
+}
+
+// All keys, sorted, e.g. for a list of fields to pick from.
+// Keys are as stored, so with case-insensitive keys it's the casing we saw first.
+func (p *Dictionary) AllKeys() []string {
+	keys := make([]string, 0, len(p.used))
+	for _, dkey := range p.used {
+		keys = append(keys, *p.dkey[dkey])
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Whether this Dictionary tells Host and host apart. That's config
+// case_sensitive_keys until the table is set up (so for a new Haystack),
+// after that it stays what it was for the keys we have, from a file or not.
+func (p *Dictionary) caseSensitive() bool {
+	if p.dkey == nil {
+		return config.case_sensitive_keys
+	}
+	return p.case_sensitive
+}
+
+// Key as this Dictionary hashes and compares it
+func (p *Dictionary) keyFold(s string) string {
+	if p.caseSensitive() {
+		return s
+	}
+
+	return strings.ToLower(s)
+}
+
+// Is ks the _timestamp key, in this Dictionary
+func (p *Dictionary) isTimestampKey(ks string) bool {
+	return p.keyFold(ks) == p.keyFold(Timestamp_key)
 }
 
 // Note that this always return successfully, since we're just hashing, no look-up.
-// And remember we're using a 24-bits hashtable, not 32!
+// And remember we're using a (up to) 24-bits hashtable, not 32!
 func (p *Dictionary) findKeyhash(s string) uint32 {
-	fnvh := fnv.New32a()                 // Initialise new hash
-	fnvh.Write([]byte(s))                // Hash our key string
-	return (fnvh.Sum32() & hashkey_mask) // Get hash and bound within 24-bits
+	fnvh := fnv.New32a()                    // Initialise new hash
+	fnvh.Write([]byte(s))                   // Hash our key string
+	return (fnvh.Sum32() & p.hashkeyMask()) // Get hash and bound within table size
+}
+
+// The dkey of key s, adding it if it's new.
+// ErrDictFull if there's no room, ErrDictNearFull when we're over config
+// dict_fill_max: existing keys are still found, new ones aren't added.
+func (p *Dictionary) FindOrAddKeyhash(s string) (uint32, error) {
+	if p.dkey == nil {
+		if err := p.initTable(0); err != nil {
+			return hashkey_invalid, fmt.Errorf("%w: can't set up Dictionary: %v", ErrDictFull, err)
+		}
+	}
+
+	h, res := p.KeyExists(s)
+	if res { // Found existing key
+		return h, nil
+	}
+	if h == hashkey_invalid {
+		return hashkey_invalid, fmt.Errorf("%w (%d keys), can't add key '%s'", ErrDictFull, p.num_dkeys, s)
+	}
+	if p.num_dkeys >= p.fillLimit(dictFillMax()) && dictFillMax() < dict_fill_upper {
+		return hashkey_invalid, fmt.Errorf("%w: %d of %d slots in use, can't add key '%s'", ErrDictNearFull, p.num_dkeys, len(p.dkey), s)
+	}
+
+	p.dkey[h] = &s    // This key is new, put it into the empty slot
+	p.dirty[h] = true // Mark for writing to disk
+	p.num_dkeys++     // Increase tally
+	p.used = append(p.used, h)
+
+	if !p.warned && p.num_dkeys >= p.fillLimit(dictFillWarn()) {
+		log.Printf("Warning: Dictionary has %d keys, %d%% of its %d slots (dict_fill_warn), it may fill up. Flattened arrays?",
+			p.num_dkeys, dictFillWarn(), len(p.dkey))
+		p.warned = true
+	}
+
+	return h, nil // Success
 }
 
-func (p *Dictionary) FindOrAddKeyhash(s string) (uint32, bool) {
-	if h, res := p.KeyExists(s); res { // Found existing key
-		return h, true
-	} else {
-		p.dkey[h] = &s    // This key is new, put it into the empty slot
-		p.dirty[h] = true // Mark for writing to disk
-		p.num_dkeys++     // Increase tally
+// How many keys are pct percent of the table (at least 1)
+func (p *Dictionary) fillLimit(pct uint32) uint32 {
+	n := uint32(uint64(len(p.dkey)) * uint64(pct) / 100)
+	if n == 0 {
+		n = 1
+	}
+	return n
+}
+
+// config dict_fill_warn and dict_fill_max, 0 = default
+func dictFillWarn() uint32 {
+	if config.dict_fill_warn == 0 {
+		return dict_fill_warn_default
+	}
+	return config.dict_fill_warn
+}
 
-		return h, true // Success
+func dictFillMax() uint32 {
+	if config.dict_fill_max == 0 {
+		return dict_fill_max_default
 	}
+	return config.dict_fill_max
 }
 
 // EOF
@@ -17,7 +17,16 @@
 
 package haystack
 
-import "testing"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
 
 func TestFindOrAddKeyhash(t *testing.T) {
 	var haystack Haystack
@@ -32,11 +41,318 @@ func TestFindOrAddKeyhash(t *testing.T) {
 		3612882, 5259835, 14872617, 14872718, 1576052, 1054892}
 
 	for i := 0; i < len(dkeys); i++ {
-		h, res := haystack.Dict.FindOrAddKeyhash(dkeys[i])
-		if res != true || h != dhash[i] {
-			t.Errorf("Dictionary add %v = %v, wanted %v (res=%v)", dkeys[i], h, dhash[i], res)
+		h, err := haystack.Dict.FindOrAddKeyhash(dkeys[i])
+		if err != nil || h != dhash[i] {
+			t.Errorf("Dictionary add %v = %v, wanted %v (err=%v)", dkeys[i], h, dhash[i], err)
 		}
 	}
 }
 
+func TestDictionaryStats(t *testing.T) {
+	var haystack Haystack
+
+	// Some of these collide on the first slot (see TestFindOrAddKeyhash)
+	var dkeys []string = []string{"envEloPES", "VerandahS", "dIMPLES", "WAITS", "CONFERATE", "vizualising"}
+	for i := range dkeys {
+		haystack.Dict.FindOrAddKeyhash(dkeys[i])
+	}
+
+	stats := haystack.Dict.Stats()
+	if stats.NumKeys != uint32(len(dkeys)) || stats.Collisions == 0 || stats.Probes < stats.Collisions {
+		t.Errorf("Dictionary stats after colliding inserts: %+v", stats)
+	}
+
+	// Looking up a colliding key again has to skip around again
+	before := stats.Collisions
+	for i := range dkeys {
+		if _, found := haystack.Dict.KeyExists(dkeys[i]); !found {
+			t.Errorf("Key %s not found", dkeys[i])
+		}
+	}
+	if after := haystack.Dict.Stats().Collisions; after <= before {
+		t.Errorf("Collisions %d before look-ups, %d after", before, after)
+	}
+}
+
+// Host and host: one key by default, two with case_sensitive_keys
+func TestCaseSensitiveKeys(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+
+	for _, sensitive := range []bool{false, true} {
+		config.case_sensitive_keys = sensitive
+
+		hs := new(Haystack)
+		hb := &Haybale{HaystackPtr: hs}
+		hs.Haybale = append(hs.Haybale, hb)
+
+		flat, err := JSONToKVmap([]byte(`{"Host":"one.example.com","host":"two.example.com"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hb.InsertBunch(&hs.Dict, flat)
+		hs.SortAllBales()
+
+		dkey_upper, found_upper := hs.Dict.KeyExists("Host")
+		dkey_lower, found_lower := hs.Dict.KeyExists("host")
+		_, found_shout := hs.Dict.KeyExists("HOST")
+
+		if !found_upper || !found_lower {
+			t.Fatalf("sensitive=%v: Host found %v, host found %v", sensitive, found_upper, found_lower)
+		}
+
+		if sensitive {
+			if dkey_upper == dkey_lower {
+				t.Errorf("sensitive=%v: Host and host share dkey %d", sensitive, dkey_upper)
+			}
+			if found_shout {
+				t.Errorf("sensitive=%v: HOST found, but was never ingested", sensitive)
+			}
+		} else {
+			if dkey_upper != dkey_lower {
+				t.Errorf("sensitive=%v: Host (%d) and host (%d) are different keys", sensitive, dkey_upper, dkey_lower)
+			}
+			if !found_shout {
+				t.Errorf("sensitive=%v: HOST not found", sensitive)
+			}
+		}
+
+		// Either way, searching for the exact casing finds our bunch
+		if n := hs.CountKeyValArray(map[string]string{"host": "two.example.com"}); n != 1 {
+			t.Errorf("sensitive=%v: host=two.example.com matched %d bunches, want 1", sensitive, n)
+		}
+	}
+}
+
+// A file's keys compare the way they did when it was written,
+// whatever case_sensitive_keys says when we read it
+func TestCaseSensitiveKeysFile(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	for _, sensitive := range []bool{false, true} {
+		config.case_sensitive_keys = sensitive
+
+		hs := new(Haystack)
+		hb := &Haybale{HaystackPtr: hs}
+		hs.Haybale = append(hs.Haybale, hb)
+		flat, err := JSONToKVmap([]byte(`{"_timestamp":"2023-06-04T00:00:00Z","Host":"one.example.com","host":"two.example.com"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := hb.InsertBunch(&hs.Dict, flat); err != nil {
+			t.Fatal(err)
+		}
+		hs.SortAllBales()
+		data, _, err := hs.Mem2Disk()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config.case_sensitive_keys = !sensitive
+		hs2 := new(Haystack)
+		if err := hs2.Disk2Mem(data); err != nil {
+			t.Fatalf("sensitive=%v: %v", sensitive, err)
+		}
+		if sensitive != (hs2.file_version_minor == version_minor) {
+			t.Errorf("sensitive=%v: version 1.%d", sensitive, hs2.file_version_minor)
+		}
+
+		dkey_upper, _ := hs2.Dict.KeyExists("Host")
+		dkey_lower, _ := hs2.Dict.KeyExists("host")
+		_, found_shout := hs2.Dict.KeyExists("HOST")
+		if (dkey_upper != dkey_lower) != sensitive || found_shout == sensitive {
+			t.Errorf("sensitive=%v, read as %v: Host %d, host %d, HOST found %v",
+				sensitive, !sensitive, dkey_upper, dkey_lower, found_shout)
+		}
+		if hs2.Dict.Fingerprint() != hs.Dict.Fingerprint() {
+			t.Errorf("sensitive=%v: fingerprint changed reading it back", sensitive)
+		}
+
+		// New keys go the way of the file too
+		if _, err := hs2.Dict.FindOrAddKeyhash("Proto"); err != nil {
+			t.Fatal(err)
+		}
+		if _, found := hs2.Dict.KeyExists("proto"); found == sensitive {
+			t.Errorf("sensitive=%v, read as %v: Proto added, proto found %v", sensitive, !sensitive, found)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+	fp := hs.Dict.Fingerprint()
+
+	data, _, err := hs.Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// From the file, without and with the Haybales
+	if ffp, err := DictionaryFingerprint(data); err != nil || ffp != fp {
+		t.Errorf("file fingerprint %x (%v), expected %x", ffp, err, fp)
+	}
+	hs2 := new(Haystack)
+	if err := hs2.Disk2Mem(data); err != nil {
+		t.Fatal(err)
+	}
+	if hs2.Dict.Fingerprint() != fp {
+		t.Errorf("fingerprint changed after round-trip")
+	}
+
+	// One more key, or another table size, is a different Dictionary
+	hs2.Dict.FindOrAddKeyhash("new.key")
+	if hs2.Dict.Fingerprint() == fp {
+		t.Errorf("fingerprint same with extra key")
+	}
+	config.dict_table_bits = 11
+	hs3 := newTestHaystack(t, "testdata/head5.json", 2)
+	if hs3.Dict.Fingerprint() == fp {
+		t.Errorf("fingerprint same with other table size")
+	}
+
+	if _, err := DictionaryFingerprint(data[:len(data)-1]); err == nil {
+		t.Errorf("no error for truncated file")
+	}
+}
+
+// Sorted, and the same after a round-trip through disk or a copy
+func TestAllKeys(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+
+	keys := hs.Dict.AllKeys()
+	if len(keys) != int(hs.Dict.num_dkeys) || !sort.StringsAreSorted(keys) {
+		t.Fatalf("%d keys for %d dkeys, sorted %v: %v", len(keys), hs.Dict.num_dkeys, sort.StringsAreSorted(keys), keys)
+	}
+	for _, k := range []string{Timestamp_key, "dest_port", "tls.sni", "tcp.tcp_flags"} {
+		if i := sort.SearchStrings(keys, k); i == len(keys) || keys[i] != k {
+			t.Errorf("%s not in %v", k, keys)
+		}
+	}
+
+	data, _, err := hs.Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs2 := new(Haystack)
+	if err := hs2.Disk2Mem(data); err != nil {
+		t.Fatal(err)
+	}
+	var d Dictionary
+	d.copyFrom(&hs.Dict)
+
+	for name, got := range map[string][]string{"Disk2Mem": hs2.Dict.AllKeys(), "copy": d.AllKeys()} {
+		if strings.Join(got, " ") != strings.Join(keys, " ") {
+			t.Errorf("%s: %v", name, got)
+		}
+	}
+
+	if keys := new(Dictionary).AllKeys(); len(keys) != 0 {
+		t.Errorf("empty Dictionary: %v", keys)
+	}
+}
+
+// Files keep the table size they were written with, whatever ours is now
+func TestDictionaryTableBits(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+	data, _, err := hs.Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := hs.CountKeyValArray(map[string]string{"dest_port": "443"})
+
+	config.dict_table_bits = 12
+	hs2 := new(Haystack)
+	if err := hs2.Disk2Mem(data); err != nil {
+		t.Fatal(err)
+	}
+	if hs2.Dict.bits != 10 || len(hs2.Dict.dkey) != 1<<10 || hs2.Dict.num_dkeys != hs.Dict.num_dkeys {
+		t.Errorf("read back: %d bits, %d slots, %d keys", hs2.Dict.bits, len(hs2.Dict.dkey), hs2.Dict.num_dkeys)
+	}
+	if n := hs2.CountKeyValArray(map[string]string{"dest_port": "443"}); n != want {
+		t.Errorf("read back: %d matches, want %d", n, want)
+	}
+	if h, err := hs2.Dict.FindOrAddKeyhash("a.new.key"); err != nil || h >= 1<<10 {
+		t.Errorf("new key in the file's table: %d %v", h, err)
+	}
+
+	// A new one gets ours, the size can't change once there are keys
+	var d Dictionary
+	if _, err := d.FindOrAddKeyhash("k"); err != nil || d.bits != 12 {
+		t.Errorf("new Dictionary: %d bits, %v", d.bits, err)
+	}
+	if err := hs2.Dict.initTable(12); err == nil {
+		t.Errorf("resized with keys in it")
+	}
+	if err := new(Dictionary).initTable(dict_table_bits_upper + 1); err == nil {
+		t.Errorf("%d bits: no error", dict_table_bits_upper+1)
+	}
+}
+
+// Warned once at dict_fill_warn, no new keys over dict_fill_max
+func TestDictionaryFill(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.dict_table_bits = 8 // 256 slots
+	config.dict_fill_warn = 50
+	config.dict_fill_max = 75
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	var d Dictionary
+	d.FindOrAddKeyhash(Timestamp_key)
+	for i := 1; i < 128; i++ {
+		if _, err := d.FindOrAddKeyhash(fmt.Sprintf("k%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		if warned := strings.Contains(buf.String(), "dict_fill_warn"); warned != (i == 127) {
+			t.Fatalf("%d keys: warned %v", i+1, warned)
+		}
+	}
+	for i := 128; i < 192; i++ {
+		d.FindOrAddKeyhash(fmt.Sprintf("k%d", i))
+	}
+	if n := strings.Count(buf.String(), "dict_fill_warn"); n != 1 {
+		t.Errorf("warned %d times", n)
+	}
+
+	// Full enough: old keys are there, new ones aren't
+	_, err := d.FindOrAddKeyhash("one.too.many")
+	if !errors.Is(err, ErrDictNearFull) || !errors.Is(err, ErrDictFull) || d.num_dkeys != 192 {
+		t.Errorf("%d keys: %v", d.num_dkeys, err)
+	}
+	if h, err := d.FindOrAddKeyhash("K5"); err != nil || *d.dkey[h] != "k5" {
+		t.Errorf("existing key: %v", err)
+	}
+
+	// And that's what InsertBunch says, with what went in anyway
+	hb := &Haybale{}
+	err = hb.InsertBunch(&d, map[string]interface{}{Timestamp_key: "1685836800", "k1": 1, "new": 2})
+	if !errors.Is(err, ErrDictNearFull) || !strings.Contains(err.Error(), "[new]") || hb.num_haystalks != 2 {
+		t.Errorf("InsertBunch: %d stalks, %v", hb.num_haystalks, err)
+	}
+
+	// 100: until the table is actually full, and then it's just full
+	config.dict_fill_max = 100
+	for i := 192; i < 256; i++ {
+		if _, err := d.FindOrAddKeyhash(fmt.Sprintf("k%d", i)); err != nil {
+			t.Fatalf("key %d: %v", i, err)
+		}
+	}
+	if _, err := d.FindOrAddKeyhash("one.too.many"); !errors.Is(err, ErrDictFull) || errors.Is(err, ErrDictNearFull) {
+		t.Errorf("full: %v", err)
+	}
+}
+
 // EOF
@@ -32,6 +32,8 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/sha512"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
@@ -88,227 +90,677 @@ func getKeyFromData(reader *bytes.Reader) (uint32, *string) {
 	return dkey, s
 }
 
-// Check a section (CRC and other sanity), return (error), section type, length and content
-func (p *Haystack) getDisk2MemSections(data []byte) error {
-	var read_com_len, read_unc_len int
-	var prev_section int
-	var err error
+// A section as read from disk, before decryption and decompression
+type diskSection struct {
+	ofs     int    // offset of the section within the dataset
+	id      uint8  // section identifier
+	flags   uint8  // section flags (since 1.1)
+	codec   uint8  // compression codec (codec_unspecified = have a look)
+	level   uint8  // compression level (0 = not specified), informational
+	cipher  uint8  // encryption cipher (resolved, never cipher_unspecified)
+	unc_len int    // uncompressed content length
+	com_len int    // compressed content length
+	crc     uint32 // stored CRC over the (plain) content
+	header  []byte // raw section header, also the AEAD additional data
+	content []byte // raw content, still compressed and encrypted
+	dict    []byte // the file's compression dictionary, for codec_deflate_dict (set by the caller)
+}
 
-	file_reader := bytes.NewReader(data)
+// A section that doesn't start with our signature. At offset 0, it's not a
+// Haystack file. Further in, we most likely lost track: the section before
+// it (Prev*, if the caller knows) wasn't as long as its header said.
+// It's ErrCorrupt as well, for errors.Is().
+type SignatureError struct {
+	Offset    int    // where we read it
+	Signature uint32 // what we read
+
+	PrevID     uint8 // section before it (0 = not known)
+	PrevOffset int
+	PrevLen    int // header and content, going by its header
+}
 
-	// Loop through each section in the Haystack Haystack
-trailer:
-	for {
-		// read in next section header
-		header := make([]byte, min_DiskHeaderBaselen)
-		if n, err := file_reader.Read(header); err != nil || n < min_DiskHeaderBaselen {
-			return fmt.Errorf("unexpected end of file while reading Haystack")
+func (e *SignatureError) Error() string {
+	msg := fmt.Sprintf("%v: incorrect signature (0x%06x instead of 0x%06x) at offset %d", ErrCorrupt, e.Signature, signature, e.Offset)
+
+	switch {
+	case e.Offset == 0:
+		return msg + ", not a Haystack?"
+	case e.PrevID != 0:
+		return fmt.Sprintf("%s, right after the %s section at offset %d (%d bytes): out of step, that section's length is likely wrong",
+			msg, SectionInfo{ID: e.PrevID}.Type(), e.PrevOffset, e.PrevLen)
+	default:
+		return msg
+	}
+}
+
+func (e *SignatureError) Unwrap() error {
+	return ErrCorrupt
+}
+
+// Fill in the section before, if err is a SignatureError
+func signatureAfter(err error, prev *diskSection) error {
+	var se *SignatureError
+	if prev != nil && errors.As(err, &se) {
+		se.PrevID = prev.id
+		se.PrevOffset = prev.ofs
+		se.PrevLen = prev.next() - prev.ofs
+	}
+
+	return err
+}
+
+// Read the section header at ofs, and locate its (still encoded) content.
+// The content is not copied, it refers back into data.
+// file_version_minor is from the file header, it tells us the header layout.
+func getDisk2MemNextSection(data []byte, ofs int, file_version_minor uint8) (*diskSection, error) {
+	var s diskSection
+
+	s.ofs = ofs
+
+	// Lengths and offsets are checked against what's left of data, rather
+	// than adding them up first: where int is 32 bits, that could wrap.
+
+	// read in next section header
+	if ofs < 0 || ofs > len(data) || len(data)-ofs < min_DiskHeaderBaselen {
+		return nil, fmt.Errorf("%w: unexpected end of file reading section header at offset %d", ErrTruncated, ofs)
+	}
+	s.header = data[ofs : ofs+min_DiskHeaderBaselen]
+	hdr_reader := bytes.NewReader(s.header)
+
+	// Get signature
+	read_signature := getUintFromData(hdr_reader, 3)
+	if read_signature == signature_swapped {
+		return nil, fmt.Errorf("%w: byte-swapped signature at offset %d, written big-endian?", ErrCorrupt, ofs)
+	}
+	if read_signature != signature {
+		return nil, &SignatureError{Offset: ofs, Signature: uint32(read_signature)}
+	}
+
+	s.id = getByteFromData(hdr_reader) // Get section identifier
+
+	// Get lengths (uncompressed and compressed), up to 4G: as uint64 until
+	// checked, after that they fit an int anywhere
+	read_unc_len := getUintFromData(hdr_reader, 4) // uncompressed len of content
+	read_com_len := getUintFromData(hdr_reader, 4) // compressed len of content
+	if read_unc_len < 1 || read_unc_len > max_filesize ||
+		read_com_len < 1 || read_com_len > max_filesize ||
+		read_com_len > read_unc_len {
+		return nil, fmt.Errorf("%w: stored lengths %d (com), %d (unc) invalid", ErrCorrupt, read_com_len, read_unc_len)
+	}
+	s.unc_len = int(read_unc_len)
+	s.com_len = int(read_com_len)
+	// Before anything gets allocated for it, see max_section_size
+	if max := maxSectionSize(); s.unc_len > max {
+		return nil, fmt.Errorf("%w: section %d at offset %d is %d bytes uncompressed, more than max_section_size (%d)",
+			ErrCorrupt, s.id, ofs, s.unc_len, max)
+	}
+
+	// CRC is over content (unc_len)
+	s.crc = uint32(getUintFromData(hdr_reader, 4)) // Read stored CRC
+
+	// The file header is never encrypted.
+	// Before 1.1, all other sections were always encrypted.
+	s.codec = codec_unspecified
+	if s.id == section_header {
+		s.cipher = cipher_none
+	} else {
+		s.cipher = cipher_aes256gcm
+	}
+
+	// Since 1.1, sections other than the file header have flags, codec and cipher
+	if s.id != section_header && file_version_minor >= 1 {
+		ext_ofs := ofs + min_DiskHeaderBaselen
+		if len(data)-ext_ofs < len_DiskHeaderExt {
+			return nil, fmt.Errorf("%w: unexpected end of file reading section header at offset %d", ErrTruncated, ofs)
+		}
+		s.header = data[ofs : ext_ofs+len_DiskHeaderExt] // flags are part of the AEAD too
+		s.flags = data[ext_ofs]
+		s.codec = data[ext_ofs+1]
+		s.level = data[ext_ofs+3]
+
+		switch data[ext_ofs+2] {
+		case cipher_unspecified: // Early 1.1 files only have the plaintext flag
+			if s.flags&section_flag_plaintext != 0 {
+				s.cipher = cipher_none
+			}
+		case cipher_none, cipher_aes256gcm:
+			s.cipher = data[ext_ofs+2]
+		default:
+			return nil, fmt.Errorf("%w: section %d uses unknown cipher %d", ErrCorrupt, s.id, data[ext_ofs+2])
 		}
-		hdr_reader := bytes.NewReader(header)
 
-		// Get signature
-		read_signature := getUintFromData(hdr_reader, 3)
-		if read_signature != signature {
-			return fmt.Errorf("incorrect signature (0x%06x instead of 0x%06x), not a Haystack or dataset corrupt?",
-				read_signature, signature)
+		switch s.codec {
+		case codec_unspecified, codec_none, codec_bzip2, codec_deflate_dict:
+		default:
+			return nil, fmt.Errorf("%w: section %d uses unknown codec %d", ErrCorrupt, s.id, s.codec)
 		}
+	}
 
-		read_section := getByteFromData(hdr_reader) // Get section identifier
+	content_len := read_com_len
+	if s.cipher != cipher_none {
+		content_len += aesgcm_block_additional
+	}
+
+	content_ofs := ofs + len(s.header)
+	if content_len > uint64(len(data)-content_ofs) {
+		return nil, fmt.Errorf("%w: unexpected end of file reading section %d content at offset %d", ErrTruncated, s.id, content_ofs)
+	}
+	s.content = data[content_ofs : content_ofs+int(content_len)]
+
+	return &s, nil
+}
+
+// Offset of the section following this one
+func (s *diskSection) next() int {
+	return s.ofs + len(s.header) + len(s.content)
+}
+
+// Decrypt and decompress section content, and check its CRC
+func getDisk2MemSectionContent(s *diskSection, aes_key_uuid string) ([]byte, error) {
+	content, err := getDisk2MemSectionPlain(s, aes_key_uuid)
+	if err != nil {
+		return nil, err
+	}
 
-		//log.Printf("getDisk2MemSections loop (section id: %d)", read_section) // DEBUG
+	// Calculate our own CRC, to compare against the stored one
+	header_crc := crc32.ChecksumIEEE(content)
+	if s.crc != header_crc {
+		return nil, fmt.Errorf("%w: section %d CRC mismatch (read 0x%08x, calculated 0x%08x)",
+			ErrCorrupt, s.id, s.crc, header_crc)
+	}
 
-		if prev_section == 0 && read_section != section_header {
-			return fmt.Errorf("first section not header, not a Haystack or dataset corrupt?")
+	return content, nil
+}
+
+// Decrypt and decompress section content, CRC not checked
+func getDisk2MemSectionPlain(s *diskSection, aes_key_uuid string) ([]byte, error) {
+	var err error
+
+	content := s.content
+
+	// Once the header says the file is encrypted, everything after it is.
+	// A plaintext section in there was swapped in or added.
+	if aes_key_uuid != "" && s.id != section_header && s.cipher != cipher_aes256gcm {
+		return nil, fmt.Errorf("%w: section %d at offset %d is not encrypted, in an encrypted file", ErrCorrupt, s.id, s.ofs)
+	}
+
+	if s.cipher == cipher_aes256gcm {
+		if aes_key_uuid == "" {
+			return nil, fmt.Errorf("%w: section %d is encrypted, but the file header has no AES key uuid", ErrCorrupt, s.id)
 		}
 
-		// Get lengths (uncompressed and compressed)
-		read_unc_len = int(getUintFromData(hdr_reader, 4)) // uncompressed len of content
-		read_com_len = int(getUintFromData(hdr_reader, 4)) // compressed len of content
-		if read_unc_len < 1 || read_unc_len > max_filesize ||
-			read_com_len < 1 || read_com_len > max_filesize ||
-			read_com_len > read_unc_len {
-			return fmt.Errorf("stored lengths %d (com), %d (unc) invalid, corrupted Haystack?", read_com_len, read_unc_len)
+		// Decryption
+		content, err = getDisk2MemAES256GCMblock(content, s.header, aes_key_uuid)
+		if err != nil {
+			return nil, err
 		}
+		// Note that AES GCM also removes its 12 + 16 bytes of overhead
+	}
 
-		// CRC is over content (read_unc_len)
-		read_crc := uint32(getUintFromData(hdr_reader, 4)) // Read stored CRC
+	// Decompressing, if compressed
+	codec := s.codec
+	if codec == codec_unspecified { // Older files
+		codec = getDisk2MemLegacyCodec(s.com_len, s.unc_len)
+	}
 
-		var len int
-		if read_section == 1 {
-			len = read_com_len
+	switch codec {
+	case codec_bzip2, codec_deflate_dict:
+		if codec == codec_bzip2 {
+			content, err = getDisk2MemBzip2block(content, s.unc_len)
 		} else {
-			len = read_com_len + aesgcm_block_additional
+			content, err = getDisk2MemDeflateDict(content, s.dict, s.unc_len)
+		}
+		if err != nil {
+			return nil, err
 		}
-		content := make([]byte, len)
+		if len(content) != s.unc_len {
+			return nil, fmt.Errorf("%w: section %d decompressed to %d bytes, expected %d",
+				ErrCorrupt, s.id, len(content), s.unc_len)
+		}
+	case codec_none:
+		if s.com_len != s.unc_len {
+			return nil, fmt.Errorf("%w: section %d is stored uncompressed, but lengths differ (%d com, %d unc)",
+				ErrCorrupt, s.id, s.com_len, s.unc_len)
+		}
+	}
 
-		if n, err := file_reader.Read(content); err != nil || n < len {
-			return fmt.Errorf("unexpected end of file: %s", err)
+	return content, nil
+}
+
+// Check a section (CRC and other sanity), return (error), section type, length and content
+// progress (if not nil) is called after each section.
+func (p *Haystack) getDisk2MemSections(data []byte, progress func(bytesRead, total int)) error {
+	var prev_section int
+	var ofs int
+	var bale_added bool      // did the last Haybale section add a Haybale
+	var last_dict_ofs uint32 // where the last Dictionary section started
+	var last *diskSection    // the section before, for errors
+
+	// Loop through each section in the Haystack Haystack.
+	// A complete file always ends with a trailer.
+trailer:
+	for {
+		if ofs >= len(data) {
+			return fmt.Errorf("%w: no trailer section after %d bytes", ErrTruncated, ofs)
 		}
 
-		if read_section != 1 {
-			// Decryption
-			content, err = p.getDisk2MemAES256GCMblock(content, header)
-			if err != nil {
-				return err
-			}
-			// Note that AES GCM also removes its 12 + 16 bytes of overhead
+		s, err := getDisk2MemNextSection(data, ofs, p.file_version_minor)
+		if err != nil {
+			return signatureAfter(err, last)
 		}
+		ofs = s.next()
+		last = s
+		s.dict = p.compression_dict
 
-		// Decompressing, if compressed
-		if read_com_len < read_unc_len {
-			content, err = getDisk2MemBzip2block(content)
-			if err != nil {
-				return err
-			}
+		//log.Printf("getDisk2MemSections loop (section id: %d)", s.id) // DEBUG
+
+		if prev_section == 0 && s.id != section_header {
+			return fmt.Errorf("%w: first section not header, not a Haystack?", ErrCorrupt)
 		}
 
-		// Calculate our own CRC, to compare against the stored one
-		header_crc := crc32.ChecksumIEEE(content)
-		if read_crc != header_crc {
-			return fmt.Errorf("section CRC mismatch (read 0x%08x, calculated 0x%08x), Haystack corrupted?",
-				read_crc, header_crc)
+		content, err := getDisk2MemSectionContent(s, p.aes_key_uuid)
+		if err != nil {
+			return err
 		}
 
-		switch read_section {
+		switch s.id {
 		case section_header:
 			if err := p.getDisk2MemHeader(content); err != nil {
 				return err
 			}
+			p.compression_dict = nil
+
+		case section_compression_dict:
+			if prev_section != section_header {
+				return fmt.Errorf("%w: compression dictionary section can only follow the Header", ErrCorrupt)
+			}
+			if p.compression_dict, err = getDisk2MemCompressionDict(content); err != nil {
+				return err
+			}
 
 		case section_dictionary:
-			if prev_section != section_header && prev_section != section_haybale {
-				return fmt.Errorf("Dictionary section can only follow a Header or Haybale")
+			if prev_section != section_header && prev_section != section_compression_dict &&
+				prev_section != section_haybale && prev_section != section_haybale_index {
+				return fmt.Errorf("%w: Dictionary section can only follow a Header or Haybale", ErrCorrupt)
 			}
-			if err := p.getDisk2MemDictionary(content); err != nil {
+			if err := p.getDisk2MemDictionary(content, last_dict_ofs, s.flags); err != nil {
 				return err
 			}
+			last_dict_ofs = uint32(s.ofs)
 
 		case section_haybale:
 			if prev_section != section_dictionary {
-				return fmt.Errorf("Haybale section can only follow a Dictionary")
+				return fmt.Errorf("%w: Haybale section can only follow a Dictionary", ErrCorrupt)
 			}
-			if err := p.getDisk2MemHaybale(content); err != nil {
+			num_bales := len(p.Haybale)
+			if err := p.getDisk2MemHaybale(content, s.flags); err != nil {
 				return err
 			}
+			bale_added = len(p.Haybale) > num_bales
+
+		case section_haybale_index:
+			if prev_section != section_haybale {
+				return fmt.Errorf("%w: Haybale index section can only follow a Haybale", ErrCorrupt)
+			}
+			index, err := p.getDisk2MemHaybaleIndex(content)
+			if err != nil {
+				return err
+			}
+			if bale_added { // empty Haybales aren't kept
+				p.Lock()
+				p.Haybale[len(p.Haybale)-1].index = index
+				p.Unlock()
+			}
 
 		case section_trailer:
+			if err := p.getDisk2MemTrailer(content, last_dict_ofs); err != nil {
+				return err
+			}
+			if progress != nil {
+				progress(ofs, len(data))
+			}
 			break trailer // Trailer section, break out of our loop. So ignore any garbage after that.
 
 		default:
-			return fmt.Errorf("unknown section type %d, not a Haystack or dataset corrupt?", read_section)
+			if !p.keep_unknown {
+				return fmt.Errorf("%w: unknown section type %d", ErrCorrupt, s.id)
+			}
+			// Kept, and it doesn't count for the order of the others
+			p.keepUnknownSection(s.id, content)
+			if progress != nil {
+				progress(ofs, len(data))
+			}
+			continue
 		}
 
-		prev_section = int(read_section)
+		prev_section = int(s.id)
+
+		if progress != nil {
+			progress(ofs, len(data))
+		}
 	}
 
 	return nil
 }
 
+// Dictionary fingerprint of a Haystack file, see Dictionary.Fingerprint().
+// Only the header and Dictionary sections are decoded, Haybales are skipped
+// (and so not checked), which makes this a lot quicker than Disk2Mem().
+func DictionaryFingerprint(data []byte) (uint64, error) {
+	p := new(Haystack)
+	var last_dict_ofs uint32
+	var last *diskSection // the section before, for errors
+
+	for ofs := 0; ; {
+		if ofs >= len(data) {
+			return 0, fmt.Errorf("%w: no trailer section after %d bytes", ErrTruncated, ofs)
+		}
+
+		s, err := getDisk2MemNextSection(data, ofs, p.file_version_minor)
+		if err != nil {
+			return 0, signatureAfter(err, last)
+		}
+		ofs = s.next()
+		last = s
+
+		if (s.ofs == 0) != (s.id == section_header) {
+			return 0, fmt.Errorf("%w: header section must be first (and only once)", ErrCorrupt)
+		}
+
+		switch s.id {
+		case section_header, section_dictionary:
+			content, err := getDisk2MemSectionContent(s, p.aes_key_uuid)
+			if err != nil {
+				return 0, err
+			}
+			if s.id == section_header {
+				err = p.getDisk2MemHeader(content)
+			} else {
+				err = p.getDisk2MemDictionary(content, last_dict_ofs, s.flags)
+				last_dict_ofs = uint32(s.ofs)
+			}
+			if err != nil {
+				return 0, err
+			}
+
+		case section_compression_dict, section_haybale, section_haybale_index:
+			// not needed
+
+		case section_trailer:
+			return p.Dict.Fingerprint(), nil
+
+		default:
+			return 0, fmt.Errorf("%w: unknown section type %d", ErrCorrupt, s.id)
+		}
+	}
+}
+
 // Process Header content
 func (p *Haystack) getDisk2MemHeader(content []byte) error {
 	//log.Printf("getDisk2MemHeader") // DEBUG
 
+	h, err := getDisk2MemHeaderContent(content)
+	if err != nil {
+		return err
+	}
+
+	p.Lock()
+	p.file_version_minor = h.version_minor
+	p.aes_key_uuid = h.aes_key_uuid // store for reference
+	p.file_uuid = h.file_uuid
+	p.Unlock()
+
+	return nil
+}
+
+// What we get out of a Header section
+type diskHeader struct {
+	version_minor uint8
+	aes_key_uuid  string // "" if the file is not encrypted
+	file_uuid     string // "" for files from before format 1.1
+}
+
+// Check Header content, return the minor version, the uuid of the AES key
+// used for the file and the file's own uuid. The key must be in our keystore.
+func getDisk2MemHeaderContent(content []byte) (*diskHeader, error) {
+	h, err := getDisk2MemHeaderFields(content)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.aes_key_uuid != "" {
+		//log.Printf("File AES used key uuid %s", h.aes_key_uuid) // DEBUG
+		if _, exists := config.aes_keystore_array[h.aes_key_uuid]; !exists {
+			return nil, fmt.Errorf("%w: file was encrypted with unknown AES key (uuid: %s)", ErrWrongKey, h.aes_key_uuid)
+		}
+	}
+
+	return h, nil
+}
+
+// Same, without looking for the key, for when we don't decrypt anything
+func getDisk2MemHeaderFields(content []byte) (*diskHeader, error) {
 	reader := bytes.NewReader(content)
 
 	read_version_major := getByteFromData(reader)
 	read_version_minor := getByteFromData(reader)
 
-	// If/Once there are multiple versions or formats, we can implement appropriate handling
+	// We can read older minor versions of our own major version.
+	// If/Once there are multiple major versions or formats, we can implement appropriate handling
 	// rather than just refusing. We want to be at least backwards compatible.
-	if read_version_major != version_major || read_version_minor != version_minor {
-		return fmt.Errorf("stored version of Haystack file (%d.%d) incompatible with this server (%d.%d)",
-			read_version_major, read_version_minor, version_major, version_minor)
+	if read_version_major != version_major || read_version_minor > version_minor {
+		return nil, fmt.Errorf("%w: stored version of Haystack file (%d.%d) incompatible with this server (%d.%d)",
+			ErrUnknownVersion, read_version_major, read_version_minor, version_major, version_minor)
+	}
+
+	h := diskHeader{version_minor: read_version_minor}
+
+	// Read back UUID (in binary form) of AES key, nil uuid ("") if the
+	// file was written without encryption
+	var err error
+	if h.aes_key_uuid, err = getUUIDFromData(reader); err != nil {
+		return nil, err
+	}
+
+	// Files from format 1.1 also carry their own uuid
+	if reader.Len() >= 16 {
+		if h.file_uuid, err = getUUIDFromData(reader); err != nil {
+			return nil, err
+		}
 	}
 
-	// Read back UUID (in binary form) of AES key
+	return &h, nil
+}
+
+// Read a uuid in binary form (16 bytes), the nil uuid is returned as ""
+func getUUIDFromData(reader *bytes.Reader) (string, error) {
 	uuid_bytes := make([]byte, 16) // 16 bytes
-	for i := 0; i < len(uuid_bytes); i++ {
-		uuid_bytes[i] = getByteFromData(reader)
+	if n, _ := reader.Read(uuid_bytes); n != len(uuid_bytes) {
+		return "", fmt.Errorf("uuid field too short")
 	}
+
 	uuid_raw, err := uuid.FromBytes(uuid_bytes)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	p.aes_key_uuid = uuid_raw.String() // convert to string form and store for reference
-	//log.Printf("File AES used key uuid %s", p.aes_key_uuid) // DEBUG
-	if _, exists := config.aes_keystore_array[p.aes_key_uuid]; !exists {
-		return fmt.Errorf("file was encrypted with unknown AES key (uuid: %s)", p.aes_key_uuid)
+	if uuid_raw == uuid.Nil {
+		return "", nil
 	}
 
+	return uuid_raw.String(), nil // convert to string form
+}
+
+// Process Trailer content (we just keep the timestamps, for reference).
+// last_dict_ofs is where the last Dictionary section started, the trailer
+// has to point there.
+func (p *Haystack) getDisk2MemTrailer(content []byte, last_dict_ofs uint32) error {
+	reader := bytes.NewReader(content)
+
+	if reader.Len() < 4+8+8 {
+		return fmt.Errorf("%w: trailer section too short, missing fields", ErrCorrupt)
+	}
+
+	read_last_dict_ofs := getUintFromData(reader, 4)
+	time_first := int64(getUintFromData(reader, 8))
+	time_last := int64(getUintFromData(reader, 8))
+
+	if uint32(read_last_dict_ofs) != last_dict_ofs {
+		return fmt.Errorf("%w: trailer points to the last Dictionary at offset %d, it's at %d",
+			ErrCorrupt, read_last_dict_ofs, last_dict_ofs)
+	}
+
+	p.Lock()
+	p.time_first = time_first
+	p.time_last = time_last
+	p.Unlock()
+
 	return nil
 }
 
-// Process Dictionary content
-func (p *Haystack) getDisk2MemDictionary(content []byte) error {
+// config max_section_size, 0 = default
+func maxSectionSize() int {
+	if config.max_section_size == 0 {
+		return max_section_size_default
+	}
+	return int(config.max_section_size)
+}
+
+// Process Dictionary content. prev_ofs is where the previous Dictionary
+// section started (0 for the first one), its prev_ofs has to point there.
+// flags are its section flags.
+func (p *Haystack) getDisk2MemDictionary(content []byte, prev_ofs uint32, flags uint8) error {
 	//log.Printf("getDisk2MemDictionary") // DEBUG
 
 	reader := bytes.NewReader(content)
 
 	if reader.Len() < min_DiskDictHeaderLen {
-		return fmt.Errorf("dictionary section too short, missing fields")
+		return fmt.Errorf("%w: dictionary section too short, missing fields", ErrCorrupt)
 	}
 
 	read_prev_ofs := getUintFromData(reader, 4)
-	read_num_dkeys := int(getUintFromData(reader, 4)) // reading 4 rather than 3 bytes, just for alignment
+	read_num_dkeys := int(getUintFromData(reader, 3))
+	read_bits := getByteFromData(reader) // hash table size, 0 for older files (24 bits)
 	// No further fields in the dictionary header at this point
 
 	//log.Printf("read_num_dkeys=%d", read_num_dkeys) // DEBUG
 
-	// This one can't be checked, either, because we're not passing the prev_ofs around between calls.
-	_ = read_prev_ofs // not used here (just for recovery purposes)
+	// The chain back through the Dictionaries, for recovery. A break in it
+	// means sections went missing, or got moved around.
+	if uint32(read_prev_ofs) != prev_ofs {
+		return fmt.Errorf("%w: Dictionary points back to offset %d, previous Dictionary is at %d",
+			ErrCorrupt, read_prev_ofs, prev_ofs)
+	}
 
 	if read_num_dkeys > max_dkeys {
-		return fmt.Errorf("read num dkeys %d > %d possible", read_num_dkeys, max_dkeys)
+		return fmt.Errorf("%w: read num dkeys %d > %d possible", ErrCorrupt, read_num_dkeys, max_dkeys)
+	}
+
+	// Searches may be looking up keys while we add to the Dictionary
+	p.Lock()
+	defer p.Unlock()
+
+	// The dkeys are slots in a table of the size the file was written with,
+	// whatever our config dict_table_bits says. Older files were always 24.
+	if read_bits == 0 {
+		read_bits = hashtable_bits_max
 	}
+	if err := p.Dict.initTable(read_bits); err != nil {
+		return err
+	}
+
+	// Keys compare the way they did when the file was written, whatever our
+	// config case_sensitive_keys says. Files before 1.5 were case-insensitive.
+	case_sensitive := flags&section_flag_case_sensitive != 0
+	if p.Dict.num_dkeys > 0 && p.Dict.case_sensitive != case_sensitive {
+		return fmt.Errorf("%w: Dictionary sections disagree on case-sensitive keys", ErrCorrupt)
+	}
+	p.Dict.case_sensitive = case_sensitive
 
 	for i := 0; i < read_num_dkeys; i++ {
 		dkey, key := getKeyFromData(reader)
 
 		//log.Printf("dkey[%d]=%-10s\r", dkey, *key) // DEBUG
 
+		if int(dkey) >= len(p.Dict.dkey) {
+			return fmt.Errorf("%w: read dkey %d outside of %d-bit Dictionary", ErrCorrupt, dkey, p.Dict.bits)
+		}
+
 		// Put key in our own hash table. Same location as original.
-		// Exact same 24-bit (min_DiskDictHeaderLen) range. Also, we use ptr to string
+		// Exact same table size. Also, we use ptr to string
+		if p.Dict.dkey[dkey] == nil {
+			p.Dict.num_dkeys++
+			p.Dict.used = append(p.Dict.used, dkey)
+		}
 		p.Dict.dkey[dkey] = key
 	}
 
 	return nil
 }
 
-// Process Haybale content
-func (p *Haystack) getDisk2MemHaybale(content []byte) error {
+// Process Haybale content, flags are its section flags
+func (p *Haystack) getDisk2MemHaybale(content []byte, flags uint8) error {
 	//log.Printf("getDisk2MemHaybale") // DEBUG
 
 	if len(content) == 0 { // do we need to bother?
 		return nil
 	}
 
+	new_hb, err := p.getDisk2MemHaybaleLayout(content, flags)
+	if err != nil {
+		return err
+	}
+
+	// An empty Haybale is legit (nothing came in), but there's nothing to search
+	if new_hb.num_haystalks == 0 {
+		return nil
+	}
+
+	// Searches may be walking the Haybale slice, so take the write lock
+	p.Lock()
+	p.memsize += new_hb.Memsize           // Calculate in this new haybale
+	p.Haybale = append(p.Haybale, new_hb) // Append to data available for search
+	p.Unlock()
+
+	return nil
+}
+
+// Decode Haybale content into a new (sorted, immutable) Haybale
+func (p *Haystack) getDisk2MemHaybaleContent(content []byte) (*Haybale, error) {
 	var new_hb Haybale // Create a new haybale
 
 	reader := bytes.NewReader(content)
 
 	if reader.Len() < min_DiskHaybaleHeaderLen {
-		return fmt.Errorf("haybale section too short, missing fields")
+		return nil, fmt.Errorf("%w: haybale section too short, missing fields", ErrCorrupt)
 	}
 
-	read_num_haystalks := int(getUintFromData(reader, 4))
+	read_num_haystalks := getUintFromData(reader, 4)
 
 	new_hb.time_first = int64(getUintFromData(reader, 8))
 	new_hb.time_last = int64(getUintFromData(reader, 8))
 
+	// Before we allocate for them: they have to fit in what's left
+	if read_num_haystalks > uint64(reader.Len()/min_DiskHaystalkLen) {
+		return nil, fmt.Errorf("%w: haybale says %d haystalks, in %d bytes", ErrCorrupt, read_num_haystalks, reader.Len())
+	}
+
 	var prev_string *string
 	var read_len uint32
-	for i := 0; i < read_num_haystalks; i++ {
+	for i := 0; i < int(read_num_haystalks); i++ {
 		var newstalk Haystalk
 
 		if i > 0 {
 			new_hb.haystalk = append(new_hb.haystalk, &Haystalk{})
 		} else { // allocate to the exact # we will have
-			new_hb.haystalk = make([]*Haystalk, 1, read_num_haystalks)
+			new_hb.haystalk = make([]*Haystalk, 1, int(read_num_haystalks))
 		}
 
 		newstalk.dkey = uint32(getUintFromData(reader, 3))
-		if p.Dict.dkey[newstalk.dkey] == nil { // DEBUG
-			panic(fmt.Sprintf("Read back nil referenced dkey %d from disk\n", newstalk.dkey))
+		if int(newstalk.dkey) >= len(p.Dict.dkey) {
+			return nil, fmt.Errorf("%w: read dkey %d outside of %d-bit Dictionary", ErrCorrupt, newstalk.dkey, p.Dict.bits)
+		}
+		if p.Dict.dkey[newstalk.dkey] == nil {
+			return nil, fmt.Errorf("%w: dkey %d not in the Dictionary", ErrCorrupt, newstalk.dkey)
 		}
 
 		read_valtype := uint8(getUintFromData(reader, 1))
@@ -323,19 +775,28 @@ func (p *Haystack) getDisk2MemHaybale(content []byte) error {
 		case valtype_float:
 			newstalk.val.SetFloat(getFloatFromData(reader, 8))
 
+		case valtype_time:
+			newstalk.val.SetTime(int64(getUintFromData(reader, 8)))
+
 		case valtype_string:
 			read_len = uint32(getUintFromData(reader, 4))
 			if read_len == len_dup {
 				if prev_string == nil { // best to check these things
-					return fmt.Errorf("de-dupped string indicated but not present")
+					return nil, fmt.Errorf("%w: de-dupped string indicated but not present", ErrCorrupt)
 				}
 
 				newstalk.val.SetString(prev_string) // use the dup
 			} else {
+				if uint64(read_len) > uint64(reader.Len()) { // before we allocate for it
+					return nil, fmt.Errorf("%w: string of %d bytes, %d left in Haybale", ErrCorrupt, read_len, reader.Len())
+				}
 				s := getStringFromData(reader, int(read_len))
 				newstalk.val.SetString(s)
 				prev_string = s
 			}
+
+		default:
+			return nil, fmt.Errorf("%w: unknown value type %d in Haybale", ErrCorrupt, read_valtype)
 		}
 
 		new_hb.Memsize += 37 // Haystalk struct, approx
@@ -349,47 +810,38 @@ func (p *Haystack) getDisk2MemHaybale(content []byte) error {
 		new_hb.num_haystalks++
 	}
 
-	p.memsize += new_hb.Memsize       // Calculate in this new haybale
 	new_hb.is_sorted_immutable = true // Set to immutable (obviously) and it's sorted.
-	// TODO: with multiple go routines we probably need to have a semaphore around the following
-	p.Haybale = append(p.Haybale, &new_hb) // Append to data available for search
+	new_hb.HaystackPtr = p
 
-	return nil
+	return &new_hb, nil
 }
 
-// bzip2's signatures are HSB (highest significant byte) first
-func bzip2_check_sig(dataslice []byte, sigseq uint64) bool {
-	var res uint64
-
-	for i := 0; i < len(dataslice); i++ {
-		res <<= 8
-		res |= uint64(dataslice[i])
+// Sections that don't say what codec they use (files from before 1.1, and
+// early 1.1). Only bzip2 was ever used, and only if it made things smaller:
+// stored uncompressed is when the lengths are equal. No sniffing for magic
+// bytes, uncompressed content may well start with "BZh".
+func getDisk2MemLegacyCodec(com_len int, unc_len int) uint8 {
+	if com_len == unc_len {
+		return codec_none
 	}
 
-	return res == sigseq
+	return codec_bzip2
 }
 
-// Process bzip2 -9 content
-func getDisk2MemBzip2block(data []byte) ([]byte, error) {
+// Process bzip2 -9 content, that should decompress to unc_len bytes.
+// We don't read past that, a few KB can decompress to gigabytes.
+func getDisk2MemBzip2block(data []byte, unc_len int) ([]byte, error) {
 	//log.Printf("getDisk2MemBzip2block") // DEBUG
 
-	// check for bzip2 file and block signatures
-	if !bzip2_check_sig(data[0:2], bzip2_hdrMagic) ||
-		!bzip2_check_sig(data[4:10], bzip2_blkMagic) {
-		// If no signatures, presume not compressed...
-		// In the worst case, it'll fail CRC check. Good.
-		return data, nil
-	}
-
 	// It's a bzip2 compressed block: decompress our data!
 	var bzip2_config bzip2.ReaderConfig
 
 	if reader, err := bzip2.NewReader(bytes.NewReader(data), &bzip2_config); err != nil {
-		return nil, fmt.Errorf("error decompressing bzip2: %v", err)
-	} else if buf, err := io.ReadAll(reader); err != nil {
-		return nil, fmt.Errorf("error decompressing bzip2: %v", err)
-	} else if reader.OutputOffset > max_filesize {
-		return nil, fmt.Errorf("dataset too long, not a Haystack?")
+		return nil, fmt.Errorf("%w: error decompressing bzip2: %v", ErrCorrupt, err)
+	} else if buf, err := io.ReadAll(io.LimitReader(reader, int64(unc_len)+1)); err != nil {
+		return nil, fmt.Errorf("%w: error decompressing bzip2: %v", ErrCorrupt, err)
+	} else if len(buf) > unc_len {
+		return nil, fmt.Errorf("%w: bzip2 content decompresses to more than %d bytes", ErrCorrupt, unc_len)
 	} else {
 		reader.Close()
 
@@ -401,12 +853,12 @@ func getDisk2MemBzip2block(data []byte) ([]byte, error) {
 }
 
 // Process AES256-GCM content
-func (p *Haystack) getDisk2MemAES256GCMblock(data []byte, extra []byte) ([]byte, error) {
+func getDisk2MemAES256GCMblock(data []byte, extra []byte, aes_key_uuid string) ([]byte, error) {
 	//log.Printf("Process AES256+GCM (extra=%v)", extra) // DEBUG
 
 	// Grab AES key belonging with uuid for this Haystack
 	// getDisk2MemHeader() has already checked that we have the key for this uuid
-	key := config.aes_keystore_array[p.aes_key_uuid]
+	key := config.aes_keystore_array[aes_key_uuid]
 	//log.Printf("AES key = %v", key) // DEBUG
 
 	// Create a new AES cipher block using the raw key
@@ -431,7 +883,8 @@ func (p *Haystack) getDisk2MemAES256GCMblock(data []byte, extra []byte) ([]byte,
 
 	plaintext, err = aesgcm.Open(nil, nonce, data, extra)
 	if err != nil {
-		return nil, fmt.Errorf("error decrypting Haystack: %s", err)
+		// GCM can't tell us which it is
+		return nil, fmt.Errorf("%w, or %w: error decrypting Haystack: %s", ErrCorrupt, ErrWrongKey, err)
 	}
 
 	return plaintext, nil
@@ -440,24 +893,45 @@ func (p *Haystack) getDisk2MemAES256GCMblock(data []byte, extra []byte) ([]byte,
 // Process byte slice into complete Haystack structure
 // We check the wazoo out of this!
 func (p *Haystack) Disk2Mem(data []byte) error {
+	return p.Disk2MemProgress(data, nil)
+}
+
+// Same as Disk2Mem(), calling progress after each section we've loaded.
+// bytesRead is our offset in data, total is len(data).
+// Handy for a progress bar with big files, pass nil if you don't want it.
+func (p *Haystack) Disk2MemProgress(data []byte, progress func(bytesRead, total int)) error {
 	//log.Printf("Disk2Mem") // DEBUG
 
 	len := len(data)
 
 	// First check some general file stuff
 	if len < min_filesize {
-		return fmt.Errorf("dataset too short, not a Haystack?")
+		return fmt.Errorf("%w: dataset too short, not a Haystack?", ErrTruncated)
 	}
 
 	if len > max_filesize {
 		return fmt.Errorf("dataset too long, not a Haystack?")
 	}
 
+	// Nothing moved or missing (encrypted files), before we take anything in
+	if err := verifyFileMAC(data); err != nil {
+		return err
+	}
+
 	// Now dive into the file's content
-	if err := p.getDisk2MemSections(data); err != nil {
+	if err := p.getDisk2MemSections(data, progress); err != nil {
 		return err
 	}
 
+	// Without a file uuid, its catalogue goes by this (see CatalogueName())
+	p.Lock()
+	p.file_sha512 = nil
+	if p.file_uuid == "" {
+		sum := sha512.Sum512(data)
+		p.file_sha512 = sum[:]
+	}
+	p.Unlock()
+
 	return nil // All good.
 }
 
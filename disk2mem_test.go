@@ -0,0 +1,713 @@
+// OpenActa/Haystack - disk to mem - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"strings"
+	"testing"
+)
+
+// Write head5.json to a Haystack file (in mem)
+func testHaystackFile(t *testing.T) []byte {
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+
+	data, _, err := hs.Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+// Cut off anywhere: always ErrTruncated, never ErrCorrupt
+func TestDisk2MemTruncated(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10 // we load a lot of Haystacks here
+
+	data := testHaystackFile(t)
+
+	for n := 0; n < len(data); n++ {
+		hs := new(Haystack)
+		err := hs.Disk2Mem(data[:n])
+		if !errors.Is(err, ErrTruncated) || errors.Is(err, ErrCorrupt) {
+			t.Fatalf("cut at %d of %d bytes: %v", n, len(data), err)
+		}
+	}
+
+	// And the whole thing is fine
+	if err := new(Haystack).Disk2Mem(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A flipped bit anywhere: ErrCorrupt (or an unknown AES key, if it's in the uuid)
+func TestDisk2MemCorrupt(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	data := testHaystackFile(t)
+
+	for n := 0; n < len(data); n++ {
+		bad := append([]byte(nil), data...)
+		bad[n] ^= 0x01
+
+		hs := new(Haystack)
+		err := hs.Disk2Mem(bad)
+		if err == nil {
+			t.Fatalf("bit flipped at %d of %d bytes: no error", n, len(data))
+		}
+		if errors.Is(err, ErrCorrupt) {
+			continue
+		}
+
+		// Lengths in the header may now point past the end, or the
+		// header's own fields are off. Those aren't always detectable as corrupt.
+		if n < min_DiskHeaderBaselen+34 || errors.Is(err, ErrTruncated) {
+			continue
+		}
+		t.Errorf("bit flipped at %d of %d bytes: %v", n, len(data), err)
+	}
+}
+
+// A bad signature says where, and after which section: not a Haystack, or out of step
+func TestDisk2MemSignatureError(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	data := testHaystackFile(t)
+	sections, err := ListSections(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dict := sections[1] // right after the header
+	if dict.ID != section_dictionary {
+		t.Fatalf("second section is %s", dict.Type())
+	}
+	after := sections[2].Offset
+
+	var se *SignatureError
+
+	// Not a Haystack at all
+	bad := append([]byte("not a haystack file"), data...)
+	err = new(Haystack).Disk2Mem(bad)
+	if !errors.As(err, &se) || !errors.Is(err, ErrCorrupt) || se.Offset != 0 || se.PrevID != 0 || !strings.Contains(err.Error(), "not a Haystack") {
+		t.Errorf("not a Haystack: %v", err)
+	}
+
+	// Something got in between sections
+	bad = append(append(append([]byte(nil), data[:after]...), 0xff, 0xff, 0xff, 0xff), data[after:]...)
+	err = new(Haystack).Disk2Mem(bad)
+	if !errors.As(err, &se) || se.Offset != after || se.PrevID != section_dictionary || se.PrevOffset != dict.Offset ||
+		se.PrevLen != after-dict.Offset || !strings.Contains(err.Error(), "dictionary section") {
+		t.Errorf("after the dictionary: %v", err)
+	}
+
+	// A section length one off: only the walk, nothing decoded
+	bad = append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(bad[dict.Offset+8:], uint32(dict.ComLen+1))
+	_, err = SectionLayout(bad, false)
+	if !errors.As(err, &se) || se.Offset != after+1 || se.PrevID != section_dictionary || se.PrevLen != after+1-dict.Offset {
+		t.Errorf("length one off: %v", err)
+	}
+}
+
+// Without encryption there's no file MAC: a Dictionary and Haybale that went
+// missing are caught by the Dictionary chain, or the trailer pointing to it
+func TestDisk2MemDictChain(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	config.encryption_disabled = true
+
+	data := testHaystackFile(t)
+	if err := new(Haystack).Disk2Mem(data); err != nil {
+		t.Fatal(err)
+	}
+
+	sections, err := ListSections(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dicts []int // section numbers
+	for i, s := range sections {
+		if s.ID == section_dictionary {
+			dicts = append(dicts, i)
+		}
+	}
+	if len(dicts) != 3 {
+		t.Fatalf("%d Dictionaries, want 3", len(dicts))
+	}
+
+	// Cut sections from..to (exclusive)
+	cut := func(from int, to int) []byte {
+		bad := append([]byte(nil), data[:sections[from].Offset]...)
+		return append(bad, data[sections[to].Offset:]...)
+	}
+
+	for _, test := range []struct {
+		what string
+		bad  []byte
+		want string
+	}{
+		{"middle one gone", cut(dicts[1], dicts[2]), "Dictionary points back"},
+		{"last one gone", cut(dicts[2], len(sections)-1), "trailer points"},
+	} {
+		err := new(Haystack).Disk2Mem(test.bad)
+		if !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: %v", test.what, err)
+		}
+		if _, err := DictionaryFingerprint(test.bad); test.what == "middle one gone" && !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: fingerprint: %v", test.what, err)
+		}
+	}
+}
+
+// A section bigger than max_section_size is refused before we decode it,
+// and bzip2 content doesn't get to decompress past its stated length
+func TestDisk2MemMaxSectionSize(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	data := testHaystackFile(t)
+	if err := new(Haystack).Disk2Mem(data); err != nil {
+		t.Fatal(err)
+	}
+
+	config.max_section_size = 100
+	err := new(Haystack).Disk2Mem(data)
+	if !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), "max_section_size") {
+		t.Errorf("max_section_size 100: %v", err)
+	}
+
+	config.compression_level = 9
+	bomb, codec, _, err := mem2DiskBzip2block(make([]byte, 4*1024*1024))
+	if err != nil || codec != codec_bzip2 {
+		t.Fatalf("codec %d: %v", codec, err)
+	}
+	if _, err := getDisk2MemBzip2block(bomb, 1000); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("%d bytes of bzip2 claiming 1000 uncompressed: %v", len(bomb), err)
+	}
+	if content, err := getDisk2MemBzip2block(bomb, 4*1024*1024); err != nil || len(content) != 4*1024*1024 {
+		t.Errorf("%d bytes: %v", len(content), err)
+	}
+}
+
+// Lengths from the file at and around the limits: an error, never a panic
+// or an allocation for what isn't there (also where int is 32 bits)
+func TestDisk2MemLengthBoundaries(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	config.max_section_size = max_section_size_upper
+
+	data := testHaystackFile(t)
+	hs := new(Haystack)
+	if err := hs.Disk2Mem(data); err != nil {
+		t.Fatal(err)
+	}
+	minor := hs.file_version_minor
+
+	first, err := getDisk2MemNextSection(data, 0, minor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ofs := first.next() // the first Dictionary
+	s, err := getDisk2MemNextSection(data, ofs, minor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	overhead := len(s.content) - s.com_len // GCM, or none
+	rest := len(data) - ofs - len(s.header)
+
+	for _, tt := range []struct {
+		name     string
+		com, unc uint32
+		err      error
+	}{
+		{"all of the rest", uint32(rest - overhead), uint32(rest - overhead), nil},
+		{"one past the end", uint32(rest - overhead + 1), uint32(rest - overhead + 1), ErrTruncated},
+		{"max_filesize", max_filesize, max_filesize, ErrTruncated},
+		{"past max_filesize", max_filesize + 1, max_filesize + 1, ErrCorrupt},
+		{"4G", 0xffffffff, 0xffffffff, ErrCorrupt},
+		{"com > unc", 100, 99, ErrCorrupt},
+		{"zero", 0, 0, ErrCorrupt},
+	} {
+		crafted := append([]byte(nil), data...)
+		binary.LittleEndian.PutUint32(crafted[ofs+4:], tt.unc)
+		binary.LittleEndian.PutUint32(crafted[ofs+8:], tt.com)
+
+		s, err := getDisk2MemNextSection(crafted, ofs, minor)
+		if !errors.Is(err, tt.err) || (err == nil && s.next() != len(crafted)) {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+
+	for _, o := range []int{-1, len(data), len(data) - min_DiskHeaderBaselen + 1, int(^uint(0) >> 1)} {
+		if _, err := getDisk2MemNextSection(data, o, minor); !errors.Is(err, ErrTruncated) {
+			t.Errorf("offset %d: %v", o, err)
+		}
+	}
+
+	// Counts and string lengths inside a section
+	dkey, _ := hs.Dict.KeyExists(Timestamp_key)
+	haybale := func(num uint32, stalk ...byte) []byte {
+		b := binary.LittleEndian.AppendUint32(nil, num)
+		b = append(b, make([]byte, 16)...) // time_first, time_last
+		return append(b, stalk...)
+	}
+	stalk := []byte{byte(dkey), byte(dkey >> 8), byte(dkey >> 16), valtype_string, 0, 0, 0, 0, 0, 0, 0, 0}
+	withDkey := func(dkey int) []byte { // and an empty string
+		b := append([]byte{byte(dkey), byte(dkey >> 8), byte(dkey >> 16)}, stalk[3:]...)
+		return binary.LittleEndian.AppendUint32(b, 0)
+	}
+	empty := 0 // a slot in the table, without a key
+	for hs.Dict.dkey[empty] != nil {
+		empty++
+	}
+	for _, tt := range []struct {
+		name    string
+		content []byte
+	}{
+		{"4G haystalks", haybale(0xffffffff)},
+		{"2 haystalks in 16 bytes", haybale(2, append(stalk, 0, 0, 0, 0)...)},
+		{"4G string", haybale(1, binary.LittleEndian.AppendUint32(stalk, 0xfffffffd)...)},
+		{"string one past the end", haybale(1, binary.LittleEndian.AppendUint32(append([]byte(nil), stalk...), 2)...)},
+		{"dkey not in the Dictionary", haybale(1, withDkey(empty)...)},
+		{"dkey outside the table", haybale(1, withDkey(len(hs.Dict.dkey))...)},
+	} {
+		if _, err := hs.getDisk2MemHaybaleContent(append(tt.content, 'x')); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+
+	if _, err := hs.getDisk2MemHaybaleIndex(binary.LittleEndian.AppendUint32(nil, 0xffffffff)); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("4G index entries: %v", err)
+	}
+	var v Val
+	if err := getIndexValFromData(bytes.NewReader(binary.LittleEndian.AppendUint32(nil, 0xffffffff)), valtype_string, &v); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("4G index string: %v", err)
+	}
+}
+
+// Progress goes up, and ends at the end
+func TestDisk2MemProgress(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	data := testHaystackFile(t)
+
+	var calls, last int
+	err := new(Haystack).Disk2MemProgress(data, func(bytesRead, total int) {
+		if total != len(data) {
+			t.Errorf("total %d, expected %d", total, len(data))
+		}
+		if bytesRead <= last {
+			t.Errorf("bytesRead %d after %d", bytesRead, last)
+		}
+		last = bytesRead
+		calls++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// header, trailer, and at least one dictionary + haybale
+	if calls < 4 || last != len(data) {
+		t.Errorf("%d calls, last at %d of %d bytes", calls, last, len(data))
+	}
+}
+
+// An empty Haybale writes fine, and reads back as nothing
+func TestDisk2MemEmptyHaybale(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+	want := hs.Info()
+
+	// One at the start, one in the middle, and one at the end
+	for _, i := range []int{0, 2, len(hs.Haybale) + 1} {
+		hs.Haybale = append(hs.Haybale[:i], append([]*Haybale{{HaystackPtr: hs}}, hs.Haybale[i:]...)...)
+	}
+
+	data, _, err := hs.Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hs.time_first != want.TimeFirst || hs.time_last != want.TimeLast {
+		t.Errorf("trailer times %d - %d, expected %d - %d", hs.time_first, hs.time_last, want.TimeFirst, want.TimeLast)
+	}
+
+	hs2 := new(Haystack)
+	if err := hs2.Disk2Mem(data); err != nil {
+		t.Fatal(err)
+	}
+
+	got := hs2.Info()
+	got.Memsize = want.Memsize
+	if got != want {
+		t.Errorf("read back:\n%v\nexpected\n%v", got, want)
+	}
+
+	if n := hs2.CountKeyValArray(map[string]string{"event_type": "flow"}); n == 0 {
+		t.Errorf("search found nothing")
+	}
+
+	// Only empty Haybales
+	hs3 := &Haystack{}
+	hs3.Haybale = []*Haybale{{HaystackPtr: hs3}}
+	if data, _, err = hs3.Mem2Disk(); err != nil {
+		t.Fatal(err)
+	}
+	hs4 := new(Haystack)
+	if err := hs4.Disk2Mem(data); err != nil {
+		t.Fatal(err)
+	}
+	if len(hs4.Haybale) != 0 || hs4.CountKeyValArray(map[string]string{"event_type": "flow"}) != 0 {
+		t.Errorf("expected nothing: %v", hs4.Info())
+	}
+}
+
+// Build a plaintext section around content, as it would be on disk
+func testSection(t *testing.T, content []byte, unc_len int, codec uint8) *diskSection {
+	data := make([]byte, 0, 64)
+	addMultibyteToData(&data, signature, 3)
+	addByteToData(&data, section_haybale)
+	addMultibyteToData(&data, uint64(unc_len), 4)
+	addMultibyteToData(&data, uint64(len(content)), 4)
+	addMultibyteToData(&data, uint64(crc32.ChecksumIEEE(content)), 4)
+
+	data, err := mem2DiskSectionContent(data, content, 0, codec, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := getDisk2MemNextSection(data, 0, version_minor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// Content that doesn't compress is stored as is, and read back without trying to decompress
+func TestStoredUncompressed(t *testing.T) {
+	setTestConfig(t)
+
+	random := make([]byte, 4096)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	// Looks like bzip2 (magic and block signature), but isn't
+	looks_bzip2 := append([]byte("BZh91AY&SY"), random[:100]...)
+
+	for _, content := range [][]byte{random, random[:1], looks_bzip2} {
+		stored, codec, level, err := mem2DiskBzip2block(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if codec != codec_none || level != 0 || !bytes.Equal(stored, content) {
+			t.Fatalf("%d bytes: codec %d, level %d, stored %d bytes", len(content), codec, level, len(stored))
+		}
+
+		// As written now, and as older files have it (codec not specified)
+		for _, codec := range []uint8{codec_none, codec_unspecified} {
+			s := testSection(t, stored, len(content), codec)
+
+			got, err := getDisk2MemSectionContent(s, "")
+			if err != nil {
+				t.Fatalf("%d bytes, codec %d: %v", len(content), codec, err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("%d bytes, codec %d: content differs", len(content), codec)
+			}
+		}
+	}
+
+	// Stored uncompressed, but the lengths differ
+	s := testSection(t, random[:100], 200, codec_none)
+	if _, err := getDisk2MemSectionContent(s, ""); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt, got %v", err)
+	}
+}
+
+// Sections say which codec and cipher they use, only older files
+// (not specified) have us work it out from the lengths and flags
+func TestSectionCodecCipher(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	// As we write them
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+	for _, encrypted := range []bool{true, false} {
+		config.encryption_disabled = !encrypted
+		data, _, err := hs.Mem2Disk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sections, err := ListSections(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, si := range sections {
+			if si.ID == section_header {
+				continue
+			}
+			ext := data[si.Offset+min_DiskHeaderBaselen:]
+			codec, cipher, level := ext[1], ext[2], ext[3]
+			if codec == codec_unspecified || cipher == cipher_unspecified ||
+				(cipher == cipher_aes256gcm) != encrypted || (codec == codec_bzip2) != (level == uint8(config.compression_level)) {
+				t.Errorf("encrypted=%v: %s section at %d has codec %d, cipher %d, level %d",
+					encrypted, si.Type(), si.Offset, codec, cipher, level)
+			}
+		}
+	}
+
+	// A plaintext section of content, stored as given, with the codec and
+	// cipher bytes as they are on disk
+	content := bytes.Repeat([]byte("haystack "), 100)
+	section := func(stored []byte, codec uint8, cipher uint8) []byte {
+		data := make([]byte, 0, 64)
+		addMultibyteToData(&data, signature, 3)
+		addByteToData(&data, section_haybale)
+		addMultibyteToData(&data, uint64(len(content)), 4)
+		addMultibyteToData(&data, uint64(len(stored)), 4)
+		addMultibyteToData(&data, uint64(crc32.ChecksumIEEE(content)), 4)
+		data, err := mem2DiskSectionContent(data, stored, 0, codec_none, 0, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[min_DiskHeaderBaselen+1] = codec
+		data[min_DiskHeaderBaselen+2] = cipher
+		return data
+	}
+	read := func(data []byte, file_version_minor uint8) ([]byte, error) {
+		s, err := getDisk2MemNextSection(data, 0, file_version_minor)
+		if err != nil {
+			return nil, err
+		}
+		return getDisk2MemSectionContent(s, "")
+	}
+
+	// bzip2: taken at its word, or worked out for older files
+	compressed, codec, _, err := mem2DiskBzip2block(content)
+	if err != nil || codec != codec_bzip2 {
+		t.Fatalf("codec %d: %v", codec, err)
+	}
+	for _, codec := range []uint8{codec_bzip2, codec_unspecified} {
+		if got, err := read(section(compressed, codec, cipher_none), version_minor); err != nil || !bytes.Equal(got, content) {
+			t.Errorf("codec %d: %v", codec, err)
+		}
+	}
+	// Said to be stored as is, so the lengths should have been the same
+	if _, err := read(section(compressed, codec_none, cipher_none), version_minor); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("bzip2 content, codec none: %v", err)
+	}
+
+	// Early 1.1: cipher not specified, the plaintext flag tells us
+	if got, err := read(section(content, codec_unspecified, cipher_unspecified), 1); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("cipher not specified, flagged plaintext: %v", err)
+	}
+
+	for _, tt := range []struct{ codec, cipher uint8 }{{codec_none, 9}, {9, cipher_none}} {
+		if _, err := read(section(content, tt.codec, tt.cipher), version_minor); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("codec %d, cipher %d: %v", tt.codec, tt.cipher, err)
+		}
+	}
+}
+
+// Pin down the byte order on disk: little-endian, everywhere
+func TestLittleEndian(t *testing.T) {
+	raw := []byte{0x78, 0x56, 0x34, 0x12, 0xef, 0xcd, 0xab, 0x90}
+
+	r := bytes.NewReader(raw)
+	if v := getUintFromData(r, 4); v != 0x12345678 {
+		t.Errorf("uint32 read as 0x%x", v)
+	}
+	if v := getUintFromData(bytes.NewReader(raw), 8); v != 0x90abcdef12345678 {
+		t.Errorf("uint64 read as 0x%x", v)
+	}
+
+	buf := make([]byte, 0, 8)
+	addMultibyteToData(&buf, 0x90abcdef12345678, 8)
+	if !bytes.Equal(buf, raw) {
+		t.Errorf("uint64 written as % x", buf)
+	}
+
+	// 1.5 is 0x3ff8000000000000
+	buf = buf[:0]
+	addMultibyteToData(&buf, 0x3ff8000000000000, 8)
+	if !bytes.Equal(buf, []byte{0, 0, 0, 0, 0, 0, 0xf8, 0x3f}) {
+		t.Errorf("float bits written as % x", buf)
+	}
+	if f := getFloatFromData(bytes.NewReader(buf), 8); f != 1.5 {
+		t.Errorf("float read as %v", f)
+	}
+
+	// The signature as it's on disk, and big-endian
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	data := testHaystackFile(t)
+	if !bytes.Equal(data[:3], []byte{0xda, 0xfe, 0xeb}) {
+		t.Errorf("signature on disk: % x", data[:3])
+	}
+	data[0], data[2] = data[2], data[0]
+	if err := new(Haystack).Disk2Mem(data); !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), "big-endian") {
+		t.Errorf("big-endian signature: %v", err)
+	}
+}
+
+// The dkeys are where the writer's table had them, whatever size ours is
+func TestDisk2MemTableSize(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	hs := testEveHaystack(t, 300, 100)
+	data, _, err := hs.Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := map[string]string{"event_type": "flow", "proto": "UDP"}
+	want := hs.CountKeyValArray(kv)
+	keys := strings.Join(hs.Dict.AllKeys(), " ")
+
+	for _, bits := range []uint32{8, 16, 24} {
+		config.dict_table_bits = bits
+
+		hs2 := new(Haystack)
+		if err := hs2.Disk2Mem(data); err != nil {
+			t.Fatalf("reading with %d bits: %v", bits, err)
+		}
+		if hs2.Dict.bits != 10 || strings.Join(hs2.Dict.AllKeys(), " ") != keys {
+			t.Errorf("reading with %d bits: %d-bit table, keys %v", bits, hs2.Dict.bits, hs2.Dict.AllKeys())
+		}
+		if n := hs2.CountKeyValArray(kv); n != want || want == 0 {
+			t.Errorf("reading with %d bits: %d matches, %d written", bits, n, want)
+		}
+
+		// And it carries on in that size
+		if _, err := hs2.Dict.FindOrAddKeyhash("new.key"); err != nil || hs2.Dict.bits != 10 {
+			t.Errorf("reading with %d bits, adding a key: %v", bits, err)
+		}
+	}
+
+	// Files from before the size was stored (0) are 24 bits
+	config.dict_table_bits = 10
+	var d24 Dictionary
+	if err := d24.initTable(hashtable_bits_max); err != nil {
+		t.Fatal(err)
+	}
+	key := "legacy.key"
+	dkey := d24.findKeyhash(key)
+	var content []byte
+	addMultibyteToData(&content, 0, 4) // prev_ofs
+	addMultibyteToData(&content, 1, 3) // num_dkeys
+	addByteToData(&content, 0)         // bits
+	if err := addKeyToData(&content, dkey, &key); err != nil {
+		t.Fatal(err)
+	}
+	hs3 := new(Haystack)
+	if err := hs3.getDisk2MemDictionary(content, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, found := hs3.Dict.KeyExists(key); !found || got != dkey || hs3.Dict.bits != hashtable_bits_max {
+		t.Errorf("older file: %s at %d (found %v), want %d; %d-bit table", key, got, found, dkey, hs3.Dict.bits)
+	}
+}
+
+// Key not in the keystore, or a different key under the same uuid
+func TestDisk2MemWrongKey(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	data := testHaystackFile(t)
+
+	config.aes_keystore_array = map[string][]byte{"0b4f1d2c-55a1-4c8e-9d3a-2e6f7a8b9c0d": make([]byte, AES_key_byte_len)}
+	if err := new(Haystack).Disk2Mem(data); !errors.Is(err, ErrWrongKey) || errors.Is(err, ErrCorrupt) {
+		t.Errorf("unknown key: %v", err)
+	}
+
+	other := make([]byte, AES_key_byte_len)
+	other[0] = 1
+	config.aes_keystore_array = map[string][]byte{test_aes_uuid: other}
+	if err := new(Haystack).Disk2Mem(data); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("different key: %v", err)
+	}
+}
+
+// A plaintext Haybale spliced into an encrypted file doesn't get loaded
+func TestDisk2MemPlaintextSplice(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+	encrypted, _, err := hs.Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.encryption_disabled = true
+	plain, _, err := hs.Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	haybale := func(data []byte) (int, int) {
+		sections, err := ListSections(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, s := range sections {
+			if s.ID == section_haybale {
+				return s.Offset, sections[i+1].Offset
+			}
+		}
+		t.Fatal("no Haybale section")
+		return 0, 0
+	}
+	enc_start, enc_end := haybale(encrypted)
+	plain_start, plain_end := haybale(plain)
+
+	spliced := append([]byte(nil), encrypted[:enc_start]...)
+	spliced = append(spliced, plain[plain_start:plain_end]...)
+	spliced = append(spliced, encrypted[enc_end:]...)
+
+	// Without the file MAC to catch it first, too
+	if err := new(Haystack).getDisk2MemSections(spliced, nil); !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), "not encrypted") {
+		t.Errorf("sections: %v", err)
+	}
+	if err := new(Haystack).Disk2Mem(spliced); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Disk2Mem: %v", err)
+	}
+
+	// A plaintext file is still fine
+	if err := new(Haystack).Disk2Mem(plain); err != nil {
+		t.Errorf("plaintext file: %v", err)
+	}
+}
+
+func TestUnknownVersion(t *testing.T) {
+	for _, v := range [][2]byte{{version_major + 1, 0}, {version_major, version_minor + 1}, {0, 9}} {
+		content := append([]byte{v[0], v[1]}, make([]byte, 32)...)
+		if _, err := getDisk2MemHeaderContent(content); !errors.Is(err, ErrUnknownVersion) {
+			t.Errorf("version %d.%d: %v", v[0], v[1], err)
+		}
+	}
+}
+
+// EOF
@@ -0,0 +1,294 @@
+// OpenActa/Haystack - compact Haybale layout
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	On disk, a Haybale is normally written the way it is in memory: sorted
+	stalks, each with its dkey, value type, and the offsets that chain it
+	into its bunch. That's 12 bytes per stalk before we even get to the
+	value, and a log from one source has the same keys in every record.
+
+	With config compact_bunches, Haybales are written bunch by bunch
+	instead. The key set of a bunch (dkeys and value types, in bunch
+	order) is its schema, each schema is stored once, and then each bunch
+	is just its schema number and its values. A string that's the same as
+	in the previous bunch with that key is a len_dup, like adjacent ones
+	in the normal layout.
+
+	The chain offsets follow from the bunch order, so the loader puts the
+	stalks back together and sorts the Haybale again. Stalks with the
+	same key and value end up in _timestamp order, which may not be the
+	order they had before (sorting doesn't care), so neither is the order
+	of matches that only differ there.
+
+	The section gets section_flag_compact, and the file is version 1.4,
+	so older versions of Haystack refuse it rather than misread it.
+*/
+
+package haystack
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Key set of the bunch starting at first, as it goes on disk
+func (p *Haybale) bunchSchema(first uint32) string {
+	var b []byte
+
+	for k := first; k != haystalk_ofs_nil; k = p.haystalk[k].next_ofs {
+		addMultibyteToData(&b, uint64(p.haystalk[k].dkey), 3)
+		addByteToData(&b, p.haystalk[k].val.valtype)
+	}
+
+	return string(b)
+}
+
+// Write the Haybale content to w in the compact layout. Same bytes every time.
+func (p *Haybale) mem2DiskCompactContent(w io.Writer) error {
+	var content = make([]byte, 0, 16384)
+
+	addMultibyteToData(&content, uint64(p.num_haystalks), 4)
+
+	addMultibyteToData(&content, uint64(p.time_first), 8)
+	addMultibyteToData(&content, uint64(p.time_last), 8)
+
+	// Schemas, numbered as we first come across them
+	schema_num := make(map[string]uint32)
+	var schemas []string
+	var num_bunches uint32
+	for i := uint32(0); i < p.num_haystalks; i++ {
+		if p.haystalk[i].first_ofs != i {
+			continue // not the start of a bunch
+		}
+		num_bunches++
+
+		schema := p.bunchSchema(i)
+		if _, ok := schema_num[schema]; !ok {
+			schema_num[schema] = uint32(len(schemas))
+			schemas = append(schemas, schema)
+		}
+	}
+
+	addMultibyteToData(&content, uint64(len(schemas)), 4)
+	for _, schema := range schemas {
+		addMultibyteToData(&content, uint64(len(schema)/4), 4)
+		content = append(content, schema...)
+	}
+
+	// Then the bunches, sorted means by _timestamp
+	addMultibyteToData(&content, uint64(num_bunches), 4)
+	prev_string := make(map[uint32]*string) // by dkey
+	for i := uint32(0); i < p.num_haystalks; i++ {
+		if p.haystalk[i].first_ofs != i {
+			continue
+		}
+
+		addMultibyteToData(&content, uint64(schema_num[p.bunchSchema(i)]), 4)
+
+		for k := i; k != haystalk_ofs_nil; k = p.haystalk[k].next_ofs {
+			stalk := p.haystalk[k]
+
+			switch stalk.val.valtype {
+			case valtype_int, valtype_time:
+				addMultibyteToData(&content, uint64(stalk.val.intval), 8)
+
+			case valtype_float:
+				addMultibyteToData(&content, math.Float64bits(stalk.val.floatval), 8)
+
+			case valtype_string:
+				if prev := prev_string[stalk.dkey]; prev != nil && *stalk.val.stringval == *prev {
+					addMultibyteToData(&content, uint64(len_dup), 4)
+				} else {
+					prev_string[stalk.dkey] = stalk.val.stringval
+					addStringToData(&content, *stalk.val.stringval)
+				}
+			}
+		}
+
+		// Pass it on when we have a decent chunk
+		if len(content) >= 16384 {
+			if _, err := w.Write(content); err != nil {
+				return err
+			}
+			content = content[:0]
+		}
+	}
+
+	_, err := w.Write(content)
+	return err
+}
+
+// Decode Haybale content, in whichever layout the section flags say
+func (p *Haystack) getDisk2MemHaybaleLayout(content []byte, flags uint8) (*Haybale, error) {
+	if flags&section_flag_compact != 0 {
+		return p.getDisk2MemCompactHaybaleContent(content)
+	}
+
+	return p.getDisk2MemHaybaleContent(content)
+}
+
+type compactSchemaKey struct {
+	dkey    uint32
+	valtype uint8
+}
+
+// Decode compact Haybale content into a new (sorted, immutable) Haybale
+func (p *Haystack) getDisk2MemCompactHaybaleContent(content []byte) (*Haybale, error) {
+	var new_hb Haybale
+
+	reader := bytes.NewReader(content)
+
+	if reader.Len() < min_DiskHaybaleHeaderLen+8 {
+		return nil, fmt.Errorf("%w: compact haybale section too short, missing fields", ErrCorrupt)
+	}
+
+	read_num_haystalks := getUintFromData(reader, 4)
+
+	new_hb.time_first = int64(getUintFromData(reader, 8))
+	new_hb.time_last = int64(getUintFromData(reader, 8))
+
+	// Before we allocate for them: they have to fit in what's left
+	if read_num_haystalks > uint64(reader.Len()/min_DiskCompactValueLen) {
+		return nil, fmt.Errorf("%w: haybale says %d haystalks, in %d bytes", ErrCorrupt, read_num_haystalks, reader.Len())
+	}
+
+	read_num_schemas := getUintFromData(reader, 4)
+	if read_num_schemas > uint64(reader.Len()/8) { // a key and its count, at least
+		return nil, fmt.Errorf("%w: haybale says %d schemas, in %d bytes", ErrCorrupt, read_num_schemas, reader.Len())
+	}
+
+	schemas := make([][]compactSchemaKey, read_num_schemas)
+	for i := range schemas {
+		if reader.Len() < 4 {
+			return nil, fmt.Errorf("%w: unexpected end of haybale in schema %d", ErrCorrupt, i)
+		}
+		read_num_keys := getUintFromData(reader, 4)
+		if read_num_keys == 0 || read_num_keys > uint64(reader.Len()/4) || read_num_keys > read_num_haystalks {
+			return nil, fmt.Errorf("%w: schema %d says %d keys, in %d bytes", ErrCorrupt, i, read_num_keys, reader.Len())
+		}
+
+		schemas[i] = make([]compactSchemaKey, read_num_keys)
+		for j := range schemas[i] {
+			key := &schemas[i][j]
+			key.dkey = uint32(getUintFromData(reader, 3))
+			if int(key.dkey) >= len(p.Dict.dkey) || p.Dict.dkey[key.dkey] == nil {
+				return nil, fmt.Errorf("%w: schema %d has dkey %d, not in the Dictionary", ErrCorrupt, i, key.dkey)
+			}
+			key.valtype = uint8(getUintFromData(reader, 1))
+			switch key.valtype {
+			case valtype_int, valtype_float, valtype_string, valtype_time:
+			default:
+				return nil, fmt.Errorf("%w: unknown value type %d in schema %d", ErrCorrupt, key.valtype, i)
+			}
+		}
+	}
+
+	if reader.Len() < 4 {
+		return nil, fmt.Errorf("%w: compact haybale section too short, missing fields", ErrCorrupt)
+	}
+	read_num_bunches := getUintFromData(reader, 4)
+	if read_num_bunches > read_num_haystalks {
+		return nil, fmt.Errorf("%w: haybale says %d bunches, and %d haystalks", ErrCorrupt, read_num_bunches, read_num_haystalks)
+	}
+
+	new_hb.haystalk = make([]*Haystalk, 0, int(read_num_haystalks))
+	prev_string := make(map[uint32]*string) // by dkey
+	for b := uint64(0); b < read_num_bunches; b++ {
+		if reader.Len() < 4 {
+			return nil, fmt.Errorf("%w: unexpected end of haybale at bunch %d", ErrCorrupt, b)
+		}
+		read_schema := getUintFromData(reader, 4)
+		if read_schema >= read_num_schemas {
+			return nil, fmt.Errorf("%w: bunch %d has schema %d, of %d", ErrCorrupt, b, read_schema, read_num_schemas)
+		}
+		schema := schemas[read_schema]
+
+		first := uint32(len(new_hb.haystalk))
+		if uint64(first)+uint64(len(schema)) > read_num_haystalks {
+			return nil, fmt.Errorf("%w: more than the %d haystalks the haybale says", ErrCorrupt, read_num_haystalks)
+		}
+
+		for j, key := range schema {
+			self := first + uint32(j)
+			newstalk := &Haystalk{dkey: key.dkey, self_ofs: self, first_ofs: first, next_ofs: self + 1}
+			if j == len(schema)-1 {
+				newstalk.next_ofs = haystalk_ofs_nil
+			}
+
+			if key.valtype == valtype_string {
+				if reader.Len() < 4 {
+					return nil, fmt.Errorf("%w: unexpected end of haybale at bunch %d", ErrCorrupt, b)
+				}
+				read_len := uint32(getUintFromData(reader, 4))
+				if read_len == len_dup {
+					if prev_string[key.dkey] == nil {
+						return nil, fmt.Errorf("%w: de-dupped string indicated but not present", ErrCorrupt)
+					}
+					newstalk.val.SetString(prev_string[key.dkey])
+				} else {
+					if uint64(read_len) > uint64(reader.Len()) { // before we allocate for it
+						return nil, fmt.Errorf("%w: string of %d bytes, %d left in Haybale", ErrCorrupt, read_len, reader.Len())
+					}
+					s := getStringFromData(reader, int(read_len))
+					newstalk.val.SetString(s)
+					prev_string[key.dkey] = s
+					new_hb.Memsize += uint32(2 + len(*s))
+				}
+			} else {
+				if reader.Len() < 8 {
+					return nil, fmt.Errorf("%w: unexpected end of haybale at bunch %d", ErrCorrupt, b)
+				}
+				switch key.valtype {
+				case valtype_int:
+					newstalk.val.SetInt(int64(getUintFromData(reader, 8)))
+				case valtype_float:
+					newstalk.val.SetFloat(getFloatFromData(reader, 8))
+				case valtype_time:
+					newstalk.val.SetTime(int64(getUintFromData(reader, 8)))
+				}
+			}
+
+			new_hb.Memsize += 37 // Haystalk struct, approx
+			new_hb.haystalk = append(new_hb.haystalk, newstalk)
+		}
+	}
+
+	if uint64(len(new_hb.haystalk)) != read_num_haystalks {
+		return nil, fmt.Errorf("%w: haybale says %d haystalks, bunches have %d", ErrCorrupt, read_num_haystalks, len(new_hb.haystalk))
+	}
+	new_hb.num_haystalks = uint32(read_num_haystalks)
+	new_hb.HaystackPtr = p
+
+	// Back in order. Ties by bunch order, so it's the same every time.
+	new_hb.sortStalksBy(func(s1, s2 *Haystalk) bool {
+		if c := s1.Compare(*s2); c != 0 {
+			return c < 0
+		}
+		return s1.self_ofs < s2.self_ofs
+	})
+	for i := uint32(0); i < new_hb.num_haystalks; i++ {
+		new_hb.haystalk[i].self_ofs = i
+	}
+
+	new_hb.is_sorted_immutable = true
+
+	return &new_hb, nil
+}
+
+// EOF
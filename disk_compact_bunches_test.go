@@ -0,0 +1,210 @@
+// OpenActa/Haystack - compact Haybale layout - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompactBunches(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	hs := testEveHaystack(t, 1000, 250)
+	kv := map[string]string{"event_type": "flow"}
+
+	plain, _, err := hs.Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.compact_bunches = true
+	data, _, err := hs.Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sections, err := ListSections(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, si := range sections {
+		s, err := getDisk2MemNextSection(data, si.Offset, version_minor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (s.flags&section_flag_compact != 0) != (s.id == section_haybale) {
+			t.Errorf("%s section at %d has flags %#x", si.Type(), si.Offset, s.flags)
+		}
+	}
+
+	// Reads back the same
+	hs2 := new(Haystack)
+	if err := hs2.Disk2Mem(data); err != nil {
+		t.Fatal(err)
+	}
+	if hs2.file_version_minor != version_minor_compact {
+		t.Errorf("version 1.%d", hs2.file_version_minor)
+	}
+	if ok, diff := hs.Equal(hs2); !ok {
+		t.Errorf("not the same after a round trip: %s", diff)
+	}
+	if want, n := hs.CountKeyValArray(kv), hs2.CountKeyValArray(kv); n != want || want == 0 {
+		t.Errorf("%d matches, %d before", n, want)
+	}
+
+	for i, hb := range hs2.Haybale {
+		orig := hs.Haybale[i]
+		if hb.time_first != orig.time_first || hb.time_last != orig.time_last || hb.num_haystalks != orig.num_haystalks {
+			t.Errorf("Haybale %d: %d stalks %d - %d, was %d stalks %d - %d", i,
+				hb.num_haystalks, hb.time_first, hb.time_last, orig.num_haystalks, orig.time_first, orig.time_last)
+		}
+		for k := uint32(1); k < hb.num_haystalks; k++ {
+			if hb.haystalk[k-1].Compare(*hb.haystalk[k]) > 0 {
+				t.Fatalf("Haybale %d not sorted at stalk %d", i, k)
+			}
+		}
+
+		// Same bunch order, so written back it's the same bytes. Smaller, too.
+		var compact, again, row bytes.Buffer
+		orig.mem2DiskCompactContent(&compact)
+		hb.mem2DiskCompactContent(&again)
+		hb.mem2DiskContent(&row)
+		if !bytes.Equal(compact.Bytes(), again.Bytes()) {
+			t.Errorf("Haybale %d: written back differently", i)
+		}
+		if compact.Len() >= row.Len() {
+			t.Errorf("Haybale %d: %d bytes compact, %d as rows", i, compact.Len(), row.Len())
+		}
+	}
+
+	// Memory-mapped, decoded the same way
+	path := filepath.Join(t.TempDir(), "compact.hs")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := OpenMapped(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	for i := 0; i < m.NumHaybales(); i++ {
+		hb, err := m.getBale(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hb.num_haystalks != hs2.Haybale[i].num_haystalks {
+			t.Errorf("mapped Haybale %d has %d stalks, not %d", i, hb.num_haystalks, hs2.Haybale[i].num_haystalks)
+		}
+	}
+
+	// Off again: the row layout, as before
+	hs3 := new(Haystack)
+	if err := hs3.Disk2Mem(plain); err != nil || hs3.file_version_minor != version_minor_plain {
+		t.Errorf("row layout: version 1.%d: %v", hs3.file_version_minor, err)
+	}
+}
+
+// Broken compact content is an error, not a panic or a short Haybale
+func TestCompactBunchesCorrupt(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	hs := testEveHaystack(t, 50, 50)
+	hb := hs.Haybale[0]
+	hb.SortBale()
+
+	var buf bytes.Buffer
+	if err := hb.mem2DiskCompactContent(&buf); err != nil {
+		t.Fatal(err)
+	}
+	content := buf.Bytes()
+
+	if _, err := hs.getDisk2MemCompactHaybaleContent(content); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []int{0, 10, min_DiskHaybaleHeaderLen + 6, len(content) / 2, len(content) - 1} {
+		if _, err := hs.getDisk2MemCompactHaybaleContent(content[:n]); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("cut at %d bytes: %v", n, err)
+		}
+	}
+
+	// First schema: a dkey that's not in the Dictionary, then an unknown value type
+	bad := append([]byte(nil), content...)
+	copy(bad[min_DiskHaybaleHeaderLen+8:], []byte{0xff, 0xff, 0xff})
+	if _, err := hs.getDisk2MemCompactHaybaleContent(bad); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("unknown dkey: %v", err)
+	}
+	bad = append(bad[:0], content...)
+	bad[min_DiskHaybaleHeaderLen+11] = 9
+	if _, err := hs.getDisk2MemCompactHaybaleContent(bad); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("unknown value type: %v", err)
+	}
+}
+
+// How much smaller the compact layout is, for Suricata eve.json
+func BenchmarkCompactBunches(b *testing.B) {
+	saved := config
+	b.Cleanup(func() { config = saved })
+	config.aes_keystore_array = map[string][]byte{test_aes_uuid: make([]byte, AES_key_byte_len)}
+	config.aes_keystore_current_uuid = test_aes_uuid
+	config.compression_level = 9
+	config.dict_table_bits = 10
+
+	hs := testEveHaystack(b, 8000, 1000)
+
+	for _, compact := range []bool{false, true} {
+		name := "rows"
+		if compact {
+			name = "compact"
+		}
+		b.Run(name, func(b *testing.B) {
+			config.compact_bunches = compact
+
+			var file_len int
+			for i := 0; i < b.N; i++ {
+				data, _, err := hs.Mem2Disk()
+				if err != nil {
+					b.Fatal(err)
+				}
+				file_len = len(data)
+			}
+
+			var content_len int
+			for _, hb := range hs.Haybale {
+				cw := newCRCWriter(&bytes.Buffer{})
+				if compact {
+					hb.mem2DiskCompactContent(cw)
+				} else {
+					hb.mem2DiskContent(cw)
+				}
+				content_len += cw.n
+			}
+
+			b.ReportMetric(float64(content_len), "content-bytes")
+			b.ReportMetric(float64(file_len), "file-bytes")
+		})
+	}
+}
+
+// EOF
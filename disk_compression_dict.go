@@ -0,0 +1,161 @@
+// OpenActa/Haystack - shared compression dictionary
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	Every Haybale section is compressed on its own, so each one starts
+	from scratch: the hostnames, event types and paths that are in every
+	Haybale get learnt again every time. For small Haybales that's most
+	of what's in them.
+
+	With config compression_dict_size, Mem2Disk() first picks the string
+	values that repeat most across the whole Haystack, and puts them in a
+	compression dictionary section, right after the file header. Haybale
+	(and index) sections are then compressed with DEFLATE, with that as
+	its preset dictionary (codec_deflate_dict): a value seen in the
+	dictionary is a back reference from the very first record.
+
+	DEFLATE looks back at most 32K, so that's the most a dictionary can
+	be. The most useful strings go at the end, closest to the content.
+
+	Dictionaries are always bzip2 as before, they only have key names.
+	Files with a compression dictionary are version 1.3, older versions
+	of Haystack refuse them rather than fail on the codec. Files without
+	one are written as 1.2, same as they always were.
+
+	Only Mem2Disk() trains one, it needs the whole Haystack to look at.
+	The streaming and rollover writers don't.
+*/
+
+package haystack
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	compression_dict_size_lower = 1024
+	compression_dict_size_upper = 32 * 1024 // DEFLATE window
+
+	compression_dict_minlen   = 4     // shorter strings aren't worth a dictionary entry
+	compression_dict_maxlen   = 256   // longer ones are likely one-offs (messages)
+	compression_dict_maxcands = 65536 // distinct strings we count, bounds the RAM for it
+)
+
+// Pick the string values that repeat most, up to size bytes in all.
+// Same Haystack, same dictionary. nil if nothing repeats.
+func (p *Haystack) trainCompressionDict(size int) []byte {
+	counts := make(map[string]int)
+	for _, hb := range p.Haybale {
+		for n := uint32(0); n < hb.num_haystalks; n++ {
+			v := &hb.haystalk[n].val
+			if v.valtype != valtype_string || len(*v.stringval) < compression_dict_minlen || len(*v.stringval) > compression_dict_maxlen {
+				continue
+			}
+			if _, ok := counts[*v.stringval]; ok || len(counts) < compression_dict_maxcands {
+				counts[*v.stringval]++
+			}
+		}
+	}
+
+	// What a string saves is about its length, for every time after the first
+	type cand struct {
+		s     string
+		score int
+	}
+	cands := make([]cand, 0, len(counts))
+	for s, n := range counts {
+		if n > 1 {
+			cands = append(cands, cand{s, (n - 1) * len(s)})
+		}
+	}
+	sort.Slice(cands, func(i, j int) bool {
+		if cands[i].score != cands[j].score {
+			return cands[i].score > cands[j].score
+		}
+		return cands[i].s < cands[j].s
+	})
+
+	var picked []string
+	var total int
+	for _, c := range cands {
+		if total+len(c.s) > size {
+			continue
+		}
+		picked = append(picked, c.s)
+		total += len(c.s)
+	}
+	if total == 0 {
+		return nil
+	}
+
+	// Best last
+	dict := make([]byte, 0, total)
+	for i := len(picked) - 1; i >= 0; i-- {
+		dict = append(dict, picked[i]...)
+	}
+
+	return dict
+}
+
+// The compression dictionary section, ready to write
+func mem2DiskCompressionDict(dict []byte, aes_key_uuid string) ([]byte, error) {
+	s, err := mem2DiskStreamSection(section_compression_dict, func(w io.Writer) error {
+		_, err := w.Write(dict)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.finish(aes_key_uuid)
+}
+
+// Compression dictionary section content, as read
+func getDisk2MemCompressionDict(content []byte) ([]byte, error) {
+	if len(content) > compression_dict_size_upper {
+		return nil, fmt.Errorf("%w: compression dictionary of %d bytes, max is %d", ErrCorrupt, len(content), compression_dict_size_upper)
+	}
+
+	return append([]byte(nil), content...), nil // ours, content may be in a mapped file
+}
+
+// Process DEFLATE content compressed with dictionary dict, that should
+// decompress to unc_len bytes
+func getDisk2MemDeflateDict(data []byte, dict []byte, unc_len int) ([]byte, error) {
+	if dict == nil {
+		return nil, fmt.Errorf("%w: section uses a compression dictionary, but the file has none", ErrCorrupt)
+	}
+
+	reader := flate.NewReaderDict(bytes.NewReader(data), dict)
+	defer reader.Close()
+
+	buf, err := io.ReadAll(io.LimitReader(reader, int64(unc_len)+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: error decompressing deflate: %v", ErrCorrupt, err)
+	}
+	if len(buf) > unc_len {
+		return nil, fmt.Errorf("%w: deflate content decompresses to more than %d bytes", ErrCorrupt, unc_len)
+	}
+
+	return buf, nil
+}
+
+// EOF
@@ -0,0 +1,167 @@
+// OpenActa/Haystack - shared compression dictionary - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompressionDict(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	config.index_keys = []string{"dest_port"}
+	kv := map[string]string{"event_type": "flow", "proto": "UDP"}
+
+	// Lots of small Haybales, where it helps most
+	hs := testEveHaystack(t, 600, 20)
+	plain, _, err := hs.Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, encrypted := range []bool{true, false} {
+		config.encryption_disabled = !encrypted
+
+		config.compression_dict_size = compression_dict_size_upper
+		data, _, err := hs.Mem2Disk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hs.compression_dict) == 0 || len(hs.compression_dict) > compression_dict_size_upper {
+			t.Fatalf("dictionary of %d bytes", len(hs.compression_dict))
+		}
+		if encrypted && len(data) >= len(plain) {
+			t.Errorf("%d bytes, %d without dictionary", len(data), len(plain))
+		}
+
+		// Header, dictionary, then the rest uses it
+		sections, err := ListSections(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sections[1].ID != section_compression_dict || sections[1].Type() != "compression dict" {
+			t.Fatalf("second section is %s", sections[1].Type())
+		}
+		for _, s := range sections {
+			if (s.ID == section_haybale || s.ID == section_haybale_index) && s.Codec != codec_deflate_dict && s.Codec != codec_none {
+				t.Errorf("%s section at %d is %s", s.Type(), s.Offset, s.CodecString())
+			}
+		}
+		if err := VerifySectionCRCs(data); err != nil {
+			t.Error(err)
+		}
+		if _, meta, err := DumpSection(data, 3); err != nil || !meta.CRCOk || meta.ID != section_haybale {
+			t.Errorf("dump %s section: %v", meta.Type(), err)
+		}
+
+		// Reads back the same, all the ways we read
+		hs2 := new(Haystack)
+		if err := hs2.Disk2Mem(data); err != nil {
+			t.Fatal(err)
+		}
+		if hs2.file_version_minor != version_minor_dict || !bytes.Equal(hs2.compression_dict, hs.compression_dict) {
+			t.Errorf("version 1.%d, dictionary %d bytes", hs2.file_version_minor, len(hs2.compression_dict))
+		}
+		want := hs.CountKeyValArray(kv)
+		if n := hs2.CountKeyValArray(kv); n != want || want == 0 {
+			t.Errorf("encrypted %v: %d matches, %d before", encrypted, n, want)
+		}
+
+		path := filepath.Join(t.TempDir(), "dict.hs")
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		m, err := OpenMapped(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		num_bales := m.NumHaybales()
+		var stalks, mapped_stalks uint32
+		for i := 0; i < num_bales; i++ {
+			hb, err := m.getBale(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mapped_stalks += hb.num_haystalks
+			stalks += hs2.Haybale[i].num_haystalks
+		}
+		m.Close()
+		if num_bales != len(hs2.Haybale) || mapped_stalks != stalks {
+			t.Errorf("mapped: %d Haybales, %d stalks; loaded %d, %d", num_bales, mapped_stalks, len(hs2.Haybale), stalks)
+		}
+	}
+
+	// Same Haystack, same dictionary (it doesn't depend on map order)
+	config.compression_dict_size = 4096
+	hs.Mem2Disk()
+	dict := hs.compression_dict
+	hs.Mem2Disk()
+	if !bytes.Equal(dict, hs.compression_dict) || len(dict) > 4096 {
+		t.Errorf("dictionary changed, or %d bytes", len(dict))
+	}
+
+	// Without: a 1.2 file, same as before
+	hs2 := new(Haystack)
+	if err := hs2.Disk2Mem(plain); err != nil || hs2.file_version_minor != version_minor_plain || hs2.compression_dict != nil {
+		t.Errorf("without dictionary: version 1.%d: %v", hs2.file_version_minor, err)
+	}
+
+	if _, err := getDisk2MemDeflateDict([]byte{1, 2, 3}, nil, 10); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("deflate without a dictionary: %v", err)
+	}
+	if _, err := getDisk2MemCompressionDict(make([]byte, compression_dict_size_upper+1)); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("dictionary too big: %v", err)
+	}
+}
+
+// Most repeated strings make it, one-offs and short ones don't
+func TestTrainCompressionDict(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	var hs Haystack
+	hb := &Haybale{HaystackPtr: &hs}
+	hs.Haybale = append(hs.Haybale, hb)
+	for i, rec := range []map[string]interface{}{
+		{"host": "web01.example.com", "msg": "once only", "x": "abc"},
+		{"host": "web01.example.com", "msg": "GET /index.html", "x": "abc"},
+		{"host": "db01.example.com", "msg": "GET /index.html", "x": "abc"},
+	} {
+		rec[Timestamp_key] = "2023-06-04T00:00:0" + string(rune('0'+i)) + "Z"
+		if err := hb.InsertBunch(&hs.Dict, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dict := string(hs.trainCompressionDict(1024))
+	if dict != "GET /index.html"+"web01.example.com" { // best last
+		t.Errorf("dictionary '%s'", dict)
+	}
+	if dict := string(hs.trainCompressionDict(20)); dict != "web01.example.com" {
+		t.Errorf("20 bytes: '%s'", dict)
+	}
+	if dict := hs.trainCompressionDict(5); dict != nil {
+		t.Errorf("5 bytes: '%s'", dict)
+	}
+}
+
+// EOF
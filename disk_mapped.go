@@ -0,0 +1,321 @@
+// OpenActa/Haystack - memory-mapped (lazy loading) Haystack access
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	Disk2Mem decrypts and decompresses an entire Haystack file in one go,
+	so we need RAM for all of it. For large archives on small nodes, that
+	doesn't work. Here we mmap the file instead, and only load the (small)
+	Dictionaries up front. Haybale sections are decrypted and decompressed
+	when a search first needs them, and kept in a small LRU cache
+	(config mapped_cache_bales) so memory use stays bounded.
+*/
+
+package haystack
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+const mapped_cache_bales_default = 4
+
+type MappedHaystack struct {
+	hs Haystack // Dictionary and AES key uuid; Haybales are not kept in here
+
+	data  []byte         // mmapped file
+	bales []*diskSection // Haybale sections, not yet decoded
+	index []baleIndex    // their index (nil if none), decoded up front
+
+	mutex     sync.Mutex            // protects data, bales and index (Close()), and the cache below
+	cache     *list.List            // LRU list of *mappedBale, most recent at front
+	cache_map map[int]*list.Element // Haybale # -> element in LRU list
+}
+
+type mappedBale struct {
+	n  int // Haybale # (index in bales)
+	hb *Haybale
+}
+
+// Open a Haystack file read-only, without loading its Haybales
+func OpenMapped(path string) (*MappedHaystack, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close() // the mapping remains valid after close
+
+	st, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// First check some general file stuff
+	if st.Size() < min_filesize {
+		return nil, fmt.Errorf("dataset too short, not a Haystack?")
+	}
+
+	if st.Size() > max_filesize {
+		return nil, fmt.Errorf("dataset too long, not a Haystack?")
+	}
+
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(st.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("mmap of '%s': %w", path, err)
+	}
+
+	m := &MappedHaystack{
+		data:      data,
+		cache:     list.New(),
+		cache_map: make(map[int]*list.Element),
+	}
+
+	// This reads through all of the file once, but doesn't keep any of it
+	if err := verifyFileMAC(m.data); err != nil {
+		m.Close()
+		return nil, err
+	}
+
+	if err := m.getMappedSections(); err != nil {
+		m.Close()
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Release the file mapping. The MappedHaystack can't be used after this.
+func (m *MappedHaystack) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.cache.Init()
+	m.cache_map = make(map[int]*list.Element)
+	m.bales = nil
+	m.index = nil
+
+	if m.data == nil {
+		return nil
+	}
+
+	err := syscall.Munmap(m.data)
+	m.data = nil
+
+	return err
+}
+
+// Walk the sections: process the header and Dictionaries, note the Haybales
+func (m *MappedHaystack) getMappedSections() error {
+	var prev_section int
+	var ofs int
+	var last_dict_ofs uint32 // where the last Dictionary section started
+	var last *diskSection    // the section before, for errors
+
+trailer:
+	for {
+		s, err := getDisk2MemNextSection(m.data, ofs, m.hs.file_version_minor)
+		if err != nil {
+			return signatureAfter(err, last)
+		}
+		ofs = s.next()
+		last = s
+		s.dict = m.hs.compression_dict // also for the Haybales, decoded later
+
+		if prev_section == 0 && s.id != section_header {
+			return fmt.Errorf("%w: first section not header, not a Haystack?", ErrCorrupt)
+		}
+
+		switch s.id {
+		case section_compression_dict:
+			if prev_section != section_header {
+				return fmt.Errorf("%w: compression dictionary section can only follow the Header", ErrCorrupt)
+			}
+			content, err := getDisk2MemSectionContent(s, m.hs.aes_key_uuid)
+			if err != nil {
+				return err
+			}
+			if m.hs.compression_dict, err = getDisk2MemCompressionDict(content); err != nil {
+				return err
+			}
+
+		case section_header, section_dictionary:
+			if s.id == section_dictionary && prev_section != section_header && prev_section != section_compression_dict &&
+				prev_section != section_haybale && prev_section != section_haybale_index {
+				return fmt.Errorf("%w: Dictionary section can only follow a Header or Haybale", ErrCorrupt)
+			}
+
+			content, err := getDisk2MemSectionContent(s, m.hs.aes_key_uuid)
+			if err != nil {
+				return err
+			}
+
+			if s.id == section_header {
+				err = m.hs.getDisk2MemHeader(content)
+			} else {
+				err = m.hs.getDisk2MemDictionary(content, last_dict_ofs, s.flags)
+				last_dict_ofs = uint32(s.ofs)
+			}
+			if err != nil {
+				return err
+			}
+
+		case section_haybale:
+			if prev_section != section_dictionary {
+				return fmt.Errorf("%w: Haybale section can only follow a Dictionary", ErrCorrupt)
+			}
+			m.bales = append(m.bales, s) // decoded on first use
+			m.index = append(m.index, nil)
+
+		case section_haybale_index:
+			if prev_section != section_haybale {
+				return fmt.Errorf("%w: Haybale index section can only follow a Haybale", ErrCorrupt)
+			}
+
+			content, err := getDisk2MemSectionContent(s, m.hs.aes_key_uuid)
+			if err != nil {
+				return err
+			}
+			if m.index[len(m.index)-1], err = m.hs.getDisk2MemHaybaleIndex(content); err != nil {
+				return err
+			}
+
+		case section_trailer:
+			break trailer
+
+		default:
+			return fmt.Errorf("%w: unknown section type %d", ErrCorrupt, s.id)
+		}
+
+		prev_section = int(s.id)
+	}
+
+	return nil
+}
+
+// Number of Haybales in the mapped file
+func (m *MappedHaystack) NumHaybales() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return len(m.bales)
+}
+
+// Get Haybale #n, decoding it if it isn't in the cache
+func (m *MappedHaystack) getBale(n int) (*Haybale, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.data == nil {
+		return nil, fmt.Errorf("mapped Haystack already closed")
+	}
+
+	if e, ok := m.cache_map[n]; ok {
+		m.cache.MoveToFront(e)
+		return e.Value.(*mappedBale).hb, nil
+	}
+
+	content, err := getDisk2MemSectionContent(m.bales[n], m.hs.aes_key_uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	hb, err := m.hs.getDisk2MemHaybaleLayout(content, m.bales[n].flags)
+	if err != nil {
+		return nil, err
+	}
+
+	// Evict least recently used bale(s) to make room
+	max_bales := int(config.mapped_cache_bales)
+	if max_bales == 0 {
+		max_bales = mapped_cache_bales_default
+	}
+	for m.cache.Len() >= max_bales && m.cache.Len() > 0 {
+		e := m.cache.Back()
+		delete(m.cache_map, e.Value.(*mappedBale).n)
+		m.cache.Remove(e)
+	}
+
+	m.cache_map[n] = m.cache.PushFront(&mappedBale{n: n, hb: hb})
+
+	return hb, nil
+}
+
+// Same as Haystack.SearchKeyValArray(), loading Haybales as we go
+func (m *MappedHaystack) SearchKeyValArray(kv_array map[string]string) error {
+	_, err := m.SearchKeyValArrayTo(kv_array, os.Stdout)
+	return err
+}
+
+// Same as Haystack.SearchKeyValArrayTo(), loading Haybales as we go
+func (m *MappedHaystack) SearchKeyValArrayTo(kv_array map[string]string, w io.Writer) (uint, error) {
+	var werr error
+
+	stats := newSearchStats()
+	defer stats.log()
+
+	hv, found := m.hs.Dict.searchConditions(kv_array)
+	if !found {
+		return 0, nil
+	}
+
+	// Equality conditions, for skipping Haybales by their index
+	conds := make([]indexCond, len(hv))
+	for i := range hv {
+		conds[i] = indexCond{dkey: hv[i].dkey, op: "=", vals: hv[i : i+1]}
+	}
+
+	// Close() may come along while we search, getBale() tells us when it has
+	m.mutex.Lock()
+	bales, index := m.bales, m.index
+	m.mutex.Unlock()
+
+	for i := range bales {
+		if !index[i].mayMatchAll(conds) {
+			debugf("Skipping Haybale %d (index)", i)
+			stats.skipped++
+			continue
+		}
+
+		cur_hb, err := m.getBale(i)
+		if err != nil {
+			return stats.matches, err
+		}
+
+		debugf("Looking in Haybale %d (%d stalks)", i, cur_hb.num_haystalks)
+		stats.bales++
+
+		cur_hb.searchBale(hv, func(first uint32) {
+			if werr != nil { // no point carrying on
+				return
+			}
+
+			// Got a match!
+			stats.matches++
+			werr = cur_hb.writeBunch(w, &m.hs.Dict, first)
+		})
+		if werr != nil {
+			return stats.matches, werr
+		}
+	}
+
+	return stats.matches, nil
+}
+
+// EOF
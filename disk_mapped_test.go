@@ -0,0 +1,180 @@
+// OpenActa/Haystack - memory-mapped Haystack files - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// head5.json, a Haybale per record, as a file to map
+func testMappedFile(t *testing.T) (*Haystack, string) {
+	hs := newTestHaystack(t, "testdata/head5.json", 1)
+	data, _, err := hs.Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "mapped.hs")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return hs, path
+}
+
+// Haybale #s in the cache, most recently used first
+func mappedCached(m *MappedHaystack) []int {
+	ns := make([]int, 0)
+	for e := m.cache.Front(); e != nil; e = e.Next() {
+		ns = append(ns, e.Value.(*mappedBale).n)
+	}
+	return ns
+}
+
+// Only the last mapped_cache_bales used stay decoded
+func TestMappedCacheLRU(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	config.mapped_cache_bales = 2
+
+	_, path := testMappedFile(t)
+	m, err := OpenMapped(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if m.NumHaybales() != 5 {
+		t.Fatalf("%d Haybales", m.NumHaybales())
+	}
+
+	get := func(n int) *Haybale {
+		t.Helper()
+		hb, err := m.getBale(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hb
+	}
+
+	first := get(0)
+	get(1)
+	if got := get(0); got != first {
+		t.Errorf("Haybale 0 decoded again while cached")
+	}
+	if c := mappedCached(m); !reflect.DeepEqual(c, []int{0, 1}) {
+		t.Errorf("after 0 1 0: cached %v", c)
+	}
+
+	get(2) // 1 is the least recently used
+	if c := mappedCached(m); !reflect.DeepEqual(c, []int{2, 0}) || len(m.cache_map) != 2 {
+		t.Errorf("after 0 1 0 2: cached %v, map of %d", c, len(m.cache_map))
+	}
+	if got := get(0); got != first {
+		t.Errorf("Haybale 0 evicted instead of 1")
+	}
+
+	// Not configured: the default
+	config.mapped_cache_bales = 0
+	for i := 0; i < m.NumHaybales(); i++ {
+		get(i)
+	}
+	if n := len(mappedCached(m)); n != mapped_cache_bales_default {
+		t.Errorf("default: %d cached", n)
+	}
+}
+
+// A search goes through more Haybales than fit in the cache
+func TestMappedSearchPastCache(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	config.mapped_cache_bales = 1
+
+	hs, path := testMappedFile(t)
+	m, err := OpenMapped(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	for _, kv := range []map[string]string{
+		{"dest_port": "443"},
+		{"dest_port": "443", "proto": "TCP"},
+		{"no_such_key": "1"},
+	} {
+		var want, got bytes.Buffer
+		want_n, err := hs.SearchKeyValArrayTo(kv, &want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := m.SearchKeyValArrayTo(kv, &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want_n || got.String() != want.String() {
+			t.Errorf("%v: %d matches, want %d\n%s\nwant\n%s", kv, n, want_n, got.String(), want.String())
+		}
+		if c := mappedCached(m); len(c) > 1 {
+			t.Errorf("%v: cached %v", kv, c)
+		}
+		if kv["dest_port"] == "443" && n < 2 {
+			t.Errorf("%v: only %d matches, in %d Haybales", kv, n, m.NumHaybales())
+		}
+	}
+}
+
+// Writes go to w, the first one closes the MappedHaystack
+type closeOnWrite struct {
+	m      *MappedHaystack
+	w      bytes.Buffer
+	closed bool
+}
+
+func (c *closeOnWrite) Write(b []byte) (int, error) {
+	if !c.closed {
+		c.closed = true
+		c.m.Close()
+	}
+	return c.w.Write(b)
+}
+
+// Closed while a search is going: an error for the rest, no panic
+func TestMappedCloseDuringSearch(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	_, path := testMappedFile(t)
+	m, err := OpenMapped(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &closeOnWrite{m: m}
+	n, err := m.SearchKeyValArrayTo(map[string]string{"dest_port": "443"}, w)
+	if err == nil || n != 1 || !w.closed {
+		t.Errorf("%d matches, %v", n, err)
+	}
+	if m.NumHaybales() != 0 {
+		t.Errorf("%d Haybales after Close()", m.NumHaybales())
+	}
+}
+
+// EOF
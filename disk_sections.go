@@ -0,0 +1,344 @@
+// OpenActa/Haystack - list the sections of a Haystack file
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"fmt"
+	"hash/crc32"
+)
+
+// What we know about one section of a Haystack file, from its header alone
+type SectionInfo struct {
+	Offset int   // in the file
+	ID     uint8 // section identifier
+	UncLen int   // plain content length
+	ComLen int   // compressed content length
+	Codec  uint8 // as stored (0 = not specified, older files)
+	Level  uint8 // compression level as stored (0 = not specified)
+	Cipher uint8 // resolved, see getDisk2MemNextSection()
+}
+
+// Section type as text
+func (si SectionInfo) Type() string {
+	switch si.ID {
+	case section_header:
+		return "header"
+	case section_dictionary:
+		return "dictionary"
+	case section_haybale:
+		return "haybale"
+	case section_haybale_index:
+		return "haybale index"
+	case section_compression_dict:
+		return "compression dict"
+	case section_sha512:
+		return "sha512"
+	case section_trailer:
+		return "trailer"
+	default:
+		return fmt.Sprintf("unknown(%d)", si.ID)
+	}
+}
+
+// Compression as text, e.g. "bzip2 -9", "none", or "bzip2" when the level
+// isn't known (older files).
+func (si SectionInfo) CodecString() string {
+	switch si.Codec {
+	case codec_none:
+		return "none"
+	case codec_bzip2:
+		if si.Level == 0 {
+			return "bzip2"
+		}
+		return fmt.Sprintf("bzip2 -%d", si.Level)
+	case codec_deflate_dict:
+		return fmt.Sprintf("deflate+dict -%d", si.Level)
+	case codec_unspecified:
+		if getDisk2MemLegacyCodec(si.ComLen, si.UncLen) == codec_none {
+			return "none"
+		}
+		return "bzip2"
+	default:
+		return fmt.Sprintf("unknown(%d)", si.Codec)
+	}
+}
+
+// Encryption as text
+func (si SectionInfo) CipherString() string {
+	switch si.Cipher {
+	case cipher_none:
+		return "none"
+	case cipher_aes256gcm:
+		return "aes256gcm"
+	default:
+		return fmt.Sprintf("unknown(%d)", si.Cipher)
+	}
+}
+
+func (si SectionInfo) String() string {
+	return fmt.Sprintf("%10d  %-10s  %10d unc  %10d com  %-9s  %s",
+		si.Offset, si.Type(), si.UncLen, si.ComLen, si.CodecString(), si.CipherString())
+}
+
+// What the section header says, as a SectionInfo
+func (s *diskSection) info() SectionInfo {
+	return SectionInfo{
+		Offset: s.ofs,
+		ID:     s.id,
+		UncLen: s.unc_len,
+		ComLen: s.com_len,
+		Codec:  s.codec,
+		Level:  s.level,
+		Cipher: s.cipher,
+	}
+}
+
+// List the sections of a Haystack file, up to and including the trailer.
+// Only the file header is decoded (it's never encrypted), so no AES key is
+// needed and content CRCs are not checked; use SectionLayout() for that.
+func ListSections(data []byte) ([]SectionInfo, error) {
+	layout, err := SectionLayout(data, false)
+
+	list := make([]SectionInfo, 0, len(layout))
+	for _, sm := range layout {
+		list = append(list, sm.SectionInfo)
+	}
+
+	return list, err
+}
+
+// Map of a Haystack file: every section up to and including the trailer,
+// with its stored CRC. Nothing is built from the content.
+// With check_crc, each section is decrypted and decompressed to check its
+// CRC (encrypted sections need the AES key, ErrWrongKey). A mismatch is not
+// an error here, CRCOk says so, same as DumpSection().
+// Without, only the section headers are read, no key needed.
+// On an error, the sections before it are returned along with it.
+func SectionLayout(data []byte, check_crc bool) ([]SectionMeta, error) {
+	list := make([]SectionMeta, 0)
+
+	var file_version_minor uint8
+	var aes_key_uuid string
+	var dict []byte
+	var last *diskSection // the section before, for errors
+
+	for ofs := 0; ; {
+		if ofs >= len(data) {
+			return list, fmt.Errorf("%w: no trailer section after %d bytes", ErrTruncated, ofs)
+		}
+
+		s, err := getDisk2MemNextSection(data, ofs, file_version_minor)
+		if err != nil {
+			return list, signatureAfter(err, last)
+		}
+		last = s
+		s.dict = dict
+
+		if ofs == 0 {
+			if s.id != section_header {
+				return list, fmt.Errorf("%w: first section not header, not a Haystack?", ErrCorrupt)
+			}
+
+			// We need the minor version for the layout of the other section
+			// headers, and the key only if we're decrypting
+			content, err := getDisk2MemSectionContent(s, "")
+			if err != nil {
+				return list, err
+			}
+			h, err := getDisk2MemHeaderFields(content)
+			if err == nil && check_crc {
+				h, err = getDisk2MemHeaderContent(content)
+			}
+			if err != nil {
+				return list, err
+			}
+			file_version_minor = h.version_minor
+			aes_key_uuid = h.aes_key_uuid
+		}
+
+		meta := SectionMeta{SectionInfo: s.info(), CRC: s.crc}
+		if check_crc {
+			content, err := getDisk2MemSectionPlain(s, aes_key_uuid)
+			if err != nil {
+				return list, fmt.Errorf("%s section at offset %d: %w", meta.Type(), s.ofs, err)
+			}
+			meta.CRCChecked = true
+			meta.CRCOk = crc32.ChecksumIEEE(content) == s.crc
+
+			if s.id == section_compression_dict { // the sections after it need it
+				if dict, err = getDisk2MemCompressionDict(content); err != nil {
+					return list, fmt.Errorf("%s section at offset %d: %w", meta.Type(), s.ofs, err)
+				}
+			}
+		}
+		list = append(list, meta)
+
+		if s.id == section_trailer {
+			return list, nil
+		}
+		ofs = s.next()
+	}
+}
+
+// Check the content CRC of every section, up to and including the trailer.
+// Cheaper than Disk2Mem(): each section is decrypted and decompressed, but
+// nothing is built from it. Encrypted sections need the AES key (ErrWrongKey).
+// Returns the first problem, with the section type and offset.
+func VerifySectionCRCs(data []byte) error {
+	var file_version_minor uint8
+	var aes_key_uuid string
+	var dict []byte
+	var last *diskSection // the section before, for errors
+
+	for ofs := 0; ; {
+		if ofs >= len(data) {
+			return fmt.Errorf("%w: no trailer section after %d bytes", ErrTruncated, ofs)
+		}
+
+		s, err := getDisk2MemNextSection(data, ofs, file_version_minor)
+		if err != nil {
+			return signatureAfter(err, last)
+		}
+		last = s
+		si := SectionInfo{Offset: s.ofs, ID: s.id}
+		s.dict = dict
+
+		if (ofs == 0) != (s.id == section_header) {
+			return fmt.Errorf("%w: %s section at offset %d, header must be first (and only once)", ErrCorrupt, si.Type(), s.ofs)
+		}
+
+		// The header is never encrypted, and tells us the key for the rest
+		content, err := getDisk2MemSectionContent(s, aes_key_uuid)
+		if err != nil {
+			return fmt.Errorf("%s section at offset %d: %w", si.Type(), s.ofs, err)
+		}
+
+		switch s.id {
+		case section_header:
+			h, err := getDisk2MemHeaderContent(content)
+			if err != nil {
+				return err
+			}
+			file_version_minor = h.version_minor
+			aes_key_uuid = h.aes_key_uuid
+
+		case section_compression_dict:
+			if dict, err = getDisk2MemCompressionDict(content); err != nil {
+				return fmt.Errorf("%s section at offset %d: %w", si.Type(), s.ofs, err)
+			}
+
+		case section_trailer:
+			return nil
+		}
+
+		ofs = s.next()
+	}
+}
+
+// One section as dumped by DumpSection(), or mapped by SectionLayout()
+type SectionMeta struct {
+	SectionInfo
+	CRC        uint32 // as stored in the section header
+	CRCChecked bool   // we looked at the content (always, for DumpSection())
+	CRCOk      bool   // content matches it
+}
+
+func (sm SectionMeta) String() string {
+	crc := "ok"
+	if !sm.CRCChecked {
+		crc = "not checked"
+	} else if !sm.CRCOk {
+		crc = "MISMATCH"
+	}
+	return fmt.Sprintf("%s  crc 0x%08x %s", sm.SectionInfo, sm.CRC, crc)
+}
+
+// Decrypt and decompress section n (0 = the header, as ListSections()),
+// for looking at what's in a file that doesn't load.
+// A CRC mismatch is not an error here, the content is returned anyway and
+// CRCOk says so. Encrypted sections need the AES key (ErrWrongKey).
+func DumpSection(data []byte, n int) ([]byte, SectionMeta, error) {
+	var meta SectionMeta
+	var file_version_minor uint8
+	var aes_key_uuid string
+	var dict []byte
+	var last *diskSection // the section before, for errors
+
+	if n < 0 {
+		return nil, meta, fmt.Errorf("no section %d", n)
+	}
+
+	for i, ofs := 0, 0; ; i++ {
+		if ofs >= len(data) {
+			return nil, meta, fmt.Errorf("%w: no trailer section after %d bytes", ErrTruncated, ofs)
+		}
+
+		s, err := getDisk2MemNextSection(data, ofs, file_version_minor)
+		if err != nil {
+			return nil, meta, signatureAfter(err, last)
+		}
+		last = s
+
+		if ofs == 0 {
+			if s.id != section_header {
+				return nil, meta, fmt.Errorf("%w: first section not header, not a Haystack?", ErrCorrupt)
+			}
+
+			// Minor version for the section header layout, and the key
+			content, err := getDisk2MemSectionContent(s, "")
+			if err != nil {
+				return nil, meta, err
+			}
+			h, err := getDisk2MemHeaderContent(content)
+			if err != nil {
+				return nil, meta, err
+			}
+			file_version_minor = h.version_minor
+			aes_key_uuid = h.aes_key_uuid
+		}
+		s.dict = dict
+
+		if i == n {
+			meta = SectionMeta{SectionInfo: s.info(), CRC: s.crc, CRCChecked: true}
+
+			content, err := getDisk2MemSectionPlain(s, aes_key_uuid)
+			if err != nil {
+				return nil, meta, fmt.Errorf("%s section at offset %d: %w", meta.Type(), s.ofs, err)
+			}
+			meta.CRCOk = crc32.ChecksumIEEE(content) == s.crc
+
+			return content, meta, nil
+		}
+
+		if s.id == section_trailer {
+			return nil, meta, fmt.Errorf("no section %d, only %d", n, i+1)
+		}
+		if s.id == section_compression_dict { // the sections after it need it
+			content, err := getDisk2MemSectionContent(s, aes_key_uuid)
+			if err == nil {
+				dict, err = getDisk2MemCompressionDict(content)
+			}
+			if err != nil {
+				return nil, meta, fmt.Errorf("compression dict section at offset %d: %w", s.ofs, err)
+			}
+		}
+		ofs = s.next()
+	}
+}
+
+// EOF
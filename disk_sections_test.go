@@ -0,0 +1,212 @@
+// OpenActa/Haystack - list the sections of a Haystack file - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestListSections(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	for _, level := range []uint32{0, 3, 9} {
+		config.compression_level = level
+
+		hs := newTestHaystack(t, "testdata/head5.json", 2)
+		data, _, err := hs.Mem2Disk()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		list, err := ListSections(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// header, 3 x (dictionary, haybale), trailer
+		if len(list) != 8 || list[0].ID != section_header || list[7].ID != section_trailer {
+			t.Fatalf("level %d: unexpected sections %v", level, list)
+		}
+
+		var compressed int
+		for _, si := range list {
+			switch {
+			case si.ID == section_header || si.ID == section_trailer || level == 0:
+				if si.CodecString() != "none" {
+					t.Errorf("level %d: %v", level, si)
+				}
+			case si.Codec == codec_bzip2:
+				if si.Level != uint8(level) {
+					t.Errorf("level %d: %v", level, si)
+				}
+				compressed++
+			}
+
+			if si.ID != section_header && si.CipherString() != "aes256gcm" {
+				t.Errorf("expected encrypted: %v", si)
+			}
+		}
+		if level > 0 && compressed == 0 {
+			t.Errorf("level %d: nothing compressed", level)
+		}
+	}
+
+	// Cut short
+	data := testHaystackFile(t)
+	if _, err := ListSections(data[:len(data)-10]); !errors.Is(err, ErrTruncated) {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+}
+
+func TestVerifySectionCRCs(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	if err := VerifySectionCRCs(testHaystackFile(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Plain and uncompressed, so a flipped bit gets to the CRC check
+	config.encryption_disabled = true
+	config.compression_level = 0
+	data := testHaystackFile(t)
+	if err := VerifySectionCRCs(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySectionCRCs(data[:len(data)-10]); !errors.Is(err, ErrTruncated) {
+		t.Errorf("cut short: %v", err)
+	}
+
+	list, err := ListSections(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bale := list[2]
+	if bale.ID != section_haybale {
+		t.Fatalf("section 2 is %v", bale)
+	}
+
+	data[bale.Offset+min_DiskHeaderBaselen+len_DiskHeaderExt+10] ^= 0x01
+	err = VerifySectionCRCs(data)
+	if !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), fmt.Sprintf("haybale section at offset %d", bale.Offset)) {
+		t.Errorf("flipped bit: %v", err)
+	}
+}
+
+func TestDumpSection(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	data := testHaystackFile(t)
+	list, err := ListSections(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, si := range list {
+		content, meta, err := DumpSection(data, i)
+		if err != nil {
+			t.Fatalf("section %d: %v", i, err)
+		}
+		if meta.SectionInfo != si || !meta.CRCOk || len(content) != si.UncLen {
+			t.Errorf("section %d: %v, %d bytes", i, meta, len(content))
+		}
+	}
+
+	// The dictionary decrypts to something with our keys in it
+	content, _, err := DumpSection(data, 1)
+	if err != nil || !bytes.Contains(content, []byte("dest_port")) {
+		t.Errorf("dictionary: %v %q", err, content)
+	}
+
+	for _, n := range []int{-1, len(list)} {
+		if _, _, err := DumpSection(data, n); err == nil {
+			t.Errorf("section %d: no error", n)
+		}
+	}
+
+	// A bad CRC still gets us the content
+	config.encryption_disabled = true
+	config.compression_level = 0
+	data = testHaystackFile(t)
+	list, _ = ListSections(data)
+	data[list[2].Offset+min_DiskHeaderBaselen+len_DiskHeaderExt+10] ^= 0x01
+	content, meta, err := DumpSection(data, 2)
+	if err != nil || meta.CRCOk || meta.ID != section_haybale || len(content) != meta.UncLen {
+		t.Errorf("flipped bit: %v, %v", meta, err)
+	}
+}
+
+func TestSectionLayout(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	data := testHaystackFile(t)
+	list, err := ListSections(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, check_crc := range []bool{true, false} {
+		layout, err := SectionLayout(data, check_crc)
+		if err != nil || len(layout) != len(list) {
+			t.Fatalf("check_crc %v: %d sections, %v", check_crc, len(layout), err)
+		}
+		for i, sm := range layout {
+			if sm.SectionInfo != list[i] || sm.CRCChecked != check_crc || sm.CRCOk != check_crc || sm.CRC == 0 {
+				t.Errorf("check_crc %v: section %d: %v", check_crc, i, sm)
+			}
+		}
+	}
+
+	// Not the key: the headers are all there, the content isn't
+	config.aes_keystore_array = nil
+	if layout, err := SectionLayout(data, false); err != nil || len(layout) != len(list) {
+		t.Errorf("without key: %d sections, %v", len(layout), err)
+	}
+	if layout, err := SectionLayout(data, true); !errors.Is(err, ErrWrongKey) || len(layout) != 0 {
+		t.Errorf("without key, checking: %d sections, %v", len(layout), err)
+	}
+
+	// A bad CRC is in the map, not the end of it
+	setTestConfig(t)
+	config.encryption_disabled = true
+	config.compression_level = 0
+	data = testHaystackFile(t)
+	list, _ = ListSections(data)
+	data[list[2].Offset+min_DiskHeaderBaselen+len_DiskHeaderExt+10] ^= 0x01
+	layout, err := SectionLayout(data, true)
+	if err != nil || len(layout) != len(list) {
+		t.Fatalf("flipped bit: %d sections, %v", len(layout), err)
+	}
+	for i, sm := range layout {
+		if sm.CRCOk != (i != 2) {
+			t.Errorf("flipped bit: section %d: %v", i, sm)
+		}
+	}
+	if !strings.HasSuffix(layout[2].String(), "MISMATCH") {
+		t.Errorf("'%s'", layout[2])
+	}
+}
+
+// EOF
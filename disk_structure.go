@@ -31,8 +31,9 @@ const (
 	max_filesize = (1024 * 1024 * 1024) // 1GB (outer limit)
 	len_dup      = 0xfffffffe           // Len to indicate de-dupped string
 
-	bzip2_hdrMagic = 0x425a         // Hex of "BZ"
-	bzip2_blkMagic = 0x314159265359 // BCD of PI
+	max_section_size_lower   = 1024 * 1024 // 1M
+	max_section_size_upper   = max_filesize
+	max_section_size_default = Max_memsize // a Haybale never gets bigger in RAM
 
 	sha512_byte_len = 64 // SHA-512
 
@@ -40,8 +41,8 @@ const (
 	aesgcm_nonce_byte_len   = 12                           // AES nonce is 92 bits
 	aesgcm_block_additional = (aesgcm_nonce_byte_len + 16) // + AES GCM overhead
 
-	NewFilePermissions = 0660 // Permissions for new files
-	NewDirPermissions  = 0770 // Permissions for new directories
+	NewFilePermissions = 0660 // Permissions for new files (default, see config file_mode)
+	NewDirPermissions  = 0770 // Permissions for new directories (default, see config dir_mode)
 )
 
 /*
@@ -51,48 +52,89 @@ type DiskSection struct {
 	unc_len	uint32		// Uncompressed content length
 	com_len	uint32		// Compressed content length
 	crc 	uint32		// IEEE CRC-32
+	// from version 1.1, for all but the file header section:
+	flags	uint8		// Section flags
+	codec	uint8		// Compression codec of content
+	cipher	uint8		// Encryption cipher of content
+	level	uint8		// Compression level used by codec (0 = not specified)
 	<content>			// Section content (compressed and encrypted)
 }
 */
 
+// All multi-byte values are little-endian (LSB first), see addMultibyteToData()
+// and getUintFromData(). The signature doubles as an endianness check.
 const (
-	signature = 0xebfeda // Our 3 byte file/segment signature
+	signature         = 0xebfeda // Our 3 byte file/segment signature
+	signature_swapped = 0xdafeeb // Our signature, written big-endian
 
 	min_DiskHeaderBaselen = 16 // # bytes in preamble of any section
+	len_DiskHeaderExt     = 4  // # extra preamble bytes of non-header sections (since 1.1)
+)
+
+const ( // Section flags (since 1.1)
+	section_flag_plaintext = 0x01 // Content is not encrypted
+	section_flag_compact   = 0x02 // Haybale in the compact layout (since 1.4)
+
+	section_flag_case_sensitive = 0x04 // Dictionary keys are case-sensitive (since 1.5)
+)
+
+const ( // Section codecs (since 1.1)
+	codec_unspecified  = 0 // Older files: bzip2 if com_len < unc_len, else none
+	codec_none         = 1 // Content stored as is
+	codec_bzip2        = 2
+	codec_deflate_dict = 3 // DEFLATE with the file's compression dictionary (since 1.3)
+)
+
+const ( // Section ciphers (since 1.1)
+	cipher_unspecified = 0 // Older files: AES256-GCM unless flagged plaintext
+	cipher_none        = 1 // Plaintext
+	cipher_aes256gcm   = 2
 )
 
 const ( // Haystack file section identifiers
-	section_header     = 1
-	section_dictionary = 2
-	section_haybale    = 3
-	section_sha512     = 254
-	section_trailer    = 255
+	section_header           = 1
+	section_dictionary       = 2
+	section_haybale          = 3
+	section_haybale_index    = 4 // optional, after its Haybale (since 1.2)
+	section_compression_dict = 5 // optional, right after the header (since 1.3)
+	section_sha512           = 254
+	section_trailer          = 255
 )
 
 /*
 type DiskFileHeader struct {
 	major     uint8     	// Major version
 	minor     uint8     	// Minor version
-	aes_uuid  [16]byte		// AES key uuid
+	aes_uuid  [16]byte		// AES key uuid (nil uuid if not encrypted)
+	file_uuid [16]byte		// Unique id of this Haystack file (since 1.1)
 }
 */
 
 const (
 	version_major = 1
-	version_minor = 0
+	version_minor = 5 // 1.0 (no section flags) and 1.1 (no Haybale index) files can still be read
+
+	// What we write when there's no compression dictionary, compact
+	// Haybales or case-sensitive keys, so older versions can still read it,
+	// see disk_compression_dict.go, disk_compact_bunches.go and
+	// getDisk2MemDictionary()
+	version_minor_plain   = 2
+	version_minor_dict    = 3 // compression dictionary, but no compact Haybales
+	version_minor_compact = 4 // compact Haybales, keys case-insensitive
 )
 
 /*
 type DiskDictHeader struct {
 	prev_ofs  uint32 		// offset of previous Dictionary+Haybale (or 0 for none)
-	num_dkeys uint32		// number of keys (max 16777216)
+	num_dkeys [3]byte		// number of keys in this section (max 16777216)
+	bits      uint8			// hash table size 2^bits (0 = 24)
 	<DiskDictEntry> ...		// Dictionary entries
 }
 */
 
 const (
 	min_DiskDictHeaderLen = 8
-	max_dkeys             = hashtable_size // 16M (24-bit hash table)
+	max_dkeys             = 1 << hashtable_bits_max // 16M (24-bit hash table)
 )
 
 /*
@@ -128,10 +170,41 @@ type DiskHaytalkEntry struct {
 }
 */
 
+const (
+	min_DiskHaystalkLen = 16 // de-dupped string: dkey, valtype, first, next, len
+)
+
+/*
+Haybale in the compact layout (section_flag_compact), see disk_compact_bunches.go
+type DiskCompactHaybale struct {
+	<DiskHaybaleHeader>
+	num_schemas uint32
+	<DiskCompactSchema> ...
+	num_bunches uint32
+	<DiskCompactBunch> ...	// in order of their _timestamp
+}
+
+type DiskCompactSchema struct {
+	num_keys uint32
+	<dkey [3]byte, valtype uint8> ...	// keys of a bunch, in bunch order
+}
+
+type DiskCompactBunch struct {
+	schema uint32		// index of its DiskCompactSchema
+	<val> ...			// one per key, as in DiskHaytalkEntry (len_dup: same
+						// string as the previous bunch with this key)
+}
+*/
+
+const (
+	min_DiskCompactValueLen = 4 // de-dupped string
+)
+
 const (
 	valtype_int    = 1
 	valtype_float  = 2
 	valtype_string = 3
+	valtype_time   = 4 // int64 Unix nanoseconds (UTC)
 )
 
 /*
@@ -139,6 +212,7 @@ type DiskFileSHA512 struct {
 	time_first uint64 	// _timestamp of first entry in this Haystack
 	time_last  uint64 	// _timestamp of last entry in this Haystack
 	sha512     [64]byte // SHA-512 over all of Haystack file
+	file_uuid  [16]byte	// Unique id of the Haystack file (since 1.1)
 }
 */
 
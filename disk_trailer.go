@@ -0,0 +1,170 @@
+// OpenActa/Haystack - reading just the trailer of a Haystack file
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	For a listing of the datastore we only need the header (key and file
+	uuid) and the trailer (time range). Reading a 1GB file for that is a
+	waste, so we read the first few hundred bytes, and the last
+	max_trailer_len. The trailer is the last section, so somewhere in
+	those last bytes is a section header for it that ends exactly at EOF.
+	We look for that backwards, it's one try for any file we wrote.
+
+	The trailer is decrypted and its CRC checked, like always. The file
+	MAC isn't: that's over the whole file, which is what we're avoiding.
+	So this is for metadata, Disk2Mem() and OpenMapped() still check it
+	all before anything in the file is used.
+
+	Disk2Mem() ignores anything after the trailer. If there's something
+	there, we don't find the trailer at the end, and fall back to reading
+	through the whole file.
+*/
+
+package haystack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+const (
+	// Biggest trailer section: extended header, fields, MAC, GCM nonce and tag
+	max_trailer_len = min_DiskHeaderBaselen + len_DiskHeaderExt + len_DiskTrailer + file_mac_len + aesgcm_block_additional
+
+	header_read_len = 256 // more than the header section ever is
+)
+
+// Trailer not where we looked, see the top of this file
+var errTrailerNotAtEnd = errors.New("trailer not at end of file")
+
+// What's in the trailer of a Haystack file
+type Trailer struct {
+	LastDictOfs uint32 // offset of the last Dictionary section
+	TimeFirst   int64  // _timestamp of first entry (Unix nanosecs)
+	TimeLast    int64  // _timestamp of last entry (Unix nanosecs)
+}
+
+// Trailer of the Haystack file at path, reading only the start and end of
+// the file (the header tells us the AES key). See the top of this file.
+func ReadTrailer(path string) (Trailer, error) {
+	_, trailer, err := readHeaderTrailer(path)
+	if errors.Is(err, errTrailerNotAtEnd) {
+		_, trailer, err = scanHeaderTrailer(path)
+	}
+	if err != nil {
+		return Trailer{}, err
+	}
+
+	return trailer, nil
+}
+
+// Header and trailer of a Haystack file, from its first and last few bytes
+func readHeaderTrailer(path string) (*HaystackFileInfo, Trailer, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return nil, Trailer{}, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, Trailer{}, err
+	}
+	size := st.Size()
+	if size < min_filesize {
+		return nil, Trailer{}, fmt.Errorf("dataset too short, not a Haystack?")
+	}
+
+	info := HaystackFileInfo{Path: path, Size: size}
+
+	head_len := int64(header_read_len)
+	if head_len > size {
+		head_len = size
+	}
+	head := make([]byte, head_len)
+	if _, err := f.ReadAt(head, 0); err != nil {
+		return nil, Trailer{}, err
+	}
+	s, err := getDisk2MemNextSection(head, 0, 0)
+	if err != nil {
+		return nil, Trailer{}, err
+	}
+	if s.id != section_header {
+		return nil, Trailer{}, fmt.Errorf("%w: first section not header, not a Haystack?", ErrCorrupt)
+	}
+	content, err := getDisk2MemSectionContent(s, "")
+	if err != nil {
+		return nil, Trailer{}, err
+	}
+	h, err := getDisk2MemHeaderContent(content)
+	if err != nil {
+		return nil, Trailer{}, err
+	}
+	info.AESKeyUUID = h.aes_key_uuid
+	info.FileUUID = h.file_uuid
+
+	// The trailer comes after the header, and at most max_trailer_len from the end
+	tail_len := size - int64(s.next())
+	if tail_len > max_trailer_len {
+		tail_len = max_trailer_len
+	}
+	tail := make([]byte, tail_len)
+	if _, err := f.ReadAt(tail, size-tail_len); err != nil {
+		return nil, Trailer{}, err
+	}
+
+	for i := len(tail) - min_DiskHeaderBaselen; i >= 0; i-- {
+		if tail[i+3] != section_trailer {
+			continue
+		}
+		s, err := getDisk2MemNextSection(tail, i, h.version_minor)
+		if err != nil || s.id != section_trailer || s.next() != len(tail) {
+			continue
+		}
+
+		content, err := getDisk2MemSectionContent(s, info.AESKeyUUID)
+		if err != nil {
+			return nil, Trailer{}, err
+		}
+		trailer, err := getTrailerContent(content)
+		if err != nil {
+			return nil, Trailer{}, err
+		}
+		info.TimeFirst = trailer.TimeFirst
+		info.TimeLast = trailer.TimeLast
+
+		return &info, trailer, nil
+	}
+
+	return nil, Trailer{}, fmt.Errorf("%w: %s", errTrailerNotAtEnd, path)
+}
+
+// Trailer fields from its (decrypted) content, the MAC is left alone
+func getTrailerContent(content []byte) (Trailer, error) {
+	if len(content) < len_DiskTrailer {
+		return Trailer{}, fmt.Errorf("%w: trailer section too short, missing fields", ErrCorrupt)
+	}
+
+	reader := bytes.NewReader(content)
+	return Trailer{
+		LastDictOfs: uint32(getUintFromData(reader, 4)),
+		TimeFirst:   int64(getUintFromData(reader, 8)),
+		TimeLast:    int64(getUintFromData(reader, 8)),
+	}, nil
+}
+
+// EOF
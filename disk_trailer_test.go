@@ -0,0 +1,131 @@
+// OpenActa/Haystack - reading just the trailer of a Haystack file - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadTrailer(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	dir := t.TempDir()
+
+	for _, encrypted := range []bool{true, false} {
+		config.encryption_disabled = !encrypted
+
+		hs := testEveHaystack(t, 300, 100)
+		data, _, err := hs.Mem2Disk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "trailer.hs")
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		sections, err := ListSections(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var last_dict int
+		for _, s := range sections {
+			if s.ID == section_dictionary {
+				last_dict = s.Offset
+			}
+		}
+
+		want := Trailer{LastDictOfs: uint32(last_dict), TimeFirst: hs.time_first, TimeLast: hs.time_last}
+		trailer, err := ReadTrailer(path)
+		if err != nil || trailer != want {
+			t.Fatalf("encrypted %v: %+v, want %+v: %v", encrypted, trailer, want, err)
+		}
+
+		// Same as reading all of it
+		info, _, err := readHeaderTrailer(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanned, scanned_trailer, err := scanHeaderTrailer(path)
+		if err != nil || !reflect.DeepEqual(info, scanned) || scanned_trailer != want {
+			t.Errorf("encrypted %v: %+v, scanned %+v %+v: %v", encrypted, info, scanned, scanned_trailer, err)
+		}
+
+		// We don't read the middle: garbage there makes no difference
+		mangled := append([]byte(nil), data...)
+		for i := len(mangled) / 4; i < len(mangled)/2; i++ {
+			mangled[i] = 0xff
+		}
+		os.WriteFile(path, mangled, 0600)
+		if trailer, err := ReadTrailer(path); err != nil || trailer != want {
+			t.Errorf("encrypted %v, mangled middle: %+v: %v", encrypted, trailer, err)
+		}
+
+		// Something after the trailer: not at the end, read through instead
+		os.WriteFile(path, append(append([]byte(nil), data...), "junk"...), 0600)
+		if _, _, err := readHeaderTrailer(path); !errors.Is(err, errTrailerNotAtEnd) {
+			t.Errorf("encrypted %v, junk at the end: %v", encrypted, err)
+		}
+		if trailer, err := ReadTrailer(path); err != nil || trailer != want {
+			t.Errorf("encrypted %v, junk at the end: %+v: %v", encrypted, trailer, err)
+		}
+	}
+
+	// The trailer fails its CRC or GCM tag
+	path := filepath.Join(dir, "trailer.hs")
+	data, _ := os.ReadFile(path)
+	data = data[:len(data)-len("junk")]
+	data[len(data)-3] ^= 0xff
+	os.WriteFile(path, data, 0600)
+	if _, err := ReadTrailer(path); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("bad trailer: %v", err)
+	}
+
+	os.WriteFile(path, data[:min_filesize-1], 0600)
+	if _, err := ReadTrailer(path); err == nil {
+		t.Errorf("too short, no error")
+	}
+}
+
+// ListDatastore() gets the same as before, through fsys
+func TestListDatastoreTrailer(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	config.datastore_dir = "/data"
+	config.catalogue_dir = "/catalogue"
+	useMemFS(t)
+
+	writeTestDatastore(t, "2023-06-05T12:00:00Z", "2023-06-06T12:00:00Z")
+
+	list, err := ListDatastore()
+	if err != nil || len(list) != 3 {
+		t.Fatalf("%d files: %v", len(list), err)
+	}
+	for _, info := range list {
+		scanned, _, err := scanHeaderTrailer(info.Path)
+		if err != nil || !reflect.DeepEqual(&info, scanned) {
+			t.Errorf("%+v, scanned %+v: %v", info, scanned, err)
+		}
+	}
+}
+
+// EOF
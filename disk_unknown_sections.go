@@ -0,0 +1,95 @@
+// OpenActa/Haystack - passing unknown sections through
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	A section type we don't know is an error for Disk2Mem(): we can't tell
+	what it means for the data. Tools that only transform files (load,
+	then Mem2Disk() with another key or compression level) don't need to
+	know, they can carry it along. Disk2MemPassThrough() does that.
+
+	Unknown sections are framed like all others, so we can still check
+	their CRC, decrypt and decompress them. We keep the plain content, and
+	where the section was: after how many Haybales. Mem2Disk() writes them
+	back there, with the same section id, encrypted with the key (and
+	compressed at the level) of the new file. Not byte for byte: a section
+	still encrypted with the old key would be unreadable in a re-keyed file.
+
+	Files with a newer minor version are still refused, as their section
+	framing may have changed. Sections a future writer adds without a
+	version bump are what this is for.
+*/
+
+package haystack
+
+import "io"
+
+// A section we didn't know, kept by Disk2MemPassThrough()
+type unknownSection struct {
+	id      uint8
+	after   int    // Haybales before it, it goes before Dictionary #after
+	content []byte // plain: decrypted and decompressed
+}
+
+// Same as Disk2Mem(), but sections of a type we don't know are kept rather
+// than an error, and written back by Mem2Disk(). See the top of this file.
+func (p *Haystack) Disk2MemPassThrough(data []byte) error {
+	p.keep_unknown = true
+	defer func() { p.keep_unknown = false }()
+
+	return p.Disk2Mem(data)
+}
+
+// Note an unknown section, its content is plain already
+func (p *Haystack) keepUnknownSection(id uint8, content []byte) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.unknown = append(p.unknown, unknownSection{
+		id:      id,
+		after:   len(p.Haybale),
+		content: append([]byte(nil), content...), // may point into the file data
+	})
+}
+
+// The unknown sections that go after Haybale #after-1, ready to write
+func (p *Haystack) mem2DiskUnknownSections(after int) ([]byte, error) {
+	var data []byte
+
+	for i := range p.unknown {
+		u := &p.unknown[i]
+		if u.after != after {
+			continue
+		}
+
+		s, err := mem2DiskStreamSection(u.id, func(w io.Writer) error {
+			_, err := w.Write(u.content)
+			return err
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+		section, err := s.finish(p.aes_key_uuid)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, section...)
+	}
+
+	return data, nil
+}
+
+// EOF
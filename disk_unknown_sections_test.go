@@ -0,0 +1,156 @@
+// OpenActa/Haystack - passing unknown sections through - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+const section_test_future = 100 // a section type from the future
+
+// head5 with two sections we don't know: after the first Haybale (as
+// Mem2Disk() writes them), and one we add before the trailer.
+// Unencrypted, an encrypted file would need a new MAC.
+func testFutureFile(t *testing.T) ([]byte, [][]byte) {
+	config.encryption_disabled = true
+	contents := [][]byte{[]byte("something new"), bytes.Repeat([]byte("more "), 100)}
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+	hs.unknown = []unknownSection{{id: section_test_future, after: 1, content: contents[0]}}
+	data, _, err := hs.Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing before it moves, so the Dictionary chain is still fine
+	sections, err := ListSections(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trailer := sections[len(sections)-1].Offset
+
+	hs.unknown = []unknownSection{{id: section_test_future, content: contents[1]}}
+	future, err := hs.mem2DiskUnknownSections(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := append([]byte(nil), data[:trailer]...)
+	out = append(out, future...)
+	out = append(out, data[trailer:]...)
+
+	return out, contents
+}
+
+// The unknown sections in data, as (section number, content)
+func testFutureSections(t *testing.T, data []byte) map[int][]byte {
+	t.Helper()
+
+	sections, err := ListSections(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := make(map[int][]byte)
+	for i, s := range sections {
+		if s.ID != section_test_future {
+			continue
+		}
+		content, meta, err := DumpSection(data, i)
+		if err != nil || !meta.CRCOk {
+			t.Fatalf("section %d: %v %v", i, meta, err)
+		}
+		found[i] = content
+	}
+
+	return found
+}
+
+func TestDisk2MemPassThrough(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	data, contents := testFutureFile(t)
+
+	// Not without asking
+	err := new(Haystack).Disk2Mem(data)
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("unknown sections: %v", err)
+	}
+
+	hs := new(Haystack)
+	if err := hs.Disk2MemPassThrough(data); err != nil {
+		t.Fatal(err)
+	}
+	if len(hs.Haybale) != 3 || len(hs.unknown) != 2 {
+		t.Fatalf("%d Haybales, %d unknown sections", len(hs.Haybale), len(hs.unknown))
+	}
+	if hs.keep_unknown {
+		t.Errorf("still keeping unknown sections")
+	}
+
+	// Re-encrypt, with another key
+	config.encryption_disabled = false
+	if err := SetActiveKey("0d6e0b9f-4b1c-4c2a-9a57-2f1a3d5e7c90", bytes.Repeat([]byte{7}, AES_key_byte_len)); err != nil {
+		t.Fatal(err)
+	}
+
+	out, _, err := hs.Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same place, same content: after the first Haybale, and before the trailer
+	sections, err := ListSections(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := testFutureSections(t, out)
+	if len(found) != 2 {
+		t.Fatalf("%d unknown sections after rewrite", len(found))
+	}
+	last := len(sections) - 2
+	first := -1
+	for i := range sections {
+		if sections[i].ID == section_dictionary && i > 1 {
+			first = i - 1 // right before the second Dictionary
+			break
+		}
+	}
+	if !bytes.Equal(found[first], contents[0]) || !bytes.Equal(found[last], contents[1]) {
+		t.Errorf("unknown sections moved or changed: %v", sections)
+	}
+
+	// And the rewritten file passes through again, with the same Haybales
+	hs2 := new(Haystack)
+	if err := hs2.Disk2MemPassThrough(out); err != nil {
+		t.Fatal(err)
+	}
+	if len(hs2.unknown) != 2 || len(hs2.Haybale) != len(hs.Haybale) {
+		t.Errorf("second pass: %d Haybales, %d unknown sections", len(hs2.Haybale), len(hs2.unknown))
+	}
+	for i := range hs.Haybale {
+		if hs.Haybale[i].num_haystalks != hs2.Haybale[i].num_haystalks {
+			t.Errorf("Haybale %d: %d stalks, was %d", i, hs2.Haybale[i].num_haystalks, hs.Haybale[i].num_haystalks)
+		}
+	}
+}
+
+// EOF
@@ -0,0 +1,343 @@
+// OpenActa/Haystack - background disk writer
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	Ingest hands full Haystacks to FlushHaystack(), a go routine writes them
+	out (Haystack file to datastore_dir, catalogue to catalogue_dir).
+	The queue in between is bounded (diskwriter_queue_len), so a slow disk
+	can't eat all our memory. What happens when it's full is up to config
+	diskwriter_queue_policy:
+		block: FlushHaystack() waits until there's room, or we're stopped
+		drop:  the Haystack is discarded (and counted), ingest carries on
+		error: FlushHaystack() returns ErrDiskWriterQueueFull, caller decides
+	With config file_rollover hourly or daily, Haystacks are appended to a
+	file per hour/day instead, see diskwriter_rollover.go.
+
+	When datastore_dir or catalogue_dir is full (or over quota), config
+	disk_full_policy says what happens to the Haystack we were writing:
+		retry: keep it in memory, and try again, backing off up to a minute.
+		       Meanwhile the queue fills up, and the queue policy kicks in.
+		       Only when we're stopped while still full is it lost.
+		drop:  log it, count it as an error, and carry on with the next one.
+	With file_rollover, the working file the Haystack was going into is kept
+	either way, with the Haystacks before it in that file; only what went in
+	half is cut off again.
+*/
+
+package haystack
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	diskwriter_policy_block = "block"
+	diskwriter_policy_drop  = "drop"
+	diskwriter_policy_error = "error"
+
+	disk_full_policy_retry = "retry"
+	disk_full_policy_drop  = "drop"
+
+	diskwriter_queue_len_default = 2
+)
+
+// Wait between tries while the disk is full, doubling each time up to the max
+var (
+	disk_full_backoff_min = time.Second
+	disk_full_backoff_max = time.Minute
+)
+
+var ErrDiskWriterQueueFull = errors.New("disk writer queue full")
+var ErrDiskWriterNotRunning = errors.New("disk writer not running")
+
+type DiskWriterStats struct {
+	QueueDepth int    // Haystacks waiting to be written
+	QueueCap   int    // max queue depth (config diskwriter_queue_len)
+	Written    uint64 // Haystack files written (finalized, with file_rollover)
+	Dropped    uint64 // Haystacks discarded because the queue was full (policy drop)
+	Rejected   uint64 // Haystacks refused because the queue was full (policy error)
+	Errors     uint64 // failed writes
+	DiskFull   bool   // the last write failed for lack of space, see disk_full_policy
+	Retries    uint64 // writes tried again because the disk was full
+}
+
+var diskwriter struct {
+	mutex   sync.RWMutex // protects ch (running or not)
+	ch      chan *Haystack
+	done    sync.WaitGroup
+	running bool
+	stop    chan struct{} // closed by StopDiskWriter(), no more waiting for disk space or queue room
+
+	stop_once *sync.Once // closes stop, StopDiskWriter() does that before taking the mutex
+
+	written  atomic.Uint64
+	dropped  atomic.Uint64
+	rejected atomic.Uint64
+	errors   atomic.Uint64
+	retries  atomic.Uint64
+
+	disk_full atomic.Bool
+
+	rollover *rolloverFile // working file (file_rollover), writer go routine only
+}
+
+// Start the disk writer go routine
+func StartDiskWriter() error {
+	diskwriter.mutex.Lock()
+	defer diskwriter.mutex.Unlock()
+
+	if diskwriter.running {
+		return fmt.Errorf("disk writer already running")
+	}
+
+	queue_len := config.diskwriter_queue_len
+	if queue_len == 0 {
+		queue_len = diskwriter_queue_len_default
+	}
+
+	diskwriter.ch = make(chan *Haystack, queue_len)
+	diskwriter.stop = make(chan struct{})
+	diskwriter.stop_once = new(sync.Once)
+	diskwriter.running = true
+
+	diskwriter.done.Add(1)
+	go diskWriter(diskwriter.ch)
+
+	return nil
+}
+
+// Stop the disk writer, after it has written everything that's queued.
+// If the disk is full, that's one more try each, not waiting for space.
+// FlushHaystack() callers still waiting for room get ErrDiskWriterNotRunning.
+func StopDiskWriter() {
+	// Those callers hold the read lock, so let them go before we wait for
+	// the write lock. Otherwise with the disk full, nothing ever moves.
+	diskwriter.mutex.RLock()
+	stop, stop_once := diskwriter.stop, diskwriter.stop_once
+	diskwriter.mutex.RUnlock()
+	if stop_once != nil {
+		stop_once.Do(func() { close(stop) })
+	}
+
+	diskwriter.mutex.Lock()
+	if !diskwriter.running {
+		diskwriter.mutex.Unlock()
+		return
+	}
+	diskwriter.running = false
+	close(diskwriter.ch)
+	stop, stop_once = diskwriter.stop, diskwriter.stop_once // restarted meanwhile?
+	stop_once.Do(func() { close(stop) })
+	diskwriter.mutex.Unlock()
+
+	diskwriter.done.Wait()
+}
+
+// Queue a Haystack for writing to disk.
+// The caller must not use or change hs after this.
+func FlushHaystack(hs *Haystack) error {
+	// Read lock: many may queue at the same time, but not while we're stopping.
+	// With policy block we can hold it for a while, until there's room or
+	// StopDiskWriter() closes stop.
+	diskwriter.mutex.RLock()
+	defer diskwriter.mutex.RUnlock()
+
+	if !diskwriter.running {
+		return ErrDiskWriterNotRunning
+	}
+
+	switch config.diskwriter_queue_policy {
+	case diskwriter_policy_drop:
+		select {
+		case diskwriter.ch <- hs:
+		default:
+			diskwriter.dropped.Add(1)
+			log.Printf("Disk writer queue full, dropped Haystack with %d Haybales", len(hs.Haybale))
+		}
+
+	case diskwriter_policy_error:
+		select {
+		case diskwriter.ch <- hs:
+		default:
+			diskwriter.rejected.Add(1)
+			return ErrDiskWriterQueueFull
+		}
+
+	default: // block
+		select {
+		case diskwriter.ch <- hs:
+		case <-diskwriter.stop:
+			return ErrDiskWriterNotRunning
+		}
+	}
+
+	return nil
+}
+
+// Disk writer queue and counters
+func GetDiskWriterStats() DiskWriterStats {
+	diskwriter.mutex.RLock()
+	defer diskwriter.mutex.RUnlock()
+
+	return DiskWriterStats{
+		QueueDepth: len(diskwriter.ch),
+		QueueCap:   cap(diskwriter.ch),
+		Written:    diskwriter.written.Load(),
+		Dropped:    diskwriter.dropped.Load(),
+		Rejected:   diskwriter.rejected.Load(),
+		Errors:     diskwriter.errors.Load(),
+		DiskFull:   diskwriter.disk_full.Load(),
+		Retries:    diskwriter.retries.Load(),
+	}
+}
+
+// The go routine
+func diskWriter(ch chan *Haystack) {
+	defer diskwriter.done.Done()
+
+	for hs := range ch {
+		diskWriterWrite(hs)
+	}
+
+	// Stopping, finalize the working file
+	if err := rolloverClose(); err != nil {
+		diskwriter.errors.Add(1)
+		log.Printf("Disk writer: %v", err)
+	}
+}
+
+// Write one Haystack, waiting for disk space as per config disk_full_policy
+func diskWriterWrite(hs *Haystack) {
+	backoff := disk_full_backoff_min
+
+	for retries := 0; ; retries++ {
+		err := writeHaystack(hs)
+		diskwriter.disk_full.Store(isDiskFull(err))
+
+		if err == nil {
+			if retries > 0 {
+				log.Printf("Disk writer: disk space available again, Haystack written after %d retries", retries)
+			}
+			return
+		}
+
+		if !isDiskFull(err) || config.disk_full_policy == disk_full_policy_drop {
+			diskwriter.errors.Add(1)
+			log.Printf("Disk writer: %v", err)
+			return
+		}
+
+		select {
+		case <-diskwriter.stop:
+			diskwriter.errors.Add(1)
+			log.Printf("ALERT: Disk writer: disk full, stopping, Haystack with %d Haybales lost: %v", len(hs.Haybale), err)
+			return
+		default:
+		}
+
+		log.Printf("ALERT: Disk writer: disk full, keeping Haystack in memory, retrying in %v: %v", backoff, err)
+		diskwriter.retries.Add(1)
+
+		select {
+		case <-time.After(backoff):
+		case <-diskwriter.stop: // one more try
+		}
+		if backoff *= 2; backoff > disk_full_backoff_max {
+			backoff = disk_full_backoff_max
+		}
+	}
+}
+
+// Write a Haystack to its own file, or the working file with file_rollover
+func writeHaystack(hs *Haystack) error {
+	if config.file_rollover == file_rollover_hourly || config.file_rollover == file_rollover_daily {
+		return rolloverWrite(hs) // counted as written when the file is finalized
+	}
+
+	if err := writeHaystackFiles(hs); err != nil {
+		return err
+	}
+	diskwriter.written.Add(1)
+	recentAdd(hs) // config recent_max_size
+
+	return nil
+}
+
+// Write a Haystack file and its catalogue
+func writeHaystackFiles(hs *Haystack) error {
+	hs.SortAllBales()
+
+	data, sha512block, err := hs.Mem2Disk()
+	if err != nil {
+		return err
+	}
+
+	fname := filepath.Join(config.datastore_dir, hs.file_uuid+Haystack_file_ext)
+	if err := writeFileAtomic(fname, data); err != nil {
+		return err
+	}
+
+	// No catalogue, no file: it couldn't be verified, and a retry writes a new one
+	cname := filepath.Join(config.catalogue_dir, hs.CatalogueName())
+	if err := writeFileAtomic(cname, sha512block); err != nil {
+		fsys.Remove(fname)
+		return err
+	}
+
+	return nil
+}
+
+// Write to a temporary file first, so nobody ever sees a half-written file
+func writeFileAtomic(fname string, data []byte) error {
+	tmp := fname + ".tmp"
+
+	f, err := fsys.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, FilePermissions())
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", tmp, err)
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(FilePermissions()) // regardless of umask, or a stale tmp file from before
+	}
+	if err == nil {
+		err = f.Sync() // on disk, before it gets its real name
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fsys.Remove(tmp)
+		return fmt.Errorf("writing %s: %w", tmp, err)
+	}
+
+	if err := fsys.Rename(tmp, fname); err != nil {
+		fsys.Remove(tmp)
+		return fmt.Errorf("renaming %s: %w", tmp, err)
+	}
+
+	return nil
+}
+
+// EOF
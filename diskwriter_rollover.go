@@ -0,0 +1,391 @@
+// OpenActa/Haystack - disk writer, time bucketed files
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	With config file_rollover hourly or daily, the disk writer doesn't write
+	a file per Haystack. Instead, each Haystack's Haybales are appended to
+	the working file for the current hour/day (UTC), streamed like
+	IngestAndStream() does, so only its Dictionary stays in RAM.
+
+	Which period a Haystack belongs to goes by its newest record. When that's
+	past the current period, the working file is finalized (trailer, and its
+	catalogue written) and a new one started. Late data (an older period)
+	goes into the current file, rather than reopening old ones.
+	A file that would go past max_filesize is finalized early, the next one
+	carries on with the same period.
+
+	Files are named <period>-<file uuid>.hs, period as 20060102 (daily) or
+	20060102T15 (hourly). Until finalized, the working file has .tmp added,
+	so ListDatastore() and friends don't see it.
+
+	The working file has Haystacks in it that FlushHaystack() took, so we
+	don't give up on it when a write fails (disk full, say). What went in
+	half is cut off again, and the next try carries on from there; same for
+	finalizing it. Should we crash, or be killed, the working file stays as
+	.tmp, and its period is lost: there's no trailer (or catalogue), and we
+	don't pick it up again on restart.
+*/
+
+package haystack
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	file_rollover_none   = "none"
+	file_rollover_hourly = "hourly"
+	file_rollover_daily  = "daily"
+)
+
+const (
+	rollover_trailer_room = 4096 // keep this much below max_filesize, for the trailer
+	section_header_room   = 256  // section header, AES overhead and such
+)
+
+var errRolloverFull = errors.New("Haystack file full")
+
+// The working file, only touched by the disk writer go routine
+type rolloverFile struct {
+	hs     *Haystack // its Dictionary and file uuid, the Haybales aren't kept
+	period time.Time // start of the hour/day
+	fname  string    // final name, we write to fname + ".tmp" until it's done
+	f      file
+	sw     *streamWriter
+
+	prev_ofs   uint32 // where the previous Dictionary&Haybale went, for the trailer
+	time_first int64
+	time_last  int64
+
+	torn    bool // a write failed, there may be a bit of it after sw.ofs
+	trailer bool // finish(): trailer written
+	synced  bool // finish(): synced
+	closed  bool // finish(): closed
+	renamed bool // finish(): in place, only the catalogue to go
+}
+
+// Start of the hour/day ts (Unix nanosecs) is in, in UTC
+func rolloverPeriod(ts int64) time.Time {
+	t := time.Unix(0, ts).UTC()
+
+	if config.file_rollover == file_rollover_hourly {
+		return t.Truncate(time.Hour)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// Period bit of the filename
+func rolloverName(period time.Time) string {
+	if config.file_rollover == file_rollover_hourly {
+		return period.Format("20060102T15")
+	}
+	return period.Format("20060102")
+}
+
+// Append a Haystack to the working file, rolling over to a new one if needed.
+// Haybales come off hs as they're written, so a retry carries on from there.
+func rolloverWrite(hs *Haystack) error {
+	var newest int64
+	for _, hb := range hs.Haybale {
+		if hb.num_haystalks > 0 && hb.time_last > newest {
+			newest = hb.time_last
+		}
+	}
+	if newest == 0 {
+		return nil // nothing in it
+	}
+	period := rolloverPeriod(newest)
+
+	// Or finishing it failed after the trailer, then nothing more goes in
+	if r := diskwriter.rollover; r != nil && (period.After(r.period) || r.trailer) {
+		if err := r.finish(); err != nil {
+			return err
+		}
+		diskwriter.rollover = nil
+		diskwriter.written.Add(1)
+	}
+
+	for len(hs.Haybale) > 0 {
+		hb := hs.Haybale[0]
+
+		// Its dkeys, usually hs's. On a retry (disk full) it may have been
+		// moved over to a working file's Dictionary already.
+		d := &hs.Dict
+		if hb.HaystackPtr != nil {
+			d = &hb.HaystackPtr.Dict
+		}
+
+		if diskwriter.rollover == nil {
+			r, err := rolloverOpen(period)
+			if err != nil {
+				return err
+			}
+			diskwriter.rollover = r
+		}
+		r := diskwriter.rollover
+
+		err := r.add(hb, d)
+		if errors.Is(err, errRolloverFull) && r.time_first != 0 {
+			// The Haybale's dkeys are r's now, start afresh from there
+			if err := r.finish(); err != nil {
+				return err
+			}
+			diskwriter.rollover = nil
+			diskwriter.written.Add(1)
+
+			if diskwriter.rollover, err = rolloverOpen(r.period); err != nil {
+				return err
+			}
+			err = diskwriter.rollover.add(hb, &r.hs.Dict)
+		}
+		if err != nil {
+			return err
+		}
+
+		hs.Haybale = hs.Haybale[1:]
+	}
+
+	return nil
+}
+
+// Finalize the working file, if there is one (StopDiskWriter)
+func rolloverClose() error {
+	r := diskwriter.rollover
+	if r == nil {
+		return nil
+	}
+
+	if err := r.finish(); err != nil {
+		return err // still there, for another try
+	}
+	diskwriter.rollover = nil
+	diskwriter.written.Add(1)
+
+	return nil
+}
+
+// Create a new working file for the period, and write its header
+func rolloverOpen(period time.Time) (*rolloverFile, error) {
+	r, err := openWorkingFile(rolloverName(period) + "-")
+	if err != nil {
+		return nil, err
+	}
+	r.period = period
+
+	return r, nil
+}
+
+// Create a new working file, <prefix><file uuid>.hs(.tmp), and write its header.
+// Haybales go in with add(), finish() puts it in place.
+func openWorkingFile(prefix string) (*rolloverFile, error) {
+	r := &rolloverFile{hs: new(Haystack)}
+	r.hs.Dict.HaystackPtr = r.hs
+
+	header, err := r.hs.mem2DiskStart()
+	if err != nil {
+		return nil, err
+	}
+
+	r.fname = filepath.Join(config.datastore_dir, prefix+r.hs.file_uuid+Haystack_file_ext)
+
+	r.f, err = fsys.OpenFile(r.fname+".tmp", os.O_WRONLY|os.O_CREATE|os.O_EXCL, FilePermissions())
+	if err != nil {
+		return nil, err
+	}
+	if err := r.f.Chmod(FilePermissions()); err != nil { // regardless of umask
+		r.abandon()
+		return nil, err
+	}
+	if r.sw, err = newStreamWriter(r.f, r.hs.aes_key_uuid); err != nil {
+		r.abandon()
+		return nil, err
+	}
+
+	if err := r.sw.write(header); err != nil {
+		r.abandon()
+		return nil, fmt.Errorf("writing %s.tmp: %w", r.fname, err)
+	}
+
+	return r, nil
+}
+
+// Append one Haybale, whose dkeys are from Dictionary d.
+// errRolloverFull means nothing was written, but the dkeys were moved over.
+// Other errors: nothing was written either, we can try again.
+func (r *rolloverFile) add(hb *Haybale, d *Dictionary) error {
+	if hb.num_haystalks == 0 {
+		return nil
+	}
+	if err := r.untear(); err != nil {
+		return err
+	}
+
+	// The file has its own Dictionary, move the stalks over to its dkeys.
+	// Then the order within the Haybale changes, so sort it again.
+	for i := uint32(0); i < hb.num_haystalks; i++ {
+		s := hb.haystalk[i]
+		if int(s.dkey) >= len(d.dkey) || d.dkey[s.dkey] == nil {
+			return fmt.Errorf("stalk %d has dkey %d, not in the Dictionary", i, s.dkey)
+		}
+
+		dkey, err := r.hs.Dict.FindOrAddKeyhash(*d.dkey[s.dkey])
+		if err != nil {
+			return err
+		}
+		s.dkey = dkey
+	}
+
+	hb.HaystackPtr = r.hs
+	hb.is_sorted_immutable = false
+	if err := hb.Rebuild(); err != nil {
+		return err
+	}
+
+	data, err := hb.Mem2Disk(&r.hs.Dict)
+	if err != nil {
+		return err
+	}
+
+	// For the first Haybale, prev_ofs will be 0: that writes out a full Dictionary.
+	// After that, only the keys that were added since.
+	// Check the size before this, as it marks the keys as written.
+	dict_max := uint64(section_header_room)
+	for i, k := range r.hs.Dict.dkey {
+		if k != nil && (r.hs.Dict.dirty[i] || r.prev_ofs == 0) {
+			dict_max += uint64(3 + 1 + len(*k)) // uncompressed, so worst case
+		}
+	}
+	if uint64(r.sw.ofs)+dict_max+uint64(len(data))+rollover_trailer_room > max_filesize {
+		return errRolloverFull
+	}
+
+	// In one go, so a failed write has sw (offset, SHA, MAC) as it was.
+	// The keys are only written if it worked.
+	cur_ofs := r.sw.ofs
+	dirty := append([]bool(nil), r.hs.Dict.dirty...)
+	dc, err := r.hs.Dict.Mem2Disk(r.prev_ofs)
+	if err == nil {
+		err = r.write(append(dc, data...))
+	}
+	if err != nil {
+		copy(r.hs.Dict.dirty, dirty)
+		return err
+	}
+
+	r.prev_ofs = cur_ofs
+
+	if r.time_first == 0 || hb.time_first < r.time_first {
+		r.time_first = hb.time_first
+	}
+	if hb.time_last > r.time_last {
+		r.time_last = hb.time_last
+	}
+
+	return nil
+}
+
+// Write the trailer, put the file in place, and write its catalogue.
+// After an error, it can be called again, and carries on where it failed.
+func (r *rolloverFile) finish() error {
+	r.hs.time_first = r.time_first
+	r.hs.time_last = r.time_last
+
+	if !r.trailer {
+		if err := r.untear(); err != nil {
+			return err
+		}
+
+		trailer, err := r.hs.mem2DiskFileTrailer(r.prev_ofs, r.time_first, r.time_last, r.sw.macSum())
+		if err != nil {
+			return err
+		}
+		if err := r.write(trailer); err != nil {
+			return err
+		}
+		r.trailer = true
+	}
+
+	if !r.synced {
+		if err := r.f.Sync(); err != nil { // on disk, before it gets its real name
+			return fmt.Errorf("writing %s.tmp: %w", r.fname, err)
+		}
+		r.synced = true
+	}
+
+	if !r.closed {
+		r.closed = true // whatever Close() says, the file is
+		if err := r.f.Close(); err != nil {
+			return fmt.Errorf("closing %s.tmp: %w", r.fname, err)
+		}
+	}
+	if !r.renamed {
+		if err := fsys.Rename(r.fname+".tmp", r.fname); err != nil {
+			return fmt.Errorf("renaming %s.tmp: %w", r.fname, err)
+		}
+		r.renamed = true
+	}
+
+	sha512section, err := r.hs.mem2DiskSHA512block(r.sw.sha.Sum(nil), r.time_first, r.time_last)
+	if err != nil {
+		return err
+	}
+
+	cname := filepath.Join(config.catalogue_dir, r.hs.CatalogueName())
+	return writeFileAtomic(cname, sha512section)
+}
+
+// Append to the working file, in one go. If that fails, what went in of it
+// is cut off again (untear) before the next write.
+func (r *rolloverFile) write(data []byte) error {
+	if err := r.sw.write(data); err != nil {
+		r.torn = true
+		return fmt.Errorf("writing %s.tmp: %w", r.fname, err)
+	}
+
+	return nil
+}
+
+// Cut off what a failed write left after sw.ofs
+func (r *rolloverFile) untear() error {
+	if !r.torn {
+		return nil
+	}
+
+	if err := r.f.Truncate(int64(r.sw.ofs)); err != nil {
+		return fmt.Errorf("truncating %s.tmp: %w", r.fname, err)
+	}
+	if _, err := r.f.Seek(int64(r.sw.ofs), io.SeekStart); err != nil {
+		return fmt.Errorf("truncating %s.tmp: %w", r.fname, err)
+	}
+	r.torn = false
+
+	return nil
+}
+
+// Give up on the working file. Only for one with nothing in it that isn't
+// somewhere else as well: just opened, or a merge's (see MergeFiles()).
+func (r *rolloverFile) abandon() {
+	r.f.Close()
+	fsys.Remove(r.fname + ".tmp")
+}
+
+// EOF
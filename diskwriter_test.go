@@ -0,0 +1,209 @@
+// OpenActa/Haystack - background disk writer - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Queue full: drop and error policies. No writer go routine, so nothing gets taken off the queue.
+func TestDiskWriterQueueFull(t *testing.T) {
+	setTestConfig(t)
+
+	for _, policy := range []string{diskwriter_policy_drop, diskwriter_policy_error} {
+		config.diskwriter_queue_policy = policy
+
+		diskwriter.ch = make(chan *Haystack, 1)
+		diskwriter.running = true
+		dropped, rejected := diskwriter.dropped.Load(), diskwriter.rejected.Load()
+
+		if err := FlushHaystack(new(Haystack)); err != nil {
+			t.Fatalf("policy %s: first flush: %v", policy, err)
+		}
+
+		err := FlushHaystack(new(Haystack))
+		stats := GetDiskWriterStats()
+		if stats.QueueDepth != 1 || stats.QueueCap != 1 {
+			t.Errorf("policy %s: queue %d/%d, want 1/1", policy, stats.QueueDepth, stats.QueueCap)
+		}
+
+		switch policy {
+		case diskwriter_policy_drop:
+			if err != nil || stats.Dropped != dropped+1 {
+				t.Errorf("policy %s: err %v, dropped %d", policy, err, stats.Dropped-dropped)
+			}
+		case diskwriter_policy_error:
+			if !errors.Is(err, ErrDiskWriterQueueFull) || stats.Rejected != rejected+1 {
+				t.Errorf("policy %s: err %v, rejected %d", policy, err, stats.Rejected-rejected)
+			}
+		}
+
+		diskwriter.running = false
+		diskwriter.ch = nil
+	}
+}
+
+// Not configured, the queue still has room for a few
+func TestDiskWriterQueueDefault(t *testing.T) {
+	setTestConfig(t)
+	config.diskwriter_queue_len = 0
+
+	if err := StartDiskWriter(); err != nil {
+		t.Fatal(err)
+	}
+	defer StopDiskWriter()
+
+	if stats := GetDiskWriterStats(); stats.QueueCap != diskwriter_queue_len_default {
+		t.Errorf("queue of %d", stats.QueueCap)
+	}
+}
+
+// Haystack file and catalogue end up in their dirs
+func TestDiskWriterWrite(t *testing.T) {
+	setTestConfig(t)
+	config.datastore_dir = t.TempDir()
+	config.catalogue_dir = t.TempDir()
+	config.diskwriter_queue_len = 2
+	config.diskwriter_queue_policy = diskwriter_policy_block
+
+	if err := StartDiskWriter(); err != nil {
+		t.Fatal(err)
+	}
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+	if err := FlushHaystack(hs); err != nil {
+		t.Fatal(err)
+	}
+	StopDiskWriter()
+
+	if err := FlushHaystack(new(Haystack)); !errors.Is(err, ErrDiskWriterNotRunning) {
+		t.Errorf("flush after stop: %v", err)
+	}
+
+	if stats := GetDiskWriterStats(); stats.Written < 1 || stats.Errors != 0 {
+		t.Errorf("stats after write: %+v", stats)
+	}
+
+	data, err := os.ReadFile(filepath.Join(config.datastore_dir, hs.file_uuid+Haystack_file_ext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(config.catalogue_dir, hs.CatalogueName())); err != nil {
+		t.Error(err)
+	}
+
+	hs2 := new(Haystack)
+	if err := hs2.Disk2Mem(data); err != nil {
+		t.Fatal(err)
+	}
+	if n := hs2.CountKeyValArray(map[string]string{"dest_port": "443"}); n != hs.CountKeyValArray(map[string]string{"dest_port": "443"}) {
+		t.Errorf("written file has %d matches", n)
+	}
+}
+
+// file_rollover hourly: Haystacks go into a file per hour, by their newest record
+func TestDiskWriterRollover(t *testing.T) {
+	setTestConfig(t)
+	config.datastore_dir = t.TempDir()
+	config.catalogue_dir = t.TempDir()
+	config.diskwriter_queue_len = 4
+	config.diskwriter_queue_policy = diskwriter_policy_block
+	config.file_rollover = file_rollover_hourly
+
+	// One bunch, in a Haystack of its own
+	oneBunch := func(ts string) *Haystack {
+		hs := new(Haystack)
+		hb := &Haybale{HaystackPtr: hs}
+		hb.InsertBunch(&hs.Dict, map[string]interface{}{Timestamp_key: ts, "extra": "yes", "dest_port": "443"})
+		hs.Haybale = append(hs.Haybale, hb)
+		return hs
+	}
+
+	if err := StartDiskWriter(); err != nil {
+		t.Fatal(err)
+	}
+	written := GetDiskWriterStats().Written
+
+	for _, hs := range []*Haystack{
+		newTestHaystack(t, "testdata/head5.json", 2), // 2023-06-04 00:00 - 00:01
+		oneBunch("2023-06-04T00:30:00Z"),
+		oneBunch("2023-06-04T01:10:00Z"),
+		oneBunch("2023-06-04T00:59:00Z"), // late, goes with 01:10
+	} {
+		if err := FlushHaystack(hs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	StopDiskWriter()
+
+	if stats := GetDiskWriterStats(); stats.Written != written+2 || stats.Errors != 0 {
+		t.Errorf("stats after write: %+v", stats)
+	}
+
+	entries, err := os.ReadDir(config.datastore_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("%d files in datastore, want 2", len(entries))
+	}
+
+	for i, want := range []struct {
+		prefix  string
+		bunches uint64
+		port443 uint
+		extra   uint
+	}{
+		{"20230604T00-", 6, 5, 1},
+		{"20230604T01-", 2, 2, 2},
+	} {
+		name := entries[i].Name()
+		if !strings.HasPrefix(name, want.prefix) || filepath.Ext(name) != Haystack_file_ext {
+			t.Errorf("file %d is %s, want %s<uuid>%s", i, name, want.prefix, Haystack_file_ext)
+		}
+
+		data, err := os.ReadFile(filepath.Join(config.datastore_dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hs := new(Haystack)
+		if err := hs.Disk2Mem(data); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if n := hs.Info().NumBunches; n != want.bunches {
+			t.Errorf("%s: %d bunches, want %d", name, n, want.bunches)
+		}
+		if n := hs.CountKeyValArray(map[string]string{"dest_port": "443"}); n != want.port443 {
+			t.Errorf("%s: dest_port=443 %d times, want %d", name, n, want.port443)
+		}
+		if n := hs.CountKeyValArray(map[string]string{"extra": "yes"}); n != want.extra {
+			t.Errorf("%s: extra=yes %d times, want %d", name, n, want.extra)
+		}
+
+		if _, err := os.Stat(filepath.Join(config.catalogue_dir, hs.CatalogueName())); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// EOF
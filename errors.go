@@ -0,0 +1,61 @@
+// OpenActa/Haystack - errors
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	Errors callers may want to act on. They're returned wrapped (with the
+	details), so check with errors.Is(err, ErrCorrupt) and such, not ==.
+	Others, like ErrDiskWriterQueueFull (diskwriter.go) and QueryError
+	(query.go), live with their code.
+*/
+
+package haystack
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reading a Haystack file fails with one of these when the data is bad.
+// Truncated files (e.g. an incomplete transfer) may be fine once complete,
+// corrupt ones won't be.
+var (
+	ErrTruncated      = errors.New("Haystack file truncated")
+	ErrCorrupt        = errors.New("Haystack file corrupt")
+	ErrUnknownVersion = errors.New("Haystack file version unknown")
+)
+
+// We don't have the AES key a file was written with, or it's not the right
+// one. Also for keys in the keystore that can't be right (bad length).
+// A failed decrypt is ErrCorrupt as well, it can be either.
+var ErrWrongKey = errors.New("wrong AES key")
+
+// Inserting a bunch (record)
+var (
+	ErrKeyTooLong   = errors.New("key too long")
+	ErrNoTimestamp  = errors.New("no " + Timestamp_key + " field")
+	ErrBadTimestamp = errors.New("can't parse " + Timestamp_key)
+	ErrDictFull     = errors.New("Dictionary full")
+)
+
+// Dictionary over config dict_fill_max, no new keys. It's ErrDictFull
+// as well, for callers that don't care which.
+var ErrDictNearFull = fmt.Errorf("%w (over dict_fill_max)", ErrDictFull)
+
+// RenameKey() to a name that's already a key, see RenameKeyMerge()
+var ErrKeyExists = errors.New("key already exists")
+
+// EOF
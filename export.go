@@ -0,0 +1,173 @@
+// OpenActa/Haystack - search result formats
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	Search results as []map[string]string, written out for a person or
+	another tool:
+
+	json	one JSON array of objects
+	ndjson	one JSON object per line (what SearchKeyValArrayTo() writes)
+	csv	header row, then a row per result
+	table	aligned columns, for reading in a terminal
+	count	just the number of results
+
+	Bunches don't all have the same keys. csv and table get a column for
+	every key in any result, _timestamp first and the rest sorted, and an
+	empty cell where a result doesn't have it.
+*/
+
+package haystack
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+var ExportFormats = []string{"json", "ndjson", "csv", "table", "count"}
+
+// Is this one of ExportFormats?
+func ValidExportFormat(format string) bool {
+	for _, f := range ExportFormats {
+		if f == format {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Write results to w in format, see the top of this file
+func ExportResults(w io.Writer, format string, results []map[string]string) error {
+	switch format {
+	case "json":
+		return exportJSON(w, results)
+	case "ndjson":
+		return exportNDJSON(w, results)
+	case "csv":
+		return exportCSV(w, results)
+	case "table":
+		return exportTable(w, results)
+	case "count":
+		_, err := fmt.Fprintf(w, "%d\n", len(results))
+		return err
+	}
+
+	return fmt.Errorf("unknown output format '%s', must be one of %s", format, strings.Join(ExportFormats, "/"))
+}
+
+// All keys in any of the results, _timestamp first, then the rest sorted
+func exportColumns(results []map[string]string) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, r := range results {
+		for k := range r {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i] == Timestamp_key || keys[j] == Timestamp_key {
+			return keys[i] == Timestamp_key
+		}
+		return keys[i] < keys[j]
+	})
+
+	return keys
+}
+
+func exportJSON(w io.Writer, results []map[string]string) error {
+	if len(results) == 0 {
+		_, err := io.WriteString(w, "[]\n")
+		return err
+	}
+
+	sep := "[\n"
+	for _, r := range results {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s%s", sep, data); err != nil {
+			return err
+		}
+		sep = ",\n"
+	}
+
+	_, err := io.WriteString(w, "\n]\n")
+	return err
+}
+
+func exportNDJSON(w io.Writer, results []map[string]string) error {
+	enc := json.NewEncoder(w) // Encode() adds the newline
+	for _, r := range results {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func exportCSV(w io.Writer, results []map[string]string) error {
+	cols := exportColumns(results)
+	cw := csv.NewWriter(w)
+
+	if err := cw.Write(cols); err != nil {
+		return err
+	}
+	row := make([]string, len(cols))
+	for _, r := range results {
+		for i, k := range cols {
+			row[i] = r[k]
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func exportTable(w io.Writer, results []map[string]string) error {
+	cols := exportColumns(results)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	// A tab or newline in a value would wreck the columns
+	clean := strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+
+	fmt.Fprintln(tw, strings.Join(cols, "\t"))
+	row := make([]string, len(cols))
+	for _, r := range results {
+		for i, k := range cols {
+			row[i] = clean.Replace(r[k])
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+
+	return tw.Flush() // tabwriter holds on to write errors until here
+}
+
+// EOF
@@ -0,0 +1,117 @@
+// OpenActa/Haystack - search result formats - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var export_test_results = []map[string]string{
+	{Timestamp_key: "2023-06-04T00:00:59Z", "dest_port": "443", "proto": "TCP"},
+	{Timestamp_key: "2023-06-04T00:01:00Z", "dest_port": "53", "query": "a,b \"c\"\td"},
+}
+
+func TestExportResults(t *testing.T) {
+	want_cols := []string{Timestamp_key, "dest_port", "proto", "query"}
+	if cols := exportColumns(export_test_results); !reflect.DeepEqual(cols, want_cols) {
+		t.Errorf("columns %v, want %v", cols, want_cols)
+	}
+
+	// json and ndjson read back the same
+	var buf bytes.Buffer
+	if err := ExportResults(&buf, "json", export_test_results); err != nil {
+		t.Fatal(err)
+	}
+	var got []map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil || !reflect.DeepEqual(got, export_test_results) {
+		t.Errorf("json: %v\n%s", err, buf.String())
+	}
+
+	buf.Reset()
+	if err := ExportResults(&buf, "ndjson", export_test_results); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(export_test_results) {
+		t.Fatalf("ndjson: %d lines\n%s", len(lines), buf.String())
+	}
+	for i, line := range lines {
+		var m map[string]string
+		if err := json.Unmarshal([]byte(line), &m); err != nil || !reflect.DeepEqual(m, export_test_results[i]) {
+			t.Errorf("ndjson line %d: %v %s", i, err, line)
+		}
+	}
+
+	// csv quotes what it needs to, empty cells for missing keys
+	buf.Reset()
+	if err := ExportResults(&buf, "csv", export_test_results); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil || len(records) != 3 {
+		t.Fatalf("csv: %d records: %v", len(records), err)
+	}
+	if !reflect.DeepEqual(records[0], want_cols) || records[1][3] != "" || records[2][3] != export_test_results[1]["query"] {
+		t.Errorf("csv: %q", records)
+	}
+
+	// table: columns line up, whatever the value lengths
+	buf.Reset()
+	if err := ExportResults(&buf, "table", export_test_results); err != nil {
+		t.Fatal(err)
+	}
+	lines = strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("table: %d lines\n%s", len(lines), buf.String())
+	}
+	col := strings.Index(lines[0], "dest_port")
+	for _, line := range lines[1:] {
+		if line[col-2:col] != "  " || line[col] == ' ' {
+			t.Errorf("table: dest_port not at column %d\n%s", col, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "\t") {
+		t.Errorf("table: tab in the output\n%s", buf.String())
+	}
+
+	buf.Reset()
+	if err := ExportResults(&buf, "count", export_test_results); err != nil || buf.String() != "2\n" {
+		t.Errorf("count: %q %v", buf.String(), err)
+	}
+
+	buf.Reset()
+	if err := ExportResults(&buf, "json", nil); err != nil || buf.String() != "[]\n" {
+		t.Errorf("json, no results: %q %v", buf.String(), err)
+	}
+
+	if err := ExportResults(&buf, "xml", export_test_results); err == nil || ValidExportFormat("xml") {
+		t.Errorf("xml is not a format we do")
+	}
+	for _, f := range ExportFormats {
+		if !ValidExportFormat(f) {
+			t.Errorf("%s not valid", f)
+		}
+	}
+}
+
+// EOF
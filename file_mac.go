@@ -0,0 +1,153 @@
+// OpenActa/Haystack - file MAC
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	AES-GCM authenticates each section on its own (with its header as AAD).
+	That doesn't stop anyone with the file from dropping sections, or
+	swapping Dictionary+Haybale pairs around: they all still decrypt fine.
+
+	So since 1.2, the trailer of an encrypted file also has a MAC over all
+	of the file before it, HMAC-SHA256 with a key derived from the AES key.
+	Sections can't move or go missing without that changing. It's checked
+	before we look at anything else in the file (Disk2Mem, OpenMapped).
+	The trailer itself is covered by its GCM tag.
+
+	The header says which version the file is, and the MAC is what
+	authenticates the header. So we don't take its word that a file is
+	from before MACs: an encrypted 1.1 file (same section layout) without
+	one is refused. Encrypted 1.0 sections have a different header, so
+	their AAD, and can't be swapped in from newer files.
+
+	Unencrypted files have no key, so no MAC. For those (and in general),
+	the SHA-512 in the catalogue covers the whole file.
+*/
+
+package haystack
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+)
+
+const (
+	file_mac_len      = sha256.Size
+	file_mac_key_info = "OpenActa/Haystack file MAC"
+	len_DiskTrailer   = 4 + 8 + 8 // without the MAC
+)
+
+// HMAC for the file MAC, nil if the file isn't encrypted
+func newFileMAC(aes_key_uuid string) (hash.Hash, error) {
+	if aes_key_uuid == "" {
+		return nil, nil
+	}
+
+	aes_key, ok := config.aes_keystore_array[aes_key_uuid]
+	if !ok {
+		return nil, fmt.Errorf("%w: no AES key %s", ErrWrongKey, aes_key_uuid)
+	}
+
+	// Not the AES key as is, keys shouldn't be used for two things
+	kdf := hmac.New(sha256.New, aes_key)
+	kdf.Write([]byte(file_mac_key_info))
+
+	return hmac.New(sha256.New, kdf.Sum(nil)), nil
+}
+
+// Check the file MAC in the trailer, over all of data before it.
+// Files from before 1.2, or not encrypted, don't have one.
+func verifyFileMAC(data []byte) error {
+	var h *diskHeader
+	var ofs int
+	var last *diskSection // the section before, for errors
+
+	for {
+		if ofs >= len(data) {
+			return fmt.Errorf("%w: no trailer section after %d bytes", ErrTruncated, ofs)
+		}
+
+		var version_minor uint8
+		if h != nil {
+			version_minor = h.version_minor
+		}
+		s, err := getDisk2MemNextSection(data, ofs, version_minor)
+		if err != nil {
+			return signatureAfter(err, last)
+		}
+		last = s
+
+		if (s.ofs == 0) != (s.id == section_header) {
+			return fmt.Errorf("%w: header section must be first (and only once)", ErrCorrupt)
+		}
+
+		switch s.id {
+		case section_header:
+			content, err := getDisk2MemSectionContent(s, "")
+			if err != nil {
+				return err
+			}
+			if h, err = getDisk2MemHeaderContent(content); err != nil {
+				return err
+			}
+			if h.aes_key_uuid == "" {
+				return nil // nothing to check with
+			}
+
+		case section_trailer:
+			content, err := getDisk2MemSectionContent(s, h.aes_key_uuid)
+			if err != nil {
+				return err
+			}
+			if len(content) < len_DiskTrailer+file_mac_len {
+				// 1.0 had none. 1.1 didn't either, but the header isn't
+				// authenticated without the MAC: a 1.2 file can say it's
+				// 1.1 and drop the MAC, with the same section layout (AAD).
+				// So from 1.1, an encrypted file has to have one.
+				if h.version_minor == 0 {
+					return nil // from before we had them
+				}
+				return fmt.Errorf("%w: trailer has no file MAC", ErrCorrupt)
+			}
+
+			mac, err := newFileMAC(h.aes_key_uuid)
+			if err != nil {
+				return err
+			}
+			mac.Write(data[:s.ofs])
+			if !hmac.Equal(mac.Sum(nil), content[len_DiskTrailer:len_DiskTrailer+file_mac_len]) {
+				return fmt.Errorf("%w: file MAC doesn't match, sections changed, dropped or moved", ErrCorrupt)
+			}
+			return nil
+		}
+
+		ofs = s.next()
+	}
+}
+
+// Helper for whole files in memory: MAC over data, nil if not encrypted
+func fileMAC(aes_key_uuid string, data []byte) ([]byte, error) {
+	mac, err := newFileMAC(aes_key_uuid)
+	if mac == nil || err != nil {
+		return nil, err
+	}
+	mac.Write(data)
+
+	return mac.Sum(nil), nil
+}
+
+// EOF
@@ -0,0 +1,189 @@
+// OpenActa/Haystack - file MAC - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// head5.json in 3 Haybales, and where its sections are
+func testMACFile(t *testing.T) ([]byte, []SectionInfo) {
+	data, _, err := newTestHaystack(t, "testdata/head5.json", 2).Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sections, err := ListSections(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data, sections
+}
+
+// Bytes of section i (sections has the trailer last)
+func sectionBytes(data []byte, sections []SectionInfo, i int) []byte {
+	end := len(data)
+	if i+1 < len(sections) {
+		end = sections[i+1].Offset
+	}
+	return data[sections[i].Offset:end]
+}
+
+func TestFileMACTamper(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	data, sections := testMACFile(t)
+
+	// header, 3x dictionary+haybale, trailer
+	var ids []string
+	for _, si := range sections {
+		ids = append(ids, si.Type())
+	}
+	if strings.Join(ids, " ") != "header dictionary haybale dictionary haybale dictionary haybale trailer" {
+		t.Fatalf("sections: %v", ids)
+	}
+	if trailer := sections[len(sections)-1]; trailer.UncLen != len_DiskTrailer+file_mac_len {
+		t.Fatalf("trailer of %d bytes", trailer.UncLen)
+	}
+
+	if err := new(Haystack).Disk2Mem(data); err != nil {
+		t.Fatalf("untouched: %v", err)
+	}
+
+	piece := func(i int) []byte { return sectionBytes(data, sections, i) }
+	join := func(is ...int) []byte {
+		var b []byte
+		for _, i := range is {
+			b = append(b, piece(i)...)
+		}
+		return b
+	}
+
+	for _, tt := range []struct {
+		what string
+		data []byte
+	}{
+		{"second and third dictionary+haybale swapped", join(0, 1, 2, 5, 6, 3, 4, 7)},
+		{"last dictionary+haybale dropped", join(0, 1, 2, 3, 4, 7)},
+		{"second haybale repeated", join(0, 1, 2, 3, 4, 3, 4, 5, 6, 7)},
+	} {
+		hs := new(Haystack)
+		err := hs.Disk2Mem(tt.data)
+		if !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), "MAC") {
+			t.Errorf("%s: %v", tt.what, err)
+		}
+		if len(hs.Haybale) != 0 {
+			t.Errorf("%s: %d Haybales loaded anyway", tt.what, len(hs.Haybale))
+		}
+
+		fname := filepath.Join(t.TempDir(), "tampered.hs")
+		if err := os.WriteFile(fname, tt.data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if m, err := OpenMapped(fname); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: OpenMapped: %v", tt.what, err)
+			if m != nil {
+				m.Close()
+			}
+		}
+	}
+
+	// The trailer of another file (same key) doesn't fit either
+	other, other_sections := testMACFile(t)
+	swapped := append(bytes.Clone(data[:sections[len(sections)-1].Offset]),
+		sectionBytes(other, other_sections, len(other_sections)-1)...)
+	if err := new(Haystack).Disk2Mem(swapped); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("other trailer: %v", err)
+	}
+}
+
+// Saying it's a 1.1 file, from before the MAC, doesn't get around it
+func TestFileMACDowngrade(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	data, sections := testMACFile(t)
+
+	// Header says 1.1 (with its CRC fixed up), last dictionary+haybale
+	// dropped, and a trailer without a MAC
+	hdr := bytes.Clone(sectionBytes(data, sections, 0))
+	hdr[min_DiskHeaderBaselen+1] = 1
+	binary.LittleEndian.PutUint32(hdr[12:], crc32.ChecksumIEEE(hdr[min_DiskHeaderBaselen:]))
+
+	trailer, err := (&Haystack{aes_key_uuid: test_aes_uuid}).mem2DiskFileTrailer(uint32(sections[3].Offset), 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	downgraded := append(hdr, data[sections[1].Offset:sections[5].Offset]...)
+	downgraded = append(downgraded, trailer...)
+
+	hs := new(Haystack)
+	if err := hs.Disk2Mem(downgraded); !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), "MAC") {
+		t.Errorf("downgraded to 1.1: %v", err)
+	}
+	if len(hs.Haybale) != 0 {
+		t.Errorf("%d Haybales loaded anyway", len(hs.Haybale))
+	}
+}
+
+// Streamed files get one too, unencrypted files don't
+func TestFileMACStreamAndPlain(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	json, err := os.ReadFile("testdata/head5.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := new(Haystack).IngestAndStream(bytes.NewReader(json), &buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyFileMAC(buf.Bytes()); err != nil {
+		t.Errorf("streamed: %v", err)
+	}
+	sections, err := ListSections(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trailer := sections[len(sections)-1]; trailer.UncLen != len_DiskTrailer+file_mac_len {
+		t.Errorf("streamed: trailer of %d bytes", trailer.UncLen)
+	}
+
+	config.encryption_disabled = true
+	data, sections := testMACFile(t)
+	if trailer := sections[len(sections)-1]; trailer.UncLen != len_DiskTrailer {
+		t.Errorf("unencrypted: trailer of %d bytes", trailer.UncLen)
+	}
+	if err := new(Haystack).Disk2Mem(data); err != nil {
+		t.Errorf("unencrypted: %v", err)
+	}
+}
+
+// EOF
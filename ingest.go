@@ -0,0 +1,390 @@
+// OpenActa/Haystack - ingest NDJSON from network connections
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	Live log shipping: clients connect (TCP, unix socket, whatever the
+	net.Listener is) and send NDJSON, one record per line.
+	All connections feed the same Haystack, in Haybales.
+
+	A Haybale is closed (and a new one started) as per config
+	haybale_wait_minsize and haybale_wait_maxtime (both must be true,
+	0 = rule inactive), or when it hits Max_memsize.
+	The Haystack goes to the disk writer (see diskwriter.go) when it reaches
+	haystack_wait_maxsize, or when a Haybale was closed because of
+	haybale_wait_maxtime, so data doesn't sit in RAM forever.
+	The disk writer must be running, StartDiskWriter(). To stop the lot
+	without losing what's in RAM, see ShutDown().
+
+	config max_ingest_rate limits the records/sec over all connections,
+	ingest_rate_policy says whether we make senders wait or shed the excess.
+
+	IngestSnapshot() gives a read-only view of the closed Haybales, for
+	searching while ingest carries on.
+*/
+
+package haystack
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	max_line_size_lower   = 64 * 1024 // bufio.Scanner's own default
+	max_line_size_upper   = max_filesize
+	max_line_size_default = 16 * 1024 * 1024
+)
+
+const (
+	ingest_rate_policy_block = "block"
+	ingest_rate_policy_shed  = "shed"
+)
+
+type IngestStats struct {
+	Connections uint64 // accepted so far
+	Active      int64  // connections open right now
+	Records     uint64 // inserted
+	Skipped     uint64 // lines we couldn't parse, records we couldn't insert
+	Flushed     uint64 // Haystacks handed to the disk writer
+	Throttled   uint64 // records that had to wait (rate policy block)
+	Shed        uint64 // records dropped (rate policy shed)
+}
+
+var ingester struct {
+	mutex    sync.Mutex // protects hs, cur_hb, hb_start, hs_size
+	hs       *Haystack
+	cur_hb   *Haybale
+	hb_start time.Time // when the first record went into cur_hb
+	hs_size  uint64    // Memsize of the closed Haybales in hs
+
+	connections atomic.Uint64
+	active      atomic.Int64
+	records     atomic.Uint64
+	skipped     atomic.Uint64
+	flushed     atomic.Uint64
+	throttled   atomic.Uint64
+	shed        atomic.Uint64
+
+	limiter rateLimiter
+	serving sync.WaitGroup // ServeIngest() calls, see ShutDown()
+}
+
+// Accept connections on listener, and ingest NDJSON from each of them.
+// Returns when the listener is closed (nil) or fails. Open connections are
+// then closed, and whatever we have is handed to the disk writer.
+func ServeIngest(listener net.Listener) error {
+	ingester.serving.Add(1)
+	defer ingester.serving.Done()
+
+	var wg sync.WaitGroup
+	var conns sync.Map // open connections, so we can close them on the way out
+
+	// Time based Haybale flushing, also when nothing comes in
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ingester.mutex.Lock()
+				ingestCheckFlush()
+				ingester.mutex.Unlock()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var err error
+	for {
+		conn, aerr := listener.Accept()
+		if aerr != nil {
+			if !errors.Is(aerr, net.ErrClosed) {
+				err = aerr
+			}
+			break
+		}
+
+		ingester.connections.Add(1)
+		conns.Store(conn, true)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ingestConn(conn)
+			conns.Delete(conn)
+		}()
+	}
+
+	close(done)
+	conns.Range(func(c, _ any) bool {
+		c.(net.Conn).Close()
+		return true
+	})
+	wg.Wait()
+
+	ingester.mutex.Lock()
+	ingestFlushHaystack()
+	ingester.mutex.Unlock()
+
+	return err
+}
+
+// Ingest counters
+func GetIngestStats() IngestStats {
+	return IngestStats{
+		Connections: ingester.connections.Load(),
+		Active:      ingester.active.Load(),
+		Records:     ingester.records.Load(),
+		Skipped:     ingester.skipped.Load(),
+		Flushed:     ingester.flushed.Load(),
+		Throttled:   ingester.throttled.Load(),
+		Shed:        ingester.shed.Load(),
+	}
+}
+
+// Snapshot of what's been ingested and not yet handed to the disk writer,
+// see Haystack.Snapshot(). Records in the current (open) Haybale aren't in it.
+func IngestSnapshot() *Haystack {
+	ingester.mutex.Lock()
+	defer ingester.mutex.Unlock()
+
+	if ingester.hs == nil {
+		return new(Haystack)
+	}
+	return ingester.hs.Snapshot()
+}
+
+// A Scanner for NDJSON, one record per line, lines up to config
+// max_line_size. bufio.Scanner on its own stops at 64K.
+func NewLineScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, max_line_size_lower), maxLineSize())
+
+	return scanner
+}
+
+// config max_line_size, 0 = default
+func maxLineSize() int {
+	if config.max_line_size == 0 {
+		return max_line_size_default
+	}
+	return int(config.max_line_size)
+}
+
+// What scanner.Err() means, after reading line lines. The Scanner just
+// stops at a line that's too long, this says which one and why.
+func LineScanError(err error, line int) error {
+	if errors.Is(err, bufio.ErrTooLong) {
+		return fmt.Errorf("line %d longer than max_line_size (%d bytes): %w", line+1, maxLineSize(), err)
+	}
+
+	return fmt.Errorf("after line %d: %w", line, err)
+}
+
+// Read NDJSON from one connection, until it's closed (by either side).
+// Bad lines are skipped, a read error ends this connection only.
+func ingestConn(conn net.Conn) {
+	ingester.active.Add(1)
+	defer ingester.active.Add(-1)
+	defer conn.Close()
+
+	scanner := NewLineScanner(conn)
+
+	var line int
+	for scanner.Scan() {
+		line++
+
+		flats, err := JSONToKVmaps(scanner.Bytes())
+		if err != nil {
+			ingester.skipped.Add(1)
+			log.Printf("Ingest %s: skipping line %d: %v", conn.RemoteAddr(), line, err)
+			continue
+		}
+
+		for _, flat := range flats {
+			if !ingestRateLimit() {
+				continue
+			}
+
+			ingester.mutex.Lock()
+			err := ingestInsert(flat)
+			ingester.mutex.Unlock()
+
+			if err != nil {
+				if !errors.Is(err, ErrDictFull) { // that one went in, just not all of it
+					ingester.skipped.Add(1)
+				}
+				log.Printf("Ingest %s: line %d: %v", conn.RemoteAddr(), line, err)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("Ingest %s: closing: %v", conn.RemoteAddr(), LineScanError(err, line))
+	}
+}
+
+// Apply config max_ingest_rate to one record: false means shed it.
+// With policy block we wait here, holding up only this connection.
+func ingestRateLimit() bool {
+	rate := float64(config.max_ingest_rate)
+	if rate == 0 {
+		return true
+	}
+
+	wait := ingester.limiter.take(rate, time.Now())
+	if wait == 0 {
+		return true
+	}
+
+	if config.ingest_rate_policy == ingest_rate_policy_shed {
+		ingester.limiter.giveBack()
+		ingester.shed.Add(1)
+		return false
+	}
+
+	ingester.throttled.Add(1)
+	time.Sleep(wait)
+	return true
+}
+
+// Token bucket, holding up to a second's worth of records
+type rateLimiter struct {
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Take a token, return how long to wait until it's actually there (0 = now)
+func (l *rateLimiter) take(rate float64, now time.Time) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.last.IsZero() {
+		l.tokens = rate
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * rate
+		if l.tokens > rate {
+			l.tokens = rate
+		}
+	}
+	l.last = now
+
+	l.tokens-- // may go negative: that's what waiters have claimed
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / rate * float64(time.Second))
+}
+
+// Undo a take() we're not going to wait for
+func (l *rateLimiter) giveBack() {
+	l.mutex.Lock()
+	l.tokens++
+	l.mutex.Unlock()
+}
+
+// Insert one record into the current Haybale. Caller holds ingester.mutex.
+func ingestInsert(flat map[string]interface{}) error {
+	if ingester.hs == nil {
+		ingester.hs = new(Haystack)
+		ingester.hs_size = 0
+	}
+
+	// Write lock, for IngestSnapshot(): we change the Dictionary and Haybale slice
+	ingester.hs.Lock()
+	if ingester.cur_hb == nil {
+		ingester.cur_hb = &Haybale{HaystackPtr: ingester.hs}
+		ingester.hs.Haybale = append(ingester.hs.Haybale, ingester.cur_hb)
+		ingester.hb_start = time.Now()
+	}
+
+	err := ingester.cur_hb.InsertBunch(&ingester.hs.Dict, flat)
+	ingester.hs.Unlock()
+	if err == nil || errors.Is(err, ErrDictFull) {
+		ingester.records.Add(1)
+	}
+
+	ingestCheckFlush()
+
+	return err
+}
+
+// Close the current Haybale and/or flush the Haystack, if it's time.
+// Caller holds ingester.mutex.
+func ingestCheckFlush() {
+	hb := ingester.cur_hb
+	if hb == nil {
+		return
+	}
+
+	minsize := uint64(config.haybale_wait_minsize)
+	maxtime := time.Duration(config.haybale_wait_maxtime) * time.Second
+
+	size_ok := minsize == 0 || uint64(hb.Memsize) >= minsize
+	time_ok := maxtime == 0 || time.Since(ingester.hb_start) >= maxtime
+	rules := minsize > 0 || maxtime > 0
+
+	if hb.Memsize <= Max_memsize && !(rules && size_ok && time_ok) {
+		return
+	}
+
+	// Close this Haybale, the next record starts a new one.
+	// Sorting makes it immutable, so snapshots can have it.
+	ingester.hs.Lock()
+	hb.SortBale()
+	ingester.hs.Unlock()
+
+	ingester.hs_size += uint64(hb.Memsize)
+	ingester.cur_hb = nil
+
+	if maxtime > 0 || ingester.hs_size >= uint64(config.haystack_wait_maxsize) {
+		ingestFlushHaystack()
+	}
+}
+
+// Hand the Haystack to the disk writer, and start afresh.
+// Caller holds ingester.mutex. With queue policy block, that means all
+// connections wait for the disk writer: back-pressure, which is what we want.
+func ingestFlushHaystack() {
+	hs := ingester.hs
+	ingester.hs = nil
+	ingester.cur_hb = nil
+
+	if hs == nil || len(hs.Haybale) == 0 {
+		return
+	}
+
+	if err := FlushHaystack(hs); err != nil {
+		log.Printf("Ingest: flushing Haystack with %d Haybales: %v", len(hs.Haybale), err)
+		return
+	}
+	ingester.flushed.Add(1)
+}
+
+// EOF
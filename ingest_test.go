@@ -0,0 +1,221 @@
+// OpenActa/Haystack - ingest NDJSON from network connections - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeIngest(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	config.datastore_dir = t.TempDir()
+	config.catalogue_dir = t.TempDir()
+	config.diskwriter_queue_len = 2
+	config.diskwriter_queue_policy = diskwriter_policy_block
+	config.haystack_wait_maxsize = haystack_wait_maxsize_lower
+	config.haybale_wait_minsize = 0
+	config.haybale_wait_maxtime = 0
+
+	if err := StartDiskWriter(); err != nil {
+		t.Fatal(err)
+	}
+	defer StopDiskWriter()
+
+	json, err := os.ReadFile("testdata/head5.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, network := range []string{"tcp", "unix"} {
+		addr := "127.0.0.1:0"
+		if network == "unix" {
+			addr = filepath.Join(t.TempDir(), "ingest.sock")
+		}
+
+		listener, err := net.Listen(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		before := GetIngestStats()
+		served := make(chan error)
+		go func() { served <- ServeIngest(listener) }()
+
+		// Two clients, one with a bad line in between
+		for _, data := range [][]byte{json, []byte("not json\n{\"a\":1}\n")} {
+			conn, err := net.Dial(network, listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := conn.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+		}
+
+		// Wait until the server has read everything
+		for i := 0; GetIngestStats().Records < before.Records+6; i++ {
+			if i > 500 {
+				t.Fatalf("%s: timeout, stats %+v", network, GetIngestStats())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		listener.Close()
+		if err := <-served; err != nil {
+			t.Errorf("%s: %v", network, err)
+		}
+
+		stats := GetIngestStats()
+		if stats.Connections != before.Connections+2 || stats.Skipped != before.Skipped+1 ||
+			stats.Flushed != before.Flushed+1 || stats.Active != 0 {
+			t.Errorf("%s: stats %+v, before %+v", network, stats, before)
+		}
+	}
+
+	StopDiskWriter()
+
+	// Two Haystack files, with all 6 records each
+	files, err := filepath.Glob(filepath.Join(config.datastore_dir, "*"+Haystack_file_ext))
+	if err != nil || len(files) != 2 {
+		t.Fatalf("expected 2 Haystack files: %v %v", files, err)
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hs := new(Haystack)
+		if err := hs.Disk2Mem(data); err != nil {
+			t.Fatal(err)
+		}
+		if info := hs.Info(); info.NumBunches != 6 {
+			t.Errorf("%s: %v", strings.TrimPrefix(f, config.datastore_dir), info)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	var l rateLimiter
+	now := time.Now()
+
+	// A second's worth straight off, then we wait our turn
+	for i := 0; i < 10; i++ {
+		if wait := l.take(10, now); wait != 0 {
+			t.Fatalf("take %d: wait %v", i, wait)
+		}
+	}
+	if wait := l.take(10, now); wait != 100*time.Millisecond {
+		t.Errorf("11th take: wait %v", wait)
+	}
+	if wait := l.take(10, now); wait != 200*time.Millisecond {
+		t.Errorf("12th take: wait %v", wait)
+	}
+
+	// After a while it's all back, but no more than a second's worth
+	now = now.Add(time.Hour)
+	for i := 0; i < 10; i++ {
+		if wait := l.take(10, now); wait != 0 {
+			t.Fatalf("take %d after an hour: wait %v", i, wait)
+		}
+	}
+	if wait := l.take(10, now); wait == 0 {
+		t.Errorf("burst bigger than a second's worth")
+	}
+}
+
+func TestIngestRateShed(t *testing.T) {
+	setTestConfig(t)
+	config.max_ingest_rate = 10
+	config.ingest_rate_policy = ingest_rate_policy_shed
+	ingester.limiter.last = time.Time{} // fresh bucket
+
+	before := GetIngestStats()
+
+	var passed int
+	for i := 0; i < 30; i++ {
+		if ingestRateLimit() {
+			passed++
+		}
+	}
+
+	// 10 in the bucket, maybe one more if we're slow
+	shed := GetIngestStats().Shed - before.Shed
+	if passed < 10 || passed > 11 || shed != uint64(30-passed) {
+		t.Errorf("%d passed, %d shed", passed, shed)
+	}
+
+	// No limit
+	config.max_ingest_rate = 0
+	for i := 0; i < 100; i++ {
+		if !ingestRateLimit() {
+			t.Fatal("shed without a limit")
+		}
+	}
+}
+
+// A JSON line over bufio's 64K goes in, one over max_line_size is reported
+func TestLineScanner(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	config.max_line_size = 0 // not configured: default
+
+	big := `{"timestamp":"2023-06-04T00:00:01Z","msg":"` + strings.Repeat("x", 100*1024) + `"}`
+	input := `{"timestamp":"2023-06-04T00:00:00Z","msg":"small"}` + "\n" + big + "\n"
+
+	hs := new(Haystack)
+	var out bytes.Buffer
+	if err := hs.IngestAndStream(strings.NewReader(input), &out); err != nil {
+		t.Fatal(err)
+	}
+	hs2 := new(Haystack)
+	if err := hs2.Disk2Mem(out.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if n := hs2.CountKeyValArray(map[string]string{"msg": strings.Repeat("x", 100*1024)}); n != 1 {
+		t.Errorf("%d matches for the big line", n)
+	}
+
+	// Too long: which line, and that it's too long
+	config.max_line_size = max_line_size_lower
+	err := new(Haystack).IngestAndStream(strings.NewReader(input), new(bytes.Buffer))
+	if !errors.Is(err, bufio.ErrTooLong) || !strings.Contains(err.Error(), "line 2 ") {
+		t.Errorf("line too long: %v", err)
+	}
+
+	scanner := NewLineScanner(strings.NewReader(input))
+	var lines int
+	for scanner.Scan() {
+		lines++
+	}
+	if err := LineScanError(scanner.Err(), lines); lines != 1 || !errors.Is(err, bufio.ErrTooLong) ||
+		!strings.Contains(err.Error(), "line 2 longer than max_line_size (65536 bytes)") {
+		t.Errorf("after %d lines: %v", lines, err)
+	}
+}
+
+// EOF
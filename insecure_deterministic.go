@@ -0,0 +1,71 @@
+//go:build haystack_insecure_deterministic
+
+// OpenActa/Haystack - deterministic output, for tests only
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	INSECURE. For golden file tests of the crypto path only.
+
+	Every file we write gets a random uuid, and its sections are encrypted
+	with nonces counting up from a random start. So Mem2Disk() never gives
+	the same bytes twice, which is the point. InsecureDeterministic() makes
+	the next file come out the same every time: the nonce starts over from
+	zero, and the file uuid is a fixed one.
+
+	With AES-GCM, the same nonce with the same key for different data gives
+	away the XOR of the plaintexts, and lets an attacker forge sections.
+	So this file is only built with
+
+		go test -tags haystack_insecure_deterministic
+
+	Without the tag there's no InsecureDeterministic(), and nothing else
+	can turn it on: a program that calls it doesn't compile. Never use the
+	tag for a build that writes real data.
+*/
+
+package haystack
+
+import (
+	"crypto/rand"
+	"io"
+	"log"
+)
+
+// Make the next file Mem2Disk() and friends write byte for byte the same as
+// last time (same data, key and config). Call again before each file.
+// on = false goes back to random nonces, see the top of this file.
+func InsecureDeterministic(on bool) {
+	aesgcm_nonce_mutex.Lock()
+	defer aesgcm_nonce_mutex.Unlock()
+
+	if !on {
+		insecure_deterministic.Store(false)
+		if _, err := io.ReadFull(rand.Reader, aesgcm_nonce); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if !insecure_deterministic.Swap(true) {
+		log.Printf("INSECURE: deterministic nonces and file uuids, for tests only!")
+	}
+	for i := range aesgcm_nonce {
+		aesgcm_nonce[i] = 0
+	}
+}
+
+// EOF
@@ -0,0 +1,86 @@
+//go:build haystack_insecure_deterministic
+
+// OpenActa/Haystack - deterministic output, for tests only - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Run with: go test -tags haystack_insecure_deterministic
+// After a deliberate format change, add -update-golden to write a new one.
+
+package haystack
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"testing"
+)
+
+const golden_file = "testdata/head5_golden.hs"
+
+var update_golden = flag.Bool("update-golden", false, "write "+golden_file)
+
+func TestInsecureDeterministicGolden(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	t.Cleanup(func() { InsecureDeterministic(false) })
+
+	write := func(deterministic bool) []byte {
+		if deterministic {
+			InsecureDeterministic(true)
+		}
+		hs := newTestHaystack(t, "testdata/head5.json", 2)
+		data, _, err := hs.Mem2Disk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	data := write(true)
+	if !bytes.Equal(write(true), data) {
+		t.Fatal("two deterministic writes differ")
+	}
+
+	// Still encrypted, and readable
+	if bytes.Contains(data, []byte("dest_port")) {
+		t.Errorf("keys in the clear")
+	}
+	if err := new(Haystack).Disk2Mem(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if *update_golden {
+		if err := os.WriteFile(golden_file, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	golden, err := os.ReadFile(golden_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, golden) {
+		t.Errorf("output differs from %s (%d bytes, golden %d)", golden_file, len(data), len(golden))
+	}
+
+	// And back to random
+	InsecureDeterministic(false)
+	if bytes.Equal(write(false), data) {
+		t.Errorf("still deterministic after turning it off")
+	}
+}
+
+// EOF
@@ -34,34 +34,285 @@
 	"c.f": "g",
 	"z.0": 2,
 	"z.1": 1.4567,
+
+	Arrays of objects are a problem though: with 10,000 elements, that's
+	10,000 x as many distinct keys in the Dictionary (alerts.0.sid,
+	alerts.1.sid, ...). With config json_array_objects = records,
+	JSONToKVmaps() instead makes one record per element, sharing the
+	other fields of the parent. From:
+	"a": "b",
+	"alerts": [{"sid": 1}, {"sid": 2}],
+
+	To:
+	"a": "b", "alerts.sid": 1
+	"a": "b", "alerts.sid": 2
+
+	With config store_raw, each record also gets the original line, byte
+	for byte, under config raw_key (default _raw). That's added after
+	flattening, as a rawLine, so InsertBunch() stores it as a plain string.
+	If the JSON has a field by that name too, the original line wins.
+
+	Numbers stay as they were written (json.Number), not float64: that only
+	has 53 bits, so a big int like -9223372036854775808 or a Suricata
+	flow_id would lose digits. InsertBunch() makes them ints or floats.
 */
 
 package haystack
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"regexp"
+	"io"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/nqd/flat" // Third party library
 )
 
-func JSONToKVmap(b []byte) (map[string]interface{}, error) {
+const (
+	json_array_objects_flatten = "flatten"
+	json_array_objects_records = "records"
+
+	// If not configured
+	max_flatten_depth_default     = 1000 // what we always used to do
+	max_fields_per_record_default = 100000
+	raw_key_default               = "_raw"
+)
+
+// The original JSON line, see store_raw above
+type rawLine string
+
+// config raw_key
+func rawKey() string {
+	if config.raw_key == "" {
+		return raw_key_default
+	}
+	return config.raw_key
+}
+
+// With config store_raw, add the original line to the records made from it
+func addRawLine(flatmaps []map[string]interface{}, b []byte) {
+	if !config.store_raw {
+		return
+	}
+
+	raw := rawLine(b) // a copy, b may be the scanner's buffer
+	for _, flatmap := range flatmaps {
+		flatmap[rawKey()] = raw
+	}
+}
+
+// Same as json.Unmarshal() into a map, but numbers as json.Number
+func unmarshalJSONObject(b []byte) (map[string]interface{}, error) {
 	var result map[string]interface{}
 
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&result); err != nil {
+		return nil, err
+	}
+	// Unmarshal() doesn't take anything after the object, neither do we
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("invalid JSON: data after the top-level object")
+	}
+
+	return result, nil
+}
+
+// One JSON object (line) to one flat KV map
+func JSONToKVmap(b []byte) (map[string]interface{}, error) {
 	// Unmarshal checks for validity too.
 	// Realistically there's not much we can do with invalid lines. Ignore.
-	err := json.Unmarshal(b, &result)
+	result, err := unmarshalJSONObject(b)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := checkJSONLimits(result); err != nil {
+		return nil, err
+	}
+
+	return flattenJSON(result)
+}
+
+// One JSON object (line) to one or more flat KV maps.
+// Arrays of objects are handled as per config json_array_objects.
+func JSONToKVmaps(b []byte) ([]map[string]interface{}, error) {
+	if config.json_array_objects != json_array_objects_records {
+		flatmap, err := JSONToKVmap(b)
+		if err != nil {
+			return nil, err
+		}
+		flatmaps := []map[string]interface{}{flatmap}
+		addRawLine(flatmaps, b)
+		return flatmaps, nil
+	}
+
+	result, err := unmarshalJSONObject(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkJSONLimits(result); err != nil {
+		return nil, err
+	}
+
+	records := splitJSONArrayObjects(result)
+	flatmaps := make([]map[string]interface{}, 0, len(records))
+	for _, r := range records {
+		flatmap, err := flattenJSON(r)
+		if err != nil {
+			return nil, err
+		}
+		flatmaps = append(flatmaps, flatmap)
+	}
+	addRawLine(flatmaps, b)
+
+	return flatmaps, nil
+}
+
+// Check the unflattened object against config max_flatten_depth and
+// max_fields_per_record, before flattening makes a (possibly huge) copy.
+// We stop looking as soon as we're over.
+func checkJSONLimits(obj map[string]interface{}) error {
+	max_depth := int(config.max_flatten_depth)
+	if max_depth == 0 {
+		max_depth = max_flatten_depth_default
+	}
+	max_fields := int(config.max_fields_per_record)
+	if max_fields == 0 {
+		max_fields = max_fields_per_record_default
+	}
+
+	var fields int
+	var walk func(v interface{}, depth int) error
+	walk = func(v interface{}, depth int) error {
+		if depth > max_depth {
+			return fmt.Errorf("JSON record nested deeper than %d levels", max_depth)
+		}
+
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			for _, e := range vv {
+				if err := walk(e, depth+1); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			for _, e := range vv {
+				if err := walk(e, depth+1); err != nil {
+					return err
+				}
+			}
+		default:
+			fields++
+			if fields > max_fields {
+				return fmt.Errorf("JSON record has more than %d fields", max_fields)
+			}
+		}
+
+		return nil
+	}
+
+	return walk(obj, 0)
+}
+
+// One record per element of each array of objects (recursively), each
+// with the other fields of the parent. Not a cross product: with two such
+// arrays of n and m elements, we get n + m records, not n * m.
+func splitJSONArrayObjects(obj map[string]interface{}) []map[string]interface{} {
+	type found struct {
+		path  []string
+		elems []interface{}
+	}
+	arrays := make([]found, 0)
+
+	// Copy obj without any arrays of objects, noting where they were
+	var strip func(m map[string]interface{}, path []string) map[string]interface{}
+	strip = func(m map[string]interface{}, path []string) map[string]interface{} {
+		c := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			switch vv := v.(type) {
+			case map[string]interface{}:
+				c[k] = strip(vv, append(path[:len(path):len(path)], k))
+			case []interface{}:
+				if isJSONArrayObjects(vv) {
+					arrays = append(arrays, found{append(path[:len(path):len(path)], k), vv})
+				} else {
+					c[k] = vv
+				}
+			default:
+				c[k] = v
+			}
+		}
+		return c
+	}
+	parent := strip(obj, nil)
+
+	if len(arrays) == 0 {
+		return []map[string]interface{}{obj}
+	}
+
+	// Go map order is random, keep our records in a predictable order
+	sort.Slice(arrays, func(i, j int) bool {
+		return strings.Join(arrays[i].path, ".") < strings.Join(arrays[j].path, ".")
+	})
+
+	records := make([]map[string]interface{}, 0)
+	for _, a := range arrays {
+		for _, e := range a.elems {
+			r := copyJSONObject(parent)
+
+			// Walk down to where the array was, then put the element there
+			m := r
+			for _, k := range a.path[:len(a.path)-1] {
+				m = m[k].(map[string]interface{})
+			}
+			m[a.path[len(a.path)-1]] = e
+
+			// The element may have arrays of objects of its own
+			records = append(records, splitJSONArrayObjects(r)...)
+		}
+	}
+
+	return records
+}
+
+// Non-empty array with only objects in it
+func isJSONArrayObjects(a []interface{}) bool {
+	if len(a) == 0 {
+		return false
+	}
+	for _, e := range a {
+		if _, ok := e.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Copy the objects (maps), values and other arrays can be shared
+func copyJSONObject(m map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if vv, ok := v.(map[string]interface{}); ok {
+			c[k] = copyJSONObject(vv)
+		} else {
+			c[k] = v
+		}
+	}
+	return c
+}
+
+// Flatten an unmarshalled JSON object, and sort out its timestamp
+func flattenJSON(result map[string]interface{}) (map[string]interface{}, error) {
 	// Note: using third party library
 	// Uses reflection.
 	flatmap, err := flat.Flatten(result, &flat.Options{
 		Delimiter: ".",   // Use the . delimiter when flattening
-		MaxDepth:  1000,  //	Maximum depth of arrays/structures
+		MaxDepth:  0,     //	No max, checkJSONLimits() already did that
 		Safe:      false, //	Flatten arrays as well as structures
 	})
 
@@ -84,22 +335,6 @@ func JSONToKVmap(b []byte) (map[string]interface{}, error) {
 		flatmap[Timestamp_key] = time.Now().UTC().Format(time.RFC3339Nano)
 	}
 
-	/*
-			Unfortunately, the parsing scrambles a few things.
-		    Suricata eve.json has flow_id:
-		    "1184018670052842" which ends up as "1.184018670052842e+15"
-		    and similar others. We can easily clean that up.
-		    TODO: create configurable regex map (multiple regexes/replace)
-	*/
-	if e_regex, err := regexp.CompilePOSIX(`([0-9])\.([0-9]+)e\+[0-9]+`); err == nil {
-		for k, v := range flatmap {
-			s := fmt.Sprint(v)
-			if e_regex.MatchString(s) {
-				flatmap[k] = e_regex.ReplaceAllString(s, "$1$2")
-			}
-		}
-	}
-
 	return flatmap, nil
 }
 
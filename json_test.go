@@ -0,0 +1,208 @@
+// OpenActa/Haystack - ingesting JSON - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const testJSONArrayObjects = `{"timestamp":"2023-06-04T00:00:59Z","host":"a","tags":["x","y"],` +
+	`"event":{"alerts":[{"sid":1,"refs":[{"id":"r1"},{"id":"r2"}]},{"sid":2}]}}`
+
+func TestJSONArrayObjectsFlatten(t *testing.T) {
+	setTestConfig(t)
+	config.json_array_objects = json_array_objects_flatten
+
+	flats, err := JSONToKVmaps([]byte(testJSONArrayObjects))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flats) != 1 {
+		t.Fatalf("%d records, expected 1", len(flats))
+	}
+	for _, k := range []string{"event.alerts.0.sid", "event.alerts.0.refs.1.id", "event.alerts.1.sid", "tags.1"} {
+		if _, ok := flats[0][k]; !ok {
+			t.Errorf("key %s missing: %v", k, flats[0])
+		}
+	}
+}
+
+func TestJSONArrayObjectsRecords(t *testing.T) {
+	setTestConfig(t)
+	config.json_array_objects = json_array_objects_records
+
+	flats, err := JSONToKVmaps([]byte(testJSONArrayObjects))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Alert 1 has two refs, so two records; alert 2 one.
+	expect := []map[string]interface{}{
+		{"event.alerts.sid": json.Number("1"), "event.alerts.refs.id": "r1"},
+		{"event.alerts.sid": json.Number("1"), "event.alerts.refs.id": "r2"},
+		{"event.alerts.sid": json.Number("2")},
+	}
+	if len(flats) != len(expect) {
+		t.Fatalf("%d records, expected %d: %v", len(flats), len(expect), flats)
+	}
+
+	for i, flat := range flats {
+		for k, v := range expect[i] {
+			if flat[k] != v {
+				t.Errorf("record %d: %s = %v, expected %v", i, k, flat[k], v)
+			}
+		}
+
+		// Parent fields in every record, arrays of scalars still flattened
+		if flat["host"] != "a" || flat["tags.0"] != "x" || flat[Timestamp_key] != "2023-06-04T00:00:59Z" {
+			t.Errorf("record %d: parent fields missing: %v", i, flat)
+		}
+
+		for k := range flat {
+			if k == "event.alerts.0.sid" || k == "event.alerts.refs.0.id" {
+				t.Errorf("record %d: indexed key %s", i, k)
+			}
+		}
+	}
+
+	// No arrays of objects: just the one record, as before
+	flats, err = JSONToKVmaps([]byte(`{"a":1,"b":[1,2],"c":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flats) != 1 || flats[0]["b.1"] != json.Number("2") {
+		t.Errorf("expected one flattened record: %v", flats)
+	}
+}
+
+func TestJSONLimits(t *testing.T) {
+	setTestConfig(t)
+	config.max_flatten_depth = 10
+	config.max_fields_per_record = 100
+
+	nested := func(depth int) string {
+		return strings.Repeat(`{"a":`, depth) + "1" + strings.Repeat("}", depth)
+	}
+	wide := func(fields int) string {
+		kv := make([]string, fields)
+		for i := range kv {
+			kv[i] = fmt.Sprintf(`"k%d":%d`, i, i)
+		}
+		return "{" + strings.Join(kv, ",") + "}"
+	}
+
+	for _, tc := range []struct {
+		json string
+		ok   bool
+	}{
+		{nested(10), true},
+		{nested(11), false},
+		{nested(5000), false},
+		{`{"a":[[[[[[[[[[1]]]]]]]]]]}`, false},
+		{wide(100), true},
+		{wide(101), false},
+		{`{"a":[` + strings.TrimSuffix(strings.Repeat("1,", 200), ",") + `]}`, false},
+	} {
+		for _, mode := range []string{json_array_objects_flatten, json_array_objects_records} {
+			config.json_array_objects = mode
+
+			_, err := JSONToKVmaps([]byte(tc.json))
+			if (err == nil) != tc.ok {
+				short := tc.json
+				if len(short) > 40 {
+					short = short[:40] + "..."
+				}
+				t.Errorf("%s (%s): expected ok=%v, got %v", short, mode, tc.ok, err)
+			}
+		}
+	}
+}
+
+// store_raw: the line comes back byte for byte, also from disk
+func TestJSONStoreRaw(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	config.store_raw = true
+
+	lines := []string{
+		`{"timestamp":"2023-06-04T00:00:59Z", "n" : 1.50, "a":[],  "_raw":"mine"}`,
+		`{"timestamp":"2023-06-04T00:01:00Z","n":42}`,
+		`[]`, // not an object, and no _raw either
+	}
+
+	hs := new(Haystack)
+	hb := &Haybale{HaystackPtr: hs}
+	hs.Haybale = append(hs.Haybale, hb)
+	for _, line := range lines {
+		flats, err := JSONToKVmaps([]byte(line))
+		if err != nil {
+			continue
+		}
+		for _, flat := range flats {
+			if err := hb.InsertBunch(&hs.Dict, flat); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	hs.SortAllBales()
+
+	data, _, err := hs.Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs2 := new(Haystack)
+	if err := hs2.Disk2Mem(data); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, h := range []*Haystack{hs, hs2} {
+		res, err := h.SearchKeyPresent(raw_key_default)
+		if err != nil || len(res) != 2 {
+			t.Fatalf("%d bunches with %s (%v)", len(res), raw_key_default, err)
+		}
+		for i, bunch := range res {
+			if bunch[raw_key_default] != lines[i] {
+				t.Errorf("bunch %d: %s = %q", i, raw_key_default, bunch[raw_key_default])
+			}
+		}
+	}
+
+	// One line, several records: all of them have it
+	config.json_array_objects = json_array_objects_records
+	config.raw_key = "original"
+	flats, err := JSONToKVmaps([]byte(testJSONArrayObjects))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, flat := range flats {
+		if flat["original"] != rawLine(testJSONArrayObjects) {
+			t.Errorf("record %d: original = %v", i, flat["original"])
+		}
+	}
+
+	// And not without store_raw
+	config.store_raw = false
+	if flats, _ := JSONToKVmaps([]byte(lines[1])); flats[0]["original"] != nil || flats[0][raw_key_default] != nil {
+		t.Errorf("raw line without store_raw: %v", flats[0])
+	}
+}
+
+// EOF
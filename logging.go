@@ -39,4 +39,18 @@ func init() {
 	}
 }
 
+// config log_level
+const (
+	log_level_info  = "info"
+	log_level_debug = "debug"
+)
+
+// Log only with log_level = debug: per-Haybale details and such,
+// too much for production logs
+func debugf(format string, v ...interface{}) {
+	if config.log_level == log_level_debug {
+		log.Printf(format, v...)
+	}
+}
+
 // EOF
@@ -27,21 +27,33 @@ package haystack
 
 import (
 	"bytes"
+	"compress/flate"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha512"
 	"fmt"
+	"hash"
 	"hash/crc32"
 	"io"
 	"math"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/dsnet/compress/bzip2"
 	"github.com/google/uuid"
 )
 
 var aesgcm_nonce = make([]byte, aesgcm_nonce_byte_len)
+var aesgcm_nonce_mutex sync.Mutex // we may be writing more than one file at a time
+
+// Only ever set by InsecureDeterministic(), which only exists in test builds
+// (tag haystack_insecure_deterministic), see insecure_deterministic.go
+var insecure_deterministic atomic.Bool
+
+const insecure_deterministic_uuid = "00000000-0000-4000-8000-000000000001"
 
 func init() {
 	// Create a unique starting nonce (feeding off the system random # generator)
@@ -52,7 +64,19 @@ func init() {
 	}
 }
 
+// Get a nonce to use, and increment it for the next one
+func aes_next_nonce() []byte {
+	aesgcm_nonce_mutex.Lock()
+	defer aesgcm_nonce_mutex.Unlock()
+
+	nonce := append([]byte(nil), aesgcm_nonce...)
+	aes_inc_nonce()
+
+	return nonce
+}
+
 // We must not re-use an IV (initialisation vector, nonce) so we increment it.
+// Caller holds aesgcm_nonce_mutex.
 func aes_inc_nonce() {
 	// We need to do the inc "by hand" as it's 96 bits, larger than any of our variable types
 	for i := 0; i < aesgcm_nonce_byte_len; i++ {
@@ -98,8 +122,8 @@ func addKeyToData(buf *[]byte, dkey uint32, key *string) error {
 	len := int32(r.Size())
 
 	if len > max_keylen {
-		// TODO: this shouldn't happen, we already have a check on insert
-		return fmt.Errorf("key '%s' length %d > %d limit", *key, len, max_keylen)
+		// This shouldn't happen, we already have a check on insert
+		return fmt.Errorf("%w: key '%s' length %d > %d limit", ErrKeyTooLong, *key, len, max_keylen)
 	}
 
 	addByteToData(buf, uint8(len))
@@ -120,20 +144,44 @@ func addKeyToData(buf *[]byte, dkey uint32, key *string) error {
 func (p *Haystack) Mem2Disk() ([]byte, []byte, error) {
 	data := make([]byte, 0, 16384) // Set up our byte array, with some initial room to spare
 
-	// Set this Haystack's AES uuid to current configured one.
-	p.aes_key_uuid = config.aes_keystore_current_uuid
+	// Optional, see disk_compression_dict.go. Before the header, it has the version.
+	p.compression_dict = nil
+	if config.compression_dict_size > 0 && config.compression_level > 0 {
+		p.compression_dict = p.trainCompressionDict(int(config.compression_dict_size))
+	}
 
-	header, err := mem2DiskFileHeader()
+	header, err := p.mem2DiskStart()
 	if err != nil {
 		return nil, nil, err
 	} else {
 		data = append(data, header...)
 	}
 
+	if p.compression_dict != nil {
+		if dict, err := mem2DiskCompressionDict(p.compression_dict, p.aes_key_uuid); err != nil {
+			return nil, nil, err
+		} else {
+			data = append(data, dict...)
+		}
+	}
+
+	// Compressing the Haybales is the expensive bit, and they don't depend
+	// on each other or on where they go in the file: do that on all cores.
+	// Dictionaries (each builds on the previous one, and needs its offset) and
+	// encryption (nonces go up in file order) are done in order, below.
+	compressed := p.mem2DiskCompressBales()
+
 	// Now go through all the haybales
 	var time_first, time_last int64
 	var prev_ofs, cur_ofs uint32
 	for i := range p.Haybale {
+		// Sections Disk2MemPassThrough() kept, that were here
+		if unknown, err := p.mem2DiskUnknownSections(i); err != nil {
+			return nil, nil, err
+		} else {
+			data = append(data, unknown...)
+		}
+
 		cur_ofs = uint32(len(data)) // note current offset in our buffer
 
 		// First we write out a Dictionary.
@@ -147,7 +195,11 @@ func (p *Haystack) Mem2Disk() ([]byte, []byte, error) {
 		}
 
 		// After a Dictionary comes a Haybale structure
-		if hb, err := p.Haybale[i].Mem2Disk(&p.Dict); err != nil {
+		c := <-compressed[i]
+		if c.err != nil {
+			return nil, nil, c.err
+		}
+		if hb, err := c.s.finish(p.aes_key_uuid); err != nil {
 			return nil, nil, err
 		} else {
 			data = append(data, hb...)
@@ -156,15 +208,33 @@ func (p *Haystack) Mem2Disk() ([]byte, []byte, error) {
 		prev_ofs = cur_ofs
 
 		// Update our bounding timestamps as well (for the trailer)
+		// An empty Haybale has none, don't let its zeroes count.
+		if p.Haybale[i].num_haystalks == 0 {
+			continue
+		}
 		if time_first == 0 || p.Haybale[i].time_first < time_first {
 			time_first = p.Haybale[i].time_first
 		}
 		if p.Haybale[i].time_last > time_last {
-			time_first = p.Haybale[i].time_last
+			time_last = p.Haybale[i].time_last
 		}
 	}
 
-	if trailer, err := p.mem2DiskFileTrailer(prev_ofs, time_first, time_last); err != nil {
+	if unknown, err := p.mem2DiskUnknownSections(len(p.Haybale)); err != nil {
+		return nil, nil, err
+	} else {
+		data = append(data, unknown...)
+	}
+
+	p.time_first = time_first
+	p.time_last = time_last
+
+	mac, err := fileMAC(p.aes_key_uuid, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if trailer, err := p.mem2DiskFileTrailer(prev_ofs, time_first, time_last, mac); err != nil {
 		return nil, nil, err
 	} else {
 		data = append(data, trailer...)
@@ -172,7 +242,8 @@ func (p *Haystack) Mem2Disk() ([]byte, []byte, error) {
 
 	// Generate SHA512 for cryptographic signature, over the entire
 	// compressed+encrypted dataset
-	sha512section, err := p.mem2DiskSHA512block(data, time_first, time_last)
+	sum := sha512.Sum512(data)
+	sha512section, err := p.mem2DiskSHA512block(sum[:], time_first, time_last)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -180,19 +251,93 @@ func (p *Haystack) Mem2Disk() ([]byte, []byte, error) {
 	return data, sha512section, nil
 }
 
-func (p *Haystack) mem2DiskSHA512block(dataset []byte, time_first int64, time_last int64) ([]byte, error) {
+type compressedSection struct {
+	s   *pendingSection
+	err error
+}
+
+// Compress all Haybales with a worker per core, result i comes on channel i.
+// The channels are buffered, so nothing gets stuck if the caller bails out.
+func (p *Haystack) mem2DiskCompressBales() []chan compressedSection {
+	res := make([]chan compressedSection, len(p.Haybale))
+	todo := make(chan int, len(p.Haybale))
+	for i := range p.Haybale {
+		res[i] = make(chan compressedSection, 1)
+		todo <- i // in order, so the first ones are ready first
+	}
+	close(todo)
+
+	for w := 0; w < runtime.GOMAXPROCS(0) && w < len(p.Haybale); w++ {
+		go func() {
+			for i := range todo {
+				s, err := p.Haybale[i].mem2DiskCompress(p.compression_dict, p.compact_bunches)
+				res[i] <- compressedSection{s: s, err: err}
+			}
+		}()
+	}
+
+	return res
+}
+
+// Set up for writing a new Haystack file, return its header
+func (p *Haystack) mem2DiskStart() ([]byte, error) {
+	// Set this Haystack's AES uuid to current configured one.
+	// No uuid means we don't encrypt.
+	if config.encryption_disabled {
+		p.aes_key_uuid = ""
+	} else {
+		p.aes_key_uuid = config.aes_keystore_current_uuid
+	}
+
+	// Every file we write gets its own unique id
+	if insecure_deterministic.Load() {
+		p.file_uuid = insecure_deterministic_uuid
+	} else {
+		p.file_uuid = uuid.New().String()
+	}
+	p.file_sha512 = nil
+
+	// 1.3, 1.4 or 1.5 only when we need it, see disk_compression_dict.go,
+	// disk_compact_bunches.go and getDisk2MemDictionary().
+	// All Haybales in the file go the same way.
+	minor := uint8(version_minor_plain)
+	if p.compression_dict != nil {
+		minor = version_minor_dict
+	}
+	p.compact_bunches = config.compact_bunches
+	if p.compact_bunches {
+		minor = version_minor_compact
+	}
+	if p.Dict.caseSensitive() { // Older versions would fold the keys
+		minor = version_minor
+	}
+
+	return mem2DiskFileHeader(p.aes_key_uuid, p.file_uuid, minor)
+}
+
+// Assemble the SHA512 block (catalogue), sha512_sum is over the entire Haystack file
+func (p *Haystack) mem2DiskSHA512block(sha512_sum []byte, time_first int64, time_last int64) ([]byte, error) {
 	var data = make([]byte, 0, 16384)
 	var content = make([]byte, 0, 16384)
 
+	// An empty keystore leaves us without a uuid, and we'd write the
+	// catalogue in plain text while encryption is on. Or with a uuid that's
+	// no longer in the keystore, a key we can't find. Neither is Ok.
+	if !config.encryption_disabled {
+		if p.aes_key_uuid == "" {
+			return nil, fmt.Errorf("%w: no active AES key (empty keystore?), not writing catalogue", ErrWrongKey)
+		}
+		if _, ok := config.aes_keystore_array[p.aes_key_uuid]; !ok {
+			return nil, fmt.Errorf("%w: AES key uuid %s not in keystore, not writing catalogue", ErrWrongKey, p.aes_key_uuid)
+		}
+	}
+
 	// Give SHA512 file has a proper header so we have major/minor versioning
-	hdr, err := mem2DiskFileHeader()
+	hdr, err := mem2DiskFileHeader(p.aes_key_uuid, p.file_uuid, version_minor_plain)
 	if err != nil {
 		return nil, err
 	}
 
-	// Now for the SHA512 itself
-	sha512 := sha512.Sum512(dataset)
-
 	// section header
 	addMultibyteToData(&data, uint64(signature), 3)
 	addByteToData(&data, section_sha512)
@@ -202,7 +347,12 @@ func (p *Haystack) mem2DiskSHA512block(dataset []byte, time_first int64, time_la
 	addMultibyteToData(&content, uint64(time_last), 8)
 
 	for i := 0; i < sha512_byte_len; i++ {
-		addByteToData(&content, sha512[i]) // 32 bytes (512 bits) SHA512
+		addByteToData(&content, sha512_sum[i]) // 32 bytes (512 bits) SHA512
+	}
+
+	// Refer back to the Haystack file this SHA512 belongs with
+	if err := addUUIDToData(&content, p.file_uuid); err != nil {
+		return nil, err
 	}
 
 	// now we know the content length. Don't bother with compression.
@@ -213,35 +363,54 @@ func (p *Haystack) mem2DiskSHA512block(dataset []byte, time_first int64, time_la
 	addMultibyteToData(&data, uint64(crc), 4) // append CRC
 
 	// Encryption
-	encrypted_content, err := mem2DiskAES256GCMblock(&content, data, p.aes_key_uuid)
+	data, err = mem2DiskSectionContent(data, content, 0, codec_none, 0, p.aes_key_uuid)
 	if err != nil {
 		return nil, err
 	}
 
-	data = append(data, *encrypted_content...) // we can glue it all together
-
 	return append(hdr, data...), nil
 }
 
-// Assemble disk structure for the Haystack header
-func mem2DiskFileHeader() ([]byte, error) {
+// Store a uuid in binary form (16 bytes). An empty string stores the nil uuid.
+func addUUIDToData(buf *[]byte, s string) error {
+	var u uuid.UUID
+
+	if s != "" {
+		var err error
+		if u, err = uuid.Parse(s); err != nil {
+			return fmt.Errorf("invalid uuid '%s': %w", s, err)
+		}
+	}
+
+	uuid_binary, _ := u.MarshalBinary() // get it out in binary
+	*buf = append(*buf, uuid_binary...) // 16 bytes
+
+	return nil
+}
+
+// Assemble disk structure for the Haystack header, with version 1.minor
+func mem2DiskFileHeader(aes_key_uuid string, file_uuid string, minor uint8) ([]byte, error) {
 	content := make([]byte, 0, min_filesize)
 	data := make([]byte, 0, min_filesize)
 
 	addByteToData(&content, version_major)
-	addByteToData(&content, version_minor)
+	addByteToData(&content, minor)
 
-	uuid, _ := uuid.Parse(config.aes_keystore_current_uuid) // grab current AES uuid
-	uuid_binary, _ := uuid.MarshalBinary()                  // get it out in binary
-	for i := 0; i < len(uuid_binary); i++ {                 // 16 bytes
-		addByteToData(&content, uuid_binary[i]) // put it in our structure
+	// AES uuid (or nil uuid if we don't encrypt)
+	if err := addUUIDToData(&content, aes_key_uuid); err != nil {
+		return nil, err
+	}
+
+	// Unique id of this file (also goes into the SHA512 block)
+	if err := addUUIDToData(&content, file_uuid); err != nil {
+		return nil, err
 	}
 
 	// Haystack (file) header
 	addMultibyteToData(&data, signature, 3)
 	addByteToData(&data, section_header)
 
-	addMultibyteToData(&data, uint64(len(content)), 4) // Len should be 18 for this version
+	addMultibyteToData(&data, uint64(len(content)), 4) // Len should be 34 for this version
 	addMultibyteToData(&data, uint64(len(content)), 4) // No compression
 
 	crc := crc32.ChecksumIEEE(content)        // CRC over all of header content
@@ -255,40 +424,36 @@ func mem2DiskFileHeader() ([]byte, error) {
 }
 
 // Assemble disk structure for the Haystack trailer
-func (p *Haystack) mem2DiskFileTrailer(last_dict_ofs uint32, time_first int64, time_last int64) ([]byte, error) {
+// mac is the file MAC over everything before it (nil if not encrypted), see file_mac.go
+func (p *Haystack) mem2DiskFileTrailer(last_dict_ofs uint32, time_first int64, time_last int64, mac []byte) ([]byte, error) {
 	content := make([]byte, 0, min_filesize)
 	data := make([]byte, 0, min_filesize)
 
 	addMultibyteToData(&content, uint64(last_dict_ofs), 4)
 	addMultibyteToData(&content, uint64(time_first), 8)
 	addMultibyteToData(&content, uint64(time_last), 8)
+	content = append(content, mac...)
 
 	// Haystack (file) header
 	addMultibyteToData(&data, signature, 3)
 	addByteToData(&data, section_trailer)
 
-	addMultibyteToData(&data, uint64(len(content)), 4) // Len should be 20 for this version
+	addMultibyteToData(&data, uint64(len(content)), 4) // Len 20, or 52 with the MAC
 	addMultibyteToData(&data, uint64(len(content)), 4) // No compression
 
 	crc := crc32.ChecksumIEEE(content)        // CRC over all of the trailer content
 	addMultibyteToData(&data, uint64(crc), 4) // append CRC
 
 	// Encryption
-	encrypted_content, err := mem2DiskAES256GCMblock(&content, data, p.aes_key_uuid)
-	if err != nil {
-		return nil, err
-	}
-
-  data = append(data, *encrypted_content...) // we can glue it all together
-
-	return data, nil
+	return mem2DiskSectionContent(data, content, 0, codec_none, 0, p.aes_key_uuid)
 }
 
 // Assemble disk structure for bzip2 compression
 // https://github.com/dsnet/compress
 // (Go's standard library implementation only does decompression)
 // Ref. https://github.com/dsnet/compress/blob/master/doc/bzip2-format.pdf
-func mem2DiskBzip2block(content []byte) ([]byte, error) {
+// Also returns the codec and level that were used (codec_none, 0 if compressing didn't help)
+func mem2DiskBzip2block(content []byte) ([]byte, uint8, uint8, error) {
 	//log.Printf("bzip2")	// DEBUG
 
 	var bzip2_config bzip2.WriterConfig
@@ -299,24 +464,54 @@ func mem2DiskBzip2block(content []byte) ([]byte, error) {
 
 		writer, err := bzip2.NewWriter(&buf, &bzip2_config)
 		if err != nil {
-			return nil, fmt.Errorf("error bzip2 compressing: %v", err)
+			return nil, codec_none, 0, fmt.Errorf("error bzip2 compressing: %v", err)
 		}
 
 		// Compress, bzip2 style.
 		if _, err := writer.Write(content); err != nil {
-			return nil, fmt.Errorf("error bzip2 compressing: %v", err)
+			return nil, codec_none, 0, fmt.Errorf("error bzip2 compressing: %v", err)
 		}
 		writer.Close()
 
 		// Check if our output is indeed shorter (it will almost always be)
 		if writer.OutputOffset > 0 && writer.OutputOffset < writer.InputOffset {
 			compressed_data := buf.Bytes()
-			return compressed_data, nil
+			return compressed_data, codec_bzip2, uint8(config.compression_level), nil
 		}
 	}
 
 	// return original data, since compressed wasn't any shorter
-	return content, nil
+	return content, codec_none, 0, nil
+}
+
+// Finish a (non-header) section: add section flags, codec and cipher, then the content.
+// data holds the section header so far, which is also the AEAD additional data.
+// codec and level say how content was compressed (level 0 if not applicable).
+// flags are any besides section_flag_plaintext, which is added here.
+// The content is encrypted, unless there's no AES key (encryption disabled).
+func mem2DiskSectionContent(data []byte, content []byte, flags uint8, codec uint8, level uint8, aes_key_uuid string) ([]byte, error) {
+	var cipher_id uint8 = cipher_aes256gcm
+
+	if aes_key_uuid == "" {
+		flags |= section_flag_plaintext
+		cipher_id = cipher_none
+	}
+
+	addByteToData(&data, flags)
+	addByteToData(&data, codec)
+	addByteToData(&data, cipher_id)
+	addByteToData(&data, level)
+
+	if cipher_id == cipher_none {
+		return append(data, content...), nil
+	}
+
+	encrypted_content, err := mem2DiskAES256GCMblock(&content, data, aes_key_uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(data, *encrypted_content...), nil // we can glue it all together
 }
 
 // Assemble disk structure for an AES encrypted block
@@ -344,17 +539,17 @@ func mem2DiskAES256GCMblock(plaintext *[]byte, extra []byte, aes_key_uuid string
 	// AES GCM mode adds some (16) bytes, so the encrypted dataset is longer!
 	encrypted_data := make([]byte, 0, len(*plaintext)+aesgcm.Overhead())
 
+	nonce := aes_next_nonce() // never re-used
+
 	// Put in our section header in as additional authenticated data (AEAD).
 	// This allows us to authenticate (and validate) the stored sections in full.
-	encrypted_content := append(encrypted_data, aesgcm.Seal(nil, aesgcm_nonce, *plaintext, extra)...)
+	encrypted_content := append(encrypted_data, aesgcm.Seal(nil, nonce, *plaintext, extra)...)
 
 	// Put it all together
 	data := make([]byte, 0, aesgcm.NonceSize()+len(*plaintext)+aesgcm.Overhead())
-	data = append(data, aesgcm_nonce...)
+	data = append(data, nonce...)
 	data = append(data, encrypted_content...)
 
-	aes_inc_nonce() // increment nonce so it doesn't get re-used
-
 	return &data, nil
 }
 
@@ -367,11 +562,14 @@ func (p *Dictionary) Mem2Disk(prev_ofs uint32) ([]byte, error) {
 	addMultibyteToData(&data, uint64(signature), 3)
 	addByteToData(&data, section_dictionary)
 
-	addMultibyteToData(&content, uint64(prev_ofs), 4)    // File pointer to previous Dictionary&Haybale
-	addMultibyteToData(&content, uint64(p.num_dkeys), 4) // Number of (new) dkeys, max. 16M
+	addMultibyteToData(&content, uint64(prev_ofs), 4) // File pointer to previous Dictionary&Haybale
+	num_dkeys_ofs := len(content)
+	addMultibyteToData(&content, 0, 3)     // Number of (new) dkeys, max. 16M - filled in below
+	addByteToData(&content, uint8(p.bits)) // Hash table size, the dkeys depend on it
 	// log.Printf("Dict: prev_ofs=%d, num_dkeys=%d", prev_ofs, p.num_dkeys) // DEBUG
 
-	for i := uint32(0); i < hashtable_size; i++ {
+	var num_dkeys uint32
+	for i := uint32(0); i < uint32(len(p.dkey)); i++ {
 		if p.dkey[i] == nil {
 			// Empty hash slot
 			continue
@@ -387,6 +585,12 @@ func (p *Dictionary) Mem2Disk(prev_ofs uint32) ([]byte, error) {
 			return nil, err
 		}
 		p.dirty[i] = false // key handled, doesn't need to be written any more
+		num_dkeys++
+	}
+
+	// Only the keys we actually wrote, incremental Dictionaries have fewer than num_dkeys
+	for i := 0; i < 3; i++ {
+		content[num_dkeys_ofs+i] = byte(num_dkeys >> (8 * i))
 	}
 
 	unc_len := len(content)
@@ -394,7 +598,7 @@ func (p *Dictionary) Mem2Disk(prev_ofs uint32) ([]byte, error) {
 	crc := crc32.ChecksumIEEE(content) // CRC over all of the Dictionary content
 
 	// Compression
-	content, err := mem2DiskBzip2block(content)
+	content, codec, level, err := mem2DiskBzip2block(content)
 	if err != nil {
 		return nil, err
 	}
@@ -407,27 +611,83 @@ func (p *Dictionary) Mem2Disk(prev_ofs uint32) ([]byte, error) {
 
 	addMultibyteToData(&data, uint64(crc), 4) // append CRC
 
+	var flags uint8
+	if p.caseSensitive() {
+		flags |= section_flag_case_sensitive
+	}
+
 	// Encryption
-	encrypted_content, err := mem2DiskAES256GCMblock(&content, data, p.HaystackPtr.aes_key_uuid)
+	return mem2DiskSectionContent(data, content, flags, codec, level, p.HaystackPtr.aes_key_uuid)
+}
+
+// Assemble the disk structure for one Haybale
+func (p *Haybale) Mem2Disk(d *Dictionary) ([]byte, error) {
+	s, err := p.mem2DiskCompress(nil, p.HaystackPtr.compact_bunches)
 	if err != nil {
 		return nil, err
 	}
 
-	data = append(data, *encrypted_content...) // we can glue it all together
+	// Encryption
+	return s.finish(p.HaystackPtr.aes_key_uuid)
+}
 
-	return data, nil
+// A section that's been put together and compressed, but not yet encrypted
+type pendingSection struct {
+	data    []byte // section header so far
+	content []byte
+	flags   uint8 // section flags, other than plaintext
+	codec   uint8
+	level   uint8
+
+	index *pendingSection // Haybale index section to go right after, if any
 }
 
-// Assemble the disk structure for one Haybale
-func (p *Haybale) Mem2Disk(d *Dictionary) ([]byte, error) {
-	var data = make([]byte, 0, 16384)
-	var content = make([]byte, 0, 16384)
+func (s *pendingSection) finish(aes_key_uuid string) ([]byte, error) {
+	data, err := mem2DiskSectionContent(s.data, s.content, s.flags, s.codec, s.level, aes_key_uuid)
+	if err != nil || s.index == nil {
+		return data, err
+	}
+
+	index, err := s.index.finish(aes_key_uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(data, index...), nil
+}
 
+// The expensive bit of Mem2Disk(), which doesn't touch anything outside this Haybale.
+// dict is the file's compression dictionary, if any.
+// compact for the compact layout, see disk_compact_bunches.go
+func (p *Haybale) mem2DiskCompress(dict []byte, compact bool) (*pendingSection, error) {
 	p.SortBale() // First of all, make sure this bale is sorted.
 
-	// section header
-	addMultibyteToData(&data, uint64(signature), 3)
-	addByteToData(&data, section_haybale)
+	gen := p.mem2DiskContent
+	if compact {
+		gen = p.mem2DiskCompactContent
+	}
+
+	s, err := mem2DiskStreamSection(section_haybale, gen, dict)
+	if err != nil {
+		return nil, err
+	}
+	if compact {
+		s.flags |= section_flag_compact
+	}
+
+	// An empty Haybale isn't loaded, so there's nothing to index either
+	if p.num_haystalks > 0 {
+		if s.index, err = p.mem2DiskIndex(dict); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Write the Haybale content to w, a bit at a time. Same bytes every time.
+func (p *Haybale) mem2DiskContent(w io.Writer) error {
+	var content = make([]byte, 0, 16384)
 
 	// Write out # of haystalks
 	addMultibyteToData(&content, uint64(p.num_haystalks), 4)
@@ -447,7 +707,7 @@ func (p *Haybale) Mem2Disk(d *Dictionary) ([]byte, error) {
 
 		// Encode our values appropriately
 		switch p.haystalk[i].val.valtype {
-		case valtype_int:
+		case valtype_int, valtype_time:
 			addMultibyteToData(&content, uint64(p.haystalk[i].val.intval), 8)
 
 		case valtype_float:
@@ -465,30 +725,98 @@ func (p *Haybale) Mem2Disk(d *Dictionary) ([]byte, error) {
 				addStringToData(&content, *p.haystalk[i].val.stringval)
 			}
 		}
+
+		// Pass it on when we have a decent chunk
+		if len(content) >= 16384 {
+			if _, err := w.Write(content); err != nil {
+				return err
+			}
+			content = content[:0]
+		}
 	}
 
-	addMultibyteToData(&data, uint64(len(content)), 4) // add uncompressed len into the section start
+	_, err := w.Write(content)
+	return err
+}
 
-	crc := crc32.ChecksumIEEE(content) // CRC over all of the Haybale content
+// Put a (non-header) section together, with the content written by gen().
+// The content is compressed and checksummed as it comes, so it's never all
+// in RAM uncompressed. If compressing doesn't help, gen() is run again to
+// get it as is (same as mem2DiskBzip2block()), so it has to write the same
+// bytes every time. With a compression dictionary (dict not nil), it's
+// DEFLATE with that instead of bzip2, see disk_compression_dict.go.
+func mem2DiskStreamSection(id uint8, gen func(w io.Writer) error, dict []byte) (*pendingSection, error) {
+	var data = make([]byte, 0, 32)
 
-	// Compression
-	content, err := mem2DiskBzip2block(content)
-	if err != nil {
-		return nil, err
-	}
-	addMultibyteToData(&data, uint64(len(content)), 4) // add compressed len into the section start
+	// section header
+	addMultibyteToData(&data, uint64(signature), 3)
+	addByteToData(&data, id)
 
-	addMultibyteToData(&data, uint64(crc), 4) // append CRC
+	var content []byte
+	var codec, level uint8 = codec_none, 0
+	var cw *crcWriter
 
-	// Encryption
-	encrypted_content, err := mem2DiskAES256GCMblock(&content, data, p.HaystackPtr.aes_key_uuid)
-	if err != nil {
-		return nil, err
+	if config.compression_level > 0 { // 0 = no compression
+		var buf bytes.Buffer
+		var writer io.WriteCloser
+		var err error
+		name, try_codec := "bzip2", uint8(codec_bzip2)
+		if dict != nil {
+			name, try_codec = "deflate", codec_deflate_dict
+			writer, err = flate.NewWriterDict(&buf, int(config.compression_level), dict)
+		} else {
+			writer, err = bzip2.NewWriter(&buf, &bzip2.WriterConfig{Level: int(config.compression_level)})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error %s compressing: %v", name, err)
+		}
+		cw = newCRCWriter(writer)
+		if err := gen(cw); err != nil {
+			return nil, fmt.Errorf("error %s compressing: %v", name, err)
+		}
+		if err := writer.Close(); err != nil {
+			return nil, fmt.Errorf("error %s compressing: %v", name, err)
+		}
+
+		// Check if our output is indeed shorter (it will almost always be)
+		if buf.Len() > 0 && buf.Len() < cw.n {
+			content, codec, level = buf.Bytes(), try_codec, uint8(config.compression_level)
+		}
+	}
+
+	if content == nil { // store as is
+		var buf bytes.Buffer
+		cw = newCRCWriter(&buf)
+		if err := gen(cw); err != nil {
+			return nil, err
+		}
+		content = buf.Bytes()
 	}
 
-	data = append(data, *encrypted_content...) // we can glue it all together
+	addMultibyteToData(&data, uint64(cw.n), 4)           // add uncompressed len into the section start
+	addMultibyteToData(&data, uint64(len(content)), 4)   // add compressed len into the section start
+	addMultibyteToData(&data, uint64(cw.crc.Sum32()), 4) // append CRC
 
-	return data, nil
+	return &pendingSection{data: data, content: content, codec: codec, level: level}, nil
+}
+
+// Passes writes on to w, keeping the CRC (IEEE) and length of it all.
+// So we can checksum content that's never in one piece.
+type crcWriter struct {
+	w   io.Writer
+	crc hash.Hash32
+	n   int
+}
+
+func newCRCWriter(w io.Writer) *crcWriter {
+	return &crcWriter{w: w, crc: crc32.NewIEEE()}
+}
+
+func (c *crcWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.crc.Write(b[:n])
+	c.n += n
+	return n, err
 }
 
 // EOF
@@ -0,0 +1,205 @@
+// OpenActa/Haystack - streaming ingest straight to disk format
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	Ingesting into mem and then doing Mem2Disk() keeps all Haybales in RAM
+	until the very end. For converting large JSON files that doesn't scale.
+	Here we write each Haybale (and its incremental Dictionary) as soon as
+	it's full, and then drop it. Only the Dictionary stays in memory.
+*/
+
+package haystack
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+)
+
+// Ingest JSON lines from r, and write them to w as a Haystack file.
+// Memory use is bounded by one Haybale (Max_memsize) plus the Dictionary.
+// p should be a new (empty) Haystack, it's not searchable while we stream.
+// No catalogue (SHA512 block) is produced, see IngestAndStreamCatalogue().
+func (p *Haystack) IngestAndStream(r io.Reader, w io.Writer) error {
+	return p.IngestAndStreamCatalogue(r, w, nil)
+}
+
+// Same as IngestAndStream(), also writing the catalogue (SHA512 block) to cw.
+// Its filename is available from CatalogueName() afterwards.
+func (p *Haystack) IngestAndStreamCatalogue(r io.Reader, w io.Writer, cw io.Writer) error {
+	header, err := p.mem2DiskStart()
+	if err != nil {
+		return err
+	}
+
+	sw, err := newStreamWriter(w, p.aes_key_uuid)
+	if err != nil {
+		return err
+	}
+	if err := sw.write(header); err != nil {
+		return err
+	}
+
+	p.Dict.HaystackPtr = p
+
+	var time_first, time_last int64
+	var prev_ofs uint32
+
+	// Write one full Haybale, with the Dictionary (keys) it needs
+	flush := func(hb *Haybale) error {
+		if hb.num_haystalks == 0 {
+			return nil
+		}
+
+		cur_ofs := sw.ofs
+
+		// For the first Haybale, prev_ofs will be 0: that writes out a full Dictionary.
+		// After that, only the keys that were added since.
+		dc, err := p.Dict.Mem2Disk(prev_ofs)
+		if err != nil {
+			return err
+		}
+		if err := sw.write(dc); err != nil {
+			return err
+		}
+
+		data, err := hb.Mem2Disk(&p.Dict) // This also sorts the bale
+		if err != nil {
+			return err
+		}
+		if err := sw.write(data); err != nil {
+			return err
+		}
+
+		prev_ofs = cur_ofs
+
+		// Update our bounding timestamps as well (for the trailer)
+		if time_first == 0 || hb.time_first < time_first {
+			time_first = hb.time_first
+		}
+		if hb.time_last > time_last {
+			time_last = hb.time_last
+		}
+
+		return nil
+	}
+
+	cur_hb := &Haybale{HaystackPtr: p}
+
+	scanner := NewLineScanner(r)
+	var line int
+	for scanner.Scan() {
+		line++
+
+		if cur_hb.Memsize > Max_memsize {
+			if err := flush(cur_hb); err != nil {
+				return err
+			}
+			cur_hb = &Haybale{HaystackPtr: p} // previous one can be garbage collected now
+		}
+
+		flats, err := JSONToKVmaps(scanner.Bytes())
+		if err != nil {
+			log.Printf("Skipping line %d: %v", line, err)
+			continue
+		}
+
+		for _, flat := range flats {
+			if err := cur_hb.InsertBunch(&p.Dict, flat); err != nil {
+				log.Printf("Line %d: %v", line, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading JSON input: %w", LineScanError(err, line))
+	}
+
+	if err := flush(cur_hb); err != nil {
+		return err
+	}
+
+	p.time_first = time_first
+	p.time_last = time_last
+
+	trailer, err := p.mem2DiskFileTrailer(prev_ofs, time_first, time_last, sw.macSum())
+	if err != nil {
+		return err
+	}
+	if err := sw.write(trailer); err != nil {
+		return err
+	}
+
+	if cw == nil {
+		return nil
+	}
+
+	sha512section, err := p.mem2DiskSHA512block(sw.sha.Sum(nil), time_first, time_last)
+	if err != nil {
+		return err
+	}
+	_, err = cw.Write(sha512section)
+
+	return err
+}
+
+// Keeps track of where we are in the file, and the SHA-512 over all of it.
+// Also the file MAC, if the file is encrypted.
+type streamWriter struct {
+	w   io.Writer
+	sha hash.Hash
+	mac hash.Hash // nil if not encrypted
+	ofs uint32
+}
+
+func newStreamWriter(w io.Writer, aes_key_uuid string) (*streamWriter, error) {
+	mac, err := newFileMAC(aes_key_uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamWriter{w: w, sha: sha512.New(), mac: mac}, nil
+}
+
+// File MAC over what's been written, for the trailer (nil if not encrypted)
+func (s *streamWriter) macSum() []byte {
+	if s.mac == nil {
+		return nil
+	}
+
+	return s.mac.Sum(nil)
+}
+
+func (s *streamWriter) write(data []byte) error {
+	if uint64(s.ofs)+uint64(len(data)) > max_filesize {
+		return fmt.Errorf("Haystack file would exceed %d bytes", uint64(max_filesize))
+	}
+
+	if _, err := s.w.Write(data); err != nil {
+		return err
+	}
+	s.sha.Write(data)
+	if s.mac != nil {
+		s.mac.Write(data)
+	}
+	s.ofs += uint32(len(data))
+
+	return nil
+}
+
+// EOF
@@ -0,0 +1,81 @@
+// OpenActa/Haystack - streaming ingest - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"os"
+	"testing"
+)
+
+// Streamed file reads back the same as one written from mem
+func TestIngestAndStream(t *testing.T) {
+	setTestConfig(t)
+
+	in, err := os.Open("testdata/head5.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	var out, catalogue bytes.Buffer
+	streamed := new(Haystack)
+	if err := streamed.IngestAndStreamCatalogue(in, &out, &catalogue); err != nil {
+		t.Fatal(err)
+	}
+
+	// Catalogue has the SHA-512 of the whole file (after its own header)
+	hdr, err := getDisk2MemNextSection(catalogue.Bytes(), 0, version_minor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := getDisk2MemNextSection(catalogue.Bytes(), hdr.next(), version_minor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := getDisk2MemSectionContent(s, test_aes_uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha512.Sum512(out.Bytes())
+	if s.id != section_sha512 || !bytes.Equal(content[16:16+sha512_byte_len], sum[:]) {
+		t.Errorf("catalogue doesn't contain SHA-512 of streamed file")
+	}
+
+	hs := new(Haystack)
+	if err := hs.Disk2Mem(out.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := newTestHaystack(t, "testdata/head5.json", 1000)
+	for _, kv := range []map[string]string{
+		{"dest_port": "443"},
+		{"event_type": "tls", "proto": "TCP"},
+	} {
+		if got, want := hs.CountKeyValArray(kv), want.CountKeyValArray(kv); got != want || got == 0 {
+			t.Errorf("search %v: %d matches in streamed file, want %d", kv, got, want)
+		}
+	}
+
+	if hs.file_uuid != streamed.file_uuid || hs.CatalogueName() != streamed.CatalogueName() {
+		t.Errorf("file read back as %s, written as %s", hs.CatalogueName(), streamed.CatalogueName())
+	}
+}
+
+// EOF
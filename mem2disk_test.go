@@ -0,0 +1,282 @@
+// OpenActa/Haystack - mem2disk - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dsnet/compress/bzip2"
+)
+
+// First lines of eve.json in a Haystack, per_bale bunches per Haybale
+func testEveHaystack(tb testing.TB, lines int, per_bale int) *Haystack {
+	src, err := os.Open("testdata/eve.json")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer src.Close()
+
+	fname := filepath.Join(tb.TempDir(), "eve.json")
+	dst, err := os.Create(fname)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	scanner := bufio.NewScanner(src)
+	for i := 0; i < lines && scanner.Scan(); i++ {
+		dst.Write(append(scanner.Bytes(), '\n'))
+	}
+	dst.Close()
+
+	return newTestHaystack(tb, fname, per_bale)
+}
+
+// Haybales compressed in parallel: still all there, in order, every nonce different
+func TestMem2DiskParallel(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	hs := testEveHaystack(t, 1000, 100)
+
+	data, _, err := hs.Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hs2 := new(Haystack)
+	if err := hs2.Disk2Mem(data); err != nil {
+		t.Fatal(err)
+	}
+	if eq, why := hs.Equal(hs2); !eq {
+		t.Errorf("read back differs: %s", why)
+	}
+	for i := range hs.Haybale {
+		if hs.Haybale[i].time_first != hs2.Haybale[i].time_first {
+			t.Errorf("Haybale %d out of order", i)
+		}
+	}
+
+	nonces := make(map[string]int)
+	var bales int
+	for ofs := 0; ofs < len(data); {
+		s, err := getDisk2MemNextSection(data, ofs, version_minor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ofs = s.next()
+
+		if s.id == section_haybale {
+			bales++
+		}
+		if s.cipher != cipher_aes256gcm {
+			continue
+		}
+		nonce := string(s.content[:aesgcm_nonce_byte_len])
+		if prev, dup := nonces[nonce]; dup {
+			t.Errorf("sections at %d and %d have the same nonce", prev, s.ofs)
+		}
+		nonces[nonce] = s.ofs
+	}
+	if bales != 10 || len(nonces) < 2*bales {
+		t.Errorf("%d Haybale sections, %d encrypted sections", bales, len(nonces))
+	}
+}
+
+// Compare with go test -bench Mem2Disk -cpu 1,4
+func BenchmarkMem2Disk(b *testing.B) {
+	saved := config
+	b.Cleanup(func() { config = saved })
+	config.aes_keystore_array = map[string][]byte{test_aes_uuid: make([]byte, AES_key_byte_len)}
+	config.aes_keystore_current_uuid = test_aes_uuid
+	config.compression_level = 9
+	config.dict_table_bits = 10
+
+	hs := testEveHaystack(b, 8000, 1000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := hs.Mem2Disk(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Streamed, the CRC and lengths come out the same as over the whole content
+func TestMem2DiskStreamCRC(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	hs := testEveHaystack(t, 300, 300) // well over one chunk
+	hb := hs.Haybale[0]
+	hb.SortBale()
+
+	var plain bytes.Buffer
+	if err := hb.mem2DiskContent(&plain); err != nil {
+		t.Fatal(err)
+	}
+	if plain.Len() < 3*16384 {
+		t.Fatalf("only %d bytes", plain.Len())
+	}
+
+	for _, level := range []uint32{0, 1, 9} {
+		config.compression_level = level
+
+		s, err := mem2DiskStreamSection(section_haybale, hb.mem2DiskContent, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := bytes.NewReader(s.data)
+		if sig := getUintFromData(r, 3); sig != signature || getByteFromData(r) != section_haybale {
+			t.Fatalf("level %d: bad section header %x", level, s.data)
+		}
+		unc_len, com_len := int(getUintFromData(r, 4)), int(getUintFromData(r, 4))
+		crc := uint32(getUintFromData(r, 4))
+
+		if unc_len != plain.Len() || com_len != len(s.content) {
+			t.Errorf("level %d: lengths %d, %d for %d bytes (%d stored)", level, unc_len, com_len, plain.Len(), len(s.content))
+		}
+		if want := crc32.ChecksumIEEE(plain.Bytes()); crc != want {
+			t.Errorf("level %d: CRC %08x, over all content %08x", level, crc, want)
+		}
+
+		content := s.content
+		if level > 0 {
+			if s.codec != codec_bzip2 || s.level != uint8(level) {
+				t.Errorf("level %d: codec %d, level %d", level, s.codec, s.level)
+			}
+			br, err := bzip2.NewReader(bytes.NewReader(s.content), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if content, err = io.ReadAll(br); err != nil {
+				t.Fatal(err)
+			}
+		} else if s.codec != codec_none {
+			t.Errorf("level 0: codec %d", s.codec)
+		}
+		if !bytes.Equal(content, plain.Bytes()) {
+			t.Errorf("level %d: content differs", level)
+		}
+	}
+
+	// In any pieces
+	cw := newCRCWriter(io.Discard)
+	for b := plain.Bytes(); len(b) > 0; {
+		n := 1 + len(b)%777
+		if n > len(b) {
+			n = len(b)
+		}
+		cw.Write(b[:n])
+		b = b[n:]
+	}
+	if cw.n != plain.Len() || cw.crc.Sum32() != crc32.ChecksumIEEE(plain.Bytes()) {
+		t.Errorf("crcWriter: %d bytes, CRC %08x", cw.n, cw.crc.Sum32())
+	}
+}
+
+// No catalogue with an empty keystore, or a key that's gone from it
+func TestMem2DiskSHA512blockKeystore(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+	sum := make([]byte, sha512_byte_len)
+
+	config.aes_keystore_array = map[string][]byte{}
+	config.aes_keystore_current_uuid = ""
+	if _, _, err := hs.Mem2Disk(); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("empty keystore: %v", err)
+	}
+
+	hs.aes_key_uuid = "0d6e0b9f-4b1c-4c2a-9a57-2f1a3d5e7c90"
+	if _, err := hs.mem2DiskSHA512block(sum, 0, 0); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("uuid not in keystore: %v", err)
+	}
+
+	// Unencrypted doesn't need a key
+	config.encryption_disabled = true
+	if _, _, err := hs.Mem2Disk(); err != nil {
+		t.Errorf("encryption disabled: %v", err)
+	}
+}
+
+// With encryption_enabled false, every section is flagged plaintext,
+// and the file reads back without any AES key
+func TestMem2DiskPlaintext(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+	for _, encrypted := range []bool{true, false} {
+		config.encryption_disabled = !encrypted
+		if err := SetActiveKey(test_aes_uuid, make([]byte, AES_key_byte_len)); err != nil {
+			t.Fatal(err)
+		}
+		data, _, err := hs.Mem2Disk()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sections, err := ListSections(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, si := range sections {
+			s, err := getDisk2MemNextSection(data, si.Offset, version_minor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if si.ID == section_header {
+				continue
+			}
+			if plain := s.flags&section_flag_plaintext != 0; plain == encrypted || (s.cipher == cipher_none) == encrypted {
+				t.Errorf("encrypted=%v: %s section at %d has flags %#x, cipher %d", encrypted, si.Type(), si.Offset, s.flags, s.cipher)
+			}
+		}
+
+		// Without a key
+		config.aes_keystore_array = nil
+		hs2 := new(Haystack)
+		err = hs2.Disk2Mem(data)
+		if encrypted {
+			if !errors.Is(err, ErrWrongKey) {
+				t.Errorf("encrypted, no key: %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hs2.aes_key_uuid != "" {
+			t.Errorf("plaintext file has AES key uuid %s", hs2.aes_key_uuid)
+		}
+		if ok, diff := hs.Equal(hs2); !ok {
+			t.Errorf("not the same after a round trip: %s", diff)
+		}
+	}
+}
+
+// EOF
@@ -0,0 +1,165 @@
+// OpenActa/Haystack - cardinality estimates
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	How many distinct values does a key have? Exactly, that's a set of all
+	of them, which for a key like src_ip over a big dataset is a lot of RAM.
+	A HyperLogLog sketch gets within a few percent with 4KB, whatever the
+	number of values: each value is hashed, and each of 2^12 registers
+	keeps the longest run of leading zero bits it's seen. A value that's
+	in several Haybales is the same hash, so it counts once.
+
+	Nothing is kept, the sketch is built when asked: within a sorted Haybale
+	the stalks of a key are together, and equal values next to each other,
+	so we hash each distinct value of the Haybale once.
+
+	Values are typed: 443 and "443" count as two.
+*/
+
+package haystack
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+const (
+	hll_precision = 12 // 2^12 registers, about 1.6% standard error
+	hll_registers = 1 << hll_precision
+)
+
+type hllSketch struct {
+	reg [hll_registers]uint8
+}
+
+// Note a value, by its hash
+func (s *hllSketch) add(h uint64) {
+	i := h >> (64 - hll_precision)
+	rho := uint8(bits.LeadingZeros64(h<<hll_precision|1<<(hll_precision-1)) + 1)
+	if rho > s.reg[i] {
+		s.reg[i] = rho
+	}
+}
+
+// Number of distinct values we've seen, about
+func (s *hllSketch) estimate() uint64 {
+	m := float64(hll_registers)
+
+	var sum float64
+	var zeros int
+	for _, r := range s.reg {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	e := alpha * m * m / sum
+
+	// Few values: linear counting on the empty registers is closer
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+
+	return uint64(e + 0.5)
+}
+
+// 64 bit hash of a value, FNV-1a mixed up some more (splitmix64 finish),
+// the sketch needs all bits to look random
+func hllHashVal(v *Val) uint64 {
+	const prime = 1099511628211
+	h := uint64(14695981039346656037)
+
+	h = (h ^ uint64(v.valtype)) * prime
+	switch v.valtype {
+	case valtype_int, valtype_time:
+		x := uint64(v.intval)
+		for i := 0; i < 8; i++ {
+			h = (h ^ (x & 0xff)) * prime
+			x >>= 8
+		}
+	case valtype_float:
+		x := math.Float64bits(v.floatval)
+		for i := 0; i < 8; i++ {
+			h = (h ^ (x & 0xff)) * prime
+			x >>= 8
+		}
+	case valtype_string:
+		s := *v.stringval
+		for i := 0; i < len(s); i++ {
+			h = (h ^ uint64(s[i])) * prime
+		}
+	}
+
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+
+	return h
+}
+
+// Add the values of dkey in this Haybale to the sketch
+func (p *Haybale) cardinalitySketch(s *hllSketch, dkey uint32) {
+	if !p.is_sorted_immutable {
+		for i := uint32(0); i < p.num_haystalks; i++ {
+			if p.haystalk[i].dkey == dkey {
+				s.add(hllHashVal(&p.haystalk[i].val))
+			}
+		}
+		return
+	}
+
+	// Sorted: the run of dkey, equal values together
+	stalks := int(p.num_haystalks)
+	lo := sort.Search(stalks, func(x int) bool { return p.haystalk[x].dkey >= dkey })
+	for i := lo; i < stalks && p.haystalk[i].dkey == dkey; i++ {
+		if i > lo && p.haystalk[i].Compare(*p.haystalk[i-1]) == 0 {
+			continue
+		}
+		s.add(hllHashVal(&p.haystalk[i].val))
+	}
+}
+
+// About how many distinct values key has, over all Haybales (within a few
+// percent, see the top of this file). A key that's not there has 0.
+func (p *Haystack) EstimateCardinality(key string) (uint64, error) {
+	if key == "" || len(key) > max_keylen {
+		return 0, fmt.Errorf("invalid key '%.32s', must be 1-%d chars", key, max_keylen)
+	}
+
+	p.RLock()
+	defer p.RUnlock()
+
+	dkey, found := p.Dict.KeyExists(key)
+	if !found {
+		return 0, nil
+	}
+
+	var s hllSketch
+	for _, hb := range p.Haybale {
+		hb.cardinalitySketch(&s, dkey)
+	}
+
+	return s.estimate(), nil
+}
+
+// EOF
@@ -0,0 +1,102 @@
+// OpenActa/Haystack - cardinality estimates - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+// Exact distinct values of key, the hard way
+func exactCardinality(hs *Haystack, key string) int {
+	dkey, found := hs.Dict.KeyExists(key)
+	if !found {
+		return 0
+	}
+
+	seen := make(map[string]bool)
+	for _, hb := range hs.Haybale {
+		for i := uint32(0); i < hb.num_haystalks; i++ {
+			if s := hb.haystalk[i]; s.dkey == dkey {
+				seen[fmt.Sprintf("%d:%s", s.val.valtype, s.val.String())] = true
+			}
+		}
+	}
+
+	return len(seen)
+}
+
+func TestEstimateCardinality(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	hs := testEveHaystack(t, 4000, 1000)
+
+	for _, key := range []string{"event_type", "dest_port", "src_ip", "flow_id", Timestamp_key} {
+		want := exactCardinality(hs, key)
+		got, err := hs.EstimateCardinality(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(float64(got)-float64(want)) > 0.05*float64(want)+1 {
+			t.Errorf("%s: estimate %d, exact %d", key, got, want)
+		}
+	}
+
+	// Same without sorting
+	for _, hb := range hs.Haybale {
+		hb.is_sorted_immutable = false
+	}
+	got, _ := hs.EstimateCardinality("src_ip")
+	for _, hb := range hs.Haybale {
+		hb.is_sorted_immutable = true
+	}
+	if sorted, _ := hs.EstimateCardinality("src_ip"); got != sorted {
+		t.Errorf("unsorted %d, sorted %d", got, sorted)
+	}
+
+	if got, err := hs.EstimateCardinality("no_such_key"); got != 0 || err != nil {
+		t.Errorf("no_such_key: %d %v", got, err)
+	}
+	for _, key := range []string{"", strings.Repeat("k", max_keylen+1)} {
+		if _, err := hs.EstimateCardinality(key); err == nil {
+			t.Errorf("key of %d chars: no error", len(key))
+		}
+	}
+}
+
+// Typed: 443 and "0443" are different, 443 in two Haybales is one
+func TestEstimateCardinalityTypes(t *testing.T) {
+	setTestConfig(t)
+
+	hs := new(Haystack)
+	for _, port := range []interface{}{443.0, "0443", 443.0, 80.0} {
+		hb := &Haybale{HaystackPtr: hs}
+		hb.InsertBunch(&hs.Dict, map[string]interface{}{Timestamp_key: "2023-06-05T12:00:00Z", "port": port})
+		hs.Haybale = append(hs.Haybale, hb)
+	}
+	hs.SortAllBales()
+
+	if got, err := hs.EstimateCardinality("port"); got != 3 || err != nil {
+		t.Errorf("port: %d %v, want 3", got, err)
+	}
+}
+
+// EOF
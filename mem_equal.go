@@ -0,0 +1,103 @@
+// OpenActa/Haystack - compare Haystacks by content
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Compare the content of two Haystacks: the same bunches (records), the same
+// number of times each. How they're spread over Haybales, dkey numbers, and
+// order within a bunch don't matter, so this works across disk round-trips,
+// merges, re-encryption etc.
+// Returns false and a description of the first difference if not equal.
+func (p *Haystack) Equal(other *Haystack) (bool, string) {
+	if p == other {
+		return true, ""
+	}
+
+	p.RLock()
+	a := p.bunchCounts()
+	p.RUnlock()
+
+	other.RLock()
+	b := other.bunchCounts()
+	other.RUnlock()
+
+	// Collect the differences, sorted so the "first" one is always the same
+	diff := make([]string, 0)
+	for bunch, n := range a {
+		if b[bunch] != n {
+			diff = append(diff, bunch)
+		}
+	}
+	for bunch := range b {
+		if _, ok := a[bunch]; !ok {
+			diff = append(diff, bunch)
+		}
+	}
+
+	if len(diff) == 0 {
+		return true, ""
+	}
+	sort.Strings(diff)
+
+	return false, fmt.Sprintf("%d bunch(es) differ, first: %s occurs %d time(s) vs %d time(s)",
+		len(diff), diff[0], a[diff[0]], b[diff[0]])
+}
+
+// Count each distinct bunch, in normalised form (sorted key=value pairs).
+// Caller holds the lock.
+func (p *Haystack) bunchCounts() map[string]int {
+	counts := make(map[string]int)
+
+	for _, hb := range p.Haybale {
+		hb.forEachBunch(func(first uint32) {
+			counts[hb.normaliseBunch(&p.Dict, first)]++
+		})
+	}
+
+	return counts
+}
+
+// Call fn for each bunch in the Haybale, with the offset of its first stalk (_timestamp)
+func (p *Haybale) forEachBunch(fn func(first uint32)) {
+	for j := uint32(0); j < p.num_haystalks; j++ {
+		if p.haystalk[j].first_ofs == j { // only the first stalk points to itself
+			fn(j)
+		}
+	}
+}
+
+// One bunch as a string, independent of stalk order and dkeys
+func (p *Haybale) normaliseBunch(d *Dictionary, first uint32) string {
+	pairs := make([]string, 0, 32)
+
+	for k := first; k != haystalk_ofs_nil; k = p.haystalk[k].next_ofs {
+		key := d.keyFold(*d.dkey[p.haystalk[k].dkey])
+		pairs = append(pairs, strconv.Quote(key)+":"+strconv.Quote(p.haystalk[k].val.String()))
+	}
+	sort.Strings(pairs)
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// EOF
@@ -0,0 +1,70 @@
+// OpenActa/Haystack - compare Haystacks by content - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"strings"
+	"testing"
+)
+
+// Disk round-trip, with different Haybale layouts, compares equal
+func TestEqualRoundTrip(t *testing.T) {
+	setTestConfig(t)
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+
+	data, _, err := hs.Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs2 := new(Haystack)
+	if err := hs2.Disk2Mem(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if eq, diff := hs.Equal(hs2); !eq {
+		t.Errorf("round-trip not equal: %s", diff)
+	}
+
+	// One big Haybale instead of three
+	if eq, diff := hs.Equal(newTestHaystack(t, "testdata/head5.json", 100)); !eq {
+		t.Errorf("different Haybale layout not equal: %s", diff)
+	}
+}
+
+func TestEqualDiff(t *testing.T) {
+	hs := newTestHaystack(t, "testdata/head5.json", 100)
+
+	// Same records, but one of them twice
+	hs2 := newTestHaystack(t, "testdata/head5.json", 100)
+	flat, err := JSONToKVmap([]byte(`{"timestamp":"2023-06-04T00:00:59.792568+0000","dest_port":443}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	extra := &Haybale{HaystackPtr: hs2}
+	extra.InsertBunch(&hs2.Dict, flat)
+	extra.SortBale()
+	hs2.Haybale = append(hs2.Haybale, extra)
+
+	eq, diff := hs.Equal(hs2)
+	if eq || !strings.Contains(diff, `"dest_port":"443"`) || !strings.Contains(diff, "0 time(s) vs 1 time(s)") {
+		t.Errorf("extra bunch: equal=%v, diff '%s'", eq, diff)
+	}
+}
+
+// EOF
@@ -0,0 +1,288 @@
+// OpenActa/Haystack - per Haybale min/max index
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	Time ranges let us skip whole Haybales for a search on _timestamp.
+	For the keys in config index_keys, we do the same with their values:
+	a sorted Haybale has all stalks of a key together, by value type and
+	then by value, so the min and max are just the ends of each run.
+	They're noted when the Haybale is sorted, and written after the Haybale
+	in an (optional) index section.
+
+	A search condition that can't be true for anything between min and max
+	rules out the whole Haybale, without looking at a single stalk.
+	No index (older files, key not configured back then) means we look.
+*/
+
+package haystack
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+/*
+type DiskHaybaleIndex struct {
+	num_entries uint32	// number of DiskHaybaleIndexEntry
+	<DiskHaybaleIndexEntry> ...
+}
+
+type DiskHaybaleIndexEntry struct {
+	dkey    [3]byte		// Key = Dictionary lookup #
+	valtype uint8		// 0 = key not in this Haybale, no min and max follow
+	min, max			// encoded as in DiskHaytalkEntry (no de-dup)
+}
+*/
+
+// min and max of a run of one value type, a key can have a few of them.
+// valtype 0 for a key that's not in the Haybale at all.
+type baleIndexEntry struct {
+	dkey uint32
+	min  Haystalk
+	max  Haystalk
+}
+
+type baleIndex []baleIndexEntry
+
+// Note min and max of the configured index keys. Haybale must be sorted.
+func (p *Haybale) buildIndex() {
+	p.index = nil
+
+	if len(config.index_keys) == 0 || p.HaystackPtr == nil {
+		return
+	}
+
+	n := int(p.num_haystalks)
+	idx := make(baleIndex, 0, len(config.index_keys))
+	seen := make(map[uint32]bool)
+	for _, k := range config.index_keys {
+		dkey, found := p.HaystackPtr.Dict.KeyExists(k)
+		if !found || seen[dkey] { // not in any Haybale (yet), or Host and host
+			continue
+		}
+		seen[dkey] = true
+
+		i := sort.Search(n, func(i int) bool { return p.haystalk[i].dkey >= dkey })
+		if i == n || p.haystalk[i].dkey != dkey {
+			idx = append(idx, baleIndexEntry{dkey: dkey})
+			continue
+		}
+
+		for i < n && p.haystalk[i].dkey == dkey {
+			vt := p.haystalk[i].val.valtype
+			j := i + sort.Search(n-i, func(j int) bool {
+				return p.haystalk[i+j].dkey != dkey || p.haystalk[i+j].val.valtype != vt
+			})
+			idx = append(idx, baleIndexEntry{dkey: dkey, min: *p.haystalk[i], max: *p.haystalk[j-1]})
+			i = j
+		}
+	}
+
+	p.index = idx
+}
+
+// Could a stalk of dkey compare (op) true with b? See fieldCompareOp().
+// We only say no if we know, so without index entries for the key it's yes.
+func (x baleIndex) mayMatch(dkey uint32, op string, b *Haystalk) bool {
+	indexed := false
+	for i := range x {
+		if x[i].dkey != dkey {
+			continue
+		}
+		indexed = true
+		if x[i].min.val.valtype == 0 {
+			return false // key not in this Haybale
+		}
+		if x[i].mayMatch(op, b) {
+			return true
+		}
+	}
+
+	return !indexed
+}
+
+func (e *baleIndexEntry) mayMatch(op string, b *Haystalk) bool {
+	// Strings against numbers are compared numerically, which is not
+	// the order they were sorted in. So min and max don't tell us anything.
+	if e.min.val.valtype == valtype_string && b.val.valtype != valtype_string {
+		return true
+	}
+
+	lo, ok := e.min.CompareValueOnly(b)
+	if !ok {
+		return false // same types in the run, so none of them compare
+	}
+	hi, _ := e.max.CompareValueOnly(b)
+
+	switch op {
+	case "==", "=":
+		return lo <= 0 && hi >= 0
+	case "!=":
+		return lo != 0 || hi != 0
+	case "<":
+		return lo < 0
+	case "<=":
+		return lo <= 0
+	case ">":
+		return hi > 0
+	case ">=":
+		return hi >= 0
+	default:
+		return true
+	}
+}
+
+// A condition for the index: key op value, true if any of vals is (for IN)
+type indexCond struct {
+	dkey uint32
+	op   string
+	vals []Haystalk
+}
+
+// Could this Haybale have bunches matching all of conds?
+func (x baleIndex) mayMatchAll(conds []indexCond) bool {
+	if x == nil {
+		return true
+	}
+
+	for _, c := range conds {
+		found := false
+		for i := range c.vals {
+			if x.mayMatch(c.dkey, c.op, &c.vals[i]) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Index section for this (sorted) Haybale, nil if there's no index.
+// dict is the file's compression dictionary, if any.
+func (p *Haybale) mem2DiskIndex(dict []byte) (*pendingSection, error) {
+	if p.index == nil {
+		return nil, nil
+	}
+
+	var content = make([]byte, 0, 256)
+
+	addMultibyteToData(&content, uint64(len(p.index)), 4)
+	for i := range p.index {
+		e := &p.index[i]
+		addMultibyteToData(&content, uint64(e.dkey), 3)
+		addByteToData(&content, e.min.val.valtype)
+		if e.min.val.valtype == 0 {
+			continue
+		}
+		addIndexValToData(&content, &e.min.val)
+		addIndexValToData(&content, &e.max.val)
+	}
+
+	return mem2DiskStreamSection(section_haybale_index, func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	}, dict)
+}
+
+func addIndexValToData(buf *[]byte, v *Val) {
+	switch v.valtype {
+	case valtype_int, valtype_time:
+		addMultibyteToData(buf, uint64(v.intval), 8)
+	case valtype_float:
+		addMultibyteToData(buf, math.Float64bits(v.floatval), 8)
+	case valtype_string:
+		addStringToData(buf, *v.stringval)
+	}
+}
+
+// Decode index section content. dkeys are checked against the Dictionary.
+func (p *Haystack) getDisk2MemHaybaleIndex(content []byte) (baleIndex, error) {
+	reader := bytes.NewReader(content)
+
+	if reader.Len() < 4 {
+		return nil, fmt.Errorf("%w: haybale index section too short", ErrCorrupt)
+	}
+	num := getUintFromData(reader, 4)
+	if num > uint64(reader.Len()/4) { // each entry is at least 4 bytes
+		return nil, fmt.Errorf("%w: haybale index says %d entries, in %d bytes", ErrCorrupt, num, reader.Len())
+	}
+
+	idx := make(baleIndex, int(num))
+	for i := range idx {
+		if reader.Len() < 4 {
+			return nil, fmt.Errorf("%w: haybale index entry %d truncated", ErrCorrupt, i)
+		}
+		idx[i].dkey = uint32(getUintFromData(reader, 3))
+		if int(idx[i].dkey) >= len(p.Dict.dkey) || p.Dict.dkey[idx[i].dkey] == nil {
+			return nil, fmt.Errorf("%w: haybale index has dkey %d, not in the Dictionary", ErrCorrupt, idx[i].dkey)
+		}
+
+		valtype := getByteFromData(reader)
+		if valtype == 0 {
+			continue
+		}
+		for _, v := range []*Val{&idx[i].min.val, &idx[i].max.val} {
+			if err := getIndexValFromData(reader, valtype, v); err != nil {
+				return nil, fmt.Errorf("haybale index entry %d: %w", i, err)
+			}
+		}
+		idx[i].min.dkey, idx[i].max.dkey = idx[i].dkey, idx[i].dkey
+	}
+
+	return idx, nil
+}
+
+func getIndexValFromData(reader *bytes.Reader, valtype uint8, v *Val) error {
+	switch valtype {
+	case valtype_int, valtype_float, valtype_time:
+		if reader.Len() < 8 {
+			return fmt.Errorf("%w: value truncated", ErrCorrupt)
+		}
+	case valtype_string:
+		if reader.Len() < 4 {
+			return fmt.Errorf("%w: value truncated", ErrCorrupt)
+		}
+	}
+
+	switch valtype {
+	case valtype_int:
+		v.SetInt(int64(getUintFromData(reader, 8)))
+	case valtype_float:
+		v.SetFloat(getFloatFromData(reader, 8))
+	case valtype_time:
+		v.SetTime(int64(getUintFromData(reader, 8)))
+	case valtype_string:
+		n := getUintFromData(reader, 4)
+		if n > uint64(reader.Len()) {
+			return fmt.Errorf("%w: string of %d bytes, %d left", ErrCorrupt, n, reader.Len())
+		}
+		v.SetString(getStringFromData(reader, int(n)))
+	default:
+		return fmt.Errorf("%w: unknown value type %d", ErrCorrupt, valtype)
+	}
+
+	return nil
+}
+
+// EOF
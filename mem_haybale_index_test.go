@@ -0,0 +1,256 @@
+// OpenActa/Haystack - per Haybale min/max index - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Query, and how many of the 5 single-bunch Haybales of head5.json the
+// index rules out: dest_port is 443 but one 514, src_ip 80.229.245.222 twice
+var index_tests = []struct {
+	query   string
+	skipped int
+}{
+	{`dest_port=514`, 4},
+	{`dest_port="514"`, 4},
+	{`dest_port>500`, 4},
+	{`dest_port<=443`, 1},
+	{`dest_port!=443`, 4},
+	{`dest_port>=1 AND dest_port<1000`, 0},
+	{`dest_port IN (514, 1)`, 4},
+	{`dest_port IN (443, 514)`, 0},
+	{`dest_port=80`, 5},
+	{`dest_port=https`, 5}, // a number doesn't compare with a word
+	{`src_ip=80.229.245.222`, 3},
+	{`src_ip>zzz`, 5},
+	{`src_ip=80.229.245.222 AND dest_port=443`, 3},
+	{`src_ip=80.229.245.222 OR dest_port=514`, 0}, // no OR
+	{`event_type=flow`, 0},                        // not indexed
+}
+
+func indexTestConfig(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	config.index_keys = []string{"dest_port", "SRC_IP", "src_ip", "not_there"}
+}
+
+// How many Haybales the index rules out for q
+func indexSkipped(hs *Haystack, q Query) int {
+	conds := hs.topIndexConds(&q)
+	skipped := 0
+	for _, hb := range hs.Haybale {
+		if !hb.index.mayMatchAll(conds) {
+			skipped++
+		}
+	}
+	return skipped
+}
+
+func TestBaleIndex(t *testing.T) {
+	indexTestConfig(t)
+
+	hs := newTestHaystack(t, "testdata/head5.json", 1)
+
+	// dest_port and src_ip, once each
+	for _, hb := range hs.Haybale {
+		if len(hb.index) != 2 {
+			t.Fatalf("index %+v", hb.index)
+		}
+	}
+
+	for _, tt := range index_tests {
+		q, err := ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n := indexSkipped(hs, q); n != tt.skipped {
+			t.Errorf("%s: index skips %d Haybales, expected %d", tt.query, n, tt.skipped)
+		}
+
+		// Same results without the index
+		with, err := hs.SearchQuery(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved := make([]baleIndex, len(hs.Haybale))
+		for i, hb := range hs.Haybale {
+			saved[i], hb.index = hb.index, nil
+		}
+		without, err := hs.SearchQuery(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, hb := range hs.Haybale {
+			hb.index = saved[i]
+		}
+		if !reflect.DeepEqual(with, without) {
+			t.Errorf("%s: %d results with index, %d without", tt.query, len(with), len(without))
+		}
+	}
+}
+
+// A key with values of several types has a run for each
+func TestBaleIndexValueTypes(t *testing.T) {
+	indexTestConfig(t)
+	config.index_keys = []string{"port"}
+
+	hs := new(Haystack)
+	hb := &Haybale{HaystackPtr: hs}
+	hs.Haybale = append(hs.Haybale, hb)
+	for _, rec := range []string{
+		`{"_timestamp": "2023-06-04T00:00:01Z", "port": 8080}`,
+		`{"_timestamp": "2023-06-04T00:00:02Z", "port": 22}`,
+		`{"_timestamp": "2023-06-04T00:00:03Z", "port": "ssh"}`,
+		`{"_timestamp": "2023-06-04T00:00:04Z", "port": "http"}`,
+		`{"_timestamp": "2023-06-04T00:00:05Z", "other": 1}`,
+	} {
+		flat, err := JSONToKVmap([]byte(rec))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := hb.InsertBunch(&hs.Dict, flat); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hb.SortBale()
+
+	if len(hb.index) != 2 || hb.index[0].min.val.GetInt() != 22 || hb.index[0].max.val.GetInt() != 8080 ||
+		*hb.index[1].min.val.GetString() != "http" || *hb.index[1].max.val.GetString() != "ssh" {
+		t.Fatalf("index %+v", hb.index)
+	}
+
+	for _, tt := range []struct {
+		query string
+		match bool
+	}{
+		{`port=22`, true},
+		{`port=8081`, true}, // "http" and "ssh" compared as numbers, can't tell
+		{`port>9000`, true},
+		{`port=ssh`, true},
+		{`port=telnet`, false},
+		{`port<abc`, false}, // no words before it, and the numbers don't compare
+	} {
+		q, err := ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := hb.index.mayMatchAll(hs.topIndexConds(&q)); m != tt.match {
+			t.Errorf("%s: %v", tt.query, m)
+		}
+	}
+
+	// Inserting more makes the index go, until the next sort
+	hs2 := new(Haystack)
+	hb2 := &Haybale{HaystackPtr: hs2}
+	flat, _ := JSONToKVmap([]byte(`{"_timestamp": "2023-06-04T00:00:01Z", "port": 1}`))
+	hb2.InsertBunch(&hs2.Dict, flat)
+	hb2.Rebuild()
+	if hb2.index == nil {
+		t.Fatalf("no index after Rebuild()")
+	}
+	flat, _ = JSONToKVmap([]byte(`{"_timestamp": "2023-06-04T00:00:02Z", "port": 2}`))
+	hb2.InsertBunch(&hs2.Dict, flat)
+	if hb2.index != nil {
+		t.Errorf("index kept after insert: %+v", hb2.index)
+	}
+}
+
+// Written after the Haybale, read back by Disk2Mem() and OpenMapped()
+func TestBaleIndexDisk(t *testing.T) {
+	indexTestConfig(t)
+
+	hs := newTestHaystack(t, "testdata/head5.json", 1)
+	data, _, err := hs.Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sections, err := ListSections(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexes := 0
+	for _, si := range sections {
+		if si.Type() == "haybale index" {
+			indexes++
+		}
+	}
+	if indexes != 5 {
+		t.Errorf("%d index sections", indexes)
+	}
+
+	// Loading doesn't need index_keys, the index comes from the file
+	config.index_keys = nil
+	hs_loaded := new(Haystack)
+	if err := hs_loaded.Disk2Mem(data); err != nil {
+		t.Fatal(err)
+	}
+	for i, hb := range hs_loaded.Haybale {
+		if len(hb.index) != len(hs.Haybale[i].index) {
+			t.Fatalf("Haybale %d index %+v", i, hb.index)
+		}
+	}
+	for _, tt := range index_tests {
+		q, err := ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := indexSkipped(hs_loaded, q); n != tt.skipped {
+			t.Errorf("%s: index skips %d Haybales after Disk2Mem, expected %d", tt.query, n, tt.skipped)
+		}
+	}
+
+	if err := VerifySectionCRCs(data); err != nil {
+		t.Errorf("VerifySectionCRCs: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "index.hs")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := OpenMapped(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if len(m.index) != m.NumHaybales() {
+		t.Fatalf("%d indexes for %d Haybales", len(m.index), m.NumHaybales())
+	}
+	dkey, _ := m.hs.Dict.KeyExists("dest_port")
+	conds := []indexCond{{dkey: dkey, op: "=", vals: []Haystalk{{dkey: dkey, val: searchVal(&m.hs.Dict, "dest_port", "514")}}}}
+	skipped := 0
+	for i := range m.index {
+		if !m.index[i].mayMatchAll(conds) {
+			skipped++
+		}
+	}
+	if skipped != 4 {
+		t.Errorf("mapped index skips %d Haybales", skipped)
+	}
+	if err := m.SearchKeyValArray(map[string]string{"dest_port": "514"}); err != nil {
+		t.Error(err)
+	}
+}
+
+// EOF
@@ -25,30 +25,25 @@
 package haystack
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"sort"
 	"strconv"
 	"time"
 )
 
 // Helper function for InsertBunch() below
-// Inserts a new stalk and returns its own offset (0 for error -> ignore)
-func (p *Haybale) insertStalk(d *Dictionary, k string, v string) uint32 {
-	var newstalk Haystalk
-
-	dkey, res := d.FindOrAddKeyhash(k)
-	if !res {
-		return haystalk_ofs_nil
-	}
-	newstalk.dkey = dkey
+// Inserts a new stalk and returns its own offset, error if the key doesn't fit
+func (p *Haybale) insertStalk(d *Dictionary, k string, v string) (uint32, error) {
+	var val Val
 
 	// First figure out what type our value is (int, float or string)
 	// We played with regexes first, but now we just rely on Go's own value format opinions
-	if i, err := strconv.Atoi(v); err == nil {
-		newstalk.val.SetInt(int64(i))
-	} else if f, err := strconv.ParseFloat(v, 64); err == nil {
-		newstalk.val.SetFloat(float64(f))
+	if num, ok := parseNumber(v); ok {
+		val = num
 	} else {
 		// Not an int or float format, we'll make it a string then.
 
@@ -58,9 +53,108 @@ func (p *Haybale) insertStalk(d *Dictionary, k string, v string) uint32 {
 		}
 
 		// We use the pointer to the string, so we don't have to (re-)allocate it.
-		newstalk.val.SetString(&v)
+		val.SetString(&v)
+	}
+
+	return p.insertStalkVal(d, k, val)
+}
+
+// A string as an int or float, but only if it's unambiguously a number:
+// the number has to format back to the very same string. Otherwise we'd
+// lose what it looked like, "010" would come back as 10, and "1e5" as 100000.
+// So those stay strings, as do "+5", " 5", "0x1f", "1.50" and "NaN".
+// Except with config hex_numbers, then "0x1f" is 31, see parseHex().
+func parseNumber(v string) (Val, bool) {
+	var val Val
+
+	if i, err := strconv.ParseInt(v, 10, 64); err == nil && strconv.FormatInt(i, 10) == v {
+		val.SetInt(i)
+		return val, true
+	}
+	if i, ok := parseHex(v); ok {
+		val.SetInt(i)
+		return val, true
+	}
+
+	if f, err := strconv.ParseFloat(v, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) &&
+		strconv.FormatFloat(f, 'f', -1, 64) == v {
+		val.SetFloat(f)
+		return val, true
+	}
+
+	return val, false
+}
+
+// With config hex_numbers, a hex int like tcp flags "0x12" (or "0X12"): 18.
+// Insert and search both type values through parseNumber(), so they agree,
+// and the value is stored as an int: it comes back as "18".
+func parseHex(v string) (int64, bool) {
+	if !config.hex_numbers || len(v) < 3 || v[0] != '0' || (v[1] != 'x' && v[1] != 'X') {
+		return 0, false
+	}
+
+	// No sign, no underscores: only what ParseInt() takes with base 16
+	i, err := strconv.ParseInt(v[2:], 16, 64)
+	if err != nil || v[2] == '+' || v[2] == '-' {
+		return 0, false
+	}
+
+	return i, true
+}
+
+// A JSON number as written (see JSONToKVmap()): an int if it is one, exactly,
+// all the way to math.MinInt64 and math.MaxInt64. Otherwise as a float64,
+// which makes 1e3 an int again (like encoding/json would have).
+func jsonLiteralVal(n json.Number) Val {
+	var val Val
+
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		val.SetInt(i)
+		return val
+	}
+	if f, err := strconv.ParseFloat(string(n), 64); err == nil {
+		return jsonNumberVal(f)
+	}
+
+	// Can't happen for what the decoder gives us, but a caller might
+	s := string(n)
+	val.SetString(&s)
+	return val
+}
+
+// A JSON number as float64: an int if it's whole and fits,
+// a float otherwise. Not via a string, %v would make 123456789 "1.23456789e+08".
+func jsonNumberVal(f float64) Val {
+	var val Val
+
+	if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+		val.SetInt(int64(f))
+	} else {
+		val.SetFloat(f)
 	}
 
+	return val
+}
+
+// Same, for a value that's already typed
+func (p *Haybale) insertStalkVal(d *Dictionary, k string, val Val) (uint32, error) {
+	dkey, err := d.FindOrAddKeyhash(k)
+	if err != nil {
+		return haystalk_ofs_nil, err
+	}
+
+	// These two get filled later by the caller, but we don't leave them at 0
+	// because that is a valid offset.
+	return p.appendStalk(dkey, val, haystalk_ofs_nil, haystalk_ofs_nil), nil
+}
+
+// Add a stalk at the end, returns its offset
+func (p *Haybale) appendStalk(dkey uint32, val Val, first_ofs uint32, next_ofs uint32) uint32 {
+	var newstalk Haystalk
+
+	newstalk.dkey = dkey
+	newstalk.val = val
+
 	if p.num_haystalks > 0 {
 		// Make space at the designated position (just a slice of pointers, fast)
 		p.haystalk = append(p.haystalk, &Haystalk{})
@@ -75,10 +169,8 @@ func (p *Haybale) insertStalk(d *Dictionary, k string, v string) uint32 {
 		p.Memsize += uint32(2 + len(*newstalk.val.stringval))
 	}
 
-	// These two get filled later by the caller, but we don't leave them at 0
-	// because that is a valid offset.
-	newstalk.first_ofs = haystalk_ofs_nil
-	newstalk.next_ofs = haystalk_ofs_nil
+	newstalk.first_ofs = first_ofs
+	newstalk.next_ofs = next_ofs
 
 	// Finally, insert at the correct position
 	pos := p.num_haystalks
@@ -86,72 +178,279 @@ func (p *Haybale) insertStalk(d *Dictionary, k string, v string) uint32 {
 	p.haystalk[pos] = &newstalk
 	p.num_haystalks++
 	p.is_sorted_immutable = false // This append makes the Haybale not sorted
+	p.index = nil                 // and the index is out of date
 
 	return pos
 }
 
-// Insert a bunch (aka a "record") of KV entries
-func (p *Haybale) InsertBunch(d *Dictionary, flatmap map[string]interface{}) {
+// Add a stalk with a value that's already typed, for building a Haybale
+// by hand (tools, tests) without InsertBunch() guessing the type from a
+// string: an IP address or "0123" can go in as a string, 443 as an int.
+// The dkey has to be in the Haystack's Dictionary already (FindOrAddKeyhash()).
+// Chains are up to the caller: a bunch starts with its _timestamp, whose
+// first_ofs is its own offset, the rest point to that, linked by next_ofs
+// (haystalk_ofs_nil for the last one). Call Rebuild() when done.
+// Returns the offset of the new stalk.
+func (p *Haybale) AppendStalk(dkey uint32, v Val, first_ofs uint32, next_ofs uint32) (uint32, error) {
+	if p.is_sorted_immutable {
+		return haystalk_ofs_nil, fmt.Errorf("cannot append to immutable Haybale")
+	}
+
+	if p.HaystackPtr != nil {
+		d := &p.HaystackPtr.Dict
+		if dkey >= uint32(len(d.dkey)) || d.dkey[dkey] == nil {
+			return haystalk_ofs_nil, fmt.Errorf("dkey %d not in the Dictionary", dkey)
+		}
+	}
+
+	switch v.valtype {
+	case valtype_int, valtype_float, valtype_time:
+	case valtype_string:
+		if v.stringval == nil {
+			return haystalk_ofs_nil, fmt.Errorf("string value without a string")
+		}
+	default:
+		return haystalk_ofs_nil, fmt.Errorf("unknown value type %d", v.valtype)
+	}
+
+	return p.appendStalk(dkey, v, first_ofs, next_ofs), nil
+}
+
+// Insert a bunch (aka a "record") of KV entries.
+// Without a _timestamp (ErrNoTimestamp) or with a key that's too long
+// (ErrKeyTooLong), nothing is inserted. If the Dictionary fills up
+// (ErrDictFull, or ErrDictNearFull over dict_fill_max), the bunch goes in
+// without the keys that didn't fit.
+// A _timestamp we can't parse is logged, and then it depends on config
+// bad_timestamp_policy: skip returns ErrBadTimestamp (nothing inserted),
+// now inserts it with the original string, counted as now for time_first/last.
+// Keys that end up as the same Dictionary key (Host and host) go by config
+// duplicate_key_policy, see bunchKeys().
+func (p *Haybale) InsertBunch(d *Dictionary, flatmap map[string]interface{}) error {
 	var first, prev uint32
 
 	if p.is_sorted_immutable {
 		// We can't break this haybale from being immutable
-		log.Printf("Cannot insert to immutable Haybale")
-		// TODO: return some error condition
-		return
+		return fmt.Errorf("cannot insert to immutable Haybale")
 	}
 
 	if _, ok := flatmap[Timestamp_key]; !ok {
-		return // Just ignore this bunch if there's no _timestamp field
-	} else {
-		// add the first tuple (_timestamp)
-		vs := fmt.Sprintf("%v", flatmap[Timestamp_key]) // TODO improve this construct
-		first = p.insertStalk(d, Timestamp_key, vs)
-		// We need to do this here as _timestamp is skipped in the loop below
-		p.haystalk[first].first_ofs = first // first field (_timestamp) points to self
-
-		/*
-			Update time_first and time_last (in nsecs) in our record.
-			This is somewhat tricky as we'll need to parse the time string.
-			What format will it have? We should support multiple formats.
-		*/
-		if t, err := time.Parse(time.RFC3339Nano, vs); err == nil { // Try to parse
-			ts := t.UnixNano() // Convert to Unix nanosecond timestamp
-
-			if p.time_first == 0 || ts < p.time_first {
-				p.time_first = ts // Update lowest if lower
-			}
-			if ts > p.time_last {
-				p.time_last = ts // Update highest if higher
-			}
+		return ErrNoTimestamp // Just ignore this bunch if there's no _timestamp field
+	}
+
+	// Check the keys before we change anything
+	keys, err := bunchKeys(d, flatmap)
+	if err != nil {
+		return err
+	}
+
+	// add the first tuple (_timestamp)
+	vs := fmt.Sprintf("%v", flatmap[Timestamp_key]) // TODO improve this construct
+	ts, ts_ok := parseTimestamp(vs)
+	if !ts_ok {
+		if config.bad_timestamp_policy == bad_timestamp_policy_skip {
+			log.Printf("Warning: skipping record, can't parse %s '%.64s'", Timestamp_key, vs)
+			return fmt.Errorf("%w: '%.64s'", ErrBadTimestamp, vs)
 		}
+		log.Printf("Warning: can't parse %s '%.64s', using the current time", Timestamp_key, vs)
+		ts = time.Now().UnixNano()
 	}
 
-	// Now insert all the KV pairs as stalks
+	first, err = p.insertStalk(d, Timestamp_key, vs)
+	if err != nil {
+		return err
+	}
+	// We need to do this here as _timestamp is skipped in the loop below
+	p.haystalk[first].first_ofs = first // first field (_timestamp) points to self
+
+	/*
+		Update time_first and time_last (in nsecs) in our record.
+		If we could parse it, the _timestamp is stored as a time value, so
+		it sorts chronologically rather than as a string.
+		Otherwise the original string stays, but it still counts for the
+		time range, as now.
+	*/
+	if ts_ok {
+		// No string to count any more, if it was one, see appendStalk()
+		if p.haystalk[first].val.valtype == valtype_string {
+			p.Memsize -= uint32(2 + len(*p.haystalk[first].val.stringval))
+		}
+		p.haystalk[first].val.SetTime(ts)
+	}
+	if p.time_first == 0 || ts < p.time_first {
+		p.time_first = ts // Update lowest if lower
+	}
+	if ts > p.time_last {
+		p.time_last = ts // Update highest if higher
+	}
 
+	// Now insert all the KV pairs as stalks.
+	// Go map order is random, we want the bunch chain in key order.
+	// Since we build the chain backwards, we go through the keys backwards too.
 	prev = haystalk_ofs_nil
 
-	for k, v := range flatmap {
-		if k != Timestamp_key {
-			if len(k) == 0 {
-				continue // ignore
-			} else if len(k) > max_keylen {
-				// TODO: handle this nicer
-				panic(fmt.Sprintf("Key '%s' longer than %d chars", k, max_keylen))
+	var dropped []string // keys that didn't fit in the Dictionary
+	dict_err := ErrDictFull
+	for i := len(keys) - 1; i >= 0; i-- {
+		k := keys[i].name
+		v := flatmap[keys[i].key]
+
+		// insert each tuple
+		var pos uint32
+		switch v := v.(type) {
+		case rawLine:
+			// The original line (config store_raw), as is
+			s := string(v)
+			var val Val
+			val.SetString(&s)
+			pos, err = p.insertStalkVal(d, k, val)
+		case json.Number:
+			pos, err = p.insertStalkVal(d, k, jsonLiteralVal(v))
+		case float64:
+			pos, err = p.insertStalkVal(d, k, jsonNumberVal(v))
+		default:
+			vs := fmt.Sprintf("%v", v) // TODO improve this construct
+			pos, err = p.insertStalk(d, k, vs)
+		}
+		if errors.Is(err, ErrDictNearFull) {
+			dict_err = ErrDictNearFull
+		}
+		if err == nil {
+			p.haystalk[pos].first_ofs = first // Point to first (_timestamp) field
+			p.haystalk[pos].next_ofs = prev   // Make a backwards chain of fields
+			prev = pos                        // On to next
+		} else {
+			dropped = append(dropped, k)
+		}
+	}
+
+	p.haystalk[first].next_ofs = prev // Put _timestamp field in front of the rest
+
+	if len(dropped) > 0 {
+		return fmt.Errorf("%w: can't add keys %v", dict_err, dropped)
+	}
+
+	return nil
+}
+
+// config bad_timestamp_policy
+const (
+	bad_timestamp_policy_now  = "now"
+	bad_timestamp_policy_skip = "skip"
+)
+
+// config duplicate_key_policy
+const (
+	duplicate_key_policy_keep_all  = "keep_all"
+	duplicate_key_policy_last_wins = "last_wins"
+	duplicate_key_policy_suffix    = "suffix"
+)
+
+// One key of a bunch: flatmap[key] goes in as name
+type bunchKey struct {
+	name string
+	key  string
+}
+
+// The keys of a bunch to insert, in key order, without the _timestamp.
+// Keys that end up as the same Dictionary key, like Host and host with
+// case-insensitive keys, go by config duplicate_key_policy:
+// keep_all = insert them all, each a stalk with that dkey in the bunch
+// (searches match any of them, results show the first).
+// last_wins = only the last one, in key order (host rather than Host).
+// suffix = the first one as is, the others as key#2, key#3, ...
+// Map order is random, so key order is what we have for first and last.
+// The _timestamp always stays, a _TIMESTAMP is the duplicate.
+// Whether keys are the same is up to d, see Dictionary.keyFold().
+func bunchKeys(d *Dictionary, flatmap map[string]interface{}) ([]bunchKey, error) {
+	names := make([]string, 0, len(flatmap))
+	for k := range flatmap {
+		if len(k) > max_keylen {
+			return nil, fmt.Errorf("%w: '%.32s...' is %d chars, max %d", ErrKeyTooLong, k, len(k), max_keylen)
+		}
+		if k != Timestamp_key && len(k) > 0 { // empty ones we ignore
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	// Names a suffix can't give us, the record may well have a host#2 of its own
+	taken := map[string]bool{d.keyFold(Timestamp_key): true}
+	for _, k := range names {
+		taken[d.keyFold(k)] = true
+	}
+
+	keys := make([]bunchKey, 0, len(names))
+	seen := map[string]int{d.keyFold(Timestamp_key): -1} // where in keys, -1 for _timestamp
+	for _, k := range names {
+		fold := d.keyFold(k)
+		i, dup := seen[fold]
+
+		switch {
+		case !dup || config.duplicate_key_policy == duplicate_key_policy_keep_all:
+			// as is
+
+		case config.duplicate_key_policy == duplicate_key_policy_last_wins:
+			if i >= 0 {
+				keys[i] = bunchKey{name: k, key: k}
 			}
+			continue
 
-			// insert each tuple
-			vs := fmt.Sprintf("%v", v) // TODO improve this construct
-			pos := p.insertStalk(d, k, vs)
-			if pos != haystalk_ofs_nil {
-				p.haystalk[pos].first_ofs = first // Point to first (_timestamp) field
-				p.haystalk[pos].next_ofs = prev   // Make a backwards chain of fields
-				prev = pos                        // On to next
+		case config.duplicate_key_policy == duplicate_key_policy_suffix:
+			var name string
+			for n := 2; name == "" || taken[d.keyFold(name)]; n++ {
+				name = fmt.Sprintf("%s#%d", k, n)
+			}
+			if len(name) > max_keylen {
+				return nil, fmt.Errorf("%w: duplicate '%.32s...' is %d chars with suffix, max %d", ErrKeyTooLong, k, len(name), max_keylen)
+			}
+			taken[d.keyFold(name)] = true
+			keys = append(keys, bunchKey{name: name, key: k})
+			continue
+		}
+
+		seen[fold] = len(keys)
+		keys = append(keys, bunchKey{name: k, key: k})
+	}
+
+	return keys, nil
+}
+
+// Timestamp formats we understand, on top of epoch numbers
+var timestamp_layouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999-0700", // Suricata eve.json (+0000)
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999-0700",
+}
+
+// Parse a timestamp, returns Unix nanosecs
+// Epoch numbers can be in seconds (may have fraction), milli-, micro- or nanoseconds.
+func parseTimestamp(s string) (int64, bool) {
+	for _, layout := range timestamp_layouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UnixNano(), true
+		}
+	}
+
+	if f, err := strconv.ParseFloat(s, 64); err == nil && f > 0 {
+		// Guess the unit by magnitude (seconds until the year 5138 or so)
+		switch {
+		case f < 1e11:
+			return int64(f * 1e9), true // seconds
+		case f < 1e14:
+			return int64(f * 1e6), true // millisecs
+		case f < 1e17:
+			return int64(f * 1e3), true // microsecs
+		default:
+			if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return i, true // nanosecs, exact
 			}
+			return int64(f), true
 		}
 	}
 
-	p.haystalk[first].next_ofs = prev // Put _timestamp field in front of the rest
+	return 0, false
 }
 
 // Sort all haybales
@@ -160,6 +459,9 @@ func (p *Haystack) SortAllBales() {
 	// Start the clock
 	//start := time.Now() // DEBUG
 
+	p.Lock()
+	defer p.Unlock()
+
 	for i := range p.Haybale {
 		p.Haybale[i].SortBale()
 	}
@@ -174,6 +476,102 @@ func (p *Haybale) SortBale() {
 		return // Nothing to do, is already sorted!
 	}
 
+	p.sortStalks()
+
+	p.is_sorted_immutable = true // Says that this haybale is sorted
+}
+
+// For a Haybale put together by hand: check and fix up the bunch chains,
+// then sort and de-dup, like SortBale() but leaving the Haybale mutable.
+// So more bunches can be inserted after, and SortBale() still works.
+//
+// Every bunch starts with a stalk whose first_ofs points to itself (the
+// _timestamp), and is chained through next_ofs. We re-derive first_ofs
+// for the other stalks from those chains. A chain running out of bounds,
+// looping, or joining another bunch, or a stalk not in any bunch, is an error.
+func (p *Haybale) Rebuild() error {
+	if p.is_sorted_immutable {
+		return fmt.Errorf("Haybale is immutable, can't rebuild")
+	}
+
+	if int(p.num_haystalks) != len(p.haystalk) {
+		return fmt.Errorf("Haybale has %d stalks, but says %d", len(p.haystalk), p.num_haystalks)
+	}
+
+	if err := p.rechain(); err != nil {
+		return err
+	}
+
+	// sortStalks() goes by self_ofs, which is stale after an earlier sort
+	for i := uint32(0); i < p.num_haystalks; i++ {
+		p.haystalk[i].self_ofs = i
+	}
+
+	p.sortStalks()
+
+	// Ready for more inserts (and the next sort)
+	for i := uint32(0); i < p.num_haystalks; i++ {
+		p.haystalk[i].self_ofs = i
+	}
+
+	// Bounding timestamps, from the _timestamp stalks
+	p.time_first, p.time_last = 0, 0
+	for i := uint32(0); i < p.num_haystalks; i++ {
+		if p.haystalk[i].first_ofs != i || p.haystalk[i].val.valtype != valtype_time {
+			continue
+		}
+		ts := p.haystalk[i].val.intval
+		if p.time_first == 0 || ts < p.time_first {
+			p.time_first = ts
+		}
+		if ts > p.time_last {
+			p.time_last = ts
+		}
+	}
+
+	return nil
+}
+
+// Walk each bunch from its first stalk, and point its stalks back at it
+func (p *Haybale) rechain() error {
+	seen := make([]bool, p.num_haystalks)
+
+	for i := uint32(0); i < p.num_haystalks; i++ {
+		if p.haystalk[i].first_ofs != i {
+			continue // not the start of a bunch
+		}
+
+		for k := i; k != haystalk_ofs_nil; k = p.haystalk[k].next_ofs {
+			if k >= p.num_haystalks {
+				return fmt.Errorf("bunch at stalk %d chains to stalk %d, out of bounds", i, k)
+			}
+			if seen[k] {
+				return fmt.Errorf("bunch at stalk %d chains to stalk %d, which is already taken", i, k)
+			}
+			seen[k] = true
+			p.haystalk[k].first_ofs = i
+		}
+	}
+
+	for k := range seen {
+		if !seen[k] {
+			return fmt.Errorf("stalk %d is not in any bunch", k)
+		}
+	}
+
+	return nil
+}
+
+// Sort the stalks, fix up the bunch chains, and de-dup adjacent strings
+func (p *Haybale) sortStalks() {
+	p.sortStalksBy(func(s1, s2 *Haystalk) bool {
+		return s1.Compare(*s2) < 0
+	})
+}
+
+// Same, with less() as the order. It has to sort by dkey then value,
+// same as Compare(), but can break ties.
+func (p *Haybale) sortStalksBy(less func(s1, s2 *Haystalk) bool) {
 	//log.Printf("Running the Go garbage collector")	// DEBUG
 	//runtime.GC() // Force garbage collector to run all the way, to ensure we measure de-dup cleanly
 
@@ -186,7 +584,7 @@ func (p *Haybale) SortBale() {
 	// If we used our own sorting function, we could take "self_ofs" out and save memory...
 	// (now it needs to be part of the same struct. Other optimisations may also be possible.)
 	sort.Slice(p.haystalk, func(p1, p2 int) bool {
-		return p.haystalk[p1].Compare(*p.haystalk[p2]) < 0
+		return less(p.haystalk[p1], p.haystalk[p2])
 	})
 
 	// Now we create a map where newold_map[i] points to its old self
@@ -214,6 +612,8 @@ func (p *Haybale) SortBale() {
 		if p.haystalk[i].val.valtype == valtype_string {
 			if prev_string == nil {
 				prev_string = p.haystalk[i].val.stringval
+			} else if p.haystalk[i].val.stringval == prev_string {
+				// Already shared (Rebuild() before), already counted
 			} else if *p.haystalk[i].val.stringval == *prev_string {
 				/*
 					We re-assign to the shared string pointer, removing the
@@ -230,7 +630,8 @@ func (p *Haybale) SortBale() {
 
 	}
 
-	p.is_sorted_immutable = true // Says that this haybale is sorted
+	// Sorted by dkey then value, so now's the time to note min and max
+	p.buildIndex()
 
 	//runtime.GC() // Force garbage collector to run all the way, to measure what the de-dup accomplishes
 	//runtime.ReadMemStats(&m)
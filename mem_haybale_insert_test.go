@@ -0,0 +1,617 @@
+// OpenActa/Haystack - Haybale insert and sort - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Mixed sub-second precision (and formats) still sort chronologically.
+// As strings, "00.5Z" would sort before "00Z", and "+0000" after "Z".
+func TestSortBaleTimestampOrder(t *testing.T) {
+	// In chronological order, each with an "n" so we can check
+	timestamps := []string{
+		"2023-06-04T00:00:00Z",
+		"2023-06-04T00:00:00.000001+0000",
+		"2023-06-04T00:00:00.12Z",
+		"2023-06-04T00:00:00.123456789Z",
+		"2023-06-04T00:00:00.5Z",
+		"2023-06-04T00:00:01+0000",
+		"1685836801.25", // epoch seconds
+		"2023-06-04T00:00:01.999999999Z",
+		"2023-06-04T02:00:02+02:00", // 00:00:02 UTC
+	}
+
+	var hs Haystack
+	hb := &Haybale{HaystackPtr: &hs}
+
+	// Insert in reverse, so the sort has work to do
+	for i := len(timestamps) - 1; i >= 0; i-- {
+		hb.InsertBunch(&hs.Dict, map[string]interface{}{Timestamp_key: timestamps[i], "n": fmt.Sprint(i)})
+	}
+	hb.SortBale()
+
+	ts_dkey, _ := hs.Dict.KeyExists(Timestamp_key)
+	n_dkey, _ := hs.Dict.KeyExists("n")
+
+	var prev int64
+	var order []int
+	for j := uint32(0); j < hb.num_haystalks; j++ {
+		stalk := hb.haystalk[j]
+		if stalk.dkey != ts_dkey {
+			continue
+		}
+
+		if stalk.val.valtype != valtype_time {
+			t.Fatalf("_timestamp '%s' not stored as time", stalk.val.String())
+		}
+		if stalk.val.GetTime() < prev {
+			t.Errorf("_timestamp %s sorted after a later one", stalk.val.String())
+		}
+		prev = stalk.val.GetTime()
+
+		n, _ := hb.FieldInBunch(stalk.first_ofs, n_dkey)
+		order = append(order, int(n.GetInt()))
+	}
+
+	if fmt.Sprint(order) != "[0 1 2 3 4 5 6 7 8]" {
+		t.Errorf("bunches in order %v", order)
+	}
+
+	if hb.time_first != 1685836800000000000 || hb.time_last != 1685836802000000000 {
+		t.Errorf("time_first %d, time_last %d", hb.time_first, hb.time_last)
+	}
+
+	// And we can search for them, in any of the formats
+	hs.Haybale = append(hs.Haybale, hb)
+	if n := hs.CountKeyValArray(map[string]string{Timestamp_key: "2023-06-04T00:00:00.500+0000"}); n != 1 {
+		t.Errorf("search on _timestamp: %d matches", n)
+	}
+}
+
+// Messed up first_ofs gets fixed, the bale stays mutable, and sorts the same
+func TestRebuild(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	hs := newTestHaystack(t, "testdata/head5.json", 100)
+	want := hs.bunchCounts()
+	hb := hs.Haybale[0]
+
+	// newTestHaystack sorts, so pretend we hand-built it instead
+	hb.is_sorted_immutable = false
+	for j := uint32(0); j < hb.num_haystalks; j++ {
+		if hb.haystalk[j].first_ofs != j {
+			hb.haystalk[j].first_ofs = haystalk_ofs_nil
+		}
+	}
+	time_first, time_last := hb.time_first, hb.time_last
+
+	if err := hb.Rebuild(); err != nil {
+		t.Fatal(err)
+	}
+	if hb.is_sorted_immutable {
+		t.Errorf("Rebuild made the Haybale immutable")
+	}
+	if hb.time_first != time_first || hb.time_last != time_last {
+		t.Errorf("times %d - %d, expected %d - %d", hb.time_first, hb.time_last, time_first, time_last)
+	}
+	if got := hs.bunchCounts(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("bunches changed:\n%v\n%v", got, want)
+	}
+
+	// More inserts, then the final sort
+	memsize := hb.Memsize
+	flat, err := JSONToKVmap([]byte(`{"timestamp":"2023-06-04T00:02:00Z","extra":"yes"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hb.InsertBunch(&hs.Dict, flat)
+	hb.SortBale()
+
+	if n := hs.CountKeyValArray(map[string]string{"extra": "yes"}); n != 1 {
+		t.Errorf("new bunch: %d matches", n)
+	}
+	if n := hs.CountKeyValArray(map[string]string{"event_type": "flow"}); n == 0 {
+		t.Errorf("old bunches not found")
+	}
+	if hb.Memsize < memsize {
+		t.Errorf("Memsize went down from %d to %d, de-dup counted twice?", memsize, hb.Memsize)
+	}
+
+	// Broken chains
+	hb.is_sorted_immutable = false
+	hb.haystalk[1].next_ofs = hb.num_haystalks + 10
+	if err := hb.Rebuild(); err == nil {
+		t.Errorf("no error for out of bounds chain")
+	}
+	hb.is_sorted_immutable = true
+	if err := hb.Rebuild(); err == nil {
+		t.Errorf("no error for immutable Haybale")
+	}
+}
+
+// Nothing goes in without a _timestamp or with a long key,
+// what doesn't fit in the Dictionary is left out
+func TestInsertBunchErrors(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.dict_table_bits = 8 // 256 keys
+
+	var hs Haystack
+	hb := &Haybale{HaystackPtr: &hs}
+
+	if err := hb.InsertBunch(&hs.Dict, map[string]interface{}{"n": "1"}); !errors.Is(err, ErrNoTimestamp) {
+		t.Errorf("no _timestamp: %v", err)
+	}
+
+	long := strings.Repeat("k", max_keylen+1)
+	if err := hb.InsertBunch(&hs.Dict, map[string]interface{}{Timestamp_key: "1685836800", long: "1"}); !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("long key: %v", err)
+	}
+
+	if hb.num_haystalks != 0 || hs.Dict.num_dkeys != 0 {
+		t.Fatalf("after errors: %d stalks, %d keys", hb.num_haystalks, hs.Dict.num_dkeys)
+	}
+
+	flat := map[string]interface{}{Timestamp_key: "1685836800"}
+	for i := 0; i < 300; i++ {
+		flat[fmt.Sprintf("k%d", i)] = i
+	}
+	if err := hb.InsertBunch(&hs.Dict, flat); !errors.Is(err, ErrDictFull) {
+		t.Errorf("Dictionary full: %v", err)
+	}
+	if hb.num_haystalks != 256 {
+		t.Errorf("Dictionary full: %d stalks went in, want 256", hb.num_haystalks)
+	}
+	if err := hb.Rebuild(); err != nil {
+		t.Errorf("Dictionary full: %v", err)
+	}
+}
+
+// A _timestamp that's stored as a time isn't counted as a string too
+func TestInsertBunchMemsize(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.dict_table_bits = 10
+
+	for _, tc := range []struct {
+		ts   interface{}
+		want uint32
+	}{
+		{"2023-06-04T00:00:59Z", 2 * 37},
+		{1685836859, 2 * 37}, // epoch seconds
+		{"yesterday-ish", 2*37 + 2 + uint32(len("yesterday-ish"))},
+	} {
+		var hs Haystack
+		hb := &Haybale{HaystackPtr: &hs}
+		hs.Haybale = append(hs.Haybale, hb)
+		if err := hb.InsertBunch(&hs.Dict, map[string]interface{}{Timestamp_key: tc.ts, "n": 1}); err != nil {
+			t.Fatal(err)
+		}
+		if hb.Memsize != tc.want {
+			t.Errorf("%v: Memsize %d, want %d", tc.ts, hb.Memsize, tc.want)
+		}
+	}
+}
+
+// A garbage _timestamp: kept as is, counted as now. Or skipped, if so configured.
+func TestInsertBunchBadTimestamp(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.dict_table_bits = 10
+
+	var hs Haystack
+	hb := &Haybale{HaystackPtr: &hs}
+	hs.Haybale = append(hs.Haybale, hb)
+
+	before := time.Now().UnixNano()
+	if err := hb.InsertBunch(&hs.Dict, map[string]interface{}{Timestamp_key: "yesterday-ish", "n": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now().UnixNano()
+
+	if hb.time_first < before || hb.time_last > after {
+		t.Errorf("time_first %d, time_last %d: not in %d..%d", hb.time_first, hb.time_last, before, after)
+	}
+
+	hs.SortAllBales()
+	res, err := hs.SearchKeyPresent("n")
+	if err != nil || len(res) != 1 || res[0][Timestamp_key] != "yesterday-ish" {
+		t.Errorf("bunch back: %v %v", res, err)
+	}
+
+	config.bad_timestamp_policy = bad_timestamp_policy_skip
+	hb = &Haybale{HaystackPtr: &hs}
+	if err := hb.InsertBunch(&hs.Dict, map[string]interface{}{Timestamp_key: "2023-13-45", "n": "2"}); !errors.Is(err, ErrBadTimestamp) {
+		t.Errorf("skip: %v", err)
+	}
+	if hb.num_haystalks != 0 || hb.time_first != 0 {
+		t.Errorf("skip: %d stalks went in, time_first %d", hb.num_haystalks, hb.time_first)
+	}
+
+	// Good ones are fine either way
+	if err := hb.InsertBunch(&hs.Dict, map[string]interface{}{Timestamp_key: "2023-06-04T00:00:59Z", "n": "3"}); err != nil {
+		t.Errorf("skip, good timestamp: %v", err)
+	}
+}
+
+// Host, host and HOST in one record, with case-insensitive keys
+func TestInsertBunchDuplicateKeys(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.dict_table_bits = 10
+
+	flat, err := JSONToKVmap([]byte(`{"_timestamp":"2023-06-04T00:00:00Z","_TIMESTAMP":"later",` +
+		`"HOST":"a.example.com","Host":"b.example.com","host":"c.example.com","host#2":"x"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		policy string
+		want   string // the bunch, in chain order
+	}{
+		{duplicate_key_policy_keep_all,
+			`_timestamp=2023-06-04T00:00:00Z host=a.example.com host=b.example.com _timestamp=later host=c.example.com host#2=x`},
+		{duplicate_key_policy_last_wins,
+			`_timestamp=2023-06-04T00:00:00Z host=c.example.com host#2=x`},
+		{duplicate_key_policy_suffix,
+			`_timestamp=2023-06-04T00:00:00Z HOST=a.example.com Host#3=b.example.com _TIMESTAMP#2=later host#4=c.example.com host#2=x`},
+	} {
+		config.duplicate_key_policy = tc.policy
+
+		var hs Haystack
+		hb := &Haybale{HaystackPtr: &hs}
+		if err := hb.InsertBunch(&hs.Dict, flat); err != nil {
+			t.Fatalf("%s: %v", tc.policy, err)
+		}
+
+		var got []string
+		for k := hb.haystalk[0].first_ofs; k != haystalk_ofs_nil; k = hb.haystalk[k].next_ofs {
+			got = append(got, *hs.Dict.dkey[hb.haystalk[k].dkey]+"="+hb.haystalk[k].val.String())
+		}
+		if strings.Join(got, " ") != tc.want {
+			t.Errorf("%s:\n got %s\nwant %s", tc.policy, strings.Join(got, " "), tc.want)
+		}
+		if err := hb.Rebuild(); err != nil {
+			t.Errorf("%s: %v", tc.policy, err)
+		}
+	}
+}
+
+// A bunch put together with AppendStalk(), typed as we say
+func TestAppendStalk(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.dict_table_bits = 10
+
+	var hs Haystack
+	hb := &Haybale{HaystackPtr: &hs}
+	hs.Haybale = append(hs.Haybale, hb)
+
+	dkey := func(k string) uint32 {
+		d, err := hs.Dict.FindOrAddKeyhash(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	ts, zip, ip, port := dkey(Timestamp_key), dkey("zip"), dkey("src_ip"), dkey("dest_port")
+
+	var tsv, zipv, ipv, portv Val
+	tsv.SetTime(time.Date(2023, 6, 4, 0, 0, 0, 0, time.UTC).UnixNano())
+	zip_s, ip_s := "0123", "10.0.0.1"
+	zipv.SetString(&zip_s) // InsertBunch would make that int 123
+	ipv.SetString(&ip_s)
+	portv.SetInt(443)
+
+	// Chained backwards, like InsertBunch() does
+	first := hb.num_haystalks
+	var next uint32 = haystalk_ofs_nil
+	for _, kv := range []struct {
+		dkey uint32
+		val  Val
+	}{{port, portv}, {ip, ipv}, {zip, zipv}} {
+		pos, err := hb.AppendStalk(kv.dkey, kv.val, first+3, next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next = pos
+	}
+	if _, err := hb.AppendStalk(ts, tsv, first+3, next); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := uint32(4*37 + 2 + len(zip_s) + 2 + len(ip_s)); hb.Memsize != want {
+		t.Errorf("Memsize %d, want %d", hb.Memsize, want)
+	}
+	if err := hb.Rebuild(); err != nil {
+		t.Fatal(err)
+	}
+	hb.SortBale()
+
+	res, err := hs.SearchKeyPresent("zip")
+	if err != nil || len(res) != 1 || res[0]["zip"] != "0123" || res[0]["src_ip"] != "10.0.0.1" || res[0]["dest_port"] != "443" {
+		t.Fatalf("bunch back: %v %v", res, err)
+	}
+	for _, s := range hb.haystalk {
+		if s.dkey == zip && s.val.valtype != valtype_string {
+			t.Errorf("zip typed %d", s.val.valtype)
+		}
+	}
+
+	var bad Val
+	hb2 := &Haybale{HaystackPtr: &hs}
+	if _, err := hb2.AppendStalk(zip, bad, 0, haystalk_ofs_nil); err == nil {
+		t.Errorf("no error for a value without a type")
+	}
+	if _, err := hb2.AppendStalk(999, portv, 0, haystalk_ofs_nil); err == nil {
+		t.Errorf("no error for a dkey not in the Dictionary")
+	}
+	if _, err := hb.AppendStalk(port, portv, 0, haystalk_ofs_nil); err == nil {
+		t.Errorf("no error appending to a sorted Haybale")
+	}
+	if hb2.num_haystalks != 0 {
+		t.Errorf("%d stalks went in anyway", hb2.num_haystalks)
+	}
+}
+
+func TestParseNumber(t *testing.T) {
+	for _, tc := range []struct {
+		v       string
+		valtype uint8 // 0 = stays a string
+	}{
+		{"10", valtype_int},
+		{"-5", valtype_int},
+		{"0", valtype_int},
+		{"9223372036854775807", valtype_int},
+		{"3.14", valtype_float},
+		{"-0.5", valtype_float},
+		{"010", 0},
+		{"1e5", 0},
+		{"+5", 0},
+		{" 5", 0},
+		{"5 ", 0},
+		{"0x1f", 0},
+		{"1.50", 0},
+		{".5", 0},
+		{"-0", valtype_float}, // formats back the same
+		{"NaN", 0},
+		{"Inf", 0},
+		{"9223372036854775808", 0}, // doesn't fit, as a float it'd lose digits
+		{"00:1f:5b:aa:bb:cc", 0},
+	} {
+		val, ok := parseNumber(tc.v)
+		if ok != (tc.valtype != 0) || (ok && val.valtype != tc.valtype) {
+			t.Errorf("'%s': %v, valtype %d", tc.v, ok, val.valtype)
+		}
+		if ok && val.String() != tc.v {
+			t.Errorf("'%s' came back as '%s'", tc.v, val.String())
+		}
+	}
+}
+
+// Strings that look a bit like numbers come back as they went in, and can be
+// searched for. JSON numbers are still numbers.
+func TestInsertBunchNumbers(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.dict_table_bits = 10
+
+	flat, err := JSONToKVmap([]byte(`{"_timestamp":"2023-06-04T00:00:00Z","zip":"010","sci":"1e5",` +
+		`"hex":"0x1f","bytes":123456789,"ratio":1.5,"port":"443"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hs Haystack
+	hb := &Haybale{HaystackPtr: &hs}
+	hs.Haybale = append(hs.Haybale, hb)
+	if err := hb.InsertBunch(&hs.Dict, flat); err != nil {
+		t.Fatal(err)
+	}
+	hs.SortAllBales()
+
+	want := map[string]struct {
+		v       string
+		valtype uint8
+	}{
+		"zip":   {"010", valtype_string},
+		"sci":   {"1e5", valtype_string},
+		"hex":   {"0x1f", valtype_string},
+		"bytes": {"123456789", valtype_int},
+		"ratio": {"1.5", valtype_float},
+		"port":  {"443", valtype_int},
+	}
+	for _, s := range hb.haystalk {
+		k := *hs.Dict.dkey[s.dkey]
+		if w, ok := want[k]; ok && (s.val.String() != w.v || s.val.valtype != w.valtype) {
+			t.Errorf("%s: '%s' valtype %d, want '%s' valtype %d", k, s.val.String(), s.val.valtype, w.v, w.valtype)
+		}
+	}
+
+	for _, kv := range []map[string]string{{"zip": "010"}, {"sci": "1e5"}, {"bytes": "123456789"}} {
+		if n := hs.CountKeyValArray(kv); n != 1 {
+			t.Errorf("%v: %d matches", kv, n)
+		}
+	}
+	if n := hs.CountKeyValArray(map[string]string{"zip": "10"}); n != 0 {
+		t.Errorf("zip 10 matches 010")
+	}
+}
+
+// With hex_numbers, "0x12" is an int on insert and in search. What went in
+// as a string before it was turned on, the normalized search still finds.
+func TestHexNumbers(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	for _, tc := range []struct {
+		v  string
+		i  int64
+		ok bool
+	}{
+		{"0x12", 18, true},
+		{"0X1F", 31, true},
+		{"0x7fffffffffffffff", 1<<63 - 1, true},
+		{"0x8000000000000000", 0, false},
+		{"0x", 0, false},
+		{"0x-1", 0, false},
+		{"0x+1", 0, false},
+		{"0xg", 0, false},
+		{"12", 0, false},
+		{"x12", 0, false},
+	} {
+		config.hex_numbers = false
+		if _, ok := parseHex(tc.v); ok {
+			t.Errorf("'%s' is hex with hex_numbers off", tc.v)
+		}
+		config.hex_numbers = true
+		if i, ok := parseHex(tc.v); ok != tc.ok || i != tc.i {
+			t.Errorf("'%s': %d %v, want %d %v", tc.v, i, ok, tc.i, tc.ok)
+		}
+	}
+
+	var hs Haystack
+	for i, rec := range []map[string]interface{}{
+		{"flags": "0x12"}, // before hex_numbers: a string
+		{"flags": "0x12"},
+		{"flags": "18"},
+		{"flags": "0x02"},
+	} {
+		config.hex_numbers = i > 0
+		hb := &Haybale{HaystackPtr: &hs}
+		hs.Haybale = append(hs.Haybale, hb)
+		rec[Timestamp_key] = "2023-06-04T00:00:0" + string(rune('0'+i)) + "Z"
+		if err := hb.InsertBunch(&hs.Dict, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hs.SortAllBales()
+
+	for _, v := range []string{"0x12", "18"} {
+		if n := hs.CountKeyValArray(map[string]string{"flags": v}); n != 2 {
+			t.Errorf("flags=%s: %d matches, want 2", v, n)
+		}
+		res, err := hs.SearchKeyValNormalized(map[string]string{"flags": v})
+		if err != nil || len(res) != 3 {
+			t.Errorf("normalized flags=%s: %d matches, want 3: %v", v, len(res), err)
+		}
+	}
+	if n := hs.CountKeyValArray(map[string]string{"flags": "0x2"}); n != 1 {
+		t.Errorf("flags=0x2: %d matches", n)
+	}
+
+	// Off again: back to a string, only the one from before
+	config.hex_numbers = false
+	if n := hs.CountKeyValArray(map[string]string{"flags": "0x12"}); n != 1 {
+		t.Errorf("hex_numbers off, flags=0x12: %d matches", n)
+	}
+}
+
+// Negative ints, zero and the int64 extremes: exact from JSON, through the
+// disk format and back, sorted as signed, and found by search and query
+func TestIntRoundTrip(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	ints := []int64{math.MinInt64, -1 << 53, -5, -1, 0, 7, 1<<53 + 1, math.MaxInt64}
+
+	for _, i := range ints {
+		var data []byte
+		addMultibyteToData(&data, uint64(i), 8)
+		if got := int64(getUintFromData(bytes.NewReader(data), 8)); got != i {
+			t.Errorf("%d stored, %d read back", i, got)
+		}
+	}
+
+	hs := new(Haystack)
+	hb := &Haybale{HaystackPtr: hs}
+	hs.Haybale = append(hs.Haybale, hb)
+	for n, i := range ints {
+		line := fmt.Sprintf(`{"timestamp":"2023-06-04T00:00:%02dZ","offset":%d,"soffset":"%d","frac":1234567.5}`, n, i, i)
+		flat, err := JSONToKVmap([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := hb.InsertBunch(&hs.Dict, flat); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hs.SortAllBales()
+
+	data, _, err := hs.Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs2 := new(Haystack)
+	if err := hs2.Disk2Mem(data); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, h := range []*Haystack{hs, hs2} {
+		// Ints, in signed order, same from JSON numbers and strings
+		for _, key := range []string{"offset", "soffset"} {
+			dkey, _ := h.Dict.KeyExists(key)
+			var got []int64
+			for _, s := range h.Haybale[0].haystalk {
+				if s.dkey != dkey {
+					continue
+				}
+				if s.val.valtype != valtype_int {
+					t.Fatalf("%s: valtype %d for %s", key, s.val.valtype, s.val.String())
+				}
+				got = append(got, s.val.GetInt())
+			}
+			if fmt.Sprint(got) != fmt.Sprint(ints) {
+				t.Errorf("%s: %v, want %v", key, got, ints)
+			}
+		}
+
+		for _, i := range ints {
+			kv := map[string]string{"offset": fmt.Sprint(i)}
+			if n := h.CountKeyValArray(kv); n != 1 {
+				t.Errorf("%v: %d matches", kv, n)
+			}
+		}
+
+		for qs, want := range map[string]int{"offset<0": 4, "offset>=-5": 6, "offset<-5": 2, "offset>0": 3, "soffset<=-1": 4} {
+			q, err := ParseQuery(qs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res, err := h.SearchQuery(q); err != nil || len(res) != want {
+				t.Errorf("%s: %d matches, want %d: %v", qs, len(res), want, err)
+			}
+		}
+
+		// Not an int, and not mangled into one either
+		if n := h.CountKeyValArray(map[string]string{"frac": "1234567.5"}); n != uint(len(ints)) {
+			t.Errorf("frac: %d matches", n)
+		}
+	}
+}
+
+// EOF
@@ -0,0 +1,156 @@
+// OpenActa/Haystack - Haybale column statistics
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	A data profile: per key, how many stalks, of which value types, and
+	the range of the numbers. Per Haybale that's one pass over the stalks,
+	in a sorted Haybale they're grouped by key (then type, then value),
+	so it's mostly just counting. A key that's not in the map isn't in
+	the Haybale.
+*/
+
+package haystack
+
+import (
+	"fmt"
+	"math"
+)
+
+type ColStat struct {
+	Count   uint64 // stalks with the key
+	Ints    uint64 // of which ints
+	Floats  uint64 // floats
+	Strings uint64 // strings
+	Times   uint64 // times (the _timestamp)
+
+	MinInt, MaxInt     int64   // if Ints > 0
+	MinFloat, MaxFloat float64 // if Floats > 0
+}
+
+// Note one value
+func (s *ColStat) addVal(val *Val) {
+	s.Count++
+
+	switch val.valtype {
+	case valtype_int:
+		if s.Ints == 0 || val.intval < s.MinInt {
+			s.MinInt = val.intval
+		}
+		if s.Ints == 0 || val.intval > s.MaxInt {
+			s.MaxInt = val.intval
+		}
+		s.Ints++
+	case valtype_float:
+		if s.Floats == 0 {
+			s.MinFloat, s.MaxFloat = val.floatval, val.floatval
+		} else {
+			s.MinFloat = math.Min(s.MinFloat, val.floatval)
+			s.MaxFloat = math.Max(s.MaxFloat, val.floatval)
+		}
+		s.Floats++
+	case valtype_string:
+		s.Strings++
+	case valtype_time:
+		s.Times++
+	}
+}
+
+// Add the stats of another Haybale
+func (s *ColStat) merge(o ColStat) {
+	if o.Ints > 0 {
+		if s.Ints == 0 || o.MinInt < s.MinInt {
+			s.MinInt = o.MinInt
+		}
+		if s.Ints == 0 || o.MaxInt > s.MaxInt {
+			s.MaxInt = o.MaxInt
+		}
+	}
+	if o.Floats > 0 {
+		if s.Floats == 0 {
+			s.MinFloat, s.MaxFloat = o.MinFloat, o.MaxFloat
+		} else {
+			s.MinFloat = math.Min(s.MinFloat, o.MinFloat)
+			s.MaxFloat = math.Max(s.MaxFloat, o.MaxFloat)
+		}
+	}
+
+	s.Count += o.Count
+	s.Ints += o.Ints
+	s.Floats += o.Floats
+	s.Strings += o.Strings
+	s.Times += o.Times
+}
+
+func (s ColStat) String() string {
+	str := fmt.Sprintf("%d stalks: %d int, %d float, %d string, %d time",
+		s.Count, s.Ints, s.Floats, s.Strings, s.Times)
+	if s.Ints > 0 {
+		str += fmt.Sprintf(", ints %d..%d", s.MinInt, s.MaxInt)
+	}
+	if s.Floats > 0 {
+		str += fmt.Sprintf(", floats %v..%v", s.MinFloat, s.MaxFloat)
+	}
+
+	return str
+}
+
+// Column statistics per dkey, in one pass over the stalks.
+// Sorted or not, but sorted we only look up a key once.
+func (p *Haybale) ColumnStats() map[uint32]ColStat {
+	stats := make(map[uint32]ColStat)
+
+	var cur ColStat
+	var cur_dkey uint32
+	for i := uint32(0); i < p.num_haystalks; i++ {
+		s := p.haystalk[i]
+		if i > 0 && s.dkey != cur_dkey { // next key, done with this one
+			prev := stats[cur_dkey]
+			prev.merge(cur)
+			stats[cur_dkey] = prev
+			cur = ColStat{}
+		}
+		cur_dkey = s.dkey
+		cur.addVal(&s.val)
+	}
+	if cur.Count > 0 {
+		prev := stats[cur_dkey]
+		prev.merge(cur)
+		stats[cur_dkey] = prev
+	}
+
+	return stats
+}
+
+// Column statistics of all Haybales together, by key
+func (p *Haystack) ColumnStats() map[string]ColStat {
+	p.RLock()
+	defer p.RUnlock()
+
+	stats := make(map[string]ColStat)
+	for _, hb := range p.Haybale {
+		for dkey, s := range hb.ColumnStats() {
+			k := *p.Dict.dkey[dkey]
+			all := stats[k]
+			all.merge(s)
+			stats[k] = all
+		}
+	}
+
+	return stats
+}
+
+// EOF
@@ -0,0 +1,97 @@
+// OpenActa/Haystack - Haybale column statistics - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"bufio"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestColumnStats(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+
+	stats := hs.ColumnStats()
+
+	// dest_port 443, 443 | 443, 514 | 443
+	if s := stats["dest_port"]; s.Count != 5 || s.Ints != 5 || s.MinInt != 443 || s.MaxInt != 514 {
+		t.Errorf("dest_port: %v", s)
+	}
+	if s := stats[Timestamp_key]; s.Count != 5 || s.Times != 5 || s.Ints != 0 {
+		t.Errorf("%s: %v", Timestamp_key, s)
+	}
+	if s := stats["src_ip"]; s.Count != 5 || s.Strings != 5 {
+		t.Errorf("src_ip: %v", s)
+	}
+	if _, ok := stats["no.such.key"]; ok {
+		t.Errorf("stats for a key that isn't there")
+	}
+
+	var count uint64
+	for _, s := range stats {
+		count += s.Count
+		if s.Count != s.Ints+s.Floats+s.Strings+s.Times {
+			t.Errorf("types don't add up: %v", s)
+		}
+	}
+	if info := hs.Info(); count != info.NumStalks {
+		t.Errorf("%d stalks counted, Info() says %d", count, info.NumStalks)
+	}
+
+	dkey, _ := hs.Dict.KeyExists("dest_port")
+	if s := hs.Haybale[0].ColumnStats()[dkey]; s.MinInt != 443 || s.MaxInt != 443 {
+		t.Errorf("first Haybale dest_port: %v", s)
+	}
+}
+
+// Same stats before and after sorting
+func TestColumnStatsUnsorted(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	file, err := os.Open("testdata/eve.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var hs Haystack
+	hb := &Haybale{HaystackPtr: &hs}
+	hs.Haybale = append(hs.Haybale, hb)
+
+	scanner := bufio.NewScanner(file)
+	for i := 0; i < 500 && scanner.Scan(); i++ {
+		flat, err := JSONToKVmap(scanner.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		hb.InsertBunch(&hs.Dict, flat)
+	}
+
+	unsorted := hb.ColumnStats()
+	hb.SortBale()
+	if sorted := hb.ColumnStats(); !reflect.DeepEqual(sorted, unsorted) {
+		t.Errorf("stats differ after sorting")
+	}
+}
+
+// EOF
@@ -44,9 +44,9 @@ func (p *Haystalk) Compare(hv Haystalk) int {
 
 	// Check value
 	switch p.val.valtype {
-	case valtype_int:
-		i1 := p.val.GetInt()
-		i2 := hv.val.GetInt()
+	case valtype_int, valtype_time: // time is Unix nanosecs, so just as easy
+		i1 := p.val.intval
+		i2 := hv.val.intval
 		if i1 > i2 {
 			return 1
 		} else if i1 < i2 {
@@ -93,34 +93,35 @@ func (p *Haystalk) Compare(hv Haystalk) int {
 
 // Function to compare an int with a Haystalk value
 func (p *Haystalk) CompareInt(i int64) (int, bool) {
+	var i2 int64
+
 	switch p.val.valtype {
 	case valtype_int:
-		// drop out so we can re-use the code for string
+		i2 = p.val.GetInt()
+		// drops out of switch to int compare
 
 	case valtype_float:
-		if float64(i) > p.val.GetFloat() {
-			return 1, true
-		} else if float64(i) < p.val.GetFloat() {
-			return -1, true
-		} else {
-			return 0, true
-		}
+		return compareFloat64(float64(i), p.val.GetFloat()), true
 
 	case valtype_string:
-		i2, err := strconv.Atoi(*p.val.GetString())
-		if err != nil {
+		if n, err := strconv.ParseInt(*p.val.GetString(), 10, 64); err == nil {
+			i2 = n
+		} else if n, ok := parseHex(*p.val.GetString()); ok { // stored before hex_numbers was on
+			i2 = n
+		} else if f, err := strconv.ParseFloat(*p.val.GetString(), 64); err == nil {
+			return compareFloat64(float64(i), f), true
+		} else {
 			return 0, false
 		}
-		i = int64(i2)
 		// drops out of switch to int compare
 
 	default:
 		return 0, false
 	}
 
-	if i > p.val.GetInt() {
+	if i > i2 {
 		return 1, true
-	} else if i < p.val.GetInt() {
+	} else if i < i2 {
 		return -1, true
 	} else {
 		return 0, true
@@ -131,35 +132,30 @@ func (p *Haystalk) CompareInt(i int64) (int, bool) {
 func (p *Haystalk) CompareFloat(f float64) (int, bool) {
 	switch p.val.valtype {
 	case valtype_int:
-		if f > p.val.GetFloat() {
-			return 1, true
-		} else if f < p.val.GetFloat() {
-			return -1, true
-		} else {
-			return 0, true
-		}
+		return compareFloat64(f, float64(p.val.GetInt())), true
 
 	case valtype_float:
-		// drop out so we can re-use the code for string
+		return compareFloat64(f, p.val.GetFloat()), true
 
 	case valtype_string:
 		f2, err := strconv.ParseFloat(*p.val.GetString(), 64)
 		if err != nil {
 			return 0, false
 		}
-		f = f2
-		// drops out of switch to float compare
+		return compareFloat64(f, f2), true
 
 	default:
 		return 0, false
 	}
+}
 
-	if float64(f) > p.val.GetFloat() {
-		return 1, true
-	} else if float64(f) < p.val.GetFloat() {
-		return -1, true
+func compareFloat64(f1 float64, f2 float64) int {
+	if f1 > f2 {
+		return 1
+	} else if f1 < f2 {
+		return -1
 	} else {
-		return 0, true
+		return 0
 	}
 }
 
@@ -200,6 +196,54 @@ func (p *Haystalk) CompareString(s *string) (int, bool) {
 	} else if sv < sv2 {
 		return -1, true
 	} else {
+		return 0, true
+	}
+}
+
+// Compare only the values of two Haystalks, ignoring their dkeys.
+// So we can compare different keys with each other (e.g. src_port vs dest_port).
+// Values of different types are compared numerically where possible, so a
+// string "443" equals int 443. Returns false if the comparison is undefined
+// (e.g. a non-numeric string against a number).
+func (p *Haystalk) CompareValueOnly(other *Haystalk) (int, bool) {
+	// Note that the CompareX methods return how X compares to their Haystalk,
+	// so when we call them on p, we have to flip the result.
+	switch p.val.valtype {
+	case valtype_int:
+		return other.CompareInt(p.val.GetInt())
+
+	case valtype_float:
+		return other.CompareFloat(p.val.GetFloat())
+
+	case valtype_time:
+		// Times only compare with times, the rest is too ambiguous
+		if other.val.valtype != valtype_time {
+			return 0, false
+		}
+		if p.val.GetTime() > other.val.GetTime() {
+			return 1, true
+		} else if p.val.GetTime() < other.val.GetTime() {
+			return -1, true
+		}
+		return 0, true
+
+	case valtype_string:
+		var res int
+		var ok bool
+
+		switch other.val.valtype {
+		case valtype_int:
+			res, ok = p.CompareInt(other.val.GetInt())
+		case valtype_float:
+			res, ok = p.CompareFloat(other.val.GetFloat())
+		case valtype_string:
+			res, ok = p.CompareString(other.val.GetString())
+		default: // incl. time, see above
+			return 0, false
+		}
+		return -res, ok
+
+	default:
 		return 0, false
 	}
 }
@@ -0,0 +1,73 @@
+// OpenActa/Haystack mem structure compare methods - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"testing"
+)
+
+func testStalk(dkey uint32, v interface{}) *Haystalk {
+	hs := &Haystalk{dkey: dkey}
+
+	switch v := v.(type) {
+	case int:
+		hs.val.SetInt(int64(v))
+	case float64:
+		hs.val.SetFloat(v)
+	case string:
+		hs.val.SetString(&v)
+	}
+
+	return hs
+}
+
+func TestCompareValueOnly(t *testing.T) {
+	tests := []struct {
+		a, b interface{}
+		res  int
+		ok   bool
+	}{
+		{443, 443, 0, true},
+		{80, 443, -1, true},
+		{443, 80, 1, true},
+		{1.5, 2, -1, true},
+		{2, 1.5, 1, true},
+		{"443", 443, 0, true},
+		{443, "443", 0, true},
+		{10, "9", 1, true}, // numeric, not lexical
+		{"9", 10, -1, true},
+		{"2.5", 2, 1, true},
+		{"Foo", "foo", 0, true},
+		{"abc", "abd", -1, true},
+		{"abc", 1, 0, false},
+		{1, "abc", 0, false},
+	}
+
+	for _, tc := range tests {
+		// Different dkeys, so Compare() would never call them equal
+		a := testStalk(1, tc.a)
+		b := testStalk(2, tc.b)
+
+		res, ok := a.CompareValueOnly(b)
+		if res != tc.res || ok != tc.ok {
+			t.Errorf("CompareValueOnly(%#v, %#v) = %d, %v; want %d, %v", tc.a, tc.b, res, ok, tc.res, tc.ok)
+		}
+	}
+}
+
+// EOF
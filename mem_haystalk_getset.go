@@ -17,6 +17,11 @@
 
 package haystack
 
+import (
+	"strconv"
+	"time"
+)
+
 func (p *Val) GetInt() int64 {
 	// Catch the bad.
 	if p.valtype != valtype_int {
@@ -63,4 +68,49 @@ func (p *Val) SetString(s *string) bool {
 	return true
 }
 
+// Time is in Unix nanoseconds
+func (p *Val) GetTime() int64 {
+	// Catch the bad.
+	if p.valtype != valtype_time {
+		return 0
+	}
+
+	return p.intval
+}
+
+func (p *Val) SetTime(ns int64) bool {
+	p.valtype = valtype_time
+	p.intval = ns
+	return true
+}
+
+// Walk the bunch starting at first_ofs (its _timestamp), return the value for dkey.
+// If a bunch has the same key more than once, we return the first one we find.
+func (p *Haybale) FieldInBunch(first_ofs uint32, dkey uint32) (*Val, bool) {
+	for k := first_ofs; k != haystalk_ofs_nil && k < p.num_haystalks; k = p.haystalk[k].next_ofs {
+		if p.haystalk[k].dkey == dkey {
+			return &p.haystalk[k].val, true
+		}
+	}
+
+	return nil, false
+}
+
+// Format value as string, without losing precision for floats.
+// The result parses back to the same value.
+func (p *Val) String() string {
+	switch p.valtype {
+	case valtype_int:
+		return strconv.FormatInt(p.intval, 10)
+	case valtype_float:
+		return strconv.FormatFloat(p.floatval, 'g', -1, 64)
+	case valtype_string:
+		return *p.stringval
+	case valtype_time:
+		return time.Unix(0, p.intval).UTC().Format(time.RFC3339Nano)
+	default:
+		return ""
+	}
+}
+
 // EOF
@@ -0,0 +1,119 @@
+// OpenActa/Haystack mem structure access methods - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestValStringFloatRoundTrip(t *testing.T) {
+	var floats []float64 = []float64{1.4567000001, 0.1, 1e-300, 123456789.123456789,
+		-2.5e+15, math.MaxFloat64, math.SmallestNonzeroFloat64}
+
+	for _, f := range floats {
+		var v Val
+		v.SetFloat(f)
+
+		s := v.String()
+		f2, err := strconv.ParseFloat(s, 64)
+		if err != nil || f2 != f {
+			t.Errorf("Float %v formatted as '%s', parsed back as %v (err=%v)", f, s, f2, err)
+		}
+	}
+}
+
+func TestValString(t *testing.T) {
+	var v Val
+
+	v.SetInt(-42)
+	if s := v.String(); s != "-42" {
+		t.Errorf("Int -42 formatted as '%s'", s)
+	}
+
+	str := "example.com"
+	v.SetString(&str)
+	if s := v.String(); s != str {
+		t.Errorf("String '%s' formatted as '%s'", str, s)
+	}
+}
+
+// The value of a key in one bunch, the first one if it's in there twice
+func TestFieldInBunch(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.dict_table_bits = 10
+	config.duplicate_key_policy = duplicate_key_policy_keep_all
+
+	hs := new(Haystack)
+	hb := &Haybale{HaystackPtr: hs}
+	hs.Haybale = append(hs.Haybale, hb)
+	for _, rec := range []string{
+		`{"_timestamp":"2023-06-04T00:00:00Z","Host":"a.example.com","host":"b.example.com","dest_port":443}`,
+		`{"_timestamp":"2023-06-04T00:00:01Z","dest_port":80}`,
+	} {
+		flat, err := JSONToKVmap([]byte(rec))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := hb.InsertBunch(&hs.Dict, flat); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hb.SortBale()
+
+	dkey := func(k string) uint32 {
+		d, found := hs.Dict.KeyExists(k)
+		if !found {
+			t.Fatalf("%s not in the Dictionary", k)
+		}
+		return d
+	}
+	host, port, ts := dkey("host"), dkey("dest_port"), dkey(Timestamp_key)
+
+	// The first stalk of each bunch, via any of its stalks
+	firsts := make(map[string]uint32)
+	for i := uint32(0); i < hb.num_haystalks; i++ {
+		if hb.haystalk[i].dkey == ts {
+			firsts[hb.haystalk[i].val.String()] = hb.haystalk[i].first_ofs
+		}
+	}
+	first, second := firsts["2023-06-04T00:00:00Z"], firsts["2023-06-04T00:00:01Z"]
+
+	for _, tc := range []struct {
+		first uint32
+		dkey  uint32
+		want  string // "" for not there
+	}{
+		{first, host, "a.example.com"},
+		{first, port, "443"},
+		{first, ts, "2023-06-04T00:00:00Z"},
+		{second, port, "80"},
+		{second, host, ""},
+		{hb.num_haystalks, port, ""}, // past the end
+		{haystalk_ofs_nil, port, ""},
+	} {
+		v, found := hb.FieldInBunch(tc.first, tc.dkey)
+		if found != (tc.want != "") || (found && v.String() != tc.want) {
+			t.Errorf("bunch at %d, dkey %d: %v %v, want '%s'", tc.first, tc.dkey, v, found, tc.want)
+		}
+	}
+}
+
+// EOF
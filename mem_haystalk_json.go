@@ -0,0 +1,134 @@
+// OpenActa/Haystack - Haystalk as JSON
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	For tools and tests: a Haystalk in JSON, like
+
+		{"dkey":123,"valtype":"int","value":443,"first_ofs":7,"next_ofs":9}
+
+	The value is typed by valtype: a JSON number for int and float, a string
+	for string and time (RFC3339Nano, UTC). next_ofs is 4294967295 for the
+	last stalk of a bunch. self_ofs is only used while sorting, not included.
+*/
+
+package haystack
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+type HaystalkJSON struct {
+	Dkey     uint32          `json:"dkey"`
+	Valtype  string          `json:"valtype"` // int, float, string or time
+	Value    json.RawMessage `json:"value"`
+	FirstOfs uint32          `json:"first_ofs"`
+	NextOfs  uint32          `json:"next_ofs"`
+}
+
+var valtype_names = map[uint8]string{
+	valtype_int:    "int",
+	valtype_float:  "float",
+	valtype_string: "string",
+	valtype_time:   "time",
+}
+
+func (p Haystalk) MarshalJSON() ([]byte, error) {
+	j := HaystalkJSON{
+		Dkey:     p.dkey,
+		Valtype:  valtype_names[p.val.valtype],
+		FirstOfs: p.first_ofs,
+		NextOfs:  p.next_ofs,
+	}
+
+	switch p.val.valtype {
+	case valtype_int:
+		j.Value = json.RawMessage(strconv.FormatInt(p.val.intval, 10))
+	case valtype_float:
+		if math.IsNaN(p.val.floatval) || math.IsInf(p.val.floatval, 0) {
+			return nil, fmt.Errorf("float value %v has no JSON", p.val.floatval)
+		}
+		j.Value = json.RawMessage(strconv.FormatFloat(p.val.floatval, 'g', -1, 64))
+	case valtype_string, valtype_time:
+		s, err := json.Marshal(p.val.String())
+		if err != nil {
+			return nil, err
+		}
+		j.Value = s
+	default:
+		return nil, fmt.Errorf("unknown value type %d", p.val.valtype)
+	}
+
+	return json.Marshal(j)
+}
+
+func (p *Haystalk) UnmarshalJSON(b []byte) error {
+	var j HaystalkJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	if j.Dkey >= max_dkeys {
+		return fmt.Errorf("dkey %d out of range", j.Dkey)
+	}
+	if len(j.Value) == 0 {
+		return fmt.Errorf("stalk without a value")
+	}
+
+	var val Val
+	switch j.Valtype {
+	case "int":
+		i, err := strconv.ParseInt(string(j.Value), 10, 64)
+		if err != nil {
+			return fmt.Errorf("int value %s: %w", j.Value, err)
+		}
+		val.SetInt(i)
+
+	case "float":
+		f, err := strconv.ParseFloat(string(j.Value), 64)
+		if err != nil {
+			return fmt.Errorf("float value %s: %w", j.Value, err)
+		}
+		val.SetFloat(f)
+
+	case "string", "time":
+		var s string
+		if err := json.Unmarshal(j.Value, &s); err != nil {
+			return fmt.Errorf("%s value %s: %w", j.Valtype, j.Value, err)
+		}
+		if j.Valtype == "string" {
+			val.SetString(&s)
+			break
+		}
+		ts, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return fmt.Errorf("time value %s: %w", j.Value, err)
+		}
+		val.SetTime(ts.UnixNano())
+
+	default:
+		return fmt.Errorf("unknown valtype '%s'", j.Valtype)
+	}
+
+	*p = Haystalk{dkey: j.Dkey, val: val, first_ofs: j.FirstOfs, next_ofs: j.NextOfs}
+
+	return nil
+}
+
+// EOF
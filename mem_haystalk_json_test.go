@@ -0,0 +1,126 @@
+// OpenActa/Haystack - Haystalk as JSON - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestHaystalkJSON(t *testing.T) {
+	str := "say \"hi\"\n"
+	stalks := []Haystalk{
+		{dkey: 1, first_ofs: 0, next_ofs: 3},
+		{dkey: 2, first_ofs: 0, next_ofs: haystalk_ofs_nil},
+		{dkey: 3, first_ofs: 5, next_ofs: 6},
+		{dkey: 4, first_ofs: 5, next_ofs: 6},
+	}
+	stalks[0].val.SetInt(math.MinInt64)
+	stalks[1].val.SetFloat(0.1)
+	stalks[2].val.SetString(&str)
+	stalks[3].val.SetTime(1685836801956264000)
+
+	for _, s := range stalks {
+		b, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var back Haystalk
+		if err := json.Unmarshal(b, &back); err != nil {
+			t.Fatalf("%s: %v", b, err)
+		}
+		if back.Compare(s) != 0 || back.first_ofs != s.first_ofs || back.next_ofs != s.next_ofs {
+			t.Errorf("%s came back as %+v", b, back)
+		}
+	}
+
+	b, _ := json.Marshal(stalks[0])
+	if string(b) != `{"dkey":1,"valtype":"int","value":-9223372036854775808,"first_ofs":0,"next_ofs":3}` {
+		t.Errorf("%s", b)
+	}
+	b, _ = json.Marshal(&stalks[3])
+	if string(b) != `{"dkey":4,"valtype":"time","value":"2023-06-04T00:00:01.956264Z","first_ofs":5,"next_ofs":6}` {
+		t.Errorf("%s", b)
+	}
+
+	var nan Haystalk
+	nan.val.SetFloat(math.NaN())
+	if _, err := json.Marshal(nan); err == nil {
+		t.Errorf("NaN marshalled")
+	}
+
+	for _, bad := range []string{
+		`{"dkey":1,"valtype":"int","value":1.5}`,
+		`{"dkey":1,"valtype":"int","value":"1"}`,
+		`{"dkey":1,"valtype":"float","value":"x"}`,
+		`{"dkey":1,"valtype":"string","value":1}`,
+		`{"dkey":1,"valtype":"time","value":"yesterday"}`,
+		`{"dkey":1,"valtype":"bool","value":true}`,
+		`{"dkey":1,"valtype":"int"}`,
+		`{"dkey":16777216,"valtype":"int","value":1}`,
+	} {
+		var s Haystalk
+		if err := json.Unmarshal([]byte(bad), &s); err == nil {
+			t.Errorf("%s: no error, got %+v", bad, s)
+		}
+	}
+}
+
+// Dump a Haybale, build it again from the dump
+func TestDumpStalks(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	hs := newTestHaystack(t, "testdata/head5.json", 5)
+	hb := hs.Haybale[0]
+
+	var buf bytes.Buffer
+	if err := hb.DumpStalks(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	rebuilt := &Haybale{HaystackPtr: hs}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		s := new(Haystalk)
+		if err := json.Unmarshal(scanner.Bytes(), s); err != nil {
+			t.Fatal(err)
+		}
+		rebuilt.haystalk = append(rebuilt.haystalk, s)
+		rebuilt.num_haystalks++
+	}
+	if rebuilt.num_haystalks != hb.num_haystalks {
+		t.Fatalf("%d stalks dumped, %d in the Haybale", rebuilt.num_haystalks, hb.num_haystalks)
+	}
+	if err := rebuilt.Rebuild(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := uint32(0); i < hb.num_haystalks; i++ {
+		a, b := hb.haystalk[i], rebuilt.haystalk[i]
+		if a.Compare(*b) != 0 || a.first_ofs != b.first_ofs || a.next_ofs != b.next_ofs {
+			t.Errorf("stalk %d: %+v, rebuilt %+v", i, *a, *b)
+		}
+	}
+}
+
+// EOF
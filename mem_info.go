@@ -0,0 +1,75 @@
+// OpenActa/Haystack - Haystack summary info
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"fmt"
+	"time"
+)
+
+type HaystackInfo struct {
+	NumBunches  uint64 // records
+	NumStalks   uint64 // key/value pairs
+	NumHaybales int
+	NumKeys     uint32 // in the Dictionary
+	TimeFirst   int64  // Unix nanosecs, 0 if empty
+	TimeLast    int64
+	Memsize     uint64 // approx bytes in RAM (sum of Haybale Memsize)
+}
+
+// Summary of what's in the Haystack, without the caller walking everything
+func (p *Haystack) Info() HaystackInfo {
+	p.RLock()
+	defer p.RUnlock()
+
+	var info HaystackInfo
+
+	info.NumHaybales = len(p.Haybale)
+	info.NumKeys = p.Dict.num_dkeys
+
+	for _, hb := range p.Haybale {
+		info.NumStalks += uint64(hb.num_haystalks)
+		info.Memsize += uint64(hb.Memsize)
+
+		hb.forEachBunch(func(first uint32) {
+			info.NumBunches++
+		})
+
+		if hb.num_haystalks == 0 {
+			continue
+		}
+		if info.TimeFirst == 0 || hb.time_first < info.TimeFirst {
+			info.TimeFirst = hb.time_first
+		}
+		if hb.time_last > info.TimeLast {
+			info.TimeLast = hb.time_last
+		}
+	}
+
+	return info
+}
+
+func (i HaystackInfo) String() string {
+	return fmt.Sprintf("%d bunches, %d stalks, %d Haybales, %d keys, %s - %s, %d bytes in mem",
+		i.NumBunches, i.NumStalks, i.NumHaybales, i.NumKeys,
+		time.Unix(0, i.TimeFirst).UTC().Format(time.RFC3339Nano),
+		time.Unix(0, i.TimeLast).UTC().Format(time.RFC3339Nano),
+		i.Memsize)
+}
+
+// EOF
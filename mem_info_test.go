@@ -0,0 +1,61 @@
+// OpenActa/Haystack - Haystack summary info - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"testing"
+)
+
+func TestInfo(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	if info := new(Haystack).Info(); info != (HaystackInfo{}) {
+		t.Errorf("empty Haystack: %v", info)
+	}
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+	info := hs.Info()
+
+	if info.NumBunches != 5 || info.NumHaybales != 3 {
+		t.Errorf("expected 5 bunches in 3 Haybales: %v", info)
+	}
+	if info.NumStalks <= info.NumBunches || info.NumKeys == 0 || info.Memsize == 0 {
+		t.Errorf("counts look wrong: %v", info)
+	}
+	if info.TimeFirst == 0 || info.TimeLast < info.TimeFirst {
+		t.Errorf("time span looks wrong: %v", info)
+	}
+
+	// Same after a round-trip, apart from Memsize (approximated a bit differently)
+	data, _, err := hs.Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs2 := new(Haystack)
+	if err := hs2.Disk2Mem(data); err != nil {
+		t.Fatal(err)
+	}
+	info2 := hs2.Info()
+	info2.Memsize = info.Memsize
+	if info2 != info {
+		t.Errorf("after round-trip:\n%v\nexpected\n%v", info2, info)
+	}
+}
+
+// EOF
@@ -0,0 +1,164 @@
+// OpenActa/Haystack - recently written data, kept in RAM for search
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	Ingest hands a Haystack to the disk writer and forgets it, from then on
+	it's only on disk. With config recent_max_size, the disk writer keeps
+	what it wrote in RAM as well, so a live search has the latest data
+	without loading files: RecentSnapshots(), next to IngestSnapshot() for
+	what's not been flushed yet.
+
+	When the window gets bigger than recent_max_size, the oldest Haybales
+	go, one at a time. With recent_max_age, so does a Haystack written more
+	than that many seconds ago. They're on disk, SearchTimeRange() still
+	finds them there. Only Haystacks that were written get in, so nothing
+	is ever only here.
+
+	With file_rollover hourly/daily, nothing gets in: the Haybales move to
+	the working file, and that's not durable until it's finalized.
+
+	Age is checked when a Haystack comes in, and on RecentSnapshots() and
+	RecentInfo(). A quiet system can hold on to things a bit longer, but
+	never more than recent_max_size.
+
+	What's queued for the disk writer isn't in either view: no longer in
+	IngestSnapshot(), not here yet.
+*/
+
+package haystack
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	recent_max_size_lower = 1024 * 1024 // 1M
+	recent_max_size_upper = 2 * 1024 * 1024 * 1024
+	recent_max_age_lower  = 1
+	recent_max_age_upper  = 7 * 24 * 3600
+)
+
+type recentHaystack struct {
+	hs      *Haystack
+	written time.Time
+}
+
+var recent struct {
+	mutex sync.Mutex
+	list  []recentHaystack // oldest first
+	size  uint64           // Memsize of all Haybales in list
+}
+
+// Keep a Haystack the disk writer just wrote, if we keep any
+func recentAdd(hs *Haystack) {
+	if config.recent_max_size == 0 {
+		return
+	}
+
+	var size uint64
+	hs.RLock()
+	for _, hb := range hs.Haybale {
+		size += uint64(hb.Memsize)
+	}
+	hs.RUnlock()
+
+	recent.mutex.Lock()
+	defer recent.mutex.Unlock()
+
+	recent.list = append(recent.list, recentHaystack{hs: hs, written: time.Now()})
+	recent.size += size
+	recentEvict(time.Now())
+}
+
+// Drop the oldest Haybales until we're within recent_max_size and
+// recent_max_age. Caller holds recent.mutex.
+func recentEvict(now time.Time) {
+	max_size := uint64(config.recent_max_size)
+	max_age := time.Duration(config.recent_max_age) * time.Second
+
+	for len(recent.list) > 0 {
+		r := &recent.list[0]
+		too_old := max_age > 0 && now.Sub(r.written) > max_age
+		if recent.size <= max_size && !too_old {
+			return
+		}
+
+		// Snapshots have their own Haybale slice, they keep what they had
+		r.hs.Lock()
+		for len(r.hs.Haybale) > 0 && (too_old || recent.size > max_size) {
+			recent.size -= uint64(r.hs.Haybale[0].Memsize)
+			r.hs.Haybale[0] = nil
+			r.hs.Haybale = r.hs.Haybale[1:]
+		}
+		empty := len(r.hs.Haybale) == 0
+		r.hs.Unlock()
+
+		if empty {
+			recent.list[0] = recentHaystack{}
+			recent.list = recent.list[1:]
+		}
+	}
+}
+
+// Read-only views of the recently written Haystacks, oldest first.
+// See Haystack.Snapshot(), and the top of this file.
+func RecentSnapshots() []*Haystack {
+	recent.mutex.Lock()
+	defer recent.mutex.Unlock()
+
+	recentEvict(time.Now())
+
+	res := make([]*Haystack, 0, len(recent.list))
+	for _, r := range recent.list {
+		res = append(res, r.hs.Snapshot())
+	}
+
+	return res
+}
+
+// What's in the window, as one Haystack: counts and Memsize add up, times
+// span all of it. Each Haystack has its own Dictionary, NumKeys is the biggest.
+func RecentInfo() HaystackInfo {
+	recent.mutex.Lock()
+	defer recent.mutex.Unlock()
+
+	recentEvict(time.Now())
+
+	var info HaystackInfo
+	for _, r := range recent.list {
+		i := r.hs.Info()
+
+		info.NumBunches += i.NumBunches
+		info.NumStalks += i.NumStalks
+		info.NumHaybales += i.NumHaybales
+		info.Memsize += i.Memsize
+		if i.NumKeys > info.NumKeys {
+			info.NumKeys = i.NumKeys
+		}
+		if i.TimeFirst != 0 && (info.TimeFirst == 0 || i.TimeFirst < info.TimeFirst) {
+			info.TimeFirst = i.TimeFirst
+		}
+		if i.TimeLast > info.TimeLast {
+			info.TimeLast = i.TimeLast
+		}
+	}
+
+	return info
+}
+
+// EOF
@@ -0,0 +1,94 @@
+// OpenActa/Haystack - recently written data, kept in RAM for search - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecent(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	config.datastore_dir = t.TempDir()
+	config.catalogue_dir = t.TempDir()
+	config.diskwriter_queue_policy = diskwriter_policy_block
+	config.recent_max_size = recent_max_size_upper
+	t.Cleanup(func() {
+		recent.list = nil
+		recent.size = 0
+	})
+
+	if err := StartDiskWriter(); err != nil {
+		t.Fatal(err)
+	}
+	hs1 := testEveHaystack(t, 300, 100)
+	hs2 := testEveHaystack(t, 200, 100)
+	info1, info2 := hs1.Info(), hs2.Info()
+	for _, hs := range []*Haystack{hs1, hs2} {
+		if err := FlushHaystack(hs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	StopDiskWriter()
+
+	info := RecentInfo()
+	if info.NumBunches != info1.NumBunches+info2.NumBunches || info.NumHaybales != info1.NumHaybales+info2.NumHaybales ||
+		info.Memsize != info1.Memsize+info2.Memsize {
+		t.Errorf("info %+v, from %+v and %+v", info, info1, info2)
+	}
+
+	// Searchable, same as the originals
+	kv := map[string]string{"event_type": "flow"}
+	want := hs1.CountKeyValArray(kv) + hs2.CountKeyValArray(kv)
+	var n uint
+	for _, hs := range RecentSnapshots() {
+		n += hs.CountKeyValArray(kv)
+	}
+	if n != want || want == 0 {
+		t.Errorf("%d matches in the window, %d written", n, want)
+	}
+
+	// Just over the limit: only the oldest Haybale goes
+	recent.mutex.Lock()
+	config.recent_max_size = uint32(recent.size - 1)
+	recentEvict(time.Now())
+	recent.mutex.Unlock()
+	if info := RecentInfo(); info.NumHaybales != info1.NumHaybales+info2.NumHaybales-1 {
+		t.Errorf("after size eviction: %d Haybales", info.NumHaybales)
+	}
+
+	// Too old: all of it
+	config.recent_max_size = recent_max_size_upper
+	config.recent_max_age = 60
+	recent.mutex.Lock()
+	recentEvict(time.Now().Add(2 * time.Minute))
+	recent.mutex.Unlock()
+	if snaps := RecentSnapshots(); len(snaps) != 0 || recent.size != 0 {
+		t.Errorf("after age eviction: %d Haystacks, %d bytes", len(snaps), recent.size)
+	}
+
+	// Off: nothing kept
+	config.recent_max_size = 0
+	recentAdd(testEveHaystack(t, 100, 100))
+	if len(recent.list) != 0 {
+		t.Errorf("recent_max_size 0, still kept")
+	}
+}
+
+// EOF
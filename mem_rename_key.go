@@ -0,0 +1,162 @@
+// OpenActa/Haystack - renaming a key
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	Renaming a field in data that's already in, like src_ip to source.ip.
+
+	A dkey is where the key hashes to in the Dictionary, so a new name
+	means a new slot. And taking a key out of the table can strand keys
+	that skipped past its slot on the way in. So we put all keys in a new
+	table, in the order they came, with the one renamed: most end up where
+	they were. Then every stalk gets its new dkey, and sorted Haybales are
+	sorted again, they're sorted by dkey first.
+
+	The Haybales are copies: a Snapshot() may still be searching the old
+	ones, with its own copy of the old Dictionary. Don't rename while
+	bunches are being inserted into this Haystack.
+
+	Only the casing changing (with case-insensitive keys) is the same
+	slot, that's just the name.
+*/
+
+package haystack
+
+import "fmt"
+
+// Rename key old_name to new_name in the Dictionary and all Haybales.
+// ErrKeyExists if new_name is already a key, see RenameKeyMerge().
+func (p *Haystack) RenameKey(old_name string, new_name string) error {
+	return p.renameKey(old_name, new_name, false)
+}
+
+// Same as RenameKey(), but if new_name is already a key, the values of
+// old_name go with it. A bunch that had both then has new_name twice.
+func (p *Haystack) RenameKeyMerge(old_name string, new_name string) error {
+	return p.renameKey(old_name, new_name, true)
+}
+
+func (p *Haystack) renameKey(old_name string, new_name string, merge bool) error {
+	if new_name == "" {
+		return fmt.Errorf("can't rename key '%s' to nothing", old_name)
+	}
+	if len(new_name) > max_keylen {
+		return fmt.Errorf("%w: '%.32s...' is %d chars, max %d", ErrKeyTooLong, new_name, len(new_name), max_keylen)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.Dict.isTimestampKey(old_name) || p.Dict.isTimestampKey(new_name) {
+		return fmt.Errorf("can't rename '%s' to '%s', every bunch starts with its %s", old_name, new_name, Timestamp_key)
+	}
+
+	old_dkey, found := p.Dict.KeyExists(old_name)
+	if !found {
+		return fmt.Errorf("no key '%s' to rename", old_name)
+	}
+
+	// Same slot, only the name as stored
+	if p.Dict.keyFold(old_name) == p.Dict.keyFold(new_name) {
+		p.Dict.dkey[old_dkey] = &new_name
+		p.Dict.dirty[old_dkey] = true
+		return nil
+	}
+
+	new_dkey, exists := p.Dict.KeyExists(new_name)
+	if exists && !merge {
+		return fmt.Errorf("%w: can't rename '%s' to '%s'", ErrKeyExists, old_name, new_name)
+	}
+
+	var remap map[uint32]uint32
+	if exists {
+		remap = p.Dict.rekey(old_dkey, "")
+		remap[old_dkey] = remap[new_dkey]
+	} else {
+		remap = p.Dict.rekey(old_dkey, new_name)
+	}
+
+	for i, hb := range p.Haybale {
+		p.memsize -= hb.Memsize
+		p.Haybale[i] = hb.rekey(remap)
+		p.memsize += p.Haybale[i].Memsize
+	}
+
+	return nil
+}
+
+// Put the keys in a new table of the same size, in the order they were
+// added, with dkey old renamed to name (or left out, name ""). All of them
+// are dirty, it's a new Dictionary. Returns old dkey -> new dkey.
+func (p *Dictionary) rekey(old uint32, name string) map[uint32]uint32 {
+	keys, used := p.dkey, p.used
+
+	p.dkey = make([]*string, len(keys))
+	p.dirty = make([]bool, len(keys))
+	p.used = make([]uint32, 0, len(used))
+	p.num_dkeys = 0
+
+	remap := make(map[uint32]uint32, len(used))
+	for _, dkey := range used {
+		key := keys[dkey]
+		if dkey == old {
+			if name == "" {
+				continue
+			}
+			key = &name
+		}
+
+		h, _ := p.KeyExists(*key) // not in there yet, so that's a free slot
+		p.dkey[h] = key
+		p.dirty[h] = true
+		p.used = append(p.used, h)
+		p.num_dkeys++
+		remap[dkey] = h
+	}
+
+	return remap
+}
+
+// A copy of the Haybale with the dkeys remapped, sorted again if it was
+func (p *Haybale) rekey(remap map[uint32]uint32) *Haybale {
+	hb := &Haybale{
+		num_haystalks: p.num_haystalks,
+		haystalk:      make([]*Haystalk, p.num_haystalks),
+		time_first:    p.time_first,
+		time_last:     p.time_last,
+		Memsize:       p.Memsize,
+		HaystackPtr:   p.HaystackPtr,
+	}
+
+	for i := uint32(0); i < p.num_haystalks; i++ {
+		stalk := *p.haystalk[i]
+		stalk.dkey = remap[stalk.dkey]
+		stalk.self_ofs = i
+		hb.haystalk[i] = &stalk
+	}
+
+	if p.is_sorted_immutable {
+		hb.sortStalks()
+		for i := uint32(0); i < hb.num_haystalks; i++ {
+			hb.haystalk[i].self_ofs = i
+		}
+		hb.is_sorted_immutable = true
+	}
+
+	return hb
+}
+
+// EOF
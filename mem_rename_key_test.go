@@ -0,0 +1,136 @@
+// OpenActa/Haystack - renaming a key - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRenameKey(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10 // small, so some keys skipped around on the way in
+
+	hs := testEveHaystack(t, 500, 100)
+
+	// A src_ip that's in there, and all the other keys
+	var ip string
+	hs.Haybale[0].forEachBunch(func(first uint32) {
+		if ip == "" {
+			ip = hs.Haybale[0].bunchMap(&hs.Dict, first)["src_ip"]
+		}
+	})
+	kv := map[string]string{"src_ip": ip}
+	want := hs.CountKeyValArray(kv)
+	if ip == "" || want == 0 {
+		t.Fatalf("no src_ip to look for")
+	}
+	other := make(map[string]uint)
+	for _, k := range hs.Dict.AllKeys() {
+		if k != "src_ip" {
+			res, _ := hs.SearchKeyPresent(k)
+			other[k] = uint(len(res))
+		}
+	}
+	num_keys := hs.Dict.num_dkeys
+	snap := hs.Snapshot()
+
+	if err := hs.RenameKey("src_ip", "source.ip"); err != nil {
+		t.Fatal(err)
+	}
+	if n := hs.CountKeyValArray(map[string]string{"source.ip": ip}); n != want {
+		t.Errorf("source.ip=%s: %d matches, %d before", ip, n, want)
+	}
+	if _, found := hs.Dict.KeyExists("src_ip"); found || hs.CountKeyValArray(kv) != 0 || hs.Dict.num_dkeys != num_keys {
+		t.Errorf("src_ip still there, or %d keys (was %d)", hs.Dict.num_dkeys, num_keys)
+	}
+	for k, n := range other { // whether they moved or not
+		if res, _ := hs.SearchKeyPresent(k); uint(len(res)) != n {
+			t.Errorf("%s: %d bunches, %d before", k, len(res), n)
+		}
+	}
+	for i, hb := range hs.Haybale {
+		for k := uint32(1); k < hb.num_haystalks; k++ {
+			if hb.haystalk[k-1].Compare(*hb.haystalk[k]) > 0 {
+				t.Fatalf("Haybale %d not sorted at stalk %d", i, k)
+			}
+		}
+	}
+
+	// The snapshot still has it as it was
+	if n := snap.CountKeyValArray(kv); n != want {
+		t.Errorf("snapshot: %d matches, %d before", n, want)
+	}
+
+	// And so does the file we write
+	data, _, err := hs.Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs2 := new(Haystack)
+	if err := hs2.Disk2Mem(data); err != nil {
+		t.Fatal(err)
+	}
+	if ok, diff := hs.Equal(hs2); !ok {
+		t.Errorf("after a round trip: %s", diff)
+	}
+	if n := hs2.CountKeyValArray(map[string]string{"source.ip": ip}); n != want {
+		t.Errorf("read back: %d matches, %d before", n, want)
+	}
+
+	// Taken, unless we merge
+	if err := hs.RenameKey("dest_ip", "source.ip"); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("rename to an existing key: %v", err)
+	}
+	either := 0
+	for _, hb := range hs.Haybale {
+		hb.forEachBunch(func(first uint32) {
+			m := hb.bunchMap(&hs.Dict, first)
+			if _, ok := m["dest_ip"]; ok {
+				either++
+			} else if _, ok := m["source.ip"]; ok {
+				either++
+			}
+		})
+	}
+	if err := hs.RenameKeyMerge("dest_ip", "source.ip"); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := hs.SearchKeyPresent("source.ip"); len(res) != either {
+		t.Errorf("merged: %d bunches with source.ip, want %d", len(res), either)
+	}
+	if _, found := hs.Dict.KeyExists("dest_ip"); found || hs.Dict.num_dkeys != num_keys-1 {
+		t.Errorf("dest_ip still there, or %d keys", hs.Dict.num_dkeys)
+	}
+
+	// Only the casing: same key, new name
+	if err := hs.RenameKey("event_type", "Event_Type"); err != nil {
+		t.Fatal(err)
+	}
+	if dkey, found := hs.Dict.KeyExists("event_type"); !found || *hs.Dict.dkey[dkey] != "Event_Type" {
+		t.Errorf("event_type not renamed")
+	}
+
+	for _, tt := range [][2]string{{"no_such_key", "x"}, {Timestamp_key, "ts"}, {"proto", Timestamp_key}, {"proto", ""}} {
+		if err := hs.RenameKey(tt[0], tt[1]); err == nil {
+			t.Errorf("renamed '%s' to '%s'", tt[0], tt[1])
+		}
+	}
+}
+
+// EOF
@@ -18,44 +18,188 @@
 package haystack
 
 import (
+	"bufio"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"path/filepath"
 	"sort"
-	"strconv"
 	"time"
 )
 
+// Search for bunches matching all key/value pairs, print them to stdout as JSON
 func (p *Haystack) SearchKeyValArray(kv_array map[string]string) {
+	if _, err := p.SearchKeyValArrayTo(kv_array, os.Stdout); err != nil {
+		log.Printf("Search: %v", err)
+	}
+}
+
+// What a search did, logged once at the end.
+// The per-Haybale details only go to the log with log_level = debug,
+// with thousands of Haybales they'd flood it otherwise.
+type searchStats struct {
+	start   time.Time
+	bales   int // Haybales searched
+	skipped int // Haybales skipped, nothing in there can match
+	matches uint
+}
+
+func newSearchStats() *searchStats {
+	return &searchStats{start: time.Now()}
+}
+
+func (s *searchStats) log() {
+	log.Printf("%d matches, %d Haybales searched, %d skipped, duration: %v",
+		s.matches, s.bales, s.skipped, time.Since(s.start))
+}
+
+// Search for bunches matching all key/value pairs, write them to w as NDJSON
+// (one JSON object per line). Returns the number of matches.
+// We stop at the first write error.
+func (p *Haystack) SearchKeyValArrayTo(kv_array map[string]string, w io.Writer) (uint, error) {
+	var werr error
+
+	stats := newSearchStats()
+	defer stats.log()
+
+	p.RLock()
+	defer p.RUnlock()
+
+	hv, found := p.Dict.searchConditions(kv_array)
+	if !found {
+		return 0, nil
+	}
+
+	// Run through all Haybales
+	for i := range p.Haybale {
+		cur_hb := p.Haybale[i]
+
+		// Make sure the bale is sorted
+		//cur_hb.SortBale()					// DEBUG - not any more for normal ops
+		if !cur_hb.is_sorted_immutable { // So obviously this should never happen.
+			log.Printf("Haybale %d is not sorted, we can't search that!", i) // DEBUG
+		}
+
+		debugf("Looking in Haybale %d (%d stalks)", i, cur_hb.num_haystalks)
+		stats.bales++
+
+		cur_hb.searchBale(hv, func(first uint32) {
+			if werr != nil { // no point carrying on
+				return
+			}
+
+			// Got a match!
+			stats.matches++
+			werr = cur_hb.writeBunch(w, &p.Dict, first)
+		})
+		if werr != nil {
+			return stats.matches, werr
+		}
+	}
+
+	return stats.matches, nil
+}
+
+// Search for bunches matching all key/value pairs, write them to a file as NDJSON.
+// A relative out_path goes into datastore_dir. An existing file is overwritten.
+// The file is synced to disk before we return. Returns the number of matches.
+func (p *Haystack) SearchKeyValToFile(kv_array map[string]string, out_path string) (uint, error) {
+	if !filepath.IsAbs(out_path) {
+		out_path = filepath.Join(config.datastore_dir, out_path)
+	}
+
+	file, err := os.OpenFile(out_path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, FilePermissions())
+	if err != nil {
+		return 0, err
+	}
+
+	// Buffer, so we don't do a write syscall per match
+	bw := bufio.NewWriter(file)
+
+	matches, err := p.SearchKeyValArrayTo(kv_array, bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return matches, fmt.Errorf("writing search results to %s: %w", out_path, err)
+	}
+
+	return matches, nil
+}
+
+// Same as SearchKeyValArrayTo(), gzip compressed. NDJSON compresses well,
+// so that's a lot less to send for a big export. The gzip stream is closed
+// (and its footer written) before we return, w isn't.
+func (p *Haystack) SearchKeyValArrayGzip(w io.Writer, kv_array map[string]string) (uint, error) {
+	zw, err := gzip.NewWriterLevel(w, gzip.BestSpeed) // we're not archiving
+	if err != nil {
+		return 0, err
+	}
+
+	matches, err := p.SearchKeyValArrayTo(kv_array, zw)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+
+	return matches, err
+}
+
+// Same as SearchKeyValArray(), but only count the matching bunches.
+// No output, so it's suitable for benchmarking.
+func (p *Haystack) CountKeyValArray(kv_array map[string]string) uint {
 	var matches uint
 
-	// Start the clock
-	start := time.Now()
+	p.RLock()
+	defer p.RUnlock()
+
+	hv, found := p.Dict.searchConditions(kv_array)
+	if !found {
+		return 0
+	}
+
+	for i := range p.Haybale {
+		p.Haybale[i].searchBale(hv, func(first uint32) {
+			matches++
+		})
+	}
+
+	return matches
+}
+
+// Convert key/value search conditions to Haystalks we can compare against.
+// Returns false if a key doesn't exist (the conditions can then never match)
+// They're in key order, not map order, so searches are repeatable.
+func (p *Dictionary) searchConditions(kv_array map[string]string) ([]Haystalk, bool) {
+	keys := make([]string, 0, len(kv_array))
+	for ks := range kv_array {
+		keys = append(keys, ks)
+	}
+	sort.Strings(keys)
 
 	hv := make([]Haystalk, 0, len(kv_array))
-	for ks, v := range kv_array {
+	for _, ks := range keys {
+		v := kv_array[ks]
 		var new_hv Haystalk
 		var found bool
 
-		new_hv.dkey, found = p.Dict.KeyExists(ks)
+		new_hv.dkey, found = p.KeyExists(ks)
 
 		// doesn't exist, and it's an AND construct so we can just bail out
 		if !found {
 			log.Printf("Key '%s' not present in dataset", ks)
-			return
+			return nil, false
 		}
 
-		// Figure out what type our first value is (int, float or string)
-		if i, err := strconv.Atoi(v); err == nil {
-			new_hv.val.SetInt(int64(i))
-		} else if f, err := strconv.ParseFloat(v, 64); err == nil {
-			new_hv.val.SetFloat(f)
-		} else {
-			// Not an int or float format, we'll make it a string then.
-			vs := v // So the compiler allocates a new string
-			new_hv.val.SetString(&vs)
-			//log.Printf("New string = %s", *new_hv.val.GetString())	// DEBUG
-		}
+		new_hv.val = searchVal(p, ks, v)
 
 		hv = append(hv, new_hv)
 	}
@@ -63,229 +207,431 @@ func (p *Haystack) SearchKeyValArray(kv_array map[string]string) {
 	/*
 		log.Printf("Search conditions: hv = %v", hv) // DEBUG
 		for i := 0; i < len(hv); i++ {	// The following only works on strings
-			log.Printf("[%d] %s=%s", i, *p.Dict.dkey[hv[i].dkey], *hv[i].val.GetString())
+			log.Printf("[%d] %s=%s", i, *p.dkey[hv[i].dkey], *hv[i].val.GetString())
 		}
 	*/
 
-	// Run through all Haybales
-	for i := range p.Haybale {
-		cur_hb := p.Haybale[i]
+	return hv, true
+}
 
-		// Make sure the bale is sorted
-		//cur_hb.SortBale()					// DEBUG - not any more for normal ops
-		if !cur_hb.is_sorted_immutable { // So obviously this should never happen.
-			log.Printf("Haybale %d is not sorted, we can't search that!", i) // DEBUG
+// Search a (sorted) Haybale for bunches matching all conditions in hv.
+// fn is called with the offset of the first stalk (_timestamp) of each matching bunch.
+// We seek with the most selective condition in this bale, see seekCondition().
+func (p *Haybale) searchBale(hv []Haystalk, fn func(first uint32)) {
+	if p.num_haystalks == 0 { // empty Haybale, nothing to find
+		return
+	}
+
+	seek, lo, hi := p.seekCondition(hv)
+	p.searchBaleRange(hv, seek, lo, hi, fn)
+}
+
+// Same as searchBale(), but seek with condition hv[seek], whatever its run length
+func (p *Haybale) searchBaleSeek(hv []Haystalk, seek int, fn func(first uint32)) {
+	if p.num_haystalks == 0 {
+		return
+	}
+
+	lo, hi := p.stalkRange(hv[seek])
+	p.searchBaleRange(hv, seek, lo, hi, fn)
+}
+
+// Which condition to seek with: the one with the fewest stalks in this bale,
+// so we walk the shortest run and check the others per bunch.
+// Costs two binary searches per condition, a lot cheaper than walking a run
+// of event_type=flow to find the one with some rare src_ip.
+// The first one wins on a tie, so it's deterministic (see searchConditions()).
+// Returns the index in hv, and its run of stalks [lo, hi).
+func (p *Haybale) seekCondition(hv []Haystalk) (int, int, int) {
+	var seek, seek_lo, seek_hi int
+	for i := range hv {
+		lo, hi := p.stalkRange(hv[i])
+		if i == 0 || hi-lo < seek_hi-seek_lo {
+			seek, seek_lo, seek_hi = i, lo, hi
+		}
+		if seek_hi == seek_lo { // can't get better than nothing
+			break
 		}
+	}
 
-		// Check in each Haybale
-		stalks := int(cur_hb.num_haystalks)
+	return seek, seek_lo, seek_hi
+}
 
-		log.Printf("Looking in Haybale %d (%d stalks)", i, stalks)
-
-		/*
-			We do a binary search within the Haybale.
-			The sort.Search (https://pkg.go.dev/sort#Search) function returns
-			the position the key would be (if it exists), or the length of the
-			array if there's no match.
-			We wrap all that in the for loop clause, with a closure.
-			Consequently, for a match, we walk all the matches. Neat!
-		*/
-	haystalk_loop:
-		for j := sort.Search(stalks, func(x int) bool {
-			// Since our data is sorted in ascending order, we search with >=
-			res := (*cur_hb.haystalk[x]).Compare(hv[0])
-			//log.Printf("res=%d", res) // DEBUG
-			if res >= 0 {
-				return true
-			} else {
-				return false
+// The run of stalks equal to hv (dkey, type and value), as [lo, hi)
+func (p *Haybale) stalkRange(hv Haystalk) (int, int) {
+	/*
+		We do a binary search within the Haybale.
+		The sort.Search (https://pkg.go.dev/sort#Search) function returns
+		the position the key would be (if it exists), or the length of the
+		array if there's no match.
+		Since our data is sorted in ascending order, we search with >=
+		for the start of the run, and > for its end.
+	*/
+	stalks := int(p.num_haystalks)
+	lo := sort.Search(stalks, func(x int) bool {
+		return (*p.haystalk[x]).Compare(hv) >= 0
+	})
+	hi := lo + sort.Search(stalks-lo, func(x int) bool {
+		return (*p.haystalk[lo+x]).Compare(hv) > 0
+	})
+
+	return lo, hi
+}
+
+// Walk the stalks [lo, hi) matching hv[seek], and check the other conditions
+// on each bunch (AND clause style)
+func (p *Haybale) searchBaleRange(hv []Haystalk, seek int, lo int, hi int, fn func(first uint32)) {
+haystalk_loop:
+	for j := lo; j < hi; j++ {
+		for k := range hv {
+			if k == seek {
+				continue
 			}
-		}); j < stalks && cur_hb.haystalk[j].Compare(hv[0]) == 0; j++ {
-			// ----
-			if len(hv) > 1 {
-				//log.Printf("Part match: checking additional conditions")
-
-				// Here we check for additional conditions (AND clause style)
-				for k := 1; k < len(hv); k++ { // from 1: 2nd key/val onward
-					cur_hv := hv[k]
-
-					found := false
-					for andi := cur_hb.haystalk[j].first_ofs; !found && andi != haystalk_ofs_nil; andi = cur_hb.haystalk[andi].next_ofs {
-						if cur_hb.haystalk[andi].Compare(cur_hv) == 0 {
-							found = true
-						}
-					}
-					if !found { // No match for this entry, so we can shortcut out
-						continue haystalk_loop
-					}
+			cur_hv := hv[k]
+
+			found := false
+			for andi := p.haystalk[j].first_ofs; !found && andi != haystalk_ofs_nil; andi = p.haystalk[andi].next_ofs {
+				if p.haystalk[andi].Compare(cur_hv) == 0 {
+					found = true
 				}
-			} /* else {
-				//log.Printf("No additional conditions")
-			}*/
+			}
+			if !found { // No match for this entry, so we can shortcut out
+				continue haystalk_loop
+			}
+		}
 
-			// ----
+		fn(p.haystalk[j].first_ofs)
+	}
+}
 
-			// Got a match!
-			matches++
+// Get one bunch as key/value map
+func (p *Haybale) bunchMap(d *Dictionary, first uint32) map[string]string {
+	// Now it gets funky...
+	// Go to first entry of this bunch, which is the _timestamp,
+	// then walk the rest of the bunch.
+	// If a key occurs more than once, the first one wins (like bunchJSON()).
+	bunch := make(map[string]string)
+	for k := first; k != haystalk_ofs_nil; k = p.haystalk[k].next_ofs {
+		key := *d.dkey[p.haystalk[k].dkey]
+		if _, seen := bunch[key]; !seen {
+			bunch[key] = p.haystalk[k].val.String()
+		}
+	}
 
-			// Now it gets funky...
-			// Go to first entry of this bunch, which is the _timestamp,
-			// then walk the rest of the bunch.
-			bunch := make(map[string]string)
-			var vs string
-			for k := cur_hb.haystalk[j].first_ofs; k != haystalk_ofs_nil; k = cur_hb.haystalk[k].next_ofs {
-				switch cur_hb.haystalk[k].val.valtype {
-				case valtype_int:
-					vs = fmt.Sprintf("%d", cur_hb.haystalk[k].val.GetInt())
-				case valtype_float:
-					vs = fmt.Sprintf("%f", cur_hb.haystalk[k].val.GetFloat())
-				case valtype_string:
-					vs = *cur_hb.haystalk[k].val.GetString()
-				}
+	return bunch
+}
 
-				bunch[*p.Dict.dkey[cur_hb.haystalk[k].dkey]] = vs
-			}
+// Print one bunch as JSON to stdout
+func (p *Haybale) printBunch(d *Dictionary, first uint32) {
+	p.writeBunch(os.Stdout, d, first)
+}
+
+// Write one bunch as JSON, on one line
+func (p *Haybale) writeBunch(w io.Writer, d *Dictionary, first uint32) error {
+	bunch_json, err := p.bunchJSON(d, first)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(bunch_json, '\n'))
+	return err
+}
+
+// One bunch as a JSON object, fields in chain order: _timestamp first, then
+// the rest as they were inserted (sorted by key, see InsertBunch()).
+// A Go map would be marshalled in whatever order, which is no good for diffs.
+// If a key occurs more than once, the first one wins (like FieldInBunch()).
+func (p *Haybale) bunchJSON(d *Dictionary, first uint32) ([]byte, error) {
+	buf := make([]byte, 0, 1024)
+	seen := make(map[uint32]bool)
+
+	buf = append(buf, '{')
+	for k := first; k != haystalk_ofs_nil; k = p.haystalk[k].next_ofs {
+		dkey := p.haystalk[k].dkey
+		if seen[dkey] {
+			continue
+		}
+		seen[dkey] = true
 
-			bunch_json, _ := json.Marshal(bunch)
-			fmt.Println(string(bunch_json))
+		key, err := json.Marshal(*d.dkey[dkey])
+		if err != nil {
+			return nil, err
 		}
+		val, err := json.Marshal(p.haystalk[k].val.String())
+		if err != nil {
+			return nil, err
+		}
+
+		if len(buf) > 1 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, key...)
+		buf = append(buf, ':')
+		buf = append(buf, val...)
 	}
+	buf = append(buf, '}')
 
-	duration := time.Since(start)
-	log.Printf("%d matches, duration: %v", matches, duration)
+	return buf, nil
 }
 
-func (p *Haystack) SearchKeyVal(ks string, v string) {
-	var matches uint
-	var val Val
+// Find bunches where any key has the value, e.g. an IP address in src_ip,
+// dest_ip, dns.answer or whatever. Handy for IOC hunting.
+// Each Haybale is sorted by dkey then value, so we do a binary search for
+// each key in the Dictionary, rather than look at every stalk.
+// The _timestamp key is skipped.
+func (p *Haystack) SearchAnyKeyValue(value string) ([]map[string]string, error) {
+	res := make([]map[string]string, 0)
+
+	p.RLock()
+	defer p.RUnlock()
+
+	ts_dkey, _ := p.Dict.KeyExists(Timestamp_key)
+	val := searchVal(&p.Dict, "", value)
+
+	// One condition per key, with the same value.
+	// Only the slots in use, the table can be mostly empty.
+	hvs := make([][]Haystalk, 0, p.Dict.num_dkeys)
+	for _, dkey := range p.Dict.used {
+		if dkey == ts_dkey {
+			continue
+		}
+		hvs = append(hvs, []Haystalk{{dkey: dkey, val: val}})
+	}
 
-	log.Printf("Searching for key %s = %s", ks, v)
+	for _, hb := range p.Haybale {
+		hb.searchBaleAny(hvs, func(first uint32) {
+			res = append(res, hb.bunchMap(&p.Dict, first))
+		})
+	}
 
-	// Start the clock
-	start := time.Now()
+	return res, nil
+}
 
-	dkey, found := p.Dict.KeyExists(ks)
-	if !found {
-		log.Printf("Key '%s' not present in dataset", ks)
-		return
+// Find bunches where key has any of the values, like dest_port IN (80,443,8080).
+// The key is the same for all, so that's a binary search per value:
+// roughly len(values) * log(stalks) per Haybale.
+// Only equality, values are typed like in the other searches.
+func (p *Haystack) SearchKeyValIn(key string, values []string) ([]map[string]string, error) {
+	res := make([]map[string]string, 0)
+
+	if len(values) == 0 {
+		return nil, fmt.Errorf("no values to search for key '%s'", key)
 	}
 
-	// Figure out what type our value is (int, float or string)
-	if i, err := strconv.Atoi(v); err == nil {
-		val.SetInt(int64(i))
-	} else if f, err := strconv.ParseFloat(v, 64); err == nil {
-		val.SetFloat(f)
-	} else {
-		// Not an int or float format, we'll make it a string then.
-		val.SetString(&v)
+	p.RLock()
+	defer p.RUnlock()
+
+	dkey, found := p.Dict.KeyExists(key)
+	if !found { // Nothing can match
+		return res, nil
 	}
 
-	// Run through all Haybales
-	for i := range p.Haybale {
-		cur_hb := p.Haybale[i]
+	hvs := make([][]Haystalk, 0, len(values))
+	for _, v := range values {
+		hvs = append(hvs, []Haystalk{{dkey: dkey, val: searchVal(&p.Dict, key, v)}})
+	}
 
-		// Make sure the bale is sorted
-		//cur_hb.SortBale()		// DEBUG - not any more for normal ops
-		if !cur_hb.is_sorted_immutable { // So obviously this should never happen.
-			panic("Haybale is not sorted, we can't search that!")
-		}
+	for _, hb := range p.Haybale {
+		hb.searchBaleAny(hvs, func(first uint32) {
+			res = append(res, hb.bunchMap(&p.Dict, first))
+		})
+	}
 
-		// Check in each Haybale
-		stalks := int(cur_hb.num_haystalks)
+	return res, nil
+}
 
-		log.Printf("Looking in Haybale %d (%d stalks)", i, stalks)
+// Search a (sorted) Haybale for bunches matching any of the condition sets
+// in hvs (OR of ANDs), see searchBale(). A bunch matching more than one set
+// is passed to fn once. fn is called in bunch order.
+func (p *Haybale) searchBaleAny(hvs [][]Haystalk, fn func(first uint32)) {
+	found := make(map[uint32]bool)
+	for _, hv := range hvs {
+		p.searchBale(hv, func(first uint32) {
+			found[first] = true
+		})
+	}
 
-		/*
-			We do a binary search within the Haybale.
-			The sort.Search function returns the position the key would be (if it exists)
-			or the length of the array if there's no match.
-			We wrap all that in the for loop clause, with a closure.
-			Consequently, for a match, we walk all the matches. Neat!
-		*/
-		for j := sort.Search(stalks, func(x int) bool {
-			// TODO: use the HayStalk.Compare* functions here
+	firsts := make([]uint32, 0, len(found))
+	for first := range found {
+		firsts = append(firsts, first)
+	}
+	sort.Slice(firsts, func(i, j int) bool { return firsts[i] < firsts[j] })
 
-			hsx := cur_hb.haystalk[x]
+	for _, first := range firsts {
+		fn(first)
+	}
+}
 
-			// First, find matching dkey
-			if hsx.dkey > dkey {
-				return true
-			} else if hsx.dkey < dkey {
-				return false
-			}
+// Find bunches that have the key, whatever its value, e.g. all records with a tls.sni.
+// Bales are sorted by dkey first, so that's a binary search to the first stalk
+// with the key, and the rest follow. A bunch with the key more than once is
+// returned once.
+func (p *Haystack) SearchKeyPresent(key string) ([]map[string]string, error) {
+	res := make([]map[string]string, 0)
 
-			// dkey equal, so search on valtype
-			if hsx.val.valtype > val.valtype {
-				return true
-			} else if hsx.val.valtype < val.valtype {
-				return false
-			}
+	p.RLock()
+	defer p.RUnlock()
 
-			// valtype also equal, so now search on value
-			switch hsx.val.valtype {
-			case valtype_int:
-				return hsx.val.GetInt() >= val.intval
-			case valtype_float:
-				return hsx.val.GetFloat() >= val.floatval
-			case valtype_string:
-				return *hsx.val.GetString() >= *val.stringval
-			default:
-				return true // This shouldn't happen
-			}
-		}); j < stalks && cur_hb.haystalk[j].dkey == dkey && cur_hb.haystalk[j].val.valtype == val.valtype; j++ {
-			// TODO: Use the HayStalk.Compare* functions here?
-
-			// Check the key value again here, so we can drop out when there are no more matches
-			var s string
-			switch cur_hb.haystalk[j].val.valtype {
-			case valtype_int:
-				s = fmt.Sprintf("%d", cur_hb.haystalk[j].val.GetInt())
-			case valtype_float:
-				s = fmt.Sprintf("%f", cur_hb.haystalk[j].val.GetFloat())
-			case valtype_string:
-				s = *cur_hb.haystalk[j].val.GetString()
-			}
-			if v != s { // Not a matching key value
-				break
+	dkey, found := p.Dict.KeyExists(key)
+	if !found { // Nothing can match
+		return res, nil
+	}
+
+	for _, hb := range p.Haybale {
+		stalks := int(hb.num_haystalks)
+
+		// Stalks with the same dkey are sorted by value, not bunch, so a
+		// repeated key can turn up anywhere in the run
+		found := make(map[uint32]bool)
+		firsts := make([]uint32, 0)
+		for j := sort.Search(stalks, func(x int) bool {
+			return hb.haystalk[x].dkey >= dkey
+		}); j < stalks && hb.haystalk[j].dkey == dkey; j++ {
+			first := hb.haystalk[j].first_ofs
+			if !found[first] {
+				found[first] = true
+				firsts = append(firsts, first)
 			}
+		}
+		sort.Slice(firsts, func(i, j int) bool { return firsts[i] < firsts[j] })
 
-			// Got a match!
-			matches++
+		for _, first := range firsts {
+			res = append(res, hb.bunchMap(&p.Dict, first))
+		}
+	}
 
-			// Now it gets funky...
-			// Go to first entry of this bunch, which is the _timestamp,
-			// then walk the rest of the bunch.
-			bunch := make(map[string]string)
-			var spotted = false // Just a precaution against bugs
-			for k := cur_hb.haystalk[j].first_ofs; k != haystalk_ofs_nil; k = cur_hb.haystalk[k].next_ofs {
-				// Find our specific key
-				if cur_hb.haystalk[k].dkey == dkey {
-					spotted = true
-				}
+	return res, nil
+}
 
-				switch cur_hb.haystalk[k].val.valtype {
-				case valtype_int:
-					s = fmt.Sprintf("%d", cur_hb.haystalk[k].val.GetInt())
-				case valtype_float:
-					s = fmt.Sprintf("%f", cur_hb.haystalk[k].val.GetFloat())
-				case valtype_string:
-					s = *cur_hb.haystalk[k].val.GetString()
-				}
+// Figure out what type a search value is (time, int, float or string), like insert does.
+// Only _timestamp is stored as time, when it could be parsed.
+func searchVal(d *Dictionary, ks string, v string) Val {
+	var val Val
+
+	if ts, ok := parseTimestamp(v); ok && d.isTimestampKey(ks) {
+		val.SetTime(ts)
+	} else if num, ok := parseNumber(v); ok { // typed like InsertBunch() does
+		val = num
+	} else {
+		// Not an int or float format, we'll make it a string then.
+		vs := v // So the compiler allocates a new string
+		val.SetString(&vs)
+	}
+
+	return val
+}
+
+// Find bunches where the value of keyA compares to the value of keyB with op
+// (==, !=, <, <=, >, >=), e.g. "bytes_toserver > bytes_toclient".
+// Values are compared with Haystalk.CompareValueOnly(), so across types.
+// Bunches missing either key, or where the values can't be compared, are skipped.
+//
+// Note that this is a full scan of all stalks for keyA, it can't use the
+// sort order of the Haybales. See SearchFieldCompareFiltered() to narrow it down.
+func (p *Haystack) SearchFieldCompare(keyA string, op string, keyB string) ([]map[string]string, error) {
+	return p.SearchFieldCompareFiltered(keyA, op, keyB, nil)
+}
+
+// Same as SearchFieldCompare(), but only for bunches that also match all
+// key/value pairs in kv_array (may be nil). That part uses the regular
+// (binary) search, so it's a lot cheaper than the full scan.
+func (p *Haystack) SearchFieldCompareFiltered(keyA string, op string, keyB string, kv_array map[string]string) ([]map[string]string, error) {
+	match_op, err := fieldCompareOp(op)
+	if err != nil {
+		return nil, err
+	}
+
+	p.RLock()
+	defer p.RUnlock()
+
+	res := make([]map[string]string, 0)
 
-				bunch[*p.Dict.dkey[cur_hb.haystalk[k].dkey]] = s
+	dkeyA, foundA := p.Dict.KeyExists(keyA)
+	dkeyB, foundB := p.Dict.KeyExists(keyB)
+	if !foundA || !foundB { // Nothing can match
+		return res, nil
+	}
+
+	var hv []Haystalk
+	if len(kv_array) > 0 {
+		var found bool
+		if hv, found = p.Dict.searchConditions(kv_array); !found {
+			return res, nil
+		}
+	}
+
+	for i := range p.Haybale {
+		cur_hb := p.Haybale[i]
+
+		check := func(first uint32) {
+			va, okA := cur_hb.FieldInBunch(first, dkeyA)
+			vb, okB := cur_hb.FieldInBunch(first, dkeyB)
+			if !okA || !okB {
+				return
 			}
 
-			if !spotted { // This shouldn't happen
-				panic("Key not found in selected bunch!?")
+			a := Haystalk{val: *va}
+			b := Haystalk{val: *vb}
+			if cmp, ok := a.CompareValueOnly(&b); ok && match_op(cmp) {
+				res = append(res, cur_hb.bunchMap(&p.Dict, first))
 			}
+		}
+
+		if hv != nil {
+			cur_hb.searchBale(hv, check)
+			continue
+		}
 
-			bunch_json, _ := json.Marshal(bunch)
-			fmt.Println(string(bunch_json))
+		// No filter: walk all stalks with keyA. Bales are sorted by dkey first,
+		// so those are all together.
+		stalks := int(cur_hb.num_haystalks)
+		for j := sort.Search(stalks, func(x int) bool {
+			return cur_hb.haystalk[x].dkey >= dkeyA
+		}); j < stalks && cur_hb.haystalk[j].dkey == dkeyA; j++ {
+			first := cur_hb.haystalk[j].first_ofs
+
+			// A bunch with keyA more than once would otherwise be checked (and returned) again,
+			// so only go with the occurrence that FieldInBunch() also picks.
+			if va, _ := cur_hb.FieldInBunch(first, dkeyA); va != &cur_hb.haystalk[j].val {
+				continue
+			}
+			check(first)
 		}
 	}
 
-	duration := time.Since(start)
-	log.Printf("%d matches, duration: %v", matches, duration)
+	return res, nil
+}
+
+// Turn a comparison operator into a check on a Compare result
+func fieldCompareOp(op string) (func(cmp int) bool, error) {
+	switch op {
+	case "==", "=":
+		return func(cmp int) bool { return cmp == 0 }, nil
+	case "!=":
+		return func(cmp int) bool { return cmp != 0 }, nil
+	case "<":
+		return func(cmp int) bool { return cmp < 0 }, nil
+	case "<=":
+		return func(cmp int) bool { return cmp <= 0 }, nil
+	case ">":
+		return func(cmp int) bool { return cmp > 0 }, nil
+	case ">=":
+		return func(cmp int) bool { return cmp >= 0 }, nil
+	default:
+		return nil, fmt.Errorf("unknown comparison operator '%s'", op)
+	}
+}
+
+func (p *Haystack) SearchKeyVal(ks string, v string) {
+	if _, err := p.SearchKeyValTo(ks, v, os.Stdout); err != nil {
+		log.Printf("Search: %v", err)
+	}
+}
+
+// Search for bunches where key ks has value v, write them to w as NDJSON.
+// That's SearchKeyValArrayTo() with one condition. Returns the number of matches.
+func (p *Haystack) SearchKeyValTo(ks string, v string, w io.Writer) (uint, error) {
+	return p.SearchKeyValArrayTo(map[string]string{ks: v}, w)
 }
 
 // EOF
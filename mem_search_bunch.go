@@ -0,0 +1,236 @@
+// OpenActa/Haystack - search results as Bunch structs
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	A map[string]string per result is a map, plus a string for every value
+	that isn't one already. Fine for a few results, but a consumer going
+	through millions of them spends most of its time allocating.
+
+	SearchKeyValArrayBunches() hands each match to a callback as a Bunch:
+	the dkeys and values of its stalks, and the Dictionary to look the keys
+	up in. The same Bunch (and its Fields slice) is used for every match,
+	so after the first few nothing gets allocated. The catch: it's only
+	valid during the callback, the values point into the Haybale. Copy what
+	you need to keep (Map() does that).
+
+	Int(), Float(), String() and Time() get a field as that type, converted
+	the way the Compare functions do: a string "443" is int 443, an int is
+	a float, "0x1bb" is 443 with config hex_numbers. Time() takes what an
+	inserted _timestamp does. Not there, or doesn't convert: false.
+*/
+
+package haystack
+
+import (
+	"log"
+	"math"
+	"strconv"
+	"time"
+)
+
+// One field of a Bunch. Val points into the Haybale, don't change it.
+type BunchField struct {
+	Dkey uint32
+	Val  *Val
+}
+
+// A bunch (record), in chain order: _timestamp first, then the rest
+type Bunch struct {
+	Dict   *Dictionary
+	Fields []BunchField
+}
+
+// Name of field i
+func (b *Bunch) Key(i int) string {
+	return *b.Dict.dkey[b.Fields[i].Dkey]
+}
+
+// Value of the field with this key. If the bunch has the key more than
+// once, the first one wins (like FieldInBunch()).
+func (b *Bunch) Field(name string) (*Val, bool) {
+	dkey, found := b.Dict.KeyExists(name)
+	if !found {
+		return nil, false
+	}
+
+	for i := range b.Fields {
+		if b.Fields[i].Dkey == dkey {
+			return b.Fields[i].Val, true
+		}
+	}
+
+	return nil, false
+}
+
+// A copy that outlives the callback, same as the other searches return
+func (b *Bunch) Map() map[string]string {
+	m := make(map[string]string, len(b.Fields))
+	for i := range b.Fields {
+		m[b.Key(i)] = b.Fields[i].Val.String()
+	}
+
+	return m
+}
+
+// Field as an int. A float only if it's a whole number that fits.
+func (b *Bunch) Int(name string) (int64, bool) {
+	v, found := b.Field(name)
+	if !found {
+		return 0, false
+	}
+
+	switch v.valtype {
+	case valtype_int:
+		return v.GetInt(), true
+
+	case valtype_float:
+		return floatToInt(v.GetFloat())
+
+	case valtype_string:
+		if i, err := strconv.ParseInt(*v.GetString(), 10, 64); err == nil {
+			return i, true
+		}
+		if i, ok := parseHex(*v.GetString()); ok {
+			return i, true
+		}
+		if f, err := strconv.ParseFloat(*v.GetString(), 64); err == nil {
+			return floatToInt(f)
+		}
+	}
+
+	return 0, false
+}
+
+func floatToInt(f float64) (int64, bool) {
+	if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, false
+	}
+
+	return int64(f), true
+}
+
+// Field as a float
+func (b *Bunch) Float(name string) (float64, bool) {
+	v, found := b.Field(name)
+	if !found {
+		return 0, false
+	}
+
+	switch v.valtype {
+	case valtype_int:
+		return float64(v.GetInt()), true
+
+	case valtype_float:
+		return v.GetFloat(), true
+
+	case valtype_string:
+		if f, err := strconv.ParseFloat(*v.GetString(), 64); err == nil {
+			return f, true
+		}
+		if i, ok := parseHex(*v.GetString()); ok {
+			return float64(i), true
+		}
+	}
+
+	return 0, false
+}
+
+// Field as a string, same as Map() has it. Anything converts.
+func (b *Bunch) String(name string) (string, bool) {
+	v, found := b.Field(name)
+	if !found {
+		return "", false
+	}
+
+	return v.String(), true
+}
+
+// Field as a time (UTC). Other than a time value, whatever parseTimestamp()
+// takes: RFC3339 and friends, or Unix seconds/millisecs/... by magnitude.
+func (b *Bunch) Time(name string) (time.Time, bool) {
+	v, found := b.Field(name)
+	if !found {
+		return time.Time{}, false
+	}
+
+	if v.valtype == valtype_time {
+		return time.Unix(0, v.GetTime()).UTC(), true
+	}
+
+	ns, ok := parseTimestamp(v.String())
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, ns).UTC(), true
+}
+
+// Set b to the bunch starting at first, reusing its Fields
+func (p *Haybale) fillBunch(b *Bunch, d *Dictionary, first uint32) {
+	b.Dict = d
+	b.Fields = b.Fields[:0]
+	for k := first; k != haystalk_ofs_nil; k = p.haystalk[k].next_ofs {
+		b.Fields = append(b.Fields, BunchField{Dkey: p.haystalk[k].dkey, Val: &p.haystalk[k].val})
+	}
+}
+
+// Search for bunches matching all key/value pairs, call fn with each.
+// The Bunch is reused, only valid until fn returns, see the top of this file.
+// We stop at the first error from fn, and return it. Returns the number of matches.
+func (p *Haystack) SearchKeyValArrayBunches(kv_array map[string]string, fn func(b *Bunch) error) (uint, error) {
+	var ferr error
+	var bunch Bunch
+
+	stats := newSearchStats()
+	defer stats.log()
+
+	p.RLock()
+	defer p.RUnlock()
+
+	hv, found := p.Dict.searchConditions(kv_array)
+	if !found {
+		return 0, nil
+	}
+
+	for i, hb := range p.Haybale {
+		if !hb.is_sorted_immutable {
+			log.Printf("Haybale %d is not sorted, we can't search that!", i)
+			stats.skipped++
+			continue
+		}
+
+		debugf("Looking in Haybale %d (%d stalks)", i, hb.num_haystalks)
+		stats.bales++
+
+		hb.searchBale(hv, func(first uint32) {
+			if ferr != nil {
+				return
+			}
+
+			stats.matches++
+			hb.fillBunch(&bunch, &p.Dict, first)
+			ferr = fn(&bunch)
+		})
+		if ferr != nil {
+			return stats.matches, ferr
+		}
+	}
+
+	return stats.matches, nil
+}
+
+// EOF
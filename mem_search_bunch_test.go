@@ -0,0 +1,197 @@
+// OpenActa/Haystack - search results as Bunch structs - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The maps the other searches would return
+func searchMaps(hs *Haystack, kv map[string]string) []map[string]string {
+	var res []map[string]string
+
+	hv, found := hs.Dict.searchConditions(kv)
+	if !found {
+		return res
+	}
+	for _, hb := range hs.Haybale {
+		hb.searchBale(hv, func(first uint32) {
+			res = append(res, hb.bunchMap(&hs.Dict, first))
+		})
+	}
+
+	return res
+}
+
+func TestSearchKeyValArrayBunches(t *testing.T) {
+	setTestConfig(t)
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+	kv := map[string]string{"dest_port": "443"}
+	want := searchMaps(hs, kv)
+
+	var got []map[string]string
+	var prev *Bunch
+	matches, err := hs.SearchKeyValArrayBunches(kv, func(b *Bunch) error {
+		if prev != nil && b != prev {
+			t.Errorf("Bunch not reused")
+		}
+		prev = b
+
+		if b.Key(0) != Timestamp_key {
+			t.Errorf("first field %s, want %s", b.Key(0), Timestamp_key)
+		}
+		if v, ok := b.Field("DEST_PORT"); !ok || v.GetInt() != 443 { // keys case-insensitive
+			t.Errorf("dest_port: %v %v", v, ok)
+		}
+		if _, ok := b.Field("no_such_key"); ok {
+			t.Errorf("found a key that's not there")
+		}
+
+		got = append(got, b.Map())
+		return nil
+	})
+	if err != nil || matches != 4 {
+		t.Fatalf("%d matches: %v", matches, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got:\n%v\nwant:\n%v", got, want)
+	}
+
+	// A key that's in the Dictionary, but not in this bunch
+	hb := &Haybale{HaystackPtr: hs}
+	hb.InsertBunch(&hs.Dict, map[string]interface{}{Timestamp_key: "2023-06-05T12:00:00Z", "other": "x"})
+	hb.SortBale()
+	var b Bunch
+	hb.fillBunch(&b, &hs.Dict, hb.haystalk[0].first_ofs)
+	if _, ok := b.Field("dest_port"); ok {
+		t.Errorf("found dest_port in a bunch without it")
+	}
+
+	// Stops at the first error
+	stop := errors.New("enough")
+	matches, err = hs.SearchKeyValArrayBunches(kv, func(b *Bunch) error { return stop })
+	if err != stop || matches != 1 {
+		t.Errorf("%d matches: %v, want 1: %v", matches, err, stop)
+	}
+
+	if matches, err := hs.SearchKeyValArrayBunches(map[string]string{"no_such_key": "1"},
+		func(b *Bunch) error { return nil }); err != nil || matches != 0 {
+		t.Errorf("%d matches: %v", matches, err)
+	}
+}
+
+// Typed fields, converted like Compare does
+func TestBunchTyped(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	var hs Haystack
+	hb := &Haybale{HaystackPtr: &hs}
+	hs.Haybale = append(hs.Haybale, hb)
+	err := hb.InsertBunch(&hs.Dict, map[string]interface{}{
+		Timestamp_key: "2023-06-04T10:00:00Z",
+		"port":        "443",
+		"padded":      "0443", // stays a string
+		"hex":         "0x1bb",
+		"ratio":       "1.5",
+		"whole":       "2.0",
+		"epoch":       "1685872800",
+		"when":        "2023-06-04T10:00:00Z", // not the timestamp: a string
+		"host":        "web01",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hb.SortBale()
+	var b Bunch
+	hb.fillBunch(&b, &hs.Dict, hb.haystalk[0].first_ofs)
+
+	for _, c := range []struct {
+		key  string
+		want int64
+		ok   bool
+	}{
+		{"port", 443, true}, {"padded", 443, true}, {"whole", 2, true}, {"epoch", 1685872800, true},
+		{"ratio", 0, false}, {"hex", 0, false}, {"host", 0, false}, {Timestamp_key, 0, false}, {"nope", 0, false},
+	} {
+		if i, ok := b.Int(c.key); i != c.want || ok != c.ok {
+			t.Errorf("Int(%s) = %d %v, want %d %v", c.key, i, ok, c.want, c.ok)
+		}
+	}
+	config.hex_numbers = true
+	if i, ok := b.Int("hex"); i != 443 || !ok {
+		t.Errorf("Int(hex) with hex_numbers = %d %v", i, ok)
+	}
+
+	if f, ok := b.Float("ratio"); f != 1.5 || !ok {
+		t.Errorf("Float(ratio) = %v %v", f, ok)
+	}
+	if f, ok := b.Float("port"); f != 443 || !ok {
+		t.Errorf("Float(port) = %v %v", f, ok)
+	}
+	if _, ok := b.Float("host"); ok {
+		t.Errorf("Float(host) converted")
+	}
+
+	if s, ok := b.String("port"); s != "443" || !ok {
+		t.Errorf("String(port) = %s %v", s, ok)
+	}
+	if _, ok := b.String("nope"); ok {
+		t.Errorf("String(nope) found")
+	}
+
+	want := time.Date(2023, 6, 4, 10, 0, 0, 0, time.UTC)
+	for _, key := range []string{Timestamp_key, "when", "epoch"} {
+		if ts, ok := b.Time(key); !ts.Equal(want) || !ok || ts.Location() != time.UTC {
+			t.Errorf("Time(%s) = %v %v", key, ts, ok)
+		}
+	}
+	if _, ok := b.Time("host"); ok {
+		t.Errorf("Time(host) converted")
+	}
+}
+
+// The point of it all: no allocations per match, once the Bunch has grown
+func TestSearchKeyValArrayBunchesAllocs(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	hs := testEveHaystack(t, 2000, 500)
+	kv := map[string]string{"event_type": "dns"}
+
+	var matches uint
+	bunch_allocs := testing.AllocsPerRun(5, func() {
+		matches, _ = hs.SearchKeyValArrayBunches(kv, func(b *Bunch) error { return nil })
+	})
+	if matches < 100 {
+		t.Fatalf("only %d matches, not much of a test", matches)
+	}
+	map_allocs := testing.AllocsPerRun(5, func() {
+		searchMaps(hs, kv)
+	})
+
+	if bunch_allocs*10 > map_allocs {
+		t.Errorf("%d matches: %v allocs with Bunch, %v with maps", matches, bunch_allocs, map_allocs)
+	}
+}
+
+// EOF
@@ -0,0 +1,77 @@
+// OpenActa/Haystack - match counts per Haybale
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	Haybales are time slices, and each one knows its first and last
+	_timestamp. So the number of matches per Haybale is a (coarse) time
+	histogram, for an activity chart, without making a map of every match.
+
+	The buckets are as wide as the Haybales are, which depends on how
+	they were filled: per ingest batch, or merged. Don't expect them to be
+	the same width, or to not overlap.
+*/
+
+package haystack
+
+import (
+	"fmt"
+	"sort"
+)
+
+type BaleCount struct {
+	Haybale   int   // index in the Haystack
+	TimeFirst int64 // _timestamp range of the Haybale (Unix nanosecs)
+	TimeLast  int64
+	Matches   uint
+}
+
+// Count the bunches matching all key/value pairs, per Haybale.
+// Only Haybales with matches, by TimeFirst (then index).
+// All Haybales must be sorted, the counts would be wrong otherwise.
+func (p *Haystack) CountByBale(kv_array map[string]string) ([]BaleCount, error) {
+	res := make([]BaleCount, 0)
+
+	p.RLock()
+	defer p.RUnlock()
+
+	for i, hb := range p.Haybale {
+		if !hb.is_sorted_immutable && hb.num_haystalks > 0 {
+			return nil, fmt.Errorf("Haybale %d is not sorted, can't count in it", i)
+		}
+	}
+
+	hv, found := p.Dict.searchConditions(kv_array)
+	if !found {
+		return res, nil
+	}
+
+	for i, hb := range p.Haybale {
+		var matches uint
+		hb.searchBale(hv, func(first uint32) {
+			matches++
+		})
+		if matches > 0 {
+			res = append(res, BaleCount{Haybale: i, TimeFirst: hb.time_first, TimeLast: hb.time_last, Matches: matches})
+		}
+	}
+
+	sort.SliceStable(res, func(i, j int) bool { return res[i].TimeFirst < res[j].TimeFirst })
+
+	return res, nil
+}
+
+// EOF
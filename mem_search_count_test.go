@@ -0,0 +1,68 @@
+// OpenActa/Haystack - match counts per Haybale - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import "testing"
+
+func TestCountByBale(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	hs := testEveHaystack(t, 500, 100)
+	kv := map[string]string{"event_type": "flow"}
+
+	counts, err := hs.CountByBale(kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) == 0 {
+		t.Fatalf("no Haybales with matches")
+	}
+
+	var total uint
+	for i, c := range counts {
+		hb := hs.Haybale[c.Haybale]
+		if c.Matches == 0 || c.TimeFirst != hb.time_first || c.TimeLast != hb.time_last || c.TimeFirst > c.TimeLast {
+			t.Errorf("%+v, Haybale has %d - %d", c, hb.time_first, hb.time_last)
+		}
+		if i > 0 && c.TimeFirst < counts[i-1].TimeFirst {
+			t.Errorf("not in time order: %+v after %+v", c, counts[i-1])
+		}
+		total += c.Matches
+	}
+	if want := hs.CountKeyValArray(kv); total != want {
+		t.Errorf("%d matches over the Haybales, %d in all", total, want)
+	}
+
+	// Nothing matches, or can
+	for _, kv := range []map[string]string{{"event_type": "no_such_type"}, {"no_such_key": "1"}} {
+		if counts, err := hs.CountByBale(kv); err != nil || len(counts) != 0 {
+			t.Errorf("%v: %v %v", kv, counts, err)
+		}
+	}
+
+	// Unsorted: no count, rather than a wrong one
+	hb := &Haybale{HaystackPtr: hs}
+	hb.InsertBunch(&hs.Dict, map[string]interface{}{Timestamp_key: "2023-06-05T12:00:00Z", "event_type": "flow"})
+	hs.Haybale = append(hs.Haybale, hb)
+	if _, err := hs.CountByBale(kv); err == nil {
+		t.Errorf("counted in an unsorted Haybale")
+	}
+}
+
+// EOF
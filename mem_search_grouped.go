@@ -0,0 +1,49 @@
+// OpenActa/Haystack - search results grouped by a key
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import "fmt"
+
+// Bucket for the matches that don't have the group key at all
+const Group_missing = ""
+
+// Search for bunches matching all key/value pairs, grouped by the value of
+// key group_by (as text, like the maps have it). Bunches without group_by go
+// under Group_missing. Within a group, matches are in search order.
+func (p *Haystack) SearchGrouped(kv_array map[string]string, group_by string) (map[string][]map[string]string, error) {
+	if group_by == "" || len(group_by) > max_keylen {
+		return nil, fmt.Errorf("invalid group key '%.32s', must be 1-%d chars", group_by, max_keylen)
+	}
+
+	groups := make(map[string][]map[string]string)
+	_, err := p.SearchKeyValArrayBunches(kv_array, func(b *Bunch) error {
+		group := Group_missing
+		if v, ok := b.Field(group_by); ok {
+			group = v.String()
+		}
+		groups[group] = append(groups[group], b.Map())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+// EOF
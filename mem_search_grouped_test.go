@@ -0,0 +1,85 @@
+// OpenActa/Haystack - search results grouped by a key - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSearchGrouped(t *testing.T) {
+	setTestConfig(t)
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+	kv := map[string]string{"dest_port": "443"}
+
+	// The flow records have app_proto, the tls ones don't
+	groups, err := hs.SearchGrouped(kv, "APP_PROTO") // keys case-insensitive
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 || len(groups["tls"]) != 2 || len(groups[Group_missing]) != 2 {
+		t.Fatalf("groups: %v", groups)
+	}
+	for _, r := range groups["tls"] {
+		if r["app_proto"] != "tls" || r["event_type"] != "flow" {
+			t.Errorf("in group tls: %v", r)
+		}
+	}
+	for _, r := range groups[Group_missing] {
+		if _, ok := r["app_proto"]; ok {
+			t.Errorf("in group missing: %v", r)
+		}
+	}
+
+	// Same matches as the plain search, whatever the grouping
+	want := searchMaps(hs, kv)
+	groups, err = hs.SearchGrouped(kv, "event_type")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int
+	for group, res := range groups {
+		total += len(res)
+		for _, r := range res {
+			if r["event_type"] != group {
+				t.Errorf("in group %s: %v", group, r)
+			}
+		}
+	}
+	if total != len(want) {
+		t.Errorf("%d grouped matches, %d without", total, len(want))
+	}
+
+	// A key nobody has: all in the one bucket
+	if groups, err := hs.SearchGrouped(kv, "no_such_key"); err != nil || len(groups) != 1 || len(groups[Group_missing]) != len(want) {
+		t.Errorf("no_such_key: %v %v", groups, err)
+	}
+
+	if groups, err := hs.SearchGrouped(map[string]string{"dest_port": "22"}, "event_type"); err != nil || len(groups) != 0 {
+		t.Errorf("no matches: %v %v", groups, err)
+	}
+
+	for _, key := range []string{"", strings.Repeat("k", max_keylen+1)} {
+		if _, err := hs.SearchGrouped(kv, key); err == nil {
+			t.Errorf("group key of %d chars, no error", len(key))
+		}
+	}
+}
+
+// EOF
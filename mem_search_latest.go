@@ -0,0 +1,125 @@
+// OpenActa/Haystack - the latest bunches
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	The newest N bunches, no conditions: a "latest events" panel.
+
+	Haybales know their time range, so we go from the one with the newest
+	time_last back, and stop at a Haybale whose time_last is older than
+	the N we already have. Usually that's only the last Haybale or two.
+
+	In a sorted Haybale the _timestamp stalks of the bunches are at the
+	end of the _timestamp run, in time order, so we take them from the
+	back. An unsorted one (still being filled) we look through.
+*/
+
+package haystack
+
+import (
+	"fmt"
+	"sort"
+)
+
+type latestBunch struct {
+	hb    *Haybale
+	first uint32
+	ts    int64
+}
+
+// Up to n bunches of the Haybale, newest first, as latestBunch
+func (p *Haybale) latestBunches(ts_dkey uint32, n uint) []latestBunch {
+	res := make([]latestBunch, 0)
+	stalks := int(p.num_haystalks)
+
+	if !p.is_sorted_immutable {
+		for i := 0; i < stalks; i++ {
+			s := p.haystalk[i]
+			if s.first_ofs == uint32(i) && s.val.valtype == valtype_time {
+				res = append(res, latestBunch{hb: p, first: uint32(i), ts: s.val.intval})
+			}
+		}
+		sort.SliceStable(res, func(i, j int) bool { return res[i].ts > res[j].ts })
+		if uint(len(res)) > n {
+			res = res[:n]
+		}
+		return res
+	}
+
+	// Time is the last value type, so those stalks end the run
+	lo := sort.Search(stalks, func(x int) bool { return p.haystalk[x].dkey >= ts_dkey })
+	hi := sort.Search(stalks, func(x int) bool { return p.haystalk[x].dkey > ts_dkey })
+	for j := hi - 1; j >= lo && uint(len(res)) < n; j-- {
+		s := p.haystalk[j]
+		if s.val.valtype != valtype_time {
+			break
+		}
+		if s.first_ofs == uint32(j) {
+			res = append(res, latestBunch{hb: p, first: uint32(j), ts: s.val.intval})
+		}
+	}
+
+	return res
+}
+
+// The n newest bunches by _timestamp, newest first, whatever is in them.
+// Equal timestamps come in the same order every time.
+func (p *Haystack) Latest(n uint) ([]map[string]string, error) {
+	if n == 0 {
+		return nil, fmt.Errorf("asking for the latest 0 bunches")
+	}
+
+	res := make([]map[string]string, 0)
+
+	p.RLock()
+	defer p.RUnlock()
+
+	ts_dkey, found := p.Dict.KeyExists(Timestamp_key)
+	if !found { // Nothing in here
+		return res, nil
+	}
+
+	// Newest Haybales first
+	bales := make([]int, len(p.Haybale))
+	for i := range bales {
+		bales[len(bales)-1-i] = i
+	}
+	sort.SliceStable(bales, func(i, j int) bool {
+		return p.Haybale[bales[i]].time_last > p.Haybale[bales[j]].time_last
+	})
+
+	latest := make([]latestBunch, 0, n)
+	for _, i := range bales {
+		hb := p.Haybale[i]
+		if uint(len(latest)) == n && latest[n-1].ts >= hb.time_last {
+			break // this one and the rest are all older
+		}
+
+		latest = append(latest, hb.latestBunches(ts_dkey, n)...)
+		sort.SliceStable(latest, func(i, j int) bool { return latest[i].ts > latest[j].ts })
+		if uint(len(latest)) > n {
+			latest = latest[:n]
+		}
+	}
+
+	for _, l := range latest {
+		res = append(res, l.hb.bunchMap(&p.Dict, l.first))
+	}
+
+	return res, nil
+}
+
+// EOF
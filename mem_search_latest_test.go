@@ -0,0 +1,90 @@
+// OpenActa/Haystack - the latest bunches - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestLatest(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	hs := testEveHaystack(t, 500, 100)
+
+	// The slow way: every bunch, newest first
+	type tsBunch struct {
+		ts    int64
+		stamp string
+	}
+	all := make([]tsBunch, 0)
+	for _, hb := range hs.Haybale {
+		hb.forEachBunch(func(first uint32) {
+			all = append(all, tsBunch{hb.haystalk[first].val.intval, hb.bunchMap(&hs.Dict, first)[Timestamp_key]})
+		})
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].ts > all[j].ts })
+
+	for _, n := range []uint{1, 7, 150, uint(len(all)), uint(len(all)) + 10} {
+		res, err := hs.Latest(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := int(n)
+		if want > len(all) {
+			want = len(all)
+		}
+		if len(res) != want {
+			t.Fatalf("latest %d: %d bunches, want %d", n, len(res), want)
+		}
+		for i, b := range res {
+			if b[Timestamp_key] != all[i].stamp {
+				t.Errorf("latest %d, #%d: %s, want %s", n, i, b[Timestamp_key], all[i].stamp)
+				break
+			}
+			if len(b) < 2 {
+				t.Errorf("latest %d, #%d: only %v", n, i, b)
+			}
+		}
+	}
+
+	if _, err := hs.Latest(0); err == nil {
+		t.Errorf("latest 0: no error")
+	}
+
+	// One still being filled, with the newest
+	hb := &Haybale{HaystackPtr: hs}
+	hb.InsertBunch(&hs.Dict, map[string]interface{}{Timestamp_key: "2030-01-02T00:00:00Z", "event_type": "newest"})
+	hb.InsertBunch(&hs.Dict, map[string]interface{}{Timestamp_key: "2030-01-01T00:00:00Z", "event_type": "newer"})
+	hs.Haybale = append(hs.Haybale, hb)
+	res, err := hs.Latest(3)
+	if err != nil || len(res) != 3 {
+		t.Fatalf("%v %v", res, err)
+	}
+	if res[0]["event_type"] != "newest" || res[1]["event_type"] != "newer" || res[2][Timestamp_key] != all[0].stamp {
+		t.Errorf("with an unsorted Haybale: %v", res)
+	}
+
+	// Nothing in it
+	if res, err := new(Haystack).Latest(5); err != nil || len(res) != 0 {
+		t.Errorf("empty Haystack: %v %v", res, err)
+	}
+}
+
+// EOF
@@ -0,0 +1,265 @@
+// OpenActa/Haystack - search with numbers normalized
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	The same field can be an int in one Haybale and a string in another:
+	"0443" stays a string (see parseNumber()), older files or other tools
+	may have typed things differently, or a JSON source sends "443" one day
+	and 443 the next. A regular search compares typed values, so port=443
+	only finds the ints.
+
+	SearchKeyValNormalized() compares by number instead, for query values
+	that look like one: ints, floats and strings that parse to the same
+	number all match (443, 443.0, "443", "0443").
+
+	Cost: the ints and floats are still a binary search each, but strings
+	are sorted as strings ("0443" < "1" < "443"), so for every numeric
+	condition we look at all string values of that key, per Haybale.
+	Cheap for a key that's mostly numbers, a scan of the whole key for one
+	that's mostly strings. Use the regular search when types are consistent.
+*/
+
+package haystack
+
+import (
+	"log"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// A condition for SearchKeyValNormalized()
+type normCond struct {
+	hv      Haystalk // dkey, and the value
+	numeric bool     // match by number, hv.val is an int or float
+}
+
+// A query value that looks like a number, by any reasonable reading:
+// unlike parseNumber(), "0443" and "1e3" count too. Hex with hex_numbers.
+func numericQueryVal(v string) (Val, bool) {
+	var val Val
+
+	if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+		val.SetInt(i)
+		return val, true
+	}
+	if i, ok := parseHex(v); ok {
+		val.SetInt(i)
+		return val, true
+	}
+	if f, err := strconv.ParseFloat(v, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+		val.SetFloat(f)
+		return val, true
+	}
+
+	return val, false
+}
+
+// Does stalk s match?
+func (c *normCond) match(s *Haystalk) bool {
+	if s.dkey != c.hv.dkey {
+		return false
+	}
+	if !c.numeric {
+		return s.Compare(c.hv) == 0
+	}
+
+	// The cross-type compares, they parse strings as numbers
+	var cmp int
+	var ok bool
+	if c.hv.val.valtype == valtype_int {
+		cmp, ok = s.CompareInt(c.hv.val.intval)
+	} else {
+		cmp, ok = s.CompareFloat(c.hv.val.floatval)
+	}
+
+	return ok && cmp == 0
+}
+
+// The runs of stalks in the Haybale that may match, as [lo, hi) pairs
+func (p *Haybale) normCondRanges(c *normCond) [][2]int {
+	if !c.numeric {
+		lo, hi := p.stalkRange(c.hv)
+		return [][2]int{{lo, hi}}
+	}
+
+	// The number as an int (if it is one) and as a float
+	var as_int, as_float Haystalk
+	as_int.dkey, as_float.dkey = c.hv.dkey, c.hv.dkey
+	ranges := make([][2]int, 0, 3)
+
+	if c.hv.val.valtype == valtype_int {
+		as_int.val = c.hv.val
+		as_float.val.SetFloat(float64(c.hv.val.intval))
+	} else {
+		f := c.hv.val.floatval
+		as_float.val = c.hv.val
+		if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+			as_int.val.SetInt(int64(f))
+		}
+	}
+
+	if as_int.val.valtype == valtype_int {
+		lo, hi := p.stalkRange(as_int)
+		ranges = append(ranges, [2]int{lo, hi})
+	}
+	lo, hi := p.stalkRange(as_float)
+	ranges = append(ranges, [2]int{lo, hi})
+
+	// All the strings of the key, see the cost above
+	lo, hi = p.keyTypeRange(c.hv.dkey, valtype_string)
+	ranges = append(ranges, [2]int{lo, hi})
+
+	return ranges
+}
+
+// The run of stalks with this dkey and value type, as [lo, hi)
+func (p *Haybale) keyTypeRange(dkey uint32, valtype uint8) (int, int) {
+	before := func(s *Haystalk) bool { // sorts before the run
+		return s.dkey < dkey || (s.dkey == dkey && s.val.valtype < valtype)
+	}
+
+	stalks := int(p.num_haystalks)
+	lo := sort.Search(stalks, func(x int) bool {
+		return !before(p.haystalk[x])
+	})
+	hi := lo + sort.Search(stalks-lo, func(x int) bool {
+		s := p.haystalk[lo+x]
+		return s.dkey > dkey || s.val.valtype > valtype
+	})
+
+	return lo, hi
+}
+
+// Search a (sorted) Haybale for bunches matching all conditions.
+// We walk the runs of the condition with the fewest candidate stalks,
+// and check the others on each bunch. fn is called once per bunch, in bunch order.
+func (p *Haybale) searchBaleNormalized(conds []normCond, fn func(first uint32)) {
+	if p.num_haystalks == 0 || len(conds) == 0 {
+		return
+	}
+
+	var seek int
+	var seek_ranges [][2]int
+	seek_len := -1
+	for i := range conds {
+		ranges := p.normCondRanges(&conds[i])
+		n := 0
+		for _, r := range ranges {
+			n += r[1] - r[0]
+		}
+		if seek_len < 0 || n < seek_len {
+			seek, seek_ranges, seek_len = i, ranges, n
+		}
+	}
+
+	// A bunch can match more than once ("443" and 443), so de-dup
+	found := make(map[uint32]bool)
+	for _, r := range seek_ranges {
+	stalk_loop:
+		for j := r[0]; j < r[1]; j++ {
+			if !conds[seek].match(p.haystalk[j]) {
+				continue // one of the strings
+			}
+			first := p.haystalk[j].first_ofs
+			if found[first] {
+				continue
+			}
+
+			for k := range conds {
+				if k == seek {
+					continue
+				}
+				ok := false
+				for andi := first; !ok && andi != haystalk_ofs_nil; andi = p.haystalk[andi].next_ofs {
+					ok = conds[k].match(p.haystalk[andi])
+				}
+				if !ok {
+					continue stalk_loop
+				}
+			}
+
+			found[first] = true
+		}
+	}
+
+	firsts := make([]uint32, 0, len(found))
+	for first := range found {
+		firsts = append(firsts, first)
+	}
+	sort.Slice(firsts, func(i, j int) bool { return firsts[i] < firsts[j] })
+
+	for _, first := range firsts {
+		fn(first)
+	}
+}
+
+// Same as SearchKeyValArray(), AND of all key/value pairs, but values that
+// look like numbers match ints, floats and strings of that number.
+// See the top of this file for what that costs.
+func (p *Haystack) SearchKeyValNormalized(kv_array map[string]string) ([]map[string]string, error) {
+	res := make([]map[string]string, 0)
+
+	p.RLock()
+	defer p.RUnlock()
+
+	hv, found := p.Dict.searchConditions(kv_array) // in key order
+	if !found {
+		return res, nil
+	}
+
+	keys := make([]string, 0, len(kv_array))
+	for ks := range kv_array {
+		keys = append(keys, ks)
+	}
+	sort.Strings(keys)
+
+	conds := make([]normCond, len(hv))
+	for i, ks := range keys {
+		conds[i].hv = hv[i]
+		if p.Dict.isTimestampKey(ks) {
+			continue // times are times
+		}
+		if num, ok := numericQueryVal(kv_array[ks]); ok {
+			conds[i].hv.val = num
+			conds[i].numeric = true
+		}
+	}
+
+	stats := newSearchStats()
+	defer stats.log()
+
+	for i, hb := range p.Haybale {
+		if !hb.is_sorted_immutable {
+			log.Printf("Haybale %d is not sorted, we can't search that!", i)
+			stats.skipped++
+			continue
+		}
+
+		debugf("Looking in Haybale %d (%d stalks)", i, hb.num_haystalks)
+		stats.bales++
+
+		hb.searchBaleNormalized(conds, func(first uint32) {
+			stats.matches++
+			res = append(res, hb.bunchMap(&p.Dict, first))
+		})
+	}
+
+	return res, nil
+}
+
+// EOF
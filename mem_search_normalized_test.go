@@ -0,0 +1,107 @@
+// OpenActa/Haystack - search with numbers normalized - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSearchKeyValNormalized(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	// port as int, as strings that are 443, and some that aren't
+	var hs Haystack
+	for i, rec := range []map[string]interface{}{
+		{"port": "443", "proto": "tcp"},   // int
+		{"port": "0443", "proto": "udp"},  // string
+		{"port": "443.0", "proto": "tcp"}, // string
+		{"port": 443.5, "proto": "tcp"},   // float
+		{"port": "444", "proto": "tcp"},
+		{"port": "https", "proto": "tcp"},
+	} {
+		hb := &Haybale{HaystackPtr: &hs}
+		hs.Haybale = append(hs.Haybale, hb)
+		rec[Timestamp_key] = "2023-06-04T00:00:0" + string(rune('0'+i)) + "Z"
+		if err := hb.InsertBunch(&hs.Dict, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hs.SortAllBales()
+
+	ports := func(res []map[string]string) string {
+		var p []string
+		for _, b := range res {
+			p = append(p, b["port"])
+		}
+		sort.Strings(p)
+		return strings.Join(p, " ")
+	}
+
+	for _, tc := range []struct {
+		kv   map[string]string
+		want string
+	}{
+		{map[string]string{"port": "443"}, "0443 443 443.0"},
+		{map[string]string{"port": "0443"}, "0443 443 443.0"},
+		{map[string]string{"port": "443.0"}, "0443 443 443.0"},
+		{map[string]string{"port": "443.5"}, "443.5"},
+		{map[string]string{"port": "443", "proto": "tcp"}, "443 443.0"},
+		{map[string]string{"port": "https"}, "https"},
+		{map[string]string{"port": "80"}, ""},
+		{map[string]string{"no.such.key": "443"}, ""},
+	} {
+		res, err := hs.SearchKeyValNormalized(tc.kv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ports(res); got != tc.want {
+			t.Errorf("%v: '%s', want '%s'", tc.kv, got, tc.want)
+		}
+	}
+
+	// The regular search only has the int
+	if n := hs.CountKeyValArray(map[string]string{"port": "443"}); n != 1 {
+		t.Errorf("regular search: %d matches", n)
+	}
+}
+
+// Whole bale: same as the regular search where the types are consistent
+func TestSearchKeyValNormalizedSame(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	hs := testEveHaystack(t, 3000, 750)
+	for _, kv := range []map[string]string{
+		{"dest_port": "443"},
+		{"dest_port": "53", "proto": "UDP"},
+		{"event_type": "alert", "dest_port": "80"},
+	} {
+		res, err := hs.SearchKeyValNormalized(kv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := hs.CountKeyValArray(kv); uint(len(res)) != want || want == 0 {
+			t.Errorf("%v: %d matches, regular search %d", kv, len(res), want)
+		}
+	}
+}
+
+// EOF
@@ -0,0 +1,139 @@
+// OpenActa/Haystack - search results in timestamp order, across Haybales
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	The other searches return matches Haybale by Haybale, and within a
+	Haybale in order of whatever condition we seeked with. Sorting all of
+	that by _timestamp afterwards means holding every result (as a map).
+
+	We don't have to. The _timestamp is the first stalk of each bunch, and
+	in a sorted Haybale all _timestamp stalks are together in time order.
+	So a bunch's offset (first_ofs) sorts the same as its timestamp, and
+	per Haybale we only keep the offsets of the matches: 4 bytes each,
+	sorted. Then a k-way merge (a heap with the next match of every
+	Haybale) hands them out oldest first, into a reused Bunch like
+	SearchKeyValArrayBunches(). Equal timestamps in different Haybales
+	come in Haybale order, so it's the same order every time.
+*/
+
+package haystack
+
+import (
+	"container/heap"
+	"log"
+	"sort"
+)
+
+// The sorted matches of one Haybale, and how far we got
+type sortedMatches struct {
+	hb    *Haybale
+	bale  int // index, for ties
+	first []uint32
+	pos   int
+}
+
+// The _timestamp stalk of the next match
+func (m *sortedMatches) head() *Haystalk {
+	return m.hb.haystalk[m.first[m.pos]]
+}
+
+// Min-heap on the next match of each Haybale, see container/heap
+type sortedMerge []*sortedMatches
+
+func (h sortedMerge) Len() int { return len(h) }
+
+func (h sortedMerge) Less(i, j int) bool {
+	if c := h[i].head().Compare(*h[j].head()); c != 0 {
+		return c < 0
+	}
+	return h[i].bale < h[j].bale
+}
+
+func (h sortedMerge) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *sortedMerge) Push(x interface{}) { *h = append(*h, x.(*sortedMatches)) }
+
+func (h *sortedMerge) Pop() interface{} {
+	old := *h
+	m := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return m
+}
+
+// Search for bunches matching all key/value pairs, call fn with each, oldest
+// first over all Haybales. The Bunch is reused, see SearchKeyValArrayBunches().
+// We stop at the first error from fn, and return it. Returns the number of matches.
+func (p *Haystack) SearchKeyValArraySortedStream(kv_array map[string]string, fn func(b *Bunch) error) (uint, error) {
+	var bunch Bunch
+	var matches uint
+
+	stats := newSearchStats()
+	defer stats.log()
+
+	p.RLock()
+	defer p.RUnlock()
+
+	hv, found := p.Dict.searchConditions(kv_array)
+	if !found {
+		return 0, nil
+	}
+
+	merge := make(sortedMerge, 0, len(p.Haybale))
+	for i, hb := range p.Haybale {
+		if !hb.is_sorted_immutable {
+			log.Printf("Haybale %d is not sorted, we can't search that!", i)
+			stats.skipped++
+			continue
+		}
+
+		debugf("Looking in Haybale %d (%d stalks)", i, hb.num_haystalks)
+		stats.bales++
+
+		m := &sortedMatches{hb: hb, bale: i}
+		hb.searchBale(hv, func(first uint32) {
+			m.first = append(m.first, first)
+		})
+		if len(m.first) == 0 {
+			continue
+		}
+		sort.Slice(m.first, func(a, b int) bool { return m.first[a] < m.first[b] })
+
+		stats.matches += uint(len(m.first))
+		merge = append(merge, m)
+	}
+	heap.Init(&merge)
+
+	for merge.Len() > 0 {
+		m := merge[0]
+		m.hb.fillBunch(&bunch, &p.Dict, m.first[m.pos])
+		matches++
+		if err := fn(&bunch); err != nil {
+			return matches, err
+		}
+
+		m.pos++
+		if m.pos < len(m.first) {
+			heap.Fix(&merge, 0)
+		} else {
+			heap.Pop(&merge)
+		}
+	}
+
+	return matches, nil
+}
+
+// EOF
@@ -0,0 +1,91 @@
+// OpenActa/Haystack - search results in timestamp order, across Haybales - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSearchKeyValArraySortedStream(t *testing.T) {
+	setTestConfig(t)
+
+	// Bales that overlap in time, each inserted out of order
+	rng := rand.New(rand.NewSource(1))
+	base := time.Date(2023, 6, 4, 0, 0, 0, 0, time.UTC)
+	hs := new(Haystack)
+	var want []string
+	for b := 0; b < 4; b++ {
+		hb := &Haybale{HaystackPtr: hs}
+		for i := 0; i < 50; i++ {
+			ts := base.Add(time.Duration(rng.Intn(3600)) * time.Second).Format(time.RFC3339)
+			port := "443"
+			if i%3 == 0 {
+				port = "53"
+			} else {
+				want = append(want, ts)
+			}
+			hb.InsertBunch(&hs.Dict, map[string]interface{}{Timestamp_key: ts, "dest_port": port, "bale": fmt.Sprint(b)})
+		}
+		hb.SortBale()
+		hs.Haybale = append(hs.Haybale, hb)
+	}
+	sort.Strings(want) // RFC3339 in UTC sorts as text
+
+	var got []string
+	prev_bale := ""
+	matches, err := hs.SearchKeyValArraySortedStream(map[string]string{"dest_port": "443"}, func(b *Bunch) error {
+		ts, _ := b.Field(Timestamp_key)
+		bale, _ := b.Field("bale")
+		s := time.Unix(0, ts.GetTime()).UTC().Format(time.RFC3339)
+
+		// Same second: lower Haybale first
+		if len(got) > 0 && got[len(got)-1] == s && bale.String() < prev_bale {
+			t.Errorf("%s: Haybale %s after %s", s, bale.String(), prev_bale)
+		}
+		got = append(got, s)
+		prev_bale = bale.String()
+		return nil
+	})
+	if err != nil || matches != uint(len(want)) {
+		t.Fatalf("%d matches, want %d: %v", matches, len(want), err)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("match %d: %s, want %s", i, got[i], want[i])
+		}
+	}
+
+	// Stops at the first error
+	stop := errors.New("enough")
+	matches, err = hs.SearchKeyValArraySortedStream(map[string]string{"dest_port": "443"}, func(b *Bunch) error { return stop })
+	if err != stop || matches != 1 {
+		t.Errorf("%d matches: %v, want 1: %v", matches, err, stop)
+	}
+
+	if matches, err := hs.SearchKeyValArraySortedStream(map[string]string{"dest_port": "22"},
+		func(b *Bunch) error { return nil }); err != nil || matches != 0 {
+		t.Errorf("%d matches: %v", matches, err)
+	}
+}
+
+// EOF
@@ -0,0 +1,574 @@
+// OpenActa/Haystack search - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const test_aes_uuid = "f9800d09-2a20-4ffe-8916-748783c1ea0a"
+
+// Set up config with a known AES key, restored after the test
+func setTestConfig(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+
+	config.aes_keystore_array = nil
+	if err := SetActiveKey(test_aes_uuid, make([]byte, AES_key_byte_len)); err != nil {
+		t.Fatal(err)
+	}
+	config.compression_level = 9
+}
+
+// Ingest a JSON lines file, starting a new Haybale every per_bale bunches
+func newTestHaystack(t testing.TB, fname string, per_bale int) *Haystack {
+	file, err := os.Open(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	hs := new(Haystack)
+
+	var cur_hb *Haybale
+	scanner := bufio.NewScanner(file)
+	for i := 0; scanner.Scan(); i++ {
+		if i%per_bale == 0 {
+			cur_hb = &Haybale{HaystackPtr: hs}
+			hs.Haybale = append(hs.Haybale, cur_hb)
+		}
+
+		flat, err := JSONToKVmap(scanner.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cur_hb.InsertBunch(&hs.Dict, flat)
+	}
+
+	hs.SortAllBales()
+
+	return hs
+}
+
+// Searches and a loader on the same Haystack at the same time (run with -race)
+func TestConcurrentSearchAndLoad(t *testing.T) {
+	setTestConfig(t)
+
+	data, _, err := newTestHaystack(t, "testdata/head5.json", 2).Mem2Disk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hs := new(Haystack)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 10; n++ {
+				hs.SearchKeyValArray(map[string]string{"dest_port": "443", "proto": "TCP"})
+			}
+		}()
+	}
+
+	for n := 0; n < 3; n++ {
+		if err := hs.Disk2Mem(data); err != nil {
+			t.Error(err)
+		}
+	}
+
+	wg.Wait()
+
+	if len(hs.Haybale) != 9 {
+		t.Errorf("loaded %d Haybales, wanted 9", len(hs.Haybale))
+	}
+}
+
+// Field-to-field compare against a brute force check of the same JSON
+func TestSearchFieldCompare(t *testing.T) {
+	const keyA = "flow.bytes_toserver"
+	const keyB = "flow.bytes_toclient"
+
+	// First 2000 lines of eve.json are plenty
+	src, err := os.Open("testdata/eve.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	fname := filepath.Join(t.TempDir(), "eve2000.json")
+	dst, err := os.Create(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want_gt, want_gt_tcp int
+	scanner := bufio.NewScanner(src)
+	for i := 0; i < 2000 && scanner.Scan(); i++ {
+		dst.Write(append(scanner.Bytes(), '\n'))
+
+		var rec struct {
+			Proto string
+			Flow  *struct {
+				Bytes_toserver int64
+				Bytes_toclient int64
+			}
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Flow != nil && rec.Flow.Bytes_toserver > rec.Flow.Bytes_toclient {
+			want_gt++
+			if rec.Proto == "TCP" {
+				want_gt_tcp++
+			}
+		}
+	}
+	dst.Close()
+
+	hs := newTestHaystack(t, fname, 500)
+
+	res, err := hs.SearchFieldCompare(keyA, ">", keyB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != want_gt || want_gt == 0 {
+		t.Errorf("%s > %s: got %d bunches, want %d", keyA, keyB, len(res), want_gt)
+	}
+
+	res, err = hs.SearchFieldCompareFiltered(keyA, ">", keyB, map[string]string{"proto": "TCP"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != want_gt_tcp {
+		t.Errorf("%s > %s with proto=TCP: got %d bunches, want %d", keyA, keyB, len(res), want_gt_tcp)
+	}
+
+	// Missing key: no matches, no error
+	if res, err := hs.SearchFieldCompare(keyA, ">", "no.such.key"); err != nil || len(res) != 0 {
+		t.Errorf("missing key: got %d bunches, err %v", len(res), err)
+	}
+
+	if _, err := hs.SearchFieldCompare(keyA, "<>", keyB); err == nil {
+		t.Errorf("unknown operator accepted")
+	}
+}
+
+func TestSearchKeyValToFile(t *testing.T) {
+	setTestConfig(t)
+	config.datastore_dir = t.TempDir()
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+	kv := map[string]string{"dest_port": "443"}
+
+	matches, err := hs.SearchKeyValToFile(kv, "results.ndjson") // relative: into datastore_dir
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := hs.CountKeyValArray(kv); matches != want || matches == 0 {
+		t.Errorf("%d matches, want %d", matches, want)
+	}
+
+	file, err := os.Open(filepath.Join(config.datastore_dir, "results.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var lines uint
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines++
+
+		var bunch map[string]string
+		if err := json.Unmarshal(scanner.Bytes(), &bunch); err != nil {
+			t.Errorf("line %d: %v", lines, err)
+		} else if bunch["dest_port"] != "443" {
+			t.Errorf("line %d: dest_port %s", lines, bunch["dest_port"])
+		}
+	}
+	if lines != matches {
+		t.Errorf("%d lines in file, %d matches", lines, matches)
+	}
+}
+
+// Same data in, same bytes out: _timestamp first, then the keys in order
+func TestSearchOutputOrder(t *testing.T) {
+	setTestConfig(t)
+
+	kv := map[string]string{"dest_port": "443"}
+
+	var out [2]bytes.Buffer
+	for i := range out {
+		hs := newTestHaystack(t, "testdata/head5.json", 2)
+		if _, err := hs.SearchKeyValArrayTo(kv, &out[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if out[0].Len() == 0 || !bytes.Equal(out[0].Bytes(), out[1].Bytes()) {
+		t.Fatalf("output differs:\n%s\n%s", out[0].String(), out[1].String())
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(out[0].String()), "\n") {
+		// Pick the keys out in order
+		dec := json.NewDecoder(strings.NewReader(line))
+		dec.Token() // {
+		keys := make([]string, 0)
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, tok.(string))
+			dec.Token() // value
+		}
+
+		if keys[0] != Timestamp_key || !sort.StringsAreSorted(keys[1:]) {
+			t.Errorf("keys out of order: %v", keys)
+		}
+	}
+}
+
+// SearchKeyValTo() writes the same ordered lines as SearchKeyValArrayTo()
+func TestSearchKeyValTo(t *testing.T) {
+	setTestConfig(t)
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+
+	var got, want bytes.Buffer
+	n, err := hs.SearchKeyValTo("dest_port", "443", &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want_n, err := hs.SearchKeyValArrayTo(map[string]string{"dest_port": "443"}, &want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 || n != want_n || got.String() != want.String() {
+		t.Errorf("%d matches, want %d\n%s\nwant\n%s", n, want_n, got.String(), want.String())
+	}
+
+	got.Reset()
+	if n, err := hs.SearchKeyValTo("no_such_key", "1", &got); n != 0 || err != nil || got.Len() != 0 {
+		t.Errorf("no_such_key: %d matches, %v, %q", n, err, got.String())
+	}
+
+	// A Haybale that's still being filled (not sorted yet) is no reason to panic
+	unsorted := new(Haystack)
+	hb := &Haybale{HaystackPtr: unsorted}
+	unsorted.Haybale = append(unsorted.Haybale, hb)
+	if err := hb.InsertBunch(&unsorted.Dict, map[string]interface{}{Timestamp_key: "2023-06-04T00:00:00Z", "dest_port": "443"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unsorted.SearchKeyValTo("dest_port", "443", io.Discard); err != nil {
+		t.Errorf("unsorted: %v", err)
+	}
+}
+
+// With keep_all, the first of a duplicate key is what every result shows
+func TestSearchDuplicateKeyFirstWins(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	config.duplicate_key_policy = duplicate_key_policy_keep_all
+
+	flat, err := JSONToKVmap([]byte(`{"_timestamp":"2023-06-04T00:00:00Z","_TIMESTAMP":"later",` +
+		`"HOST":"a.example.com","Host":"b.example.com","proto":"TCP"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hs := new(Haystack)
+	hb := &Haybale{HaystackPtr: hs}
+	hs.Haybale = append(hs.Haybale, hb)
+	if err := hb.InsertBunch(&hs.Dict, flat); err != nil {
+		t.Fatal(err)
+	}
+	hb.SortBale()
+
+	var buf bytes.Buffer
+	if n, err := hs.SearchKeyValTo("proto", "TCP", &buf); n != 1 || err != nil {
+		t.Fatalf("%d matches, %v", n, err)
+	}
+	host_dkey, _ := hs.Dict.KeyExists("host")
+	host := *hs.Dict.dkey[host_dkey] // whichever spelling the Dictionary has
+	want := `{"_timestamp":"2023-06-04T00:00:00Z","` + host + `":"a.example.com","proto":"TCP"}`
+	if got := strings.TrimSpace(buf.String()); got != want {
+		t.Errorf("JSON:\n got %s\nwant %s", got, want)
+	}
+
+	m := hb.bunchMap(&hs.Dict, hb.haystalk[0].first_ofs)
+	if m[host] != "a.example.com" || m[Timestamp_key] != "2023-06-04T00:00:00Z" {
+		t.Errorf("bunchMap: %v", m)
+	}
+}
+
+func TestSearchAnyKeyValue(t *testing.T) {
+	setTestConfig(t)
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+
+	for _, tc := range []struct {
+		val  string
+		want int
+	}{
+		{"443", 4},            // dest_port
+		{"80.229.245.222", 2}, // src_ip
+		{"203.0.113.99", 0},   // nowhere
+	} {
+		res, err := hs.SearchAnyKeyValue(tc.val)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != tc.want {
+			t.Errorf("%s: got %d bunches, want %d", tc.val, len(res), tc.want)
+		}
+	}
+}
+
+func TestSearchKeyPresent(t *testing.T) {
+	setTestConfig(t)
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+
+	for _, tc := range []struct {
+		key  string
+		want int
+	}{
+		{"tls.sni", 2},
+		{"app_proto", 3},
+		{"tcp.tcp_flags", 2},
+		{"dest_port", 5},
+		{"no.such.key", 0},
+	} {
+		res, err := hs.SearchKeyPresent(tc.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != tc.want {
+			t.Errorf("%s: got %d bunches, want %d", tc.key, len(res), tc.want)
+		}
+		for _, bunch := range res {
+			if _, ok := bunch[tc.key]; !ok {
+				t.Errorf("%s: not in %v", tc.key, bunch)
+			}
+		}
+	}
+
+	// Host and host are the same key, that bunch should still come back once
+	hs = new(Haystack)
+	hb := &Haybale{HaystackPtr: hs}
+	hs.Haybale = append(hs.Haybale, hb)
+	for _, line := range []string{
+		`{"timestamp":"2023-06-04T00:00:59Z","Host":"b.example.com","host":"a.example.com"}`,
+		`{"timestamp":"2023-06-04T00:01:00Z","host":"c.example.com"}`,
+		`{"timestamp":"2023-06-04T00:01:01Z","other":"x"}`,
+	} {
+		flat, err := JSONToKVmap([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := hb.InsertBunch(&hs.Dict, flat); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hs.SortAllBales()
+
+	if res, _ := hs.SearchKeyPresent("HOST"); len(res) != 2 {
+		t.Errorf("HOST: got %d bunches, want 2: %v", len(res), res)
+	}
+}
+
+func TestSearchKeyValIn(t *testing.T) {
+	setTestConfig(t)
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+
+	for _, tc := range []struct {
+		key    string
+		values []string
+		want   int
+	}{
+		{"dest_port", []string{"80", "443", "8080"}, 4},
+		{"dest_port", []string{"443", "514"}, 5},
+		{"dest_port", []string{"443", "443"}, 4}, // same value twice, bunches once
+		{"event_type", []string{"tls", "dns"}, 2},
+		{"no.such.key", []string{"1"}, 0},
+	} {
+		res, err := hs.SearchKeyValIn(tc.key, tc.values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != tc.want {
+			t.Errorf("%s IN %v: got %d bunches, want %d", tc.key, tc.values, len(res), tc.want)
+		}
+	}
+
+	if _, err := hs.SearchKeyValIn("dest_port", nil); err == nil {
+		t.Errorf("no error for empty IN list")
+	}
+}
+
+// The rarest condition is the one we seek with, and whichever we seek with,
+// the matches are the same
+func TestSearchSeekCondition(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	hs := testEveHaystack(t, 4000, 4000)
+	hb := hs.Haybale[0]
+
+	hv, found := hs.Dict.searchConditions(map[string]string{"event_type": "alert", "dest_port": "80"})
+	if !found {
+		t.Fatal("conditions not found")
+	}
+	if *hs.Dict.dkey[hv[0].dkey] != "dest_port" { // key order, not map order
+		t.Fatalf("conditions out of order: %v", hv)
+	}
+
+	seek, lo, hi := hb.seekCondition(hv)
+	if seek != 1 {
+		lo0, hi0 := hb.stalkRange(hv[0])
+		t.Errorf("seek with %d (%d stalks), dest_port has %d", seek, hi-lo, hi0-lo0)
+	}
+
+	var want []uint32
+	hb.searchBale(hv, func(first uint32) { want = append(want, first) })
+	if len(want) == 0 {
+		t.Fatal("no matches")
+	}
+	for i := range hv {
+		var got []uint32
+		hb.searchBaleSeek(hv, i, func(first uint32) { got = append(got, first) })
+		sort.Slice(got, func(a, b int) bool { return got[a] < got[b] })
+		sort.Slice(want, func(a, b int) bool { return want[a] < want[b] })
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("seek %d: %v, want %v", i, got, want)
+		}
+	}
+}
+
+// Seeking with the common dest_port=80 vs the rare event_type=alert
+func BenchmarkSearchSeekCondition(b *testing.B) {
+	saved := config
+	b.Cleanup(func() { config = saved })
+	config.dict_table_bits = 10
+
+	hs := testEveHaystack(b, 8000, 8000)
+	hb := hs.Haybale[0]
+
+	hv, found := hs.Dict.searchConditions(map[string]string{"event_type": "alert", "dest_port": "80"})
+	if !found {
+		b.Fatal("conditions not found")
+	}
+
+	b.Run("dest_port", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			hb.searchBaleSeek(hv, 0, func(first uint32) {})
+		}
+	})
+	b.Run("selective", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			hb.searchBale(hv, func(first uint32) {})
+		}
+	})
+}
+
+// Per-Haybale lines only with log_level = debug, always a summary
+func TestSearchLogLevel(t *testing.T) {
+	setTestConfig(t)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+	kv := map[string]string{"dest_port": "443"}
+
+	for _, level := range []string{log_level_info, log_level_debug} {
+		config.log_level = level
+		buf.Reset()
+
+		if _, err := hs.SearchKeyValArrayTo(kv, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+
+		out := buf.String()
+		if got, want := strings.Count(out, "Looking in Haybale"), map[string]int{log_level_info: 0, log_level_debug: 3}[level]; got != want {
+			t.Errorf("%s: %d per-Haybale lines, want %d:\n%s", level, got, want, out)
+		}
+		if !strings.Contains(out, "4 matches, 3 Haybales searched, 0 skipped") {
+			t.Errorf("%s: no summary:\n%s", level, out)
+		}
+	}
+}
+
+func TestSearchKeyValArrayGzip(t *testing.T) {
+	setTestConfig(t)
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+	kv := map[string]string{"dest_port": "443"}
+
+	var plain, zipped bytes.Buffer
+	want, err := hs.SearchKeyValArrayTo(kv, &plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matches, err := hs.SearchKeyValArrayGzip(&zipped, kv)
+	if err != nil || matches != want {
+		t.Fatalf("%d matches, want %d: %v", matches, want, err)
+	}
+
+	zr, err := gzip.NewReader(&zipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(zr) // checks the footer too
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain.Bytes()) {
+		t.Errorf("gunzipped:\n%s\nwant:\n%s", got, plain.Bytes())
+	}
+
+	// No matches is still a valid (empty) gzip stream
+	zipped.Reset()
+	if _, err := hs.SearchKeyValArrayGzip(&zipped, map[string]string{"dest_port": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if zr, err := gzip.NewReader(&zipped); err != nil {
+		t.Error(err)
+	} else if b, err := io.ReadAll(zr); err != nil || len(b) != 0 {
+		t.Errorf("no matches: %q %v", b, err)
+	}
+}
+
+// EOF
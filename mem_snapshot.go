@@ -0,0 +1,53 @@
+// OpenActa/Haystack - read-only snapshots
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+// A read-only view of the Haystack, for searching while ingest carries on.
+//
+// Only the sorted (immutable) Haybales are in it, so records in the Haybale
+// that's still being written to are NOT, nor is anything ingested after.
+// Those Haybales are shared, not copied. The Dictionary is copied, as ingest
+// keeps adding keys to it.
+// Don't insert into, sort, or load into a snapshot.
+func (p *Haystack) Snapshot() *Haystack {
+	p.RLock()
+	defer p.RUnlock()
+
+	s := &Haystack{
+		aes_key_uuid:       p.aes_key_uuid,
+		file_version_minor: p.file_version_minor,
+		file_uuid:          p.file_uuid,
+		time_first:         p.time_first,
+		time_last:          p.time_last,
+	}
+
+	s.Dict.copyFrom(&p.Dict)
+	s.Dict.HaystackPtr = s
+
+	for _, hb := range p.Haybale {
+		if !hb.is_sorted_immutable {
+			continue
+		}
+		s.Haybale = append(s.Haybale, hb)
+		s.memsize += hb.Memsize
+	}
+
+	return s
+}
+
+// EOF
@@ -0,0 +1,77 @@
+// OpenActa/Haystack - read-only snapshots - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// The open Haybale isn't in the snapshot, and writing to it doesn't race
+// with searching the snapshot (go test -race)
+func TestSnapshot(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2) // sorted
+	kv := map[string]string{"dest_port": "443"}
+
+	hs.Lock()
+	open_hb := &Haybale{HaystackPtr: hs}
+	hs.Haybale = append(hs.Haybale, open_hb)
+	open_hb.InsertBunch(&hs.Dict, map[string]interface{}{Timestamp_key: "2023-06-04T00:02:00Z", "dest_port": "443"})
+	hs.Unlock()
+
+	if n := hs.CountKeyValArray(kv); n != 5 {
+		t.Fatalf("Haystack has dest_port=443 %d times, want 5", n)
+	}
+
+	snap := hs.Snapshot()
+	if len(snap.Haybale) != 3 {
+		t.Errorf("snapshot has %d Haybales, want 3", len(snap.Haybale))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			hs.Lock()
+			open_hb.InsertBunch(&hs.Dict, map[string]interface{}{
+				Timestamp_key: "2023-06-04T00:03:00Z", "dest_port": "443", fmt.Sprintf("new%d", i): "x"})
+			hs.Unlock()
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		if n := snap.CountKeyValArray(kv); n != 4 {
+			t.Fatalf("snapshot has dest_port=443 %d times, want 4", n)
+		}
+		if res, err := snap.SearchAnyKeyValue("x"); err != nil || len(res) != 0 {
+			t.Fatalf("snapshot found %d new bunches, err %v", len(res), err)
+		}
+	}
+	wg.Wait()
+
+	if _, found := snap.Dict.KeyExists("new0"); found {
+		t.Errorf("snapshot Dictionary has a key added after")
+	}
+}
+
+// EOF
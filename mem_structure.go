@@ -17,15 +17,20 @@
 
 package haystack
 
+import (
+	"sync"
+	"sync/atomic"
+)
+
 // Ref doc/haystack.txt
 
 const (
-	max_keylen       = 255               // Max text len of a key
-	Max_memsize      = 512 * 1024 * 1024 // 512MB (half a gig) in RAM
-	hashtable_size   = 16 * 1024 * 1024  // Exact size of key hashtable (16M)
-	Timestamp_key    = "_timestamp"      // Timestamp key string
-	haystalk_ofs_nil = 0xffffffff        // used for nil, last
-	cap_initial      = 100000            // Size of initial haystalk slice allocation
+	max_keylen         = 255               // Max text len of a key
+	Max_memsize        = 512 * 1024 * 1024 // 512MB (half a gig) in RAM
+	hashtable_bits_max = 24                // Max size of key hashtable (16M), dkeys are 3 bytes on disk
+	Timestamp_key      = "_timestamp"      // Timestamp key string
+	haystalk_ofs_nil   = 0xffffffff        // used for nil, last
+	cap_initial        = 100000            // Size of initial haystalk slice allocation
 
 	// outer bounds of config variables
 	haystack_wait_maxsize_lower = 64 * 1024 * 1024   // 64M
@@ -36,23 +41,74 @@ const (
 	haybale_wait_maxtime_upper  = 6 * 3600 // 6 hrs
 	compression_level_lower     = 0        // lowest (fast) compression
 	compression_level_upper     = 9        // highest (slower) compression
+	mapped_cache_bales_lower    = 1
+	mapped_cache_bales_upper    = 4096
+	dict_table_bits_lower       = 8 // 256 keys
+	dict_table_bits_upper       = hashtable_bits_max
+	dict_fill_lower             = 1 // percent of the Dictionary table slots
+	dict_fill_upper             = 100
+	dict_fill_warn_default      = 75
+	dict_fill_max_default       = 100 // until it's full
+	diskwriter_queue_len_lower  = 1
+	diskwriter_queue_len_upper  = 64
+	max_flatten_depth_lower     = 1
+	max_flatten_depth_upper     = 1000
+	max_fields_per_record_lower = 1
+	max_fields_per_record_upper = 1000000
+	max_ingest_rate_lower       = 0 // 0 = no limit
+	max_ingest_rate_upper       = 10000000
+	search_cache_files_lower    = 1
+	search_cache_files_upper    = 256
+	search_cache_maxsize_lower  = 1024 * 1024            // 1M
+	search_cache_maxsize_upper  = 3 * 1024 * 1024 * 1024 // 3G
 )
 
 type Haystack struct {
+	/*
+		Searches take the read lock, anything changing Dict or the Haybale
+		slice (loaders, sorting) takes the write lock. Immutable Haybales
+		can then be searched by multiple go routines at the same time.
+		Callers that append to Haybale themselves should Lock() as well.
+	*/
+	sync.RWMutex
+
 	Dict Dictionary
 
 	Haybale []*Haybale // Array of pointers to Haybale record (time slices)
 
-	aes_key_uuid string // UUID of AES key used to encrypt this Haystack on disk
+	aes_key_uuid string // UUID of AES key used to encrypt this Haystack on disk ("" = not encrypted)
+
+	file_version_minor uint8  // minor format version of the file we read from disk
+	file_uuid          string // unique id of the file we last wrote or read ("" if unknown)
+	file_sha512        []byte // SHA-512 of the file we read, only kept if it has no uuid (catalogue name)
+
+	// bounding timestamps of the file we last wrote or read (from the trailer)
+	time_first int64
+	time_last  int64
+
+	compression_dict []byte // of the file we last wrote or read, see disk_compression_dict.go
+	compact_bunches  bool   // the file we're writing has compact Haybales, see disk_compact_bunches.go
+
+	keep_unknown bool             // Disk2MemPassThrough() is loading
+	unknown      []unknownSection // sections it kept, Mem2Disk() writes them back
 
 	// needed to keep track of our in-mem and on-disk size
 	memsize uint32
 }
 
 type Dictionary struct {
-	num_dkeys uint32                  // How many keys do we use (used in mem2disk)
-	dkey      [hashtable_size]*string // 24-bit hash table (16MB)
-	dirty     [hashtable_size]bool    // Save to disk with next Haybale (record)
+	num_dkeys uint32    // How many keys do we use
+	bits      uint8     // Hash table has 2^bits slots, see initTable()
+	dkey      []*string // Hash table (nil until first key is added)
+	dirty     []bool    // Save to disk with next Haybale (record)
+	used      []uint32  // dkeys in use, so AllKeys() doesn't have to look at every slot
+	warned    bool      // logged that we're over dict_fill_warn
+
+	case_sensitive bool // Host and host are different keys, see keyFold()
+
+	// Hash table statistics, see Stats()
+	collisions atomic.Uint64 // look-ups that didn't find their key (or empty slot) straight off
+	probes     atomic.Uint64 // slots skipped over in those look-ups
 
 	HaystackPtr *Haystack // ptr ref back to Haystack (for AES key)
 }
@@ -71,6 +127,8 @@ type Haybale struct {
 	time_first int64
 	time_last  int64
 
+	index baleIndex // min/max of the index_keys, see buildIndex()
+
 	// needed to keep track of our in-mem and on-disk size
 	Memsize uint32
 
@@ -87,9 +145,9 @@ type Haystalk struct {
 }
 
 type Val struct {
-	valtype uint8 // Value type (int, float, string)
+	valtype uint8 // Value type (int, float, string, time)
 
-	intval    int64
+	intval    int64 // also time (Unix nanosecs)
 	floatval  float64
 	stringval *string
 }
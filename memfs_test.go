@@ -0,0 +1,690 @@
+// OpenActa/Haystack - in-memory filesystem - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Files in a map, no directories (any name goes).
+// fail lets a test make an operation go wrong: return an error for op
+// ("open", "write", "truncate", "seek", "sync", "close", "rename", "remove") on name.
+type memFS struct {
+	mutex sync.Mutex
+	files map[string]*memFileData
+	fail  func(op string, name string) error
+}
+
+type memFileData struct {
+	data   []byte
+	mode   os.FileMode
+	synced bool // Sync() since the last Write()
+}
+
+// Use a memFS for the rest of this test
+func useMemFS(t *testing.T) *memFS {
+	m := &memFS{files: make(map[string]*memFileData)}
+
+	saved := fsys
+	fsys = m
+	t.Cleanup(func() { fsys = saved })
+
+	return m
+}
+
+func (m *memFS) check(op string, name string) error {
+	if m.fail == nil {
+		return nil
+	}
+	if err := m.fail(op, name); err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.check("open", name); err != nil {
+		return nil, err
+	}
+
+	d, exists := m.files[name]
+	switch {
+	case exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !exists:
+		d = &memFileData{mode: perm}
+		m.files[name] = d
+	case flag&os.O_TRUNC != 0:
+		d.data = nil
+	}
+
+	return &memFile{fs: m, name: name}, nil
+}
+
+// A snapshot of the file as it is now, for reading
+func (m *memFS) Open(name string) (readFile, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.check("open", name); err != nil {
+		return nil, err
+	}
+
+	d, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	snap := &memFileData{data: append([]byte(nil), d.data...), mode: d.mode}
+	return &memReadFile{Reader: bytes.NewReader(snap.data), info: memFileInfo{filepath.Base(name), snap}}, nil
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	d, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return append([]byte(nil), d.data...), nil
+}
+
+func (m *memFS) ReadDir(name string) ([]os.DirEntry, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	list := make([]os.DirEntry, 0)
+	for fname, d := range m.files {
+		if filepath.Dir(fname) == filepath.Clean(name) {
+			list = append(list, fs.FileInfoToDirEntry(memFileInfo{filepath.Base(fname), d}))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+
+	return list, nil
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	d, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return memFileInfo{filepath.Base(name), d}, nil
+}
+
+func (m *memFS) Rename(oldpath string, newpath string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.check("rename", oldpath); err != nil {
+		return err
+	}
+
+	d, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	delete(m.files, oldpath)
+	m.files[newpath] = d
+
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.check("remove", name); err != nil {
+		return err
+	}
+
+	if _, ok := m.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.files, name)
+
+	return nil
+}
+
+// Names of all files, sorted
+func (m *memFS) names() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	names := make([]string, 0, len(m.files))
+	for name := range m.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+type memFile struct {
+	fs     *memFS
+	name   string
+	closed bool
+}
+
+func (f *memFile) op(op string, fn func(d *memFileData)) error {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if f.closed {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	}
+	if err := f.fs.check(op, f.name); err != nil {
+		return err
+	}
+
+	// Renamed or removed while open: writes go nowhere
+	if d, ok := f.fs.files[f.name]; ok {
+		fn(d)
+	}
+
+	return nil
+}
+
+// A failed write still leaves the first half of p, like a disk filling up
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if f.closed {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrClosed}
+	}
+	err := f.fs.check("write", f.name)
+	n := len(p)
+	if err != nil {
+		n /= 2
+	}
+
+	if d, ok := f.fs.files[f.name]; ok {
+		d.data = append(d.data, p[:n]...)
+		d.synced = false
+	}
+
+	return n, err
+}
+
+func (f *memFile) Truncate(size int64) error {
+	return f.op("truncate", func(d *memFileData) {
+		if size < int64(len(d.data)) {
+			d.data = d.data[:size]
+		}
+		d.synced = false
+	})
+}
+
+// Writes always go at the end, so that's the only place to seek to
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	var end int64
+	err := f.op("seek", func(d *memFileData) { end = int64(len(d.data)) })
+	if err == nil && (whence != io.SeekStart || offset != end) {
+		err = &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	return end, err
+}
+
+func (f *memFile) Chmod(mode os.FileMode) error {
+	return f.op("chmod", func(d *memFileData) { d.mode = mode })
+}
+
+func (f *memFile) Sync() error {
+	return f.op("sync", func(d *memFileData) { d.synced = true })
+}
+
+func (f *memFile) Close() error {
+	err := f.op("close", func(d *memFileData) {})
+	f.closed = true
+	return err
+}
+
+type memReadFile struct {
+	*bytes.Reader
+	info memFileInfo
+}
+
+func (f *memReadFile) Stat() (os.FileInfo, error) { return f.info, nil }
+func (f *memReadFile) Close() error               { return nil }
+
+type memFileInfo struct {
+	name string
+	d    *memFileData
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return int64(len(i.d.data)) }
+func (i memFileInfo) Mode() os.FileMode  { return i.d.mode }
+func (i memFileInfo) ModTime() time.Time { return time.Time{} }
+func (i memFileInfo) IsDir() bool        { return false }
+func (i memFileInfo) Sys() any           { return nil }
+
+// Disk writer, all in memory: file and catalogue in place, synced, nothing left behind
+func TestDiskWriterMemFS(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	config.datastore_dir = "/data"
+	config.catalogue_dir = "/catalogue"
+	config.file_mode = 0640
+	m := useMemFS(t)
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+	if err := writeHaystackFiles(hs); err != nil {
+		t.Fatal(err)
+	}
+
+	hpath := filepath.Join(config.datastore_dir, hs.file_uuid+Haystack_file_ext)
+	cpath := filepath.Join(config.catalogue_dir, hs.CatalogueName())
+	if names := m.names(); len(names) != 2 || names[0] != cpath || names[1] != hpath {
+		t.Fatalf("files %v, want %s and %s", names, cpath, hpath)
+	}
+	for _, name := range m.names() {
+		if d := m.files[name]; !d.synced || d.mode != 0640 {
+			t.Errorf("%s: synced %v, mode %04o", name, d.synced, d.mode)
+		}
+	}
+
+	data, _ := fsys.ReadFile(hpath)
+	if err := VerifySectionCRCs(data); err != nil {
+		t.Error(err)
+	}
+
+	list, err := ListDatastore()
+	if err != nil || len(list) != 1 || list[0].FileUUID != hs.file_uuid {
+		t.Errorf("ListDatastore: %v %+v", err, list)
+	}
+
+	if err := DeleteHaystackFile(hpath); err != nil {
+		t.Fatal(err)
+	}
+	if names := m.names(); len(names) != 0 {
+		t.Errorf("after delete: %v", names)
+	}
+}
+
+// Things going wrong along the way: no half-written or .tmp files left
+func TestDiskWriterMemFSFailures(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	config.datastore_dir = "/data"
+	config.catalogue_dir = "/catalogue"
+
+	broken := errors.New("broken")
+	for _, tt := range []struct {
+		op  string
+		dir string
+	}{
+		{"open", "/data"},
+		{"write", "/data"},
+		{"sync", "/data"},
+		{"close", "/data"},
+		{"rename", "/data"},
+		{"rename", "/catalogue"},
+	} {
+		m := useMemFS(t)
+		m.fail = func(op string, name string) error {
+			if op == tt.op && strings.HasPrefix(name, tt.dir+"/") {
+				return broken
+			}
+			return nil
+		}
+
+		hs := newTestHaystack(t, "testdata/head5.json", 2)
+		if err := writeHaystackFiles(hs); !errors.Is(err, broken) {
+			t.Errorf("%s in %s: %v", tt.op, tt.dir, err)
+		}
+
+		for _, name := range m.names() {
+			if strings.HasSuffix(name, ".tmp") || (tt.dir == "/data" && strings.HasPrefix(name, "/catalogue/")) {
+				t.Errorf("%s in %s: left %s", tt.op, tt.dir, name)
+			}
+		}
+	}
+}
+
+// file_rollover: the working file is .tmp until the period is done,
+// then renamed, after a sync. A failed sync or rename keeps it, for another try.
+func TestDiskWriterRolloverMemFS(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	config.datastore_dir = "/data"
+	config.catalogue_dir = "/catalogue"
+	config.file_rollover = file_rollover_hourly
+	m := useMemFS(t)
+
+	oneBunch := func(ts string) *Haystack {
+		hs := new(Haystack)
+		hb := &Haybale{HaystackPtr: hs}
+		if err := hb.InsertBunch(&hs.Dict, map[string]interface{}{Timestamp_key: ts, "dest_port": "443"}); err != nil {
+			t.Fatal(err)
+		}
+		hs.Haybale = append(hs.Haybale, hb)
+		return hs
+	}
+
+	if err := rolloverWrite(oneBunch("2023-06-04T00:30:00Z")); err != nil {
+		t.Fatal(err)
+	}
+	if names := m.names(); len(names) != 1 || !strings.HasPrefix(names[0], "/data/20230604T00-") || !strings.HasSuffix(names[0], ".tmp") {
+		t.Fatalf("working file: %v", names)
+	}
+
+	// Next hour: the first one is done
+	if err := rolloverWrite(oneBunch("2023-06-04T01:30:00Z")); err != nil {
+		t.Fatal(err)
+	}
+	names := m.names()
+	if len(names) != 3 || !strings.HasPrefix(names[0], "/catalogue/") ||
+		!strings.HasPrefix(names[1], "/data/20230604T00-") || !strings.HasSuffix(names[1], Haystack_file_ext) ||
+		!strings.HasPrefix(names[2], "/data/20230604T01-") || !strings.HasSuffix(names[2], ".tmp") {
+		t.Fatalf("after rollover: %v", names)
+	}
+	if !m.files[names[1]].synced {
+		t.Errorf("%s not synced", names[1])
+	}
+
+	// Can't finish the second one
+	m.fail = func(op string, name string) error {
+		if op == "sync" {
+			return errors.New("broken")
+		}
+		return nil
+	}
+	if err := rolloverClose(); err == nil {
+		t.Errorf("close with broken sync: no error")
+	}
+	if after := m.names(); len(after) != 3 || after[2] != names[2] || diskwriter.rollover == nil {
+		t.Errorf("after failed sync: %v", after)
+	}
+
+	// Sync works again, rename doesn't yet
+	m.fail = func(op string, name string) error {
+		if op == "rename" && strings.HasPrefix(name, "/data/") {
+			return errors.New("broken")
+		}
+		return nil
+	}
+	if err := rolloverClose(); err == nil {
+		t.Errorf("close with broken rename: no error")
+	}
+	if after := m.names(); len(after) != 3 || after[2] != names[2] || !m.files[names[2]].synced {
+		t.Errorf("after failed rename: %v", after)
+	}
+
+	m.fail = nil
+	if err := rolloverClose(); err != nil {
+		t.Fatal(err)
+	}
+	names = m.names()
+	if len(names) != 4 || !strings.HasPrefix(names[3], "/data/20230604T01-") || !strings.HasSuffix(names[3], Haystack_file_ext) {
+		t.Fatalf("after close: %v", names)
+	}
+	data, _ := fsys.ReadFile(names[3])
+	hs := new(Haystack)
+	if err := hs.Disk2Mem(data); err != nil {
+		t.Fatal(err)
+	}
+	if n := hs.Info().NumBunches; n != 1 {
+		t.Errorf("%d bunches", n)
+	}
+}
+
+// Catalogue dir full: the Haystack waits in memory until there's space,
+// nothing half-written is left. Stopping while full gives up on it.
+func TestDiskWriterDiskFull(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	config.datastore_dir = "/data"
+	config.catalogue_dir = "/catalogue"
+	config.diskwriter_queue_len = 2
+	config.diskwriter_queue_policy = diskwriter_policy_block
+	config.disk_full_policy = disk_full_policy_retry
+	m := useMemFS(t)
+
+	saved_min, saved_max := disk_full_backoff_min, disk_full_backoff_max
+	disk_full_backoff_min, disk_full_backoff_max = time.Millisecond, 4*time.Millisecond
+	t.Cleanup(func() { disk_full_backoff_min, disk_full_backoff_max = saved_min, saved_max })
+
+	var full atomic.Bool
+	full.Store(true)
+	m.fail = func(op string, name string) error {
+		if full.Load() && op == "write" && strings.HasPrefix(name, "/catalogue/") {
+			return syscall.ENOSPC
+		}
+		return nil
+	}
+
+	// Wait for the disk writer to get there
+	waitFor := func(what string, cond func(s DiskWriterStats) bool) {
+		t.Helper()
+		for start := time.Now(); !cond(GetDiskWriterStats()); time.Sleep(time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("%s: %+v", what, GetDiskWriterStats())
+			}
+		}
+	}
+
+	before := GetDiskWriterStats()
+	if err := StartDiskWriter(); err != nil {
+		t.Fatal(err)
+	}
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+	if err := FlushHaystack(hs); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("retrying", func(s DiskWriterStats) bool { return s.Retries >= before.Retries+2 && s.DiskFull })
+	for _, name := range m.names() {
+		if strings.HasPrefix(name, "/data/") {
+			t.Errorf("while full: %s without a catalogue", name)
+		}
+	}
+
+	full.Store(false)
+	waitFor("written", func(s DiskWriterStats) bool { return s.Written == before.Written+1 })
+	if s := GetDiskWriterStats(); s.DiskFull || s.Errors != before.Errors {
+		t.Errorf("after space: %+v", s)
+	}
+	if names := m.names(); len(names) != 2 {
+		t.Errorf("after space: %v", names)
+	}
+
+	// Full again, and we stop
+	full.Store(true)
+	retries := GetDiskWriterStats().Retries
+	if err := FlushHaystack(newTestHaystack(t, "testdata/head5.json", 2)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("retrying again", func(s DiskWriterStats) bool { return s.Retries > retries })
+	StopDiskWriter()
+	if s := GetDiskWriterStats(); s.Errors != before.Errors+1 || s.Written != before.Written+1 {
+		t.Errorf("stopped while full: %+v", s)
+	}
+
+	// Policy drop: no retries
+	config.disk_full_policy = disk_full_policy_drop
+	retries = GetDiskWriterStats().Retries
+	diskWriterWrite(newTestHaystack(t, "testdata/head5.json", 2))
+	if s := GetDiskWriterStats(); s.Retries != retries || s.Errors != before.Errors+2 || !s.DiskFull {
+		t.Errorf("policy drop: %+v", s)
+	}
+}
+
+// Disk full and queue full, with ingest waiting for room (policy block):
+// ShutDown() still gets through, the one waiting is told we stopped
+func TestDiskWriterDiskFullShutDown(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	config.datastore_dir = "/data"
+	config.catalogue_dir = "/catalogue"
+	config.diskwriter_queue_len = 1
+	config.diskwriter_queue_policy = diskwriter_policy_block
+	config.disk_full_policy = disk_full_policy_retry
+	m := useMemFS(t)
+	m.fail = func(op string, name string) error {
+		if op == "write" {
+			return syscall.ENOSPC
+		}
+		return nil
+	}
+
+	saved_min, saved_max := disk_full_backoff_min, disk_full_backoff_max
+	disk_full_backoff_min, disk_full_backoff_max = time.Millisecond, 4*time.Millisecond
+	t.Cleanup(func() { disk_full_backoff_min, disk_full_backoff_max = saved_min, saved_max })
+
+	before := GetDiskWriterStats()
+	if err := StartDiskWriter(); err != nil {
+		t.Fatal(err)
+	}
+
+	// One being retried, one in the queue
+	for i := 0; i < 2; i++ {
+		if err := FlushHaystack(newTestHaystack(t, "testdata/head5.json", 2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for start := time.Now(); GetDiskWriterStats().Retries < before.Retries+2; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("not retrying: %+v", GetDiskWriterStats())
+		}
+	}
+
+	// and one waiting for room
+	flushed := make(chan error, 1)
+	go func() { flushed <- FlushHaystack(newTestHaystack(t, "testdata/head5.json", 2)) }()
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case err := <-flushed:
+		t.Fatalf("flush didn't wait for room: %v", err)
+	default:
+	}
+
+	if err := ShutDown(nil, 5*time.Second); err != nil {
+		t.Fatalf("ShutDown: %v", err)
+	}
+
+	select {
+	case err := <-flushed:
+		// It may have got in after all, as the writer gave up on the others
+		if err != nil && !errors.Is(err, ErrDiskWriterNotRunning) {
+			t.Errorf("waiting flush: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("flush still waiting after ShutDown")
+	}
+
+	if s := GetDiskWriterStats(); s.Written != before.Written || s.Errors < before.Errors+2 {
+		t.Errorf("after ShutDown: %+v", s)
+	}
+	for _, name := range m.names() {
+		t.Errorf("after ShutDown: %s", name)
+	}
+}
+
+// file_rollover: out of space halfway through a Haystack, the working file
+// keeps what went in before, and the retry adds the rest, with the right keys
+func TestDiskWriterDiskFullRollover(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	config.datastore_dir = "/data"
+	config.catalogue_dir = "/catalogue"
+	config.file_rollover = file_rollover_hourly
+	m := useMemFS(t)
+
+	var writes atomic.Int32
+	m.fail = func(op string, name string) error {
+		if op == "write" && strings.HasPrefix(name, "/data/") && writes.Add(1) == 4 {
+			return syscall.ENOSPC // header, a Haystack, then the second Haybale of the next
+		}
+		return nil
+	}
+
+	// One in there already
+	before := new(Haystack)
+	hb := &Haybale{HaystackPtr: before}
+	if err := hb.InsertBunch(&before.Dict, map[string]interface{}{Timestamp_key: "2023-06-04T00:00:00Z", "extra": "yes"}); err != nil {
+		t.Fatal(err)
+	}
+	before.Haybale = append(before.Haybale, hb)
+	if err := writeHaystack(before); err != nil {
+		t.Fatal(err)
+	}
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+	want := hs.CountKeyValArray(map[string]string{"dest_port": "443"})
+
+	err := writeHaystack(hs)
+	if !isDiskFull(err) {
+		t.Fatalf("first try: %v", err)
+	}
+	if names := m.names(); len(names) != 1 || !strings.HasSuffix(names[0], ".tmp") {
+		t.Fatalf("after first try: %v", names)
+	}
+	if len(hs.Haybale) != 2 {
+		t.Errorf("after first try: %d Haybales to go", len(hs.Haybale))
+	}
+
+	if err := writeHaystack(hs); err != nil {
+		t.Fatal(err)
+	}
+	if err := rolloverClose(); err != nil {
+		t.Fatal(err)
+	}
+
+	names := m.names()
+	if len(names) != 2 {
+		t.Fatalf("files %v", names)
+	}
+	data, _ := fsys.ReadFile(names[1])
+	hs2 := new(Haystack)
+	if err := hs2.Disk2Mem(data); err != nil {
+		t.Fatal(err)
+	}
+	if n := hs2.CountKeyValArray(map[string]string{"dest_port": "443"}); n != want {
+		t.Errorf("%d matches, want %d", n, want)
+	}
+	if n := hs2.CountKeyValArray(map[string]string{"extra": "yes"}); n != 1 {
+		t.Errorf("the one from before: %d matches", n)
+	}
+	if n := hs2.Info().NumBunches; n != 6 {
+		t.Errorf("%d bunches", n)
+	}
+}
+
+// EOF
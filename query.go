@@ -0,0 +1,567 @@
+// OpenActa/Haystack - query strings
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	Human readable queries, for the CLI and such:
+
+		event_type=alert AND dest_port>=443
+		(src_ip="10.0.0.1" OR dest_ip="10.0.0.1") AND proto!=UDP
+		dest_port IN (80, 443, 8080)
+
+	query      := and_expr { OR and_expr }
+	and_expr   := term { AND term }
+	term       := '(' query ')' | key op value | key IN '(' value { ',' value } ')'
+	op         := = == != < <= > >=
+	key, value := bare word, or "quoted" (with \" and \\)
+
+	AND binds tighter than OR, AND/OR/IN are case insensitive.
+	IN matches if the value equals any of the list, same as a chain of ORs.
+	Values are typed like in the other searches: int, float, string
+	(and time for _timestamp).
+*/
+
+package haystack
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	query_and = "AND"
+	query_or  = "OR"
+	query_in  = "IN"
+)
+
+// A parsed query. Either AND/OR of Sub queries, or a single condition.
+type Query struct {
+	Op  string   // query_and, query_or, or "" for a condition
+	Sub []*Query // for AND and OR
+
+	Key    string
+	Cmp    string   // = != < <= > >= IN
+	Value  string   // for all but IN
+	Values []string // for IN
+}
+
+// Parse error, Column is 1-based (in bytes)
+type QueryError struct {
+	Column int
+	Msg    string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("query column %d: %s", e.Column, e.Msg)
+}
+
+// Parse a query string into a Query, see above for the syntax
+func ParseQuery(s string) (Query, error) {
+	p := queryParser{s: s}
+
+	q, err := p.parseOr()
+	if err != nil {
+		return Query{}, err
+	}
+
+	p.skipSpace()
+	if p.pos < len(p.s) {
+		if p.s[p.pos] == ')' {
+			return Query{}, p.errorf("unexpected ')'")
+		}
+		return Query{}, p.errorf("expected AND or OR, got '%s'", p.peekWord())
+	}
+
+	return *q, nil
+}
+
+// Back to a string, that parses to the same Query
+func (q Query) String() string {
+	if q.Op == "" && q.Cmp == query_in {
+		vals := make([]string, len(q.Values))
+		for i, v := range q.Values {
+			if vals[i] = queryQuote(v); strings.ContainsRune(v, ',') && vals[i] == v {
+				vals[i] = `"` + v + `"`
+			}
+		}
+		return queryQuote(q.Key) + " " + query_in + " (" + strings.Join(vals, ",") + ")"
+	}
+	if q.Op == "" {
+		return queryQuote(q.Key) + q.Cmp + queryQuote(q.Value)
+	}
+
+	parts := make([]string, len(q.Sub))
+	for i, sub := range q.Sub {
+		parts[i] = sub.String()
+		if sub.Op == query_or && q.Op == query_and {
+			parts[i] = "(" + parts[i] + ")"
+		}
+	}
+	return strings.Join(parts, " "+q.Op+" ")
+}
+
+// Quote if it wouldn't come back as one bare word
+func queryQuote(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\"\\=!<>()") ||
+		strings.EqualFold(s, query_and) || strings.EqualFold(s, query_or) || strings.EqualFold(s, query_in) {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+	}
+	return s
+}
+
+type queryParser struct {
+	s   string
+	pos int
+}
+
+func (p *queryParser) errorf(format string, args ...interface{}) error {
+	return &QueryError{Column: p.pos + 1, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *queryParser) skipSpace() {
+	for p.pos < len(p.s) && unicode.IsSpace(rune(p.s[p.pos])) {
+		p.pos++
+	}
+}
+
+// The next bare word, without consuming it (for error messages)
+func (p *queryParser) peekWord() string {
+	end := p.pos
+	for end < len(p.s) && !unicode.IsSpace(rune(p.s[end])) {
+		end++
+	}
+	return p.s[p.pos:end]
+}
+
+// Consume keyword (AND, OR) if it's next, as a whole word
+func (p *queryParser) keyword(kw string) bool {
+	p.skipSpace()
+
+	end := p.pos + len(kw)
+	if end > len(p.s) || !strings.EqualFold(p.s[p.pos:end], kw) {
+		return false
+	}
+	if end < len(p.s) && !unicode.IsSpace(rune(p.s[end])) && p.s[end] != '(' && p.s[end] != '"' {
+		return false // just a word starting with AND/OR
+	}
+
+	p.pos = end
+	return true
+}
+
+func (p *queryParser) parseOr() (*Query, error) {
+	return p.parseList(query_or, p.parseAnd)
+}
+
+func (p *queryParser) parseAnd() (*Query, error) {
+	return p.parseList(query_and, p.parseTerm)
+}
+
+// next { op next }, a single one isn't wrapped
+func (p *queryParser) parseList(op string, next func() (*Query, error)) (*Query, error) {
+	first, err := next()
+	if err != nil {
+		return nil, err
+	}
+
+	list := &Query{Op: op, Sub: []*Query{first}}
+	for p.keyword(op) {
+		q, err := next()
+		if err != nil {
+			return nil, err
+		}
+		list.Sub = append(list.Sub, q)
+	}
+
+	if len(list.Sub) == 1 {
+		return first, nil
+	}
+	return list, nil
+}
+
+func (p *queryParser) parseTerm() (*Query, error) {
+	p.skipSpace()
+
+	if p.pos >= len(p.s) {
+		return nil, p.errorf("unexpected end of query, expected a condition")
+	}
+
+	if p.s[p.pos] == '(' {
+		open := p.pos
+		p.pos++
+
+		q, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		p.skipSpace()
+		if p.pos >= len(p.s) || p.s[p.pos] != ')' {
+			return nil, &QueryError{Column: open + 1, Msg: "'(' without matching ')'"}
+		}
+		p.pos++
+		return q, nil
+	}
+
+	var q Query
+	var err error
+
+	if q.Key, err = p.parseWord("key"); err != nil {
+		return nil, err
+	}
+	if q.Key == "" {
+		return nil, p.errorf("empty key")
+	}
+
+	if p.keyword(query_in) {
+		q.Cmp = query_in
+		if q.Values, err = p.parseInList(); err != nil {
+			return nil, err
+		}
+		return &q, nil
+	}
+
+	p.skipSpace()
+	for _, op := range []string{"==", "!=", "<=", ">=", "=", "<", ">"} { // longest first
+		if strings.HasPrefix(p.s[p.pos:], op) {
+			q.Cmp = op
+			break
+		}
+	}
+	if q.Cmp == "" {
+		return nil, p.errorf("expected comparison operator (= != < <= > >=) after key '%s'", q.Key)
+	}
+	p.pos += len(q.Cmp)
+	if q.Cmp == "==" {
+		q.Cmp = "="
+	}
+
+	if q.Value, err = p.parseWord("value"); err != nil {
+		return nil, err
+	}
+
+	return &q, nil
+}
+
+// '(' value { ',' value } ')', after IN
+func (p *queryParser) parseInList() ([]string, error) {
+	p.skipSpace()
+	if p.pos >= len(p.s) || p.s[p.pos] != '(' {
+		return nil, p.errorf("expected '(' after IN")
+	}
+	open := p.pos
+	p.pos++
+
+	values := make([]string, 0)
+	for {
+		v, err := p.parseWordStop("value", query_stop+",")
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+
+		p.skipSpace()
+		if p.pos >= len(p.s) {
+			return nil, &QueryError{Column: open + 1, Msg: "'(' without matching ')'"}
+		}
+		switch p.s[p.pos] {
+		case ',':
+			p.pos++
+		case ')':
+			p.pos++
+			return values, nil
+		default:
+			return nil, p.errorf("expected ',' or ')' in IN list, got '%c'", p.s[p.pos])
+		}
+	}
+}
+
+// What ends a bare word, apart from space
+const query_stop = "=!<>()\""
+
+// A bare word (up to space, operator or bracket), or a quoted string
+func (p *queryParser) parseWord(what string) (string, error) {
+	return p.parseWordStop(what, query_stop)
+}
+
+func (p *queryParser) parseWordStop(what string, stop string) (string, error) {
+	p.skipSpace()
+
+	if p.pos >= len(p.s) {
+		return "", p.errorf("unexpected end of query, expected %s", what)
+	}
+
+	if p.s[p.pos] != '"' {
+		start := p.pos
+		for p.pos < len(p.s) && !unicode.IsSpace(rune(p.s[p.pos])) && !strings.ContainsRune(stop, rune(p.s[p.pos])) {
+			p.pos++
+		}
+		if p.pos == start {
+			return "", p.errorf("expected %s, got '%c'", what, p.s[p.pos])
+		}
+		return p.s[start:p.pos], nil
+	}
+
+	open := p.pos
+	p.pos++
+
+	var sb strings.Builder
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		switch {
+		case c == '"':
+			p.pos++
+			return sb.String(), nil
+		case c == '\\' && p.pos+1 < len(p.s):
+			sb.WriteByte(p.s[p.pos+1])
+			p.pos += 2
+		default:
+			sb.WriteByte(c)
+			p.pos++
+		}
+	}
+
+	return "", &QueryError{Column: open + 1, Msg: "unterminated quoted " + what}
+}
+
+// Find bunches matching the query.
+// A condition matches when the bunch has the key, with a value that compares
+// as asked (see Haystalk.CompareValueOnly(), so across types). A bunch
+// without the key doesn't match, not even for !=.
+// Equality conditions at the top (AND) level use the binary search to find
+// candidates, otherwise it's a scan of all bunches. With an IN at the top
+// level, that's a binary search per value: roughly len(Values) * log(stalks)
+// per Haybale. Top level conditions on index_keys skip Haybales that can't
+// have a match, see baleIndex.
+func (p *Haystack) SearchQuery(q Query) ([]map[string]string, error) {
+	res := make([]map[string]string, 0)
+
+	p.RLock()
+	defer p.RUnlock()
+
+	match, err := p.compileQuery(&q)
+	if err != nil {
+		return nil, err
+	}
+
+	var hv []Haystalk
+	if eq := q.topEquals(); len(eq) > 0 {
+		var found bool
+		if hv, found = p.Dict.searchConditions(eq); !found {
+			return res, nil
+		}
+	}
+
+	// One set of conditions per IN value, each with the equals
+	var hvs [][]Haystalk
+	if in := q.topIn(); in != nil {
+		dkey, found := p.Dict.KeyExists(in.Key)
+		if !found {
+			return res, nil
+		}
+		for _, v := range in.Values {
+			hvs = append(hvs, append([]Haystalk{{dkey: dkey, val: searchVal(&p.Dict, in.Key, v)}}, hv...))
+		}
+	}
+
+	conds := p.topIndexConds(&q)
+
+	for _, hb := range p.Haybale {
+		if !hb.index.mayMatchAll(conds) {
+			continue
+		}
+
+		check := func(first uint32) {
+			if match(hb, first) {
+				res = append(res, hb.bunchMap(&p.Dict, first))
+			}
+		}
+
+		switch {
+		case hvs != nil:
+			hb.searchBaleAny(hvs, check)
+		case hv != nil:
+			hb.searchBale(hv, check)
+		default:
+			hb.forEachBunch(check)
+		}
+	}
+
+	return res, nil
+}
+
+// Checks one bunch (starting at first) against a compiled query
+type queryMatch func(hb *Haybale, first uint32) bool
+
+// The key=value conditions that must all be true for the query to be
+func (q *Query) topEquals() map[string]string {
+	eq := make(map[string]string)
+
+	conds := []*Query{q}
+	if q.Op == query_and {
+		conds = q.Sub
+	}
+	for _, c := range conds {
+		if c.Op != "" || c.Cmp != "=" {
+			continue
+		}
+		if _, dup := eq[c.Key]; !dup { // a=1 AND a=2, leave that to the full check
+			eq[c.Key] = c.Value
+		}
+	}
+
+	return eq
+}
+
+// The first IN condition that must be true for the query to be, or nil
+func (q *Query) topIn() *Query {
+	conds := []*Query{q}
+	if q.Op == query_and {
+		conds = q.Sub
+	}
+	for _, c := range conds {
+		if c.Op == "" && c.Cmp == query_in && len(c.Values) > 0 {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// The conditions that must all be true for the query to be, for the index
+func (p *Haystack) topIndexConds(q *Query) []indexCond {
+	var conds []indexCond
+
+	top := []*Query{q}
+	if q.Op == query_and {
+		top = q.Sub
+	}
+	for _, c := range top {
+		if c.Op != "" {
+			continue
+		}
+		dkey, found := p.Dict.KeyExists(c.Key)
+		if !found {
+			continue
+		}
+
+		if c.Cmp == query_in {
+			cond := indexCond{dkey: dkey, op: "="}
+			for _, v := range c.Values {
+				cond.vals = append(cond.vals, Haystalk{val: searchVal(&p.Dict, c.Key, v)})
+			}
+			conds = append(conds, cond)
+		} else {
+			conds = append(conds, indexCond{dkey: dkey, op: c.Cmp, vals: []Haystalk{{val: searchVal(&p.Dict, c.Key, c.Value)}}})
+		}
+	}
+
+	return conds
+}
+
+// Turn the query into a function that checks one bunch. Caller holds the lock.
+func (p *Haystack) compileQuery(q *Query) (queryMatch, error) {
+	switch q.Op {
+	case query_and, query_or:
+		subs := make([]queryMatch, len(q.Sub))
+		for i := range q.Sub {
+			m, err := p.compileQuery(q.Sub[i])
+			if err != nil {
+				return nil, err
+			}
+			subs[i] = m
+		}
+
+		want := q.Op == query_or // OR is done at the first true, AND at the first false
+		return func(hb *Haybale, first uint32) bool {
+			for _, m := range subs {
+				if m(hb, first) == want {
+					return want
+				}
+			}
+			return !want
+		}, nil
+
+	case "":
+		if q.Key == "" {
+			return nil, fmt.Errorf("empty query condition")
+		}
+
+		if q.Cmp == query_in {
+			return p.compileQueryIn(q)
+		}
+
+		cmp_op, err := fieldCompareOp(q.Cmp)
+		if err != nil {
+			return nil, err
+		}
+
+		dkey, found := p.Dict.KeyExists(q.Key)
+		if !found {
+			return func(*Haybale, uint32) bool { return false }, nil
+		}
+		b := Haystalk{val: searchVal(&p.Dict, q.Key, q.Value)}
+
+		return func(hb *Haybale, first uint32) bool {
+			for k := first; k != haystalk_ofs_nil; k = hb.haystalk[k].next_ofs {
+				if hb.haystalk[k].dkey != dkey {
+					continue
+				}
+				if cmp, ok := hb.haystalk[k].CompareValueOnly(&b); ok && cmp_op(cmp) {
+					return true
+				}
+			}
+			return false
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown query operator '%s'", q.Op)
+	}
+}
+
+// key IN (values): any of them equal
+func (p *Haystack) compileQueryIn(q *Query) (queryMatch, error) {
+	if len(q.Values) == 0 {
+		return nil, fmt.Errorf("no values for IN on key '%s'", q.Key)
+	}
+
+	dkey, found := p.Dict.KeyExists(q.Key)
+	if !found {
+		return func(*Haybale, uint32) bool { return false }, nil
+	}
+
+	vals := make([]Haystalk, len(q.Values))
+	for i, v := range q.Values {
+		vals[i] = Haystalk{val: searchVal(&p.Dict, q.Key, v)}
+	}
+
+	return func(hb *Haybale, first uint32) bool {
+		for k := first; k != haystalk_ofs_nil; k = hb.haystalk[k].next_ofs {
+			if hb.haystalk[k].dkey != dkey {
+				continue
+			}
+			for i := range vals {
+				if cmp, ok := hb.haystalk[k].CompareValueOnly(&vals[i]); ok && cmp == 0 {
+					return true
+				}
+			}
+		}
+		return false
+	}, nil
+}
+
+// EOF
@@ -0,0 +1,139 @@
+// OpenActa/Haystack - query strings - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	for _, tc := range []struct {
+		in, out string // out: String() of the parsed Query
+	}{
+		{`a=1`, `a=1`},
+		{` a == 1 `, `a=1`},
+		{`event_type=alert AND dest_port>=443`, `event_type=alert AND dest_port>=443`},
+		{`a=1 or b!=2 and c<3`, `a=1 OR b!=2 AND c<3`},
+		{`(a=1 OR b=2) AND c<=3`, `(a=1 OR b=2) AND c<=3`},
+		{`((a>1))`, `a>1`},
+		{`tls.sni="example.com" AND msg="say \"hi\" AND \\bye"`, `tls.sni=example.com AND msg="say \"hi\" AND \\bye"`},
+		{`a="" AND b="and"`, `a="" AND b="and"`},
+		{`android=1 ANDa=2`, ``}, // ANDa isn't AND
+		{`orbit=x`, `orbit=x`},
+		{`dest_port in (80, 443,8080)`, `dest_port IN (80,443,8080)`},
+		{`a IN ("x,y", "") AND b=1`, `a IN ("x,y","") AND b=1`},
+		{`a IN (1) OR inbound=1`, `a IN (1) OR inbound=1`},
+		{`"in" IN (in)`, `"in" IN ("in")`},
+	} {
+		q, err := ParseQuery(tc.in)
+		if tc.out == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", tc.in, q)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.in, err)
+			continue
+		}
+		if q.String() != tc.out {
+			t.Errorf("%s: parsed as %s", tc.in, q.String())
+		}
+
+		// And back again
+		if q2, err := ParseQuery(q.String()); err != nil || q2.String() != q.String() {
+			t.Errorf("%s: round-trip %s (%v)", tc.in, q2.String(), err)
+		}
+	}
+
+	for _, tc := range []struct {
+		in     string
+		column int
+	}{
+		{``, 1},
+		{`a=1 AND`, 8},
+		{`a 1`, 3},
+		{`(a=1`, 1},
+		{`a="x`, 3},
+		{`a=1 b=2`, 5},
+		{`a=1)`, 4},
+		{`=1`, 1},
+		{`a=`, 3},
+		{`a IN 1`, 6},
+		{`a IN ()`, 7},
+		{`a IN (1 2)`, 9},
+		{`a IN (1,`, 9},
+		{`a IN (1`, 6},
+	} {
+		_, err := ParseQuery(tc.in)
+		var qerr *QueryError
+		if !errors.As(err, &qerr) {
+			t.Errorf("%q: expected QueryError, got %v", tc.in, err)
+		} else if qerr.Column != tc.column {
+			t.Errorf("%q: error at column %d, expected %d: %v", tc.in, qerr.Column, tc.column, err)
+		}
+	}
+}
+
+func TestSearchQuery(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+
+	hs := newTestHaystack(t, "testdata/head5.json", 2)
+
+	for _, tc := range []struct {
+		query   string
+		matches int
+	}{
+		{`event_type=flow`, 3},
+		{`event_type = "flow" AND dest_port>=443`, 3},
+		{`dest_port>443`, 1},
+		{`src_ip="80.229.245.222" OR dest_port=514`, 3},
+		{`(event_type=tls OR dest_port=514) AND src_port<40000`, 1},
+		{`event_type!=flow`, 2},
+		{`event_type=flow AND event_type=tls`, 0},
+		{`no.such.key=1`, 0},
+		{`no.such.key!=1`, 0},
+		{`no.such.key=1 OR dest_port=514`, 1},
+		{`_timestamp>="2023-06-04T00:01:01Z"`, 3},
+		{`dest_port IN (443, 514)`, 5},
+		{`dest_port IN (80, 514, 8080)`, 1},
+		{`event_type=flow AND dest_port IN (443, 8080)`, 2},
+		{`dest_port IN (514) OR src_ip="80.229.245.222"`, 3},
+		{`no.such.key IN (1, 2)`, 0},
+	} {
+		q, err := ParseQuery(tc.query)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.query, err)
+		}
+
+		res, err := hs.SearchQuery(q)
+		if err != nil {
+			t.Errorf("%s: %v", tc.query, err)
+		} else if len(res) != tc.matches {
+			t.Errorf("%s: %d matches, expected %d", tc.query, len(res), tc.matches)
+		}
+	}
+
+	if _, err := hs.SearchQuery(Query{}); err == nil {
+		t.Errorf("no error for empty query")
+	}
+}
+
+// EOF
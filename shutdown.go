@@ -0,0 +1,123 @@
+// OpenActa/Haystack - clean shutdown
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+/*
+	Records in the current Haybale only live in RAM until the Haystack goes
+	to the disk writer. So on the way out, ingest has to hand over what it
+	has, and the disk writer has to finish writing it: ShutDown().
+
+	HandleShutdownSignals() does that on SIGTERM/SIGINT, then exits.
+	It's opt-in, programs that deal with signals themselves can just call
+	ShutDown(). A second signal while we're at it gets the default
+	treatment, so an impatient ^C^C still works.
+*/
+
+package haystack
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var ErrShutdownTimeout = errors.New("shutdown timed out")
+
+// So tests can see what we would exit with
+var shutdownExit = os.Exit
+
+// One ShutDown() at a time, a second one waits for the first to finish
+var shutdownMutex sync.Mutex
+
+// Stop ingest on listener (may be nil), wait for ServeIngest() to hand what
+// it has to the disk writer, then stop the disk writer once it's written
+// everything, and stop merging. After timeout (0 = no limit) we give up with ErrShutdownTimeout,
+// whatever is still in RAM then is lost.
+func ShutDown(listener net.Listener, timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		shutdownMutex.Lock()
+		defer shutdownMutex.Unlock()
+		defer close(done)
+
+		if listener != nil {
+			if err := listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Shutdown: closing listener: %v", err)
+			}
+		}
+		ingester.serving.Wait()
+
+		StopDiskWriter()
+		StopAutoMerge()
+	}()
+
+	if timeout == 0 {
+		<-done
+		return nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		return ErrShutdownTimeout
+	}
+}
+
+// Opt-in: on SIGTERM or SIGINT, ShutDown() and exit (1 if that failed).
+// Returns a function to stop watching for the signals, safe to call more than once.
+func HandleShutdownSignals(listener net.Listener, timeout time.Duration) (stop func()) {
+	ch := make(chan os.Signal, 1)
+	quit := make(chan struct{})
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		select {
+		case sig := <-ch:
+			signal.Stop(ch) // next one kills us the usual way
+
+			log.Printf("Got %v, shutting down", sig)
+			start := time.Now()
+			if err := ShutDown(listener, timeout); err != nil {
+				log.Printf("Shutdown: %v after %v", err, time.Since(start))
+				shutdownExit(1)
+				return
+			}
+			log.Printf("Shutdown complete, duration: %v", time.Since(start))
+			shutdownExit(0)
+
+		case <-quit:
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(quit)
+		})
+	}
+}
+
+// EOF
@@ -0,0 +1,153 @@
+// OpenActa/Haystack - clean shutdown - tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package haystack
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// SIGTERM with records still in RAM: they end up on disk, and we exit 0
+func TestHandleShutdownSignals(t *testing.T) {
+	setTestConfig(t)
+	config.dict_table_bits = 10
+	config.datastore_dir = t.TempDir()
+	config.catalogue_dir = t.TempDir()
+	config.diskwriter_queue_len = 2
+	config.haystack_wait_maxsize = haystack_wait_maxsize_upper // nothing goes to disk by itself
+	config.haybale_wait_minsize = 0
+	config.haybale_wait_maxtime = 0
+
+	exited := make(chan int, 1)
+	shutdownExit = func(code int) { exited <- code }
+	t.Cleanup(func() { shutdownExit = os.Exit })
+
+	if err := StartDiskWriter(); err != nil {
+		t.Fatal(err)
+	}
+	defer StopDiskWriter()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- ServeIngest(listener) }()
+
+	stop := HandleShutdownSignals(listener, 10*time.Second)
+	defer stop()
+
+	json, err := os.ReadFile("testdata/head5.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := GetIngestStats()
+	written := GetDiskWriterStats().Written
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(json)
+	conn.Close()
+
+	for i := 0; GetIngestStats().Records < before.Records+5; i++ {
+		if i > 500 {
+			t.Fatalf("timeout, stats %+v", GetIngestStats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if GetDiskWriterStats().Written != written {
+		t.Fatalf("Haystack written before the signal")
+	}
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case code := <-exited:
+		if code != 0 {
+			t.Errorf("exit code %d", code)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("no exit after SIGTERM")
+	}
+	if err := <-served; err != nil {
+		t.Errorf("ServeIngest: %v", err)
+	}
+
+	files, err := ListDatastore()
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected 1 Haystack file: %v %v", files, err)
+	}
+	data, err := os.ReadFile(files[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := new(Haystack)
+	if err := hs.Disk2Mem(data); err != nil {
+		t.Fatal(err)
+	}
+	if info := hs.Info(); info.NumBunches != 5 {
+		t.Errorf("%v", info)
+	}
+}
+
+// Closes when told to, not before
+type stuckListener struct {
+	net.Listener
+	release chan struct{}
+}
+
+func (l *stuckListener) Close() error {
+	<-l.release
+	return nil
+}
+
+func TestShutDownTimeout(t *testing.T) {
+	setTestConfig(t)
+
+	l := &stuckListener{release: make(chan struct{})}
+
+	start := time.Now()
+	if err := ShutDown(l, 50*time.Millisecond); !errors.Is(err, ErrShutdownTimeout) {
+		t.Errorf("ShutDown: %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("ShutDown took %v", d)
+	}
+
+	// Another one waits for the first to finish, then goes straight through
+	close(l.release)
+	if err := ShutDown(nil, 5*time.Second); err != nil {
+		t.Errorf("ShutDown after release: %v", err)
+	}
+}
+
+// Stopping twice is fine, like signal.Stop()
+func TestHandleShutdownSignalsStopTwice(t *testing.T) {
+	stop := HandleShutdownSignals(nil, time.Second)
+	stop()
+	stop()
+}
+
+// EOF